@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/server"
+	"github.com/adamboardman/sponsor-hub/store"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Posts a recorded webhook payload to a local server, signed the way the provider would sign it.
+func main() {
+	provider := ""
+	url := ""
+	secretFileName := ""
+	eventId := ""
+	flag.StringVar(&provider, "provider", string(store.PaymentProviderGitHubSponsors), "payment provider to impersonate")
+	flag.StringVar(&url, "url", "http://localhost:3020/api/payments/webhooks/", "webhook endpoint, the provider name is appended")
+	flag.StringVar(&secretFileName, "secret-file", "", "file holding the webhook secret, defaults to <provider>_webhook_secret.txt")
+	flag.StringVar(&eventId, "event-id", "", "delivery id for providers that send it as a header, defaults to a timestamp")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal("usage: payment-webhook-sender [flags] payload.json")
+	}
+	body, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(secretFileName) == 0 {
+		secretFileName = provider + "_webhook_secret.txt"
+	}
+	secret, err := ioutil.ReadFile(secretFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(eventId) == 0 {
+		eventId = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+
+	req, err := server.NewPaymentWebhookRequest(url+provider, store.PaymentProvider(provider), bytes.TrimSpace(secret), body, eventId)
+	if err != nil {
+		log.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer response.Body.Close()
+	reply, _ := ioutil.ReadAll(response.Body)
+	fmt.Println(response.Status)
+	fmt.Println(string(reply))
+}
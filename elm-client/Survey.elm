@@ -4,10 +4,11 @@ import Bootstrap.Button as Button
 import Bootstrap.Form as Form
 import Bootstrap.Form.Checkbox as Checkbox
 import Bootstrap.Form.Input as Input
+import Bootstrap.Form.Select as Select
 import Bootstrap.Form.Textarea as Textarea
 import FormValidation exposing (viewProblem)
 import Html exposing (Html, a, div, h1, li, p, text, ul)
-import Html.Attributes exposing (class, for, href)
+import Html.Attributes exposing (class, for, href, selected, value)
 import Html.Events exposing (onSubmit)
 import Http exposing (emptyBody)
 import Json.Decode exposing (Decoder, list)
@@ -150,14 +151,12 @@ viewSurveyForm model =
             ]
         , Form.group []
             [ Form.label [ for "commsFrequency" ] [ text "Communications Frequency" ]
-            , p [ class "clarification" ] [ text "Free form text for you to indicate your max and min communications frequency." ]
-            , p [ class "example" ] [ text "from: no more than one email per week and at least one email every two months" ]
-            , p [ class "example" ] [ text "to: just if there is some significant progress to report" ]
-            , Textarea.textarea
-                [ Textarea.id "commsFrequency"
-                , Textarea.onInput EnteredSurveyCommsFrequency
-                , Textarea.value model.surveyForm.comms_frequency
+            , p [ class "clarification" ] [ text "How often you would like to hear from us, anything above this will be merged into a digest." ]
+            , Select.select
+                [ Select.id "commsFrequency"
+                , Select.onChange EnteredSurveyCommsFrequency
                 ]
+                (List.map (selectItem model.surveyForm.comms_frequency) commsFrequencyOptions)
             , Form.invalidFeedback [] [ text "Please enter your communications frequency preferences" ]
             ]
         , Form.group []
@@ -173,14 +172,14 @@ viewSurveyForm model =
             ]
         , Form.group []
             [ Form.label [ for "privacy" ] [ text "Privacy" ]
-            , p [ class "clarification" ] [ text "How private do you consider your donation amount to be." ]
+            , p [ class "clarification" ] [ text "Who should be able to see your survey answers." ]
             , p [ class "example" ] [ text "Answers given so far indicate that we should not make use of the Goals feature as it shows a % progress bar to goal target thus allowing fine grained calculation of totals which could be used to figure out individual supporters sponsorship levels by noting it and additions/removals over time." ]
             , p [ class "example" ] [ text "So you only need to answer this if you object to occasional ranged $/month totals, eg 32-64, 64-128, 128-256." ]
-            , Textarea.textarea
-                [ Textarea.id "privacy"
-                , Textarea.onInput EnteredSurveyPrivacy
-                , Textarea.value model.surveyForm.privacy
+            , Select.select
+                [ Select.id "privacy"
+                , Select.onChange EnteredSurveyPrivacy
                 ]
+                (List.map (selectItem model.surveyForm.privacy) privacyOptions)
             , Form.invalidFeedback [] [ text "Please enter your privacy preferences" ]
             ]
         , ul [ class "error-messages" ]
@@ -192,6 +191,29 @@ viewSurveyForm model =
         ]
 
 
+commsFrequencyOptions : List ( String, String )
+commsFrequencyOptions =
+    [ ( "releases-only", "Only when there is a release" )
+    , ( "monthly", "At most once a month" )
+    , ( "weekly", "At most once a week" )
+    , ( "as-it-happens", "As it happens" )
+    , ( "never", "Never" )
+    ]
+
+
+privacyOptions : List ( String, String )
+privacyOptions =
+    [ ( "admins", "Only the Sponsor-Hub admins" )
+    , ( "developers", "The developers I sponsor" )
+    , ( "public", "Anyone" )
+    ]
+
+
+selectItem : String -> ( String, String ) -> Select.Item Msg
+selectItem current ( option, label ) =
+    Select.item [ value option, selected (option == current) ] [ text label ]
+
+
 surveyUpdateForm : (SurveyForm -> SurveyForm) -> Model -> ( Model, Cmd Msg )
 surveyUpdateForm transform model =
     ( { model | surveyForm = transform model.surveyForm }, Cmd.none )
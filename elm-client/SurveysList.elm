@@ -83,7 +83,7 @@ loadPreReleaseUsers : Model -> Cmd Msg
 loadPreReleaseUsers model =
     Http.request
         { method = "GET"
-        , url = "api/prereleaseusers"
+        , url = "api/channels/default/subscribers"
         , expect = Http.expectJson LoadedPreReleaseUsers preReleaseUsersListDecoder
         , headers = [ authHeader model.session.loginToken ]
         , body = emptyBody
@@ -4,17 +4,30 @@ import (
 	"flag"
 	"github.com/adamboardman/sponsor-hub/server"
 	"github.com/gin-gonic/gin"
+	"time"
 )
 
 func main() {
 	isDebugging := false
+	deletionGraceDays := 30
+	reportingCurrency := ""
+	buildsDirectory := ""
+	liveEventsBackend := ""
 	flag.BoolVar(&isDebugging, "debugging", false, "if true, we start in debug mode")
+	flag.IntVar(&deletionGraceDays, "deletion-grace-days", 30, "days before a requested account deletion is carried out")
+	flag.StringVar(&reportingCurrency, "reporting-currency", "GBP", "ISO 4217 currency that reports convert amounts into")
+	flag.StringVar(&buildsDirectory, "builds-dir", "builds", "directory holding pre-release build files, storage keys are relative to it")
+	flag.StringVar(&liveEventsBackend, "live-events", "postgres", "live event fan-out, postgres uses LISTEN/NOTIFY so several instances can share it, local keeps events in this process")
 	flag.Parse()
 
 	if !isDebugging {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	a := server.WebApp{}
+	a.DeletionGracePeriod = time.Duration(deletionGraceDays) * 24 * time.Hour
+	a.ReportingCurrency = reportingCurrency
+	a.BuildsDirectory = buildsDirectory
+	a.LiveEventsBackend = liveEventsBackend
 	a.Init("aye-social")
 
 	a.Run(":3020")
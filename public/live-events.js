@@ -0,0 +1,50 @@
+// Signed event links expire after a minute, so when the browser's own reconnect
+// is refused the EventSource closes and a fresh link has to be fetched.
+function openLiveEvents(userId, token, onEvent) {
+    const eventTypes = ["sponsor-added", "sponsor-updated", "sponsor-removed", "notification", "announcement-published"];
+    let source = null;
+    let retryDelay = 1000;
+    let stopped = false;
+
+    function connect() {
+        fetch("api/users/" + userId + "/events-link", { headers: { "Authorization": "Bearer " + token } })
+            .then(function(response) {
+                if (!response.ok) {
+                    throw new Error(response.statusText);
+                }
+                return response.json();
+            })
+            .then(function(link) {
+                if (stopped) {
+                    return;
+                }
+                source = new EventSource(link.url);
+                source.onopen = function() { retryDelay = 1000; };
+                source.onerror = function() {
+                    if (source.readyState === EventSource.CLOSED) {
+                        retry();
+                    }
+                };
+                eventTypes.forEach(function(type) {
+                    source.addEventListener(type, function(event) { onEvent(type, JSON.parse(event.data)); });
+                });
+            })
+            .catch(retry);
+    }
+
+    function retry() {
+        if (stopped) {
+            return;
+        }
+        setTimeout(connect, retryDelay);
+        retryDelay = Math.min(retryDelay * 2, 60000);
+    }
+
+    connect();
+    return function() {
+        stopped = true;
+        if (source !== null) {
+            source.close();
+        }
+    };
+}
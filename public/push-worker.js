@@ -0,0 +1,13 @@
+self.addEventListener("push", function(event) {
+    const notification = event.data ? event.data.json() : {};
+    event.waitUntil(self.registration.showNotification(notification.Title || "Sponsor-Hub", {
+        body: notification.Body,
+        tag: notification.Category,
+        data: notification
+    }));
+});
+
+self.addEventListener("notificationclick", function(event) {
+    event.notification.close();
+    event.waitUntil(clients.openWindow("../index.html"));
+});
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"github.com/yuin/goldmark"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AnnouncementJSON struct {
+	Subject   string
+	Markdown  string
+	Audience  string
+	ChannelId uint
+	Platform  string
+}
+
+type AnnouncementScheduleJSON struct {
+	SendAt time.Time
+}
+
+func announcementUnsubscribeResource(announcementId uint, userId uint) string {
+	return fmt.Sprintf("announcements/%d/recipients/%d/unsubscribe", announcementId, userId)
+}
+
+func AnnouncementsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	announcements, err := App.Store.ListAnnouncements()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Announcements not found"})
+		return
+	}
+	c.JSON(http.StatusOK, announcements)
+}
+
+func LoadAnnouncement(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	announcement, ok := loadAnnouncement(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, announcement)
+}
+
+func AddAnnouncement(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	announcement := store.Announcement{AuthorId: uint(claims["id"].(float64))}
+
+	err := readJSONIntoAnnouncement(&announcement, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Announcement failed validation - err: %s", err.Error())})
+		return
+	}
+	announcementId, err := App.Store.InsertAnnouncement(&announcement)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Announcement failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Announcement drafted successfully", "resourceId": announcementId,
+	})
+}
+
+func UpdateAnnouncement(c *gin.Context) {
+	announcement, ok := loadAnnouncement(c)
+	if !ok {
+		return
+	}
+	err := readJSONIntoAnnouncement(announcement, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Announcement failed validation - err: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.UpdateAnnouncement(announcement)
+	if err == store.ErrAnnouncementNotDraft {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Announcement failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Announcement updated successfully", "resourceId": announcement.ID,
+	})
+}
+
+func PreviewAnnouncement(c *gin.Context) {
+	announcement, ok := loadAnnouncement(c)
+	if !ok {
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	user, err := App.Store.LoadPrivilegedUserAsSelf(loggedInUserId, loggedInUserId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "User not found"})
+		return
+	}
+	message, err := composeAnnouncement(announcement, user.ID, user.Email)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Rendering Announcement failed - err: %s", err.Error())})
+		return
+	}
+	if c.Query("format") == "text" {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(message.Text))
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(message.HTML))
+}
+
+func ScheduleAnnouncement(c *gin.Context) {
+	announcement, ok := loadAnnouncement(c)
+	if !ok {
+		return
+	}
+	scheduleJSON := AnnouncementScheduleJSON{}
+	err := c.BindJSON(&scheduleJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Schedule failed validation - err: %s", err.Error())})
+		return
+	}
+	sendAt := scheduleJSON.SendAt
+	if sendAt.IsZero() {
+		sendAt = time.Now()
+	}
+	err = App.Store.ScheduleAnnouncement(announcement.ID, sendAt)
+	if err == store.ErrAnnouncementNotDraft {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Schedule Announcement failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Announcement scheduled for " + sendAt.Format(time.RFC1123), "resourceId": announcement.ID,
+	})
+}
+
+func CancelAnnouncement(c *gin.Context) {
+	announcement, ok := loadAnnouncement(c)
+	if !ok {
+		return
+	}
+	err := App.Store.CancelAnnouncement(announcement.ID)
+	if err == store.ErrAnnouncementNotScheduled {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Cancel Announcement failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Announcement cancelled", "resourceId": announcement.ID,
+	})
+}
+
+func AnnouncementDeliveriesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	announcement, ok := loadAnnouncement(c)
+	if !ok {
+		return
+	}
+	deliveries, err := App.Store.ListAnnouncementDeliveries(announcement.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Announcement deliveries not found"})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func announcementUnsubscribeParams(c *gin.Context) (uint, uint, bool) {
+	announcementId, err := strconv.Atoi(c.Param("announcementID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid AnnouncementID"})
+		return 0, 0, false
+	}
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return 0, 0, false
+	}
+	if !validSignedRequest(c, announcementUnsubscribeResource(uint(announcementId), uint(userId))) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Unsubscribe link is invalid or has expired"})
+		return 0, 0, false
+	}
+	return uint(announcementId), uint(userId), true
+}
+
+func UnsubscribeFromAnnouncementPage(c *gin.Context) {
+	announcementId, _, ok := announcementUnsubscribeParams(c)
+	if !ok {
+		return
+	}
+	announcement, err := App.Store.LoadAnnouncement(announcementId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Announcement not found"})
+		return
+	}
+	what := "Sponsor-Hub announcements"
+	if announcement.Audience == store.AnnouncementAudienceChannel {
+		what = "emails about this release channel"
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte("<!DOCTYPE html>\r\n<html>\r\n<body>\r\n"+
+		"<form method=\"post\">\r\n"+
+		"<p>Stop receiving "+html.EscapeString(what)+"?</p>\r\n"+
+		"<button type=\"submit\">Unsubscribe</button>\r\n"+
+		"</form>\r\n</body>\r\n</html>\r\n"))
+}
+
+func UnsubscribeFromAnnouncement(c *gin.Context) {
+	announcementId, userId, ok := announcementUnsubscribeParams(c)
+	if !ok {
+		return
+	}
+	err := App.Store.UnsubscribeFromAnnouncement(announcementId, userId, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Announcement not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "You have been unsubscribed",
+	})
+}
+
+func loadAnnouncement(c *gin.Context) (*store.Announcement, bool) {
+	announcementId, err := strconv.Atoi(c.Param("announcementID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid AnnouncementID"})
+		return nil, false
+	}
+	announcement, err := App.Store.LoadAnnouncement(uint(announcementId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Announcement not found"})
+		return nil, false
+	}
+	return announcement, true
+}
+
+func readJSONIntoAnnouncement(announcement *store.Announcement, c *gin.Context) error {
+	announcementJSON := AnnouncementJSON{}
+	err := c.BindJSON(&announcementJSON)
+	if err != nil {
+		return err
+	}
+	audience, err := store.ParseAnnouncementAudience(announcementJSON.Audience)
+	if err != nil {
+		return err
+	}
+	if audience == store.AnnouncementAudienceChannel {
+		channel, err := App.Store.LoadReleaseChannel(announcementJSON.ChannelId)
+		if err != nil {
+			return store.ErrUnknownReleaseChannel
+		}
+		if !channel.SupportsPlatform(announcementJSON.Platform) {
+			return store.ErrUnsupportedPlatform
+		}
+	}
+
+	announcement.Subject = announcementJSON.Subject
+	announcement.Markdown = announcementJSON.Markdown
+	announcement.Audience = audience
+	announcement.ChannelId = announcementJSON.ChannelId
+	announcement.Platform = announcementJSON.Platform
+	return announcement.Validate()
+}
+
+func composeAnnouncement(announcement *store.Announcement, userId uint, email string) (*MailMessage, error) {
+	var rendered bytes.Buffer
+	err := goldmark.Convert([]byte(announcement.Markdown), &rendered)
+	if err != nil {
+		return nil, err
+	}
+	unsubscribe := signedUrl(announcementUnsubscribeResource(announcement.ID, userId), time.Now().Add(unsubscribeValidFor))
+	return &MailMessage{
+		To:      email,
+		Subject: announcement.Subject,
+		Text:    announcement.Markdown + "\r\n\r\n--\r\nUnsubscribe: " + unsubscribe + "\r\n",
+		HTML: rendered.String() + "<hr>\r\n" +
+			"<p><a href=\"" + unsubscribe + "\">Unsubscribe</a></p>\r\n",
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribe + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	}, nil
+}
+
+func SendDueAnnouncements(now time.Time) {
+	dueIds, err := App.Store.ListDueAnnouncementIds(now)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, id := range dueIds {
+		announcement, err := App.Store.LoadAnnouncement(id)
+		if err == nil {
+			_, err = App.Store.StartSendingAnnouncement(announcement)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	sendingIds, err := App.Store.ListSendingAnnouncementIds()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, id := range sendingIds {
+		err = sendAnnouncement(id, now)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func deliverAnnouncement(message *store.MessageDelivery, now time.Time) error {
+	delivery, err := App.Store.LoadAnnouncementDelivery(message.AnnouncementDeliveryId)
+	if err != nil {
+		return err
+	}
+	announcement, err := App.Store.LoadAnnouncement(delivery.AnnouncementId)
+	if err == nil {
+		var mail *MailMessage
+		mail, err = composeAnnouncement(announcement, delivery.UserId, delivery.Email)
+		if err == nil {
+			err = sendMail(mail)
+		}
+	}
+	delivery.Error = ""
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	err = saveDeliveryAttempt(message, err, now)
+	delivery.Status = message.Status
+	delivery.SentAt = message.SentAt
+	_, saveErr := App.Store.UpdateAnnouncementDelivery(delivery)
+	if err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func sendAnnouncement(announcementId uint, now time.Time) error {
+	announcement, err := App.Store.LoadAnnouncement(announcementId)
+	if err != nil {
+		return err
+	}
+	deliveries, err := App.Store.ListPendingAnnouncementDeliveries(announcement.ID)
+	if err != nil {
+		return err
+	}
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		claimed, err := App.Store.ClaimAnnouncementDelivery(delivery.ID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		addToInbox(delivery.UserId, announcement.Category(), announcement.Subject, announcement.Markdown)
+		publishLiveEvent(delivery.UserId, LiveEventAnnouncementPublished, gin.H{"ID": announcement.ID, "Subject": announcement.Subject})
+		message := &store.MessageDelivery{
+			UserId:                 delivery.UserId,
+			Kind:                   announcement.Category().Kind(),
+			Category:               announcement.Category(),
+			Subject:                announcement.Subject,
+			Body:                   announcement.Markdown,
+			AnnouncementDeliveryId: delivery.ID,
+		}
+		err = dispatchDelivery(message, now)
+		if err != nil {
+			log.Print(err)
+		}
+		if message.Status == store.DeliveryStatusHeld || message.Status == store.DeliveryStatusSuppressed {
+			delivery.Status = message.Status
+			_, err = App.Store.UpdateAnnouncementDelivery(delivery)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return App.Store.FinishSendingAnnouncement(announcement.ID, now, store.NewOutboxEvent(store.WebhookEventAnnouncementSent, gin.H{
+		"ID": announcement.ID, "Subject": announcement.Subject, "Audience": announcement.Audience, "ChannelId": announcement.ChannelId,
+		"Platform": announcement.Platform, "SentAt": now,
+	}))
+}
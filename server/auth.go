@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"github.com/adamboardman/sponsor-hub/store"
@@ -12,7 +11,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/smtp"
 	"net/url"
 	"time"
 )
@@ -203,7 +201,7 @@ func RegisterUser(c *gin.Context) {
 				existingUser.Confirmed = true
 				existingUser.ConfirmVerifier = ""
 
-				_, err := App.Store.UpdateUser(existingUser)
+				_, err := App.Store.UpdateUser(existingUser, store.NewOutboxEvent(store.WebhookEventUserRegistered, &existingUser.PublicUser))
 				if err == nil {
 					c.JSON(http.StatusOK, gin.H{
 						"status": http.StatusOK, "message": "User registered successfully", "resourceId": existingUser.ID,
@@ -263,20 +261,8 @@ func SendEmail(emailAddress string, verificationKey string, invite string, descr
 	data := url.Values{}
 	data.Set("email", url.QueryEscape(emailAddress))
 	data.Set("verification", url.QueryEscape(verificationKey))
-	confirmUrl := "https://gemian.thinkglobally.org/sponsor-hub/api/auth/confirm_email?" + data.Encode()
+	confirmUrl := publicBaseUrl + "/api/auth/confirm_email?" + data.Encode()
 	log.Print(confirmUrl)
-	c, err := smtp.Dial("localhost:25")
-	if err != nil {
-		log.Print(err)
-		return
-	}
-	defer c.Close()
-	_ = c.Mail("no-reply@thinkglobally.org")
-	_ = c.Rcpt(emailAddress)
-	boundary := base64.StdEncoding.EncodeToString(RandomBytes(16))
-	wc, err := c.Data()
-	LogFatalError(err)
-	defer wc.Close()
 
 	subject := "Sponsor-Hub Confirm Email Address"
 	opening := "Thanks for signing up for a"
@@ -291,43 +277,23 @@ func SendEmail(emailAddress string, verificationKey string, invite string, descr
 		ending = "and select a password "
 	}
 
-	buf := bytes.NewBufferString("" +
-		"Subject: " + subject + "\r\n" +
-		"From: Sponsor-Hub <no-reply@thinkglobally.org>\r\n" +
-		"Reply-To: Sponsor-Hub <no-reply@thinkglobally.org>\r\n" +
-		"MIME-Version: 1.0\r\n" +
-		"Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n" +
-		"\r\n" +
-		"--" + boundary + "\r\n" +
-		"Content-Type: text/plain; charset=utf-8\r\n" +
-		"Content-Transfer-Encoding: 7bit\r\n" +
-		"\r\n" +
-		opening + " Sponsor Hub\r\n" +
-		"\r\n" +
-		middling +
-		"Please click on the following link to confirm your email address " + ending +
-		"\r\n" + confirmUrl + "\r\n" +
-		"\r\n" +
-		"--" + boundary + "\r\n" +
-		"Content-Type: text/html; charset=utf-8\r\n" +
-		"Content-Transfer-Encoding: 7bit\r\n" +
-		"\r\n" +
-		"<!DOCTYPE html>\r\n" +
-		"<html>\r\n" +
-		"<head>\r\n" +
-		"</head>\r\n" +
-		"<body>\r\n" +
-		"<p>" + opening + " Sponsor-hub account</p>\r\n" +
-		"\r\n" +
-		middlingHTML +
-		"<p>Please click on the following link to confirm your email address " + ending + "</p>" +
-		"<p><a href=" + confirmUrl + ">" + confirmUrl + "</a></p>\r\n" +
-		"</body>\r\n" +
-		"</html>\r\n" +
-		"\r\n" +
-		"--" + boundary + "--\r\n")
-	_, err = buf.WriteTo(wc)
-	LogFatalError(err)
+	err := sendMail(&MailMessage{
+		To:      emailAddress,
+		Subject: subject,
+		Text: opening + " Sponsor Hub\r\n" +
+			"\r\n" +
+			middling +
+			"Please click on the following link to confirm your email address " + ending +
+			"\r\n" + confirmUrl + "\r\n",
+		HTML: "<p>" + opening + " Sponsor-hub account</p>\r\n" +
+			"\r\n" +
+			middlingHTML +
+			"<p>Please click on the following link to confirm your email address " + ending + "</p>" +
+			"<p><a href=" + confirmUrl + ">" + confirmUrl + "</a></p>\r\n",
+	})
+	if err != nil {
+		log.Print(err)
+	}
 }
 
 func ConfirmEmail(c *gin.Context) {
@@ -346,7 +312,7 @@ func ConfirmEmail(c *gin.Context) {
 			if len(user.Password) > 0 {
 				user.Confirmed = true
 				user.ConfirmVerifier = ""
-				_, _ = App.Store.UpdateUser(user)
+				_, _ = App.Store.UpdateUser(user, store.NewOutboxEvent(store.WebhookEventUserRegistered, &user.PublicUser))
 				c.Redirect(307, "/sponsor-hub/")
 			} else {
 				c.Redirect(307, "/sponsor-hub/register?email="+url.QueryEscape(email)+"&verification="+url.QueryEscape(verificationKey))
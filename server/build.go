@@ -0,0 +1,241 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const buildsDirectoryDefault = "builds"
+const buildLinkValidFor = 24 * time.Hour
+
+type BuildArtifactJSON struct {
+	ChannelId  uint
+	Platform   string
+	Version    string
+	FileName   string
+	StorageKey string
+	Sha256     string
+	Notes      string
+}
+
+type UserBuildJSON struct {
+	store.BuildArtifact
+	Url       string
+	ExpiresAt time.Time
+}
+
+func buildDownloadResource(artifactId uint, userId uint) string {
+	return fmt.Sprintf("builds/%d/users/%d/download", artifactId, userId)
+}
+
+func buildArtifactPath(artifact *store.BuildArtifact) string {
+	return filepath.Join(App.BuildsDirectory, filepath.FromSlash(artifact.StorageKey))
+}
+
+func checksumBuildArtifact(artifact *store.BuildArtifact) error {
+	file, err := os.Open(buildArtifactPath(artifact))
+	if err != nil {
+		return errors.New("build file not found")
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if len(artifact.Sha256) > 0 && artifact.Sha256 != checksum {
+		return errors.New("checksum does not match the build file")
+	}
+	artifact.Sha256 = checksum
+	artifact.Size = size
+	return nil
+}
+
+func AddBuildArtifact(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	artifactJSON := BuildArtifactJSON{}
+	err := c.BindJSON(&artifactJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Build failed validation - err: %s", err.Error())})
+		return
+	}
+	artifact := store.BuildArtifact{
+		ChannelId:  artifactJSON.ChannelId,
+		Platform:   artifactJSON.Platform,
+		Version:    artifactJSON.Version,
+		FileName:   artifactJSON.FileName,
+		StorageKey: artifactJSON.StorageKey,
+		Sha256:     artifactJSON.Sha256,
+		Notes:      artifactJSON.Notes,
+		UploadedBy: loggedInUserId,
+	}
+	err = artifact.Validate()
+	if err == nil {
+		channel, loadErr := App.Store.LoadReleaseChannel(artifact.ChannelId)
+		if loadErr != nil {
+			err = store.ErrUnknownReleaseChannel
+		} else if !channel.SupportsPlatform(artifact.Platform) {
+			err = store.ErrUnsupportedPlatform
+		}
+	}
+	if err == nil {
+		err = checksumBuildArtifact(&artifact)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Build failed validation - err: %s", err.Error())})
+		return
+	}
+
+	artifactId, err := App.Store.InsertBuildArtifact(&artifact)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Build failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Build registered successfully", "resourceId": artifactId,
+	})
+}
+
+func DeleteBuildArtifact(c *gin.Context) {
+	artifact, ok := loadBuildArtifact(c)
+	if !ok {
+		return
+	}
+	err := App.Store.DeleteBuildArtifact(artifact.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Delete Build failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Build deleted",
+	})
+}
+
+func ChannelBuildsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	channel, ok := loadReleaseChannel(c)
+	if !ok {
+		return
+	}
+	artifacts, err := App.Store.ListBuildArtifactsForChannel(channel.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Builds not found"})
+		return
+	}
+	c.JSON(http.StatusOK, artifacts)
+}
+
+func BuildDownloadsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	artifact, ok := loadBuildArtifact(c)
+	if !ok {
+		return
+	}
+	downloads, err := App.Store.ListBuildDownloads(artifact.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Build downloads not found"})
+		return
+	}
+	c.JSON(http.StatusOK, downloads)
+}
+
+func UserBuildsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	artifacts, err := App.Store.ListBuildArtifactsForUser(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Builds not found"})
+		return
+	}
+	expires := time.Now().Add(buildLinkValidFor)
+	buildsJSON := []UserBuildJSON{}
+	for _, v := range artifacts {
+		buildsJSON = append(buildsJSON, UserBuildJSON{BuildArtifact: v, Url: signedUrl(buildDownloadResource(v.ID, userId), expires), ExpiresAt: expires})
+	}
+	c.JSON(http.StatusOK, buildsJSON)
+}
+
+func DownloadBuildArtifact(c *gin.Context) {
+	artifactId, err := strconv.Atoi(c.Param("buildID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid BuildID"})
+		return
+	}
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	if !validSignedRequest(c, buildDownloadResource(uint(artifactId), uint(userId))) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Download link is invalid or has expired"})
+		return
+	}
+	if !App.Store.CanDownloadBuildArtifact(uint(userId), uint(artifactId)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Not subscribed to this build's channel"})
+		return
+	}
+	artifact, err := App.Store.LoadBuildArtifact(uint(artifactId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Build not found"})
+		return
+	}
+	file, err := os.Open(buildArtifactPath(artifact))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Build file not found"})
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Build file not found"})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+artifact.FileName+"\"")
+	c.Header("ETag", "\""+artifact.Sha256+"\"")
+	http.ServeContent(c.Writer, c.Request, artifact.FileName, info.ModTime(), file)
+
+	_, err = App.Store.InsertBuildDownload(&store.BuildDownload{
+		ArtifactId: artifact.ID,
+		UserId:     uint(userId),
+		RemoteAddr: c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		Bytes:      int64(c.Writer.Size()),
+		Status:     c.Writer.Status(),
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func loadBuildArtifact(c *gin.Context) (*store.BuildArtifact, bool) {
+	artifactId, err := strconv.Atoi(c.Param("buildID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid BuildID"})
+		return nil, false
+	}
+	artifact, err := App.Store.LoadBuildArtifact(uint(artifactId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Build not found"})
+		return nil, false
+	}
+	return artifact, true
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type SurveyCampaignJSON struct {
+	ID          uint
+	Name        string
+	Description string
+	OpensAt     time.Time
+	ClosesAt    time.Time
+	Open        bool
+}
+
+func surveyCampaignToJSON(campaign *store.SurveyCampaign) SurveyCampaignJSON {
+	return SurveyCampaignJSON{
+		ID:          campaign.ID,
+		Name:        campaign.Name,
+		Description: campaign.Description,
+		OpensAt:     campaign.OpensAt,
+		ClosesAt:    campaign.ClosesAt,
+		Open:        campaign.IsOpen(time.Now()),
+	}
+}
+
+func SurveyCampaignsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	campaigns, err := App.Store.ListSurveyCampaigns()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey campaigns not found"})
+		return
+	}
+	campaignsJSON := []SurveyCampaignJSON{}
+	for i := range campaigns {
+		campaignsJSON = append(campaignsJSON, surveyCampaignToJSON(&campaigns[i]))
+	}
+	c.JSON(http.StatusOK, campaignsJSON)
+}
+
+func AddSurveyCampaign(c *gin.Context) {
+	campaign := store.SurveyCampaign{}
+	err := readJSONIntoSurveyCampaign(&campaign, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Survey campaign failed validation - err: %s", err.Error())})
+		return
+	}
+
+	campaignId, err := App.Store.InsertSurveyCampaign(&campaign)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Survey campaign failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Survey campaign created successfully", "resourceId": campaignId,
+	})
+}
+
+func UpdateSurveyCampaign(c *gin.Context) {
+	campaignId, err := strconv.Atoi(c.Param("campaignID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("CampaignID invalid - err: %s", err.Error())})
+		return
+	}
+
+	campaign, err := App.Store.LoadSurveyCampaign(uint(campaignId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey campaign not found"})
+		return
+	}
+
+	err = readJSONIntoSurveyCampaign(campaign, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Survey campaign failed validation - err: %s", err.Error())})
+		return
+	}
+
+	_, err = App.Store.UpdateSurveyCampaign(campaign)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Survey campaign failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Survey campaign updated successfully", "resourceId": campaignId,
+	})
+}
+
+func readJSONIntoSurveyCampaign(campaign *store.SurveyCampaign, c *gin.Context) error {
+	campaignJSON := SurveyCampaignJSON{}
+	err := c.BindJSON(&campaignJSON)
+	if err != nil {
+		return err
+	}
+	if len(campaignJSON.Name) == 0 {
+		return errors.New("name is required")
+	}
+	if !campaignJSON.ClosesAt.After(campaignJSON.OpensAt) {
+		return errors.New("closing date must be after the opening date")
+	}
+
+	campaign.Name = campaignJSON.Name
+	campaign.Description = campaignJSON.Description
+	campaign.OpensAt = campaignJSON.OpensAt
+	campaign.ClosesAt = campaignJSON.ClosesAt
+	return nil
+}
+
+func LoadCampaignSurvey(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	campaignId, err := strconv.Atoi(c.Param("campaignID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid CampaignID"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	survey, err := App.Store.LoadSurveyForUserCampaign(loggedInUserId, uint(campaignId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey not found"})
+		return
+	}
+	c.JSON(http.StatusOK, surveyToJSON(survey))
+}
+
+func AddCampaignSurvey(c *gin.Context) {
+	campaign, ok := loadOpenCampaign(c)
+	if !ok {
+		return
+	}
+
+	survey := store.Survey{}
+	err := readJSONIntoSurvey(&survey, c, true)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Survey failed validation - err: %s", err.Error())})
+		return
+	}
+
+	claims := jwt.ExtractClaims(c)
+	survey.UserId = uint(claims["id"].(float64))
+	survey.CampaignId = campaign.ID
+
+	surveyId, err := App.Store.InsertCampaignSurvey(&survey)
+	if err == store.ErrCampaignAlreadyAnswered {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": "Survey campaign already answered"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Survey failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Survey created successfully", "resourceId": surveyId,
+	})
+}
+
+func UpdateCampaignSurvey(c *gin.Context) {
+	campaign, ok := loadOpenCampaign(c)
+	if !ok {
+		return
+	}
+
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	survey, err := App.Store.LoadSurveyForUserCampaign(loggedInUserId, campaign.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey not found"})
+		return
+	}
+
+	err = readJSONIntoSurvey(survey, c, true)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Survey details failed validation - err: %s", err.Error())})
+		return
+	}
+
+	_, err = App.Store.UpdateSurvey(survey, loggedInUserId, surveyUpdatedEvent(survey, loggedInUserId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Survey failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Survey updated successfully", "resourceId": survey.ID,
+	})
+}
+
+func loadOpenCampaign(c *gin.Context) (*store.SurveyCampaign, bool) {
+	campaignId, err := strconv.Atoi(c.Param("campaignID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid CampaignID"})
+		return nil, false
+	}
+	campaign, err := App.Store.LoadSurveyCampaign(uint(campaignId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey campaign not found"})
+		return nil, false
+	}
+	if !campaign.IsOpen(time.Now()) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Survey campaign is not open"})
+		return nil, false
+	}
+	return campaign, true
+}
+
+func SurveyCampaignReport(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	campaignId, err := strconv.Atoi(c.Param("campaignID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid CampaignID"})
+		return
+	}
+	stats, err := App.Store.CampaignStatistics(uint(campaignId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey campaign not found"})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func CompareSurveyCampaigns(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	campaignId, err := strconv.Atoi(c.Param("campaignID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid CampaignID"})
+		return
+	}
+	otherId, err := strconv.Atoi(c.Param("otherID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid CampaignID to compare with"})
+		return
+	}
+	comparison, err := App.Store.CompareCampaigns(uint(campaignId), uint(otherId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey campaign not found"})
+		return
+	}
+	c.JSON(http.StatusOK, comparison)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+type ReleaseChannelJSON struct {
+	Name        string
+	Description string
+	Platforms   string
+	IsDefault   bool
+}
+
+type ChannelSubscriptionJSON struct {
+	ChannelId uint
+	Platform  string
+}
+
+func ReleaseChannelsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	channels, err := App.Store.ListReleaseChannels()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Release channels not found"})
+		return
+	}
+	c.JSON(http.StatusOK, channels)
+}
+
+func AddReleaseChannel(c *gin.Context) {
+	channel := store.ReleaseChannel{}
+	err := readJSONIntoReleaseChannel(&channel, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Release channel failed validation - err: %s", err.Error())})
+		return
+	}
+	channelId, err := App.Store.InsertReleaseChannel(&channel)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Release channel failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Release channel created successfully", "resourceId": channelId,
+	})
+}
+
+func UpdateReleaseChannel(c *gin.Context) {
+	channel, ok := loadReleaseChannel(c)
+	if !ok {
+		return
+	}
+	err := readJSONIntoReleaseChannel(channel, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Release channel failed validation - err: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.UpdateReleaseChannel(channel)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Release channel failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Release channel updated successfully", "resourceId": channel.ID,
+	})
+}
+
+func DeleteReleaseChannel(c *gin.Context) {
+	channel, ok := loadReleaseChannel(c)
+	if !ok {
+		return
+	}
+	err := App.Store.DeleteReleaseChannel(channel.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Delete Release channel failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Release channel deleted",
+	})
+}
+
+func loadReleaseChannel(c *gin.Context) (*store.ReleaseChannel, bool) {
+	if c.Param("channelID") == "default" {
+		channel, err := App.Store.DefaultReleaseChannel()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "No default release channel"})
+			return nil, false
+		}
+		return channel, true
+	}
+	channelId, err := strconv.Atoi(c.Param("channelID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid ChannelID"})
+		return nil, false
+	}
+	channel, err := App.Store.LoadReleaseChannel(uint(channelId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Release channel not found"})
+		return nil, false
+	}
+	return channel, true
+}
+
+func readJSONIntoReleaseChannel(channel *store.ReleaseChannel, c *gin.Context) error {
+	channelJSON := ReleaseChannelJSON{}
+	err := c.BindJSON(&channelJSON)
+	if err != nil {
+		return err
+	}
+
+	channel.Name = channelJSON.Name
+	channel.Description = channelJSON.Description
+	channel.Platforms = channelJSON.Platforms
+	channel.IsDefault = channelJSON.IsDefault
+	return channel.Validate()
+}
+
+func ChannelSubscribersList(c *gin.Context) {
+	channel, ok := loadReleaseChannel(c)
+	if !ok {
+		return
+	}
+	platform := c.Query("platform")
+	if !channel.SupportsPlatform(platform) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": store.ErrUnsupportedPlatform.Error()})
+		return
+	}
+	subscribers, err := App.Store.ListChannelSubscribers(channel.ID, platform)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Channel subscribers not found"})
+		return
+	}
+
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, subscribers)
+		return
+	}
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", "attachment; filename=\"subscribers-"+channel.Name+".csv\"")
+	csvWriter := csv.NewWriter(c.Writer)
+	_ = csvWriter.Write([]string{"ID", "Name", "Email", "Platform"})
+	for _, v := range subscribers {
+		_ = csvWriter.Write([]string{strconv.FormatUint(uint64(v.ID), 10), v.Name, v.Email, v.Platform})
+	}
+	csvWriter.Flush()
+}
+
+func ChannelSubscriptionsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	subscriptions, err := App.Store.ListChannelSubscriptionsForUser(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Channel subscriptions not found"})
+		return
+	}
+	c.JSON(http.StatusOK, subscriptions)
+}
+
+func ReplaceChannelSubscriptions(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	var subscriptionsJSON []ChannelSubscriptionJSON
+	err := c.BindJSON(&subscriptionsJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Channel subscriptions failed validation - err: %s", err.Error())})
+		return
+	}
+	var subscriptions []store.ChannelSubscription
+	for _, v := range subscriptionsJSON {
+		subscriptions = append(subscriptions, store.ChannelSubscription{ChannelId: v.ChannelId, Platform: v.Platform})
+	}
+
+	err = App.Store.ReplaceChannelSubscriptions(userId, subscriptions)
+	switch err {
+	case nil:
+	case store.ErrUnknownReleaseChannel, store.ErrUnsupportedPlatform, store.ErrDuplicateSubscription:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Channel subscriptions failed validation - err: %s", err.Error())})
+		return
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Replace Channel subscriptions failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Channel subscriptions updated successfully",
+	})
+}
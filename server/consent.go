@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+type ConsentJSON struct {
+	Type    string
+	Granted bool
+	Source  string
+}
+
+type PrivacyPolicyJSON struct {
+	Version     string
+	Url         string
+	PublishedAt time.Time
+}
+
+func ConsentsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	statuses, err := App.Store.ConsentStatusForUser(loggedInUserId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Consents not found"})
+		return
+	}
+	reconsentRequired := false
+	for _, v := range statuses {
+		reconsentRequired = reconsentRequired || v.ReconsentRequired
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"PolicyVersion": App.Store.CurrentPrivacyPolicyVersion(), "ReconsentRequired": reconsentRequired, "Consents": statuses,
+	})
+}
+
+func ConsentHistory(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	records, err := App.Store.ListConsentRecordsForUser(loggedInUserId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Consents not found"})
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+func AddConsent(c *gin.Context) {
+	consentJSON := ConsentJSON{}
+	err := c.BindJSON(&consentJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Consent failed validation - err: %s", err.Error())})
+		return
+	}
+	consentType, err := store.ParseConsentType(consentJSON.Type)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Consent failed validation - err: %s", err.Error())})
+		return
+	}
+	source := consentJSON.Source
+	if len(source) == 0 {
+		source = "api"
+	}
+
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	record, err := App.Store.RecordConsent(loggedInUserId, consentType, consentJSON.Granted, source)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Consent failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Consent recorded successfully", "resourceId": record.ID,
+	})
+}
+
+func recordSurveyConsents(userId uint, before *store.Survey, after *store.Survey) {
+	if after.CampaignId != 0 {
+		return
+	}
+	changes := []struct {
+		consentType store.ConsentType
+		before      bool
+		after       bool
+	}{
+		{store.ConsentTypePreReleaseEmails, before.PreRelease, after.PreRelease},
+		{store.ConsentTypePublicListing, before.Privacy == store.PrivacyLevelPublic, after.Privacy == store.PrivacyLevelPublic},
+		{store.ConsentTypeDataSharing, before.Privacy.VisibleTo(store.SurveyViewerSponsoredDeveloper), after.Privacy.VisibleTo(store.SurveyViewerSponsoredDeveloper)},
+	}
+	for _, v := range changes {
+		if v.before != v.after {
+			_, err := App.Store.RecordConsent(userId, v.consentType, v.after, "survey")
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func PrivacyPoliciesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	policies, err := App.Store.ListPrivacyPolicies()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Privacy policies not found"})
+		return
+	}
+	c.JSON(http.StatusOK, policies)
+}
+
+func AddPrivacyPolicy(c *gin.Context) {
+	policyJSON := PrivacyPolicyJSON{}
+	err := c.BindJSON(&policyJSON)
+	if err == nil && len(policyJSON.Version) == 0 {
+		err = errors.New("version is required")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Privacy policy failed validation - err: %s", err.Error())})
+		return
+	}
+	if policyJSON.PublishedAt.IsZero() {
+		policyJSON.PublishedAt = time.Now()
+	}
+
+	policy := store.PrivacyPolicy{
+		Version:     policyJSON.Version,
+		Url:         policyJSON.Url,
+		PublishedAt: policyJSON.PublishedAt,
+	}
+	policyId, err := App.Store.InsertPrivacyPolicy(&policy)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Privacy policy failed"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Privacy policy added successfully", "resourceId": policyId,
+	})
+}
+
+func SendDuePrivacyPolicyReconsents(now time.Time) {
+	policies, err := App.Store.ClaimDuePrivacyPolicies(now)
+	if err != nil {
+		log.Print(err)
+	}
+	if len(policies) > 0 {
+		askForReconsent(&policies[len(policies)-1])
+	}
+}
+
+func askForReconsent(policy *store.PrivacyPolicy) {
+	userIds, err := App.Store.ListUserIdsWithGrantedConsent()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	unconsented, err := App.Store.ListUserIdsWithUnconsentedSubscriptions()
+	if err != nil {
+		log.Print(err)
+	}
+	userIds = append(userIds, unconsented...)
+	for _, userId := range userIds {
+		_, err = Notify(userId, store.NotificationCategoryAccount, "Sponsor-Hub privacy policy updated",
+			"Our privacy policy has been updated to version "+policy.Version+" "+policy.Url+"\n"+
+				"Please log in to Sponsor-Hub to review and renew your consents.")
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const crashUploadMaxSize = 10 * 1024 * 1024
+const crashSignatureMaxRead = 1024 * 1024
+const crashUploadRetention = 90 * 24 * time.Hour
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zipMagic = []byte{'P', 'K', 0x03, 0x04}
+
+type DeviceTokenJSON struct {
+	Name string
+}
+
+func DeviceTokensList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	tokens, err := App.Store.ListDeviceTokensForUser(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Device tokens not found"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+func AddDeviceToken(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	tokenJSON := DeviceTokenJSON{}
+	err := c.BindJSON(&tokenJSON)
+	if err == nil && len(strings.TrimSpace(tokenJSON.Name)) == 0 {
+		err = fmt.Errorf("device name is required")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Device token failed validation - err: %s", err.Error())})
+		return
+	}
+	token := RandomKey(32)
+	deviceToken := store.DeviceToken{UserId: userId, Name: strings.TrimSpace(tokenJSON.Name), TokenHash: store.HashDeviceToken(token)}
+	tokenId, err := App.Store.InsertDeviceToken(&deviceToken)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Device token failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Device token created, it will not be shown again", "resourceId": tokenId, "token": token,
+	})
+}
+
+func DeleteDeviceToken(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	tokenId, err := strconv.Atoi(c.Param("tokenID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid TokenID"})
+		return
+	}
+	err = App.Store.DeleteDeviceToken(userId, uint(tokenId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Delete Device token failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Device token revoked",
+	})
+}
+
+func IngestCrashUpload(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	deviceToken, err := App.Store.AuthenticateDeviceToken(token, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"statusText": "Invalid device token"})
+		return
+	}
+	artifact, ok := loadBuildArtifact(c)
+	if !ok {
+		return
+	}
+	if !App.Store.CanDownloadBuildArtifact(deviceToken.UserId, artifact.ID) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Not subscribed to this build's channel"})
+		return
+	}
+	kind, err := store.ParseCrashKind(c.DefaultQuery("kind", string(store.CrashKindCrash)))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, crashUploadMaxSize))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"statusText": "Uploads are limited to 10MB compressed"})
+		return
+	}
+	device := c.Query("device")
+	if len(device) == 0 {
+		device = deviceToken.Name
+	}
+	signature, title, contentType, err := crashUploadSignature(kind, fmt.Sprintf("%s #%d", device, deviceToken.ID), data)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Upload failed validation - err: %s", err.Error())})
+		return
+	}
+
+	upload := store.CrashUpload{
+		ArtifactId:    artifact.ID,
+		UserId:        deviceToken.UserId,
+		DeviceTokenId: deviceToken.ID,
+		Device:        device,
+		Kind:          kind,
+		ContentType:   contentType,
+		Size:          int64(len(data)),
+		Data:          data,
+	}
+	group, err := App.Store.InsertCrashUpload(&upload, signature, title, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Upload failed"})
+		return
+	}
+	if upload.ID == 0 {
+		c.JSON(http.StatusAccepted, gin.H{
+			"status": http.StatusAccepted, "message": fmt.Sprintf("Upload counted but not stored, seen %d times and %d samples are already kept",
+				group.Count, store.CrashSamplesPerGroup), "resourceId": group.ID, "count": group.Count,
+		})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": fmt.Sprintf("Upload recorded, seen %d times", group.Count), "resourceId": group.ID,
+	})
+}
+
+func crashUploadSignature(kind store.CrashKind, device string, data []byte) (string, string, string, error) {
+	if kind == store.CrashKindLog {
+		if !bytes.HasPrefix(data, gzipMagic) && !bytes.HasPrefix(data, zipMagic) {
+			return "", "", "", fmt.Errorf("log bundles should be gzip or zip compressed")
+		}
+		signature, title := store.CrashSignature(kind, device)
+		contentType := "application/gzip"
+		if bytes.HasPrefix(data, zipMagic) {
+			contentType = "application/zip"
+		}
+		return signature, title, contentType, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", "", "", fmt.Errorf("crash dumps should be gzip compressed")
+	}
+	report, err := ioutil.ReadAll(io.LimitReader(reader, crashSignatureMaxRead))
+	if err != nil {
+		return "", "", "", err
+	}
+	signature, title := store.CrashSignature(kind, string(report))
+	return signature, title, "application/gzip", nil
+}
+
+func BuildCrashGroupsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	artifact, ok := loadBuildArtifact(c)
+	if !ok {
+		return
+	}
+	groups, err := App.Store.ListCrashGroupsForBuild(artifact.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Crash groups not found"})
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+func CrashGroupUploadsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	groupId, err := strconv.Atoi(c.Param("groupID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid GroupID"})
+		return
+	}
+	group, err := App.Store.LoadCrashGroup(uint(groupId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Crash group not found"})
+		return
+	}
+	uploads, err := App.Store.ListCrashUploadsForGroup(group.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Uploads not found"})
+		return
+	}
+	c.JSON(http.StatusOK, uploads)
+}
+
+func DownloadCrashUpload(c *gin.Context) {
+	uploadId, err := strconv.Atoi(c.Param("uploadID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UploadID"})
+		return
+	}
+	upload, err := App.Store.LoadCrashUpload(uint(uploadId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Upload not found"})
+		return
+	}
+	extension := ".gz"
+	if upload.ContentType == "application/zip" {
+		extension = ".zip"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%d%s\"", upload.Kind, upload.ID, extension))
+	c.Data(http.StatusOK, upload.ContentType, upload.Data)
+}
+
+func ExpireCrashUploads(now time.Time) {
+	err := App.Store.DeleteCrashUploadsBefore(now.Add(-crashUploadRetention))
+	if err != nil {
+		log.Print(err)
+	}
+}
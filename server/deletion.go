@@ -0,0 +1,102 @@
+package server
+
+import (
+	"github.com/adamboardman/sponsor-hub/store"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultDeletionGracePeriod = 30 * 24 * time.Hour
+
+func DeleteUser(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+
+	deletion, err := App.Store.ScheduleAccountDeletion(userId, time.Now().Add(App.DeletionGracePeriod))
+	if err == store.ErrAccountDeletionAlreadyScheduled {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": "Account deletion already scheduled"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Schedule Account deletion failed"})
+		return
+	}
+
+	user, err := App.Store.LoadPrivilegedUserAsSelf(userId, userId)
+	if err == nil {
+		err = sendMail(&MailMessage{
+			To:      user.Email,
+			Subject: "Sponsor-Hub account deletion scheduled",
+			Text: "Your Sponsor-Hub account will be deleted on " + deletion.ScheduledFor.Format(time.RFC1123) + "\r\n" +
+				"If you did not ask for this, log in before then and cancel the deletion.\r\n",
+			HTML: "<p>Your Sponsor-Hub account will be deleted on " + deletion.ScheduledFor.Format(time.RFC1123) + "</p>\r\n" +
+				"<p>If you did not ask for this, log in before then and cancel the deletion.</p>\r\n",
+		})
+	}
+	if err != nil {
+		log.Print(err)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"status": http.StatusAccepted, "message": "Account deletion scheduled", "resourceId": deletion.ID, "scheduledFor": deletion.ScheduledFor,
+	})
+}
+
+func LoadAccountDeletion(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+
+	deletion, err := App.Store.LoadScheduledAccountDeletion(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "No account deletion scheduled"})
+		return
+	}
+	c.JSON(http.StatusOK, deletion)
+}
+
+func CancelAccountDeletion(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+
+	err := App.Store.CancelAccountDeletion(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "No account deletion scheduled"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Account deletion cancelled",
+	})
+}
+
+func ProcessDueAccountDeletions(now time.Time) {
+	deletions, err := App.Store.ListDueAccountDeletions(now)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for i := range deletions {
+		err = App.Store.CompleteAccountDeletion(&deletions[i], now)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func AuditRecordsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	records, err := App.Store.ListAuditRecords()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Audit records not found"})
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	LiveEventsBackendLocal    = "local"
+	LiveEventsBackendPostgres = "postgres"
+)
+
+const (
+	LiveEventSponsorAdded          = "sponsor-added"
+	LiveEventSponsorUpdated        = "sponsor-updated"
+	LiveEventSponsorRemoved        = "sponsor-removed"
+	LiveEventNotification          = "notification"
+	LiveEventAnnouncementPublished = "announcement-published"
+)
+
+const liveEventsKeepAlive = 25 * time.Second
+const liveEventsLinkValidFor = time.Minute
+const liveEventsBuffer = 16
+
+type LiveEvent struct {
+	UserId uint
+	Type   string
+	Data   json.RawMessage
+}
+
+type liveEventHub struct {
+	mu          sync.RWMutex
+	subscribers map[uint]map[chan *LiveEvent]bool
+}
+
+var liveEvents = &liveEventHub{subscribers: map[uint]map[chan *LiveEvent]bool{}}
+
+func (h *liveEventHub) subscribe(userId uint) chan *LiveEvent {
+	events := make(chan *LiveEvent, liveEventsBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[userId] == nil {
+		h.subscribers[userId] = map[chan *LiveEvent]bool{}
+	}
+	h.subscribers[userId][events] = true
+	return events
+}
+
+func (h *liveEventHub) unsubscribe(userId uint, events chan *LiveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[userId], events)
+	if len(h.subscribers[userId]) == 0 {
+		delete(h.subscribers, userId)
+	}
+}
+
+func (h *liveEventHub) dispatch(event *LiveEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for events := range h.subscribers[event.UserId] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+func (h *liveEventHub) dispatchPayload(payload string) {
+	event := LiveEvent{}
+	err := json.Unmarshal([]byte(payload), &event)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	h.dispatch(&event)
+}
+
+func startLiveEvents(a *WebApp) {
+	if a.LiveEventsBackend != LiveEventsBackendPostgres {
+		return
+	}
+	err := a.Store.ListenForLiveEvents(liveEvents.dispatchPayload)
+	if err != nil {
+		log.Print(err)
+		a.LiveEventsBackend = LiveEventsBackendLocal
+	}
+}
+
+func publishLiveEvent(userId uint, eventType string, data interface{}) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	event := &LiveEvent{UserId: userId, Type: eventType, Data: encoded}
+	if App.LiveEventsBackend != LiveEventsBackendPostgres {
+		liveEvents.dispatch(event)
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err == nil && len(payload) > store.LiveEventMaxPayload {
+		event.Data = nil
+		payload, err = json.Marshal(event)
+	}
+	if err == nil {
+		err = App.Store.PublishLiveEvent(string(payload))
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func publishSponsorshipEvent(eventType string, surveyId uint, developerIds ...uint) {
+	survey, err := App.Store.LoadSurvey(surveyId)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, developerId := range developerIds {
+		data := gin.H{"SurveyId": surveyId, "DeveloperId": developerId}
+		publishLiveEvent(developerId, eventType, data)
+		if survey.UserId != 0 && survey.UserId != developerId {
+			publishLiveEvent(survey.UserId, eventType, data)
+		}
+	}
+}
+
+func liveEventsResource(userId uint) string {
+	return fmt.Sprintf("events/users/%d", userId)
+}
+
+func LiveEventsStream(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	streamLiveEvents(c, userId)
+}
+
+func LiveEventsLink(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Connect within a minute", "url": signedUrl(liveEventsResource(userId), time.Now().Add(liveEventsLinkValidFor)),
+	})
+}
+
+func SignedLiveEventsStream(c *gin.Context) {
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	if !validSignedRequest(c, liveEventsResource(uint(userId))) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Event stream link is invalid or has expired"})
+		return
+	}
+	streamLiveEvents(c, uint(userId))
+}
+
+func streamLiveEvents(c *gin.Context, userId uint) {
+	events := liveEvents.subscribe(userId)
+	defer liveEvents.unsubscribe(userId, events)
+	keepAlive := time.NewTicker(liveEventsKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-events:
+			c.SSEvent(event.Type, event.Data)
+		case <-keepAlive.C:
+			_, _ = io.WriteString(w, ": keep-alive\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
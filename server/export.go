@@ -0,0 +1,300 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const dataExportLifetime = 48 * time.Hour
+
+type DataExportJSON struct {
+	ID        uint
+	Status    store.DataExportStatus
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Url       string
+}
+
+func dataExportResource(exportId uint) string {
+	return "exports/" + strconv.FormatUint(uint64(exportId), 10) + "/download"
+}
+
+func selfUserIdParam(c *gin.Context) (uint, bool) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return 0, false
+	}
+	if userId != 0 && uint(userId) != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Trying to access someone else's details?"})
+		return 0, false
+	}
+	return loggedInUserId, true
+}
+
+func RequestDataExport(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+
+	export := store.DataExport{UserId: userId, Status: store.DataExportStatusPending}
+	exportId, err := App.Store.InsertDataExport(&export)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Data export failed"})
+		return
+	}
+	go generateDataExport(&export)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"status": http.StatusAccepted, "message": "Data export requested, you will be emailed a download link", "resourceId": exportId,
+	})
+}
+
+func DataExportsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+
+	exports, err := App.Store.ListDataExportsForUser(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Data exports not found"})
+		return
+	}
+	exportsJSON := []DataExportJSON{}
+	for _, v := range exports {
+		exportJSON := DataExportJSON{ID: v.ID, Status: v.Status, CreatedAt: v.CreatedAt, ExpiresAt: v.ExpiresAt}
+		if v.Status == store.DataExportStatusReady {
+			exportJSON.Url = signedUrl(dataExportResource(v.ID), v.ExpiresAt)
+		}
+		exportsJSON = append(exportsJSON, exportJSON)
+	}
+	c.JSON(http.StatusOK, exportsJSON)
+}
+
+func DownloadDataExport(c *gin.Context) {
+	exportId, err := strconv.Atoi(c.Param("exportID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid ExportID"})
+		return
+	}
+	if !validSignedRequest(c, dataExportResource(uint(exportId))) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Download link is invalid or has expired"})
+		return
+	}
+	export, err := App.Store.LoadDataExport(uint(exportId))
+	if err != nil || export.Status != store.DataExportStatusReady {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Data export not found"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"sponsor-hub-export-%d.zip\"", export.ID))
+	c.Data(http.StatusOK, "application/zip", export.Data)
+}
+
+func generateDataExport(export *store.DataExport) {
+	data, err := App.Store.CollectUserData(export.UserId)
+	if err == nil {
+		export.Data, err = buildDataExportZip(data)
+	}
+	if err != nil {
+		log.Print(err)
+		export.Status = store.DataExportStatusFailed
+		_, _ = App.Store.UpdateDataExport(export)
+		return
+	}
+	export.Status = store.DataExportStatusReady
+	export.ExpiresAt = time.Now().Add(dataExportLifetime)
+	_, err = App.Store.UpdateDataExport(export)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	link := signedUrl(dataExportResource(export.ID), export.ExpiresAt)
+	err = sendMail(&MailMessage{
+		To:      data.User.Email,
+		Subject: "Sponsor-Hub data export ready",
+		Text:    "Your Sponsor-Hub data export is ready to download until " + export.ExpiresAt.Format(time.RFC1123) + "\r\n" + link + "\r\n",
+		HTML: "<p>Your Sponsor-Hub data export is ready to download until " + export.ExpiresAt.Format(time.RFC1123) + "</p>\r\n" +
+			"<p><a href=\"" + link + "\">" + link + "</a></p>\r\n",
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func ExpireDataExports(now time.Time) {
+	err := App.Store.ExpireDataExports(now)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+type dataExportTable struct {
+	name   string
+	header []string
+	rows   [][]string
+}
+
+func buildDataExportZip(data *store.UserData) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+
+	jsonWriter, err := zipWriter.Create("sponsor-hub-export.json")
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(jsonWriter)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	formatTime := func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	}
+	formatUint := func(v uint) string {
+		return strconv.FormatUint(uint64(v), 10)
+	}
+
+	user := data.User
+	var tables []dataExportTable
+	tables = append(tables, dataExportTable{"user.csv", []string{"ID", "CreatedAt", "Name", "Email", "Confirmed", "Permissions"}, [][]string{
+		{formatUint(user.ID), formatTime(user.CreatedAt), user.Name, user.Email, strconv.FormatBool(user.Confirmed), strconv.Itoa(int(user.Permissions))},
+	}})
+
+	surveys := dataExportTable{name: "surveys.csv", header: []string{"ID", "CreatedAt", "UpdatedAt", "CampaignId", "Name", "GitHubId", "Priorities", "Issues", "CommsFrequency", "PreRelease", "Privacy"}}
+	for _, v := range data.Surveys {
+		surveys.rows = append(surveys.rows, []string{formatUint(v.ID), formatTime(v.CreatedAt), formatTime(v.UpdatedAt), formatUint(v.CampaignId),
+			v.Name, v.GitHubId, v.Priorities, v.Issues, string(v.CommsFrequency), strconv.FormatBool(v.PreRelease), string(v.Privacy)})
+	}
+	tables = append(tables, surveys)
+
+	revisions := dataExportTable{name: "survey_revisions.csv", header: []string{"SurveyId", "Revision", "CreatedAt", "AuthorId", "Name", "GitHubId", "Priorities", "Issues", "CommsFrequency", "PreRelease", "Privacy"}}
+	for _, v := range data.SurveyRevisions {
+		revisions.rows = append(revisions.rows, []string{formatUint(v.SurveyId), formatUint(v.Revision), formatTime(v.CreatedAt), formatUint(v.AuthorId),
+			v.Name, v.GitHubId, v.Priorities, v.Issues, string(v.CommsFrequency), strconv.FormatBool(v.PreRelease), string(v.Privacy)})
+	}
+	tables = append(tables, revisions)
+
+	sponsors := dataExportTable{name: "survey_sponsors.csv", header: []string{"ID", "CreatedAt", "SurveyId", "UserId", "State", "StateChangedAt"}}
+	for _, v := range data.SurveySponsors {
+		sponsors.rows = append(sponsors.rows, []string{formatUint(v.ID), formatTime(v.CreatedAt), formatUint(v.SurveyId), formatUint(v.UserId),
+			string(v.State), formatTime(v.StateChangedAt)})
+	}
+	tables = append(tables, sponsors)
+
+	history := dataExportTable{name: "sponsorship_history.csv", header: []string{"CreatedAt", "SurveySponsorId", "SponsorId", "DeveloperId", "FromState", "ToState", "Reason"}}
+	for _, v := range data.Sponsorships {
+		history.rows = append(history.rows, []string{formatTime(v.CreatedAt), formatUint(v.SurveySponsorId), formatUint(v.SponsorId), formatUint(v.DeveloperId),
+			string(v.FromState), string(v.ToState), v.Reason})
+	}
+	tables = append(tables, history)
+
+	payments := dataExportTable{name: "payments.csv", header: []string{"CreatedAt", "Provider", "EventId", "Type", "Status", "Amount", "Currency", "Recurrence"}}
+	for _, v := range data.Payments {
+		payments.rows = append(payments.rows, []string{formatTime(v.CreatedAt), string(v.Provider), v.EventId, v.Type, string(v.Status),
+			strconv.FormatInt(v.Amount, 10), v.Currency, string(v.Recurrence)})
+	}
+	tables = append(tables, payments)
+
+	consents := dataExportTable{name: "consents.csv", header: []string{"CreatedAt", "Type", "Granted", "PolicyVersion", "Source"}}
+	for _, v := range data.Consents {
+		consents.rows = append(consents.rows, []string{formatTime(v.CreatedAt), string(v.Type), strconv.FormatBool(v.Granted), v.PolicyVersion, v.Source})
+	}
+	tables = append(tables, consents)
+
+	emails := dataExportTable{name: "emails.csv", header: []string{"CreatedAt", "Kind", "Subject", "Status", "Body"}}
+	for _, v := range data.Messages {
+		emails.rows = append(emails.rows, []string{formatTime(v.CreatedAt), string(v.Kind), v.Subject, string(v.Status), v.Body})
+	}
+	tables = append(tables, emails)
+
+	subscriptions := dataExportTable{name: "channel_subscriptions.csv", header: []string{"CreatedAt", "ChannelId", "Platform"}}
+	for _, v := range data.Subscriptions {
+		subscriptions.rows = append(subscriptions.rows, []string{formatTime(v.CreatedAt), formatUint(v.ChannelId), v.Platform})
+	}
+	tables = append(tables, subscriptions)
+
+	downloads := dataExportTable{name: "build_downloads.csv", header: []string{"CreatedAt", "ArtifactId", "RemoteAddr", "UserAgent", "Bytes"}}
+	for _, v := range data.Downloads {
+		downloads.rows = append(downloads.rows, []string{formatTime(v.CreatedAt), formatUint(v.ArtifactId), v.RemoteAddr, v.UserAgent,
+			strconv.FormatInt(v.Bytes, 10)})
+	}
+	tables = append(tables, downloads)
+
+	reports := dataExportTable{name: "test_reports.csv", header: []string{"CreatedAt", "ArtifactId", "Verdict", "Device", "Description", "Status"}}
+	for _, v := range data.TestReports {
+		reports.rows = append(reports.rows, []string{formatTime(v.CreatedAt), formatUint(v.ArtifactId), string(v.Verdict), v.Device,
+			v.Description, string(v.Status)})
+	}
+	tables = append(tables, reports)
+
+	crashes := dataExportTable{name: "crash_uploads.csv", header: []string{"CreatedAt", "ArtifactId", "Device", "Kind", "Size"}}
+	for _, v := range data.CrashUploads {
+		crashes.rows = append(crashes.rows, []string{formatTime(v.CreatedAt), formatUint(v.ArtifactId), v.Device, string(v.Kind),
+			strconv.FormatInt(v.Size, 10)})
+	}
+	tables = append(tables, crashes)
+
+	preferences := dataExportTable{name: "notification_preferences.csv", header: []string{"UpdatedAt", "Channel", "Category", "Enabled", "Source"}}
+	for _, v := range data.Preferences {
+		preferences.rows = append(preferences.rows, []string{formatTime(v.UpdatedAt), string(v.Channel), string(v.Category), strconv.FormatBool(v.Enabled),
+			v.Source})
+	}
+	tables = append(tables, preferences)
+
+	push := dataExportTable{name: "push_subscriptions.csv", header: []string{"CreatedAt", "Endpoint", "UserAgent", "LastUsedAt"}}
+	for _, v := range data.Push {
+		lastUsed := ""
+		if v.LastUsedAt != nil {
+			lastUsed = formatTime(*v.LastUsedAt)
+		}
+		push.rows = append(push.rows, []string{formatTime(v.CreatedAt), v.Endpoint, v.UserAgent, lastUsed})
+	}
+	tables = append(tables, push)
+
+	identities := dataExportTable{name: "verified_identities.csv", header: []string{"CreatedAt", "Provider", "Login", "Source"}}
+	for _, v := range data.Identities {
+		identities.rows = append(identities.rows, []string{formatTime(v.CreatedAt), v.Provider, v.Login, v.Source})
+	}
+	tables = append(tables, identities)
+
+	for _, table := range tables {
+		csvFile, err := zipWriter.Create(table.name)
+		if err != nil {
+			return nil, err
+		}
+		csvWriter := csv.NewWriter(csvFile)
+		err = csvWriter.Write(table.header)
+		if err == nil {
+			err = csvWriter.WriteAll(table.rows)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = zipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
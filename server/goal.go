@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type FundingMilestoneJSON struct {
+	Title  string
+	Amount int64
+}
+
+type FundingGoalJSON struct {
+	Title       string
+	Description string
+	Amount      int64
+	Currency    string
+	Milestones  []FundingMilestoneJSON
+}
+
+func FundingGoalsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	goals, err := App.Store.ListFundingGoalsForUsers([]uint{uint(userId)})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Funding goals not found"})
+		return
+	}
+	c.JSON(http.StatusOK, goals)
+}
+
+func AddFundingGoal(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	goal := store.FundingGoal{UserId: uint(claims["id"].(float64))}
+
+	err := readJSONIntoFundingGoal(&goal, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Funding goal failed validation - err: %s", err.Error())})
+		return
+	}
+	goalId, err := App.Store.InsertFundingGoal(&goal)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Funding goal failed"})
+		return
+	}
+	go checkFundingMilestones(goal.UserId)
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Funding goal created successfully", "resourceId": goalId,
+	})
+}
+
+func UpdateFundingGoal(c *gin.Context) {
+	goal, ok := loadOwnFundingGoal(c)
+	if !ok {
+		return
+	}
+	err := readJSONIntoFundingGoal(goal, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Funding goal failed validation - err: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.UpdateFundingGoal(goal)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Funding goal failed"})
+		return
+	}
+	go checkFundingMilestones(goal.UserId)
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Funding goal updated successfully", "resourceId": goal.ID,
+	})
+}
+
+func DeleteFundingGoal(c *gin.Context) {
+	goal, ok := loadOwnFundingGoal(c)
+	if !ok {
+		return
+	}
+	err := App.Store.DeleteFundingGoal(goal.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Delete Funding goal failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Funding goal deleted",
+	})
+}
+
+func loadOwnFundingGoal(c *gin.Context) (*store.FundingGoal, bool) {
+	goalId, err := strconv.Atoi(c.Param("goalID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid GoalID"})
+		return nil, false
+	}
+	goal, err := App.Store.LoadFundingGoal(uint(goalId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Funding goal not found"})
+		return nil, false
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if goal.UserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Attempt to change someone elses funding goal"})
+		return nil, false
+	}
+	return goal, true
+}
+
+func readJSONIntoFundingGoal(goal *store.FundingGoal, c *gin.Context) error {
+	goalJSON := FundingGoalJSON{}
+	err := c.BindJSON(&goalJSON)
+	if err != nil {
+		return err
+	}
+
+	goal.Title = goalJSON.Title
+	goal.Description = goalJSON.Description
+	goal.Amount = goalJSON.Amount
+	goal.Currency = goalJSON.Currency
+	goal.Milestones = nil
+	for _, v := range goalJSON.Milestones {
+		goal.Milestones = append(goal.Milestones, store.FundingMilestone{Title: v.Title, Amount: v.Amount})
+	}
+	return goal.Validate()
+}
+
+func checkFundingMilestones(developerId uint) {
+	checkFundingMilestonesAt(developerId, time.Now())
+}
+
+func checkFundingMilestonesAt(developerId uint, now time.Time) {
+	crossings, err := App.Store.CheckFundingMilestones(developerId, now)
+	if err != nil {
+		log.Print(err)
+	}
+	if len(crossings) == 0 {
+		return
+	}
+	developerName := developerDisplayName(developerId)
+	sponsorIds, err := App.Store.ListActiveSponsorIdsForUser(developerId)
+	if err != nil {
+		log.Print(err)
+	}
+	for _, v := range crossings {
+		progress := fmt.Sprintf("%s a month from %d sponsors, %d%% of the %s a month goal \"%s\".",
+			v.Progress.Monthly.String(), v.Progress.Sponsors, v.Progress.Percent, v.Goal.Money.String(), v.Goal.Title)
+		_, err = Notify(developerId, store.NotificationCategorySponsorship, "Milestone reached: "+v.Milestone.Title,
+			"Your sponsors have reached the milestone \""+v.Milestone.Title+"\".\n\nYou now receive "+progress)
+		if err != nil {
+			log.Print(err)
+		}
+		for _, sponsorId := range sponsorIds {
+			_, err = Notify(sponsorId, store.NotificationCategorySponsorship, developerName+" reached a milestone: "+v.Milestone.Title,
+				"Thanks to you and other sponsors "+developerName+" has reached the milestone \""+v.Milestone.Title+"\".\n\n"+
+					developerName+" now receives "+progress)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func CheckAllFundingMilestones(now time.Time) {
+	userIds, err := App.Store.ListUserIdsWithFundingGoals()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, userId := range userIds {
+		checkFundingMilestonesAt(userId, now)
+	}
+}
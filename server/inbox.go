@@ -0,0 +1,131 @@
+package server
+
+import (
+	"github.com/adamboardman/sponsor-hub/store"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func InboxList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	beforeId, _ := strconv.Atoi(c.Query("before"))
+	notifications, err := App.Store.ListInboxNotifications(userId, c.Query("unread") == "true", uint(beforeId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Notifications not found"})
+		return
+	}
+	c.JSON(http.StatusOK, notifications)
+}
+
+func InboxUnreadCount(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	count, err := App.Store.InboxUnreadCountForUser(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Notifications not found"})
+		return
+	}
+	c.JSON(http.StatusOK, count)
+}
+
+func MarkInboxNotificationRead(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	notificationId, err := strconv.Atoi(c.Param("notificationID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid NotificationID"})
+		return
+	}
+	marked, err := App.Store.MarkInboxNotificationRead(userId, uint(notificationId), time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Mark Notification read failed"})
+		return
+	}
+	if !marked {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Notification not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Notification marked as read", "resourceId": notificationId,
+	})
+}
+
+func MarkAllInboxNotificationsRead(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	category := store.NotificationCategory(c.Query("category"))
+	if len(category) > 0 && category != store.NotificationCategoryAccount {
+		_, err := store.ParseNotificationCategory(string(category))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+			return
+		}
+	}
+	marked, err := App.Store.MarkAllInboxNotificationsRead(userId, category, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Mark Notifications read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": strconv.FormatInt(marked, 10) + " notifications marked as read",
+	})
+}
+
+func addToInbox(userId uint, category store.NotificationCategory, title string, body string) {
+	notification := store.InboxNotification{UserId: userId, Category: category, Title: title, Body: body}
+	_, err := App.Store.InsertInboxNotification(&notification)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	publishLiveEvent(userId, LiveEventNotification, gin.H{"ID": notification.ID, "Category": category, "Title": title})
+	go pushToUser(userId, PushPayload{ID: notification.ID, Category: category, Title: title, Body: body})
+}
+
+func sponsorDisplayName(surveyId uint) string {
+	survey, err := App.Store.LoadSurvey(surveyId)
+	if err != nil {
+		return "A sponsor"
+	}
+	survey = store.RedactSurvey(survey, store.SurveyViewerSponsoredDeveloper)
+	if len(survey.Name) == 0 {
+		return "A sponsor"
+	}
+	return survey.Name
+}
+
+func notifyNewSponsor(surveySponsor store.SurveySponsor) {
+	name := sponsorDisplayName(surveySponsor.SurveyId)
+	_, err := Notify(surveySponsor.UserId, store.NotificationCategorySponsorship, name+" is now sponsoring you",
+		name+" has started sponsoring you on Sponsor-Hub.")
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func notifySurveyChanged(surveyId uint) {
+	developerIds, err := App.Store.ListActiveSponsoredDeveloperIds(surveyId)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	name := sponsorDisplayName(surveyId)
+	for _, developerId := range developerIds {
+		addToInbox(developerId, store.NotificationCategorySponsorship, name+" updated their survey",
+			name+" has changed their priorities or issues, take a look to see what they need.")
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type LedgerEntryJSON struct {
+	Kind          string
+	SponsorId     uint
+	DeveloperId   uint
+	Amount        int64
+	Currency      string
+	EffectiveDate time.Time
+	Reference     string
+	Memo          string
+}
+
+type LedgerReversalJSON struct {
+	Memo string
+}
+
+func LedgerEntriesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	sponsorId, _ := strconv.Atoi(c.Query("sponsor"))
+	developerId, _ := strconv.Atoi(c.Query("developer"))
+	entries, err := App.Store.ListLedgerEntries(uint(sponsorId), uint(developerId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Ledger entries not found"})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+func AddLedgerEntry(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	entryJSON := LedgerEntryJSON{}
+	err := c.BindJSON(&entryJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Ledger entry failed validation - err: %s", err.Error())})
+		return
+	}
+	kind, err := store.ParseLedgerEntryKind(entryJSON.Kind)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Ledger entry failed validation - err: %s", err.Error())})
+		return
+	}
+	entry := store.LedgerEntry{
+		Kind:          kind,
+		SponsorId:     entryJSON.SponsorId,
+		DeveloperId:   entryJSON.DeveloperId,
+		Money:         store.Money{Amount: entryJSON.Amount, Currency: entryJSON.Currency},
+		EffectiveDate: entryJSON.EffectiveDate,
+		Reference:     entryJSON.Reference,
+		Memo:          entryJSON.Memo,
+		RecordedBy:    loggedInUserId,
+	}
+	err = entry.Validate()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Ledger entry failed validation - err: %s", err.Error())})
+		return
+	}
+
+	entryId, err := App.Store.InsertLedgerEntry(&entry)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Ledger entry failed"})
+		return
+	}
+	go emailReceiptForSource(store.ReceiptSourceLedger, entryId)
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Ledger entry recorded", "resourceId": entryId,
+	})
+}
+
+func ReverseLedgerEntry(c *gin.Context) {
+	entryId, err := strconv.Atoi(c.Param("entryID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid EntryID"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	reversalJSON := LedgerReversalJSON{}
+	err = c.BindJSON(&reversalJSON)
+	if err != nil || len(reversalJSON.Memo) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "A reversal needs a memo explaining why"})
+		return
+	}
+
+	reversal, err := App.Store.ReverseLedgerEntry(uint(entryId), reversalJSON.Memo, loggedInUserId)
+	if err == store.ErrLedgerEntryAlreadyReversed || err == store.ErrLedgerEntryIsReversal {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Ledger entry not found"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Ledger entry reversed", "resourceId": reversal.ID,
+	})
+}
+
+func LedgerBalancesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	balances, err := App.Store.LedgerBalances()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Ledger balances not found"})
+		return
+	}
+	c.JSON(http.StatusOK, balances)
+}
+
+func LedgerReconciliationReport(c *gin.Context) {
+	month, err := time.Parse("2006-01", c.Param("month"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Month should be formatted as YYYY-MM"})
+		return
+	}
+	report, err := App.Store.ReconciliationReportForMonth(month.Year(), month.Month())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Reconciliation report failed"})
+		return
+	}
+
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", "attachment; filename=\"reconciliation-"+c.Param("month")+".csv\"")
+	csvWriter := csv.NewWriter(c.Writer)
+	_ = csvWriter.Write([]string{"SponsorId", "DeveloperId", "Currency", "Expected", "ReceivedManual", "ReceivedProvider", "Difference"})
+	for _, v := range append(report.Lines, report.Totals...) {
+		_ = csvWriter.Write([]string{strconv.FormatUint(uint64(v.SponsorId), 10), strconv.FormatUint(uint64(v.DeveloperId), 10), v.Currency,
+			strconv.FormatInt(v.Expected, 10), strconv.FormatInt(v.ReceivedManual, 10), strconv.FormatInt(v.ReceivedProvider, 10),
+			strconv.FormatInt(v.Difference, 10)})
+	}
+	csvWriter.Flush()
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"net/smtp"
+	"sort"
+	"strings"
+)
+
+type MailMessage struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Headers     map[string]string
+	Attachments []MailAttachment
+}
+
+type MailAttachment struct {
+	FileName    string
+	ContentType string
+	Data        []byte
+}
+
+var sendMail = smtpSendMail
+
+func smtpSendMail(message *MailMessage) error {
+	c, err := smtp.Dial("localhost:25")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	err = c.Mail("no-reply@thinkglobally.org")
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(message.To)
+	if err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = composeMail(message).WriteTo(wc)
+	if err != nil {
+		_ = wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+var headerLineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func headerValue(value string) string {
+	return headerLineBreaks.Replace(value)
+}
+
+func composeMail(message *MailMessage) *bytes.Buffer {
+	boundary := base64.StdEncoding.EncodeToString(RandomBytes(16))
+
+	var headerNames []string
+	for name := range message.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	extraHeaders := ""
+	for _, name := range headerNames {
+		extraHeaders += name + ": " + headerValue(message.Headers[name]) + "\r\n"
+	}
+
+	alternative := "" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" +
+		message.Text +
+		"\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" +
+		"<!DOCTYPE html>\r\n" +
+		"<html>\r\n" +
+		"<head>\r\n" +
+		"</head>\r\n" +
+		"<body>\r\n" +
+		message.HTML +
+		"</body>\r\n" +
+		"</html>\r\n" +
+		"\r\n" +
+		"--" + boundary + "--\r\n"
+
+	headers := "" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", headerValue(message.Subject)) + "\r\n" +
+		"From: Sponsor-Hub <no-reply@thinkglobally.org>\r\n" +
+		"Reply-To: Sponsor-Hub <no-reply@thinkglobally.org>\r\n" +
+		extraHeaders +
+		"MIME-Version: 1.0\r\n"
+
+	if len(message.Attachments) == 0 {
+		return bytes.NewBufferString(headers +
+			"Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n" +
+			"\r\n" +
+			alternative)
+	}
+
+	mixedBoundary := base64.StdEncoding.EncodeToString(RandomBytes(16))
+	mail := bytes.NewBufferString(headers +
+		"Content-Type: multipart/mixed; boundary=\"" + mixedBoundary + "\"\r\n" +
+		"\r\n" +
+		"--" + mixedBoundary + "\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n" +
+		"\r\n" +
+		alternative)
+	for _, attachment := range message.Attachments {
+		mail.WriteString("--" + mixedBoundary + "\r\n" +
+			"Content-Type: " + attachment.ContentType + "; name=\"" + attachment.FileName + "\"\r\n" +
+			"Content-Disposition: attachment; filename=\"" + attachment.FileName + "\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n")
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			mail.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		mail.WriteString(encoded + "\r\n")
+	}
+	mail.WriteString("--" + mixedBoundary + "--\r\n")
+	return mail
+}
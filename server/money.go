@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ExchangeRateJSON struct {
+	FromCurrency  string
+	ToCurrency    string
+	Rate          string
+	EffectiveFrom time.Time
+}
+
+func ExchangeRatesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	rates, err := App.Store.ListExchangeRates()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Exchange rates not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ReportingCurrency": App.Store.ReportingCurrency, "Rates": rates})
+}
+
+func AddExchangeRate(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	rateJSON := ExchangeRateJSON{}
+	err := c.BindJSON(&rateJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Exchange rate failed validation - err: %s", err.Error())})
+		return
+	}
+	rate := store.ExchangeRate{
+		FromCurrency:  strings.ToUpper(rateJSON.FromCurrency),
+		ToCurrency:    strings.ToUpper(rateJSON.ToCurrency),
+		Rate:          rateJSON.Rate,
+		EffectiveFrom: rateJSON.EffectiveFrom,
+		CreatedBy:     loggedInUserId,
+	}
+	err = rate.Validate()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Exchange rate failed validation - err: %s", err.Error())})
+		return
+	}
+
+	rateId, err := App.Store.InsertExchangeRate(&rate)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Exchange rate failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Exchange rate added", "resourceId": rateId,
+	})
+}
+
+func DeleteExchangeRate(c *gin.Context) {
+	rateId, err := strconv.Atoi(c.Param("rateID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid RateID"})
+		return
+	}
+	err = App.Store.DeleteExchangeRate(uint(rateId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Delete Exchange rate failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Exchange rate deleted",
+	})
+}
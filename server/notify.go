@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	"html"
+	"log"
+	"strings"
+	"time"
+)
+
+const deliveryMaxAttempts = 5
+const deliveryLease = 10 * time.Minute
+
+func Notify(userId uint, category store.NotificationCategory, subject string, body string) (*store.MessageDelivery, error) {
+	return notifyAt(userId, category, subject, body, time.Now())
+}
+
+func notifyAt(userId uint, category store.NotificationCategory, subject string, body string, now time.Time) (*store.MessageDelivery, error) {
+	delivery := &store.MessageDelivery{
+		UserId:   userId,
+		Kind:     category.Kind(),
+		Category: category,
+		Subject:  subject,
+		Body:     body,
+	}
+	addToInbox(userId, category, subject, body)
+	err := dispatchDelivery(delivery, now)
+	return delivery, err
+}
+
+func dispatchDelivery(delivery *store.MessageDelivery, now time.Time) error {
+	frequency := App.Store.LoadCommsFrequencyForUser(delivery.UserId)
+	if !frequency.Allows(delivery.Kind) || !App.Store.AllowsNotification(delivery.UserId, delivery.Category) {
+		delivery.Status = store.DeliveryStatusSuppressed
+		_, err := App.Store.InsertMessageDelivery(delivery)
+		return err
+	}
+	if delivery.Kind == store.MessageKindTransactional || !nextAllowedSlot(delivery.UserId, frequency).After(now) {
+		return sendDelivery(delivery, now)
+	}
+	delivery.Status = store.DeliveryStatusHeld
+	_, err := App.Store.InsertMessageDelivery(delivery)
+	return err
+}
+
+func sendDelivery(delivery *store.MessageDelivery, now time.Time) error {
+	if delivery.Kind == store.MessageKindDigest {
+		return deliverDigest(delivery, now)
+	}
+	if delivery.ReceiptId != 0 {
+		receipt, err := App.Store.LoadReceipt(delivery.ReceiptId)
+		if err != nil {
+			return err
+		}
+		return deliverReceipt(delivery, receipt, now)
+	}
+	if delivery.AnnouncementDeliveryId != 0 {
+		return deliverAnnouncement(delivery, now)
+	}
+	return deliverMessage(delivery, nil, now)
+}
+
+func nextAllowedSlot(userId uint, frequency store.CommsFrequency) time.Time {
+	interval := frequency.Interval()
+	if interval == 0 {
+		return time.Time{}
+	}
+	last, err := App.Store.LastSentMessageForUser(userId)
+	if err != nil || last.SentAt == nil {
+		return time.Time{}
+	}
+	return last.SentAt.Add(interval)
+}
+
+func deliverMessage(delivery *store.MessageDelivery, attachments []MailAttachment, now time.Time) error {
+	user, err := App.Store.LoadPrivilegedUserAsSelf(delivery.UserId, delivery.UserId)
+	if err == nil {
+		category := delivery.Category
+		if delivery.Kind == store.MessageKindDigest {
+			category = store.NotificationCategoryAll
+		}
+		err = sendMail(withUnsubscribe(&MailMessage{
+			To:          user.Email,
+			Subject:     delivery.Subject,
+			Text:        delivery.Body + "\r\n",
+			HTML:        "<p>" + strings.Replace(html.EscapeString(delivery.Body), "\n", "<br>\r\n", -1) + "</p>\r\n",
+			Attachments: attachments,
+		}, user.ID, category))
+	}
+	return saveDeliveryAttempt(delivery, err, now)
+}
+
+func saveDeliveryAttempt(delivery *store.MessageDelivery, err error, now time.Time) error {
+	delivery.Attempts++
+	if err != nil {
+		log.Print(err)
+		delivery.Status = store.DeliveryStatusFailed
+		nextAttemptAt := now.Add(store.MessageRetryDelay(delivery.Attempts))
+		delivery.NextAttemptAt = &nextAttemptAt
+	} else {
+		delivery.Status = store.DeliveryStatusSent
+		delivery.SentAt = &now
+		delivery.NextAttemptAt = nil
+	}
+
+	var saveErr error
+	if delivery.ID == 0 {
+		_, saveErr = App.Store.InsertMessageDelivery(delivery)
+	} else {
+		_, saveErr = App.Store.UpdateMessageDelivery(delivery)
+	}
+	if err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func RetryFailedDeliveries(now time.Time) {
+	deliveries, err := App.Store.ListDueFailedDeliveries(now, deliveryMaxAttempts)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for i := range deliveries {
+		claimed, err := App.Store.ClaimFailedDelivery(&deliveries[i], now, deliveryLease)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if claimed {
+			_ = sendDelivery(&deliveries[i], now)
+		}
+	}
+}
+
+func SendDueDigests(now time.Time) {
+	userIds, err := App.Store.ListUserIdsWithHeldMessages(now)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, userId := range userIds {
+		err = sendDigestForUser(userId, now)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func sendDigestForUser(userId uint, now time.Time) error {
+	frequency := App.Store.LoadCommsFrequencyForUser(userId)
+	if nextAllowedSlot(userId, frequency).After(now) {
+		return nil
+	}
+	held, err := App.Store.ClaimHeldMessagesForUser(userId, now, deliveryLease)
+	if err != nil {
+		return err
+	}
+
+	var allowed []store.MessageDelivery
+	for i := range held {
+		if frequency.Allows(held[i].Kind) && App.Store.AllowsNotification(userId, held[i].Category) {
+			allowed = append(allowed, held[i])
+		} else {
+			held[i].Status = store.DeliveryStatusSuppressed
+			_, _ = App.Store.UpdateMessageDelivery(&held[i])
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	if len(allowed) == 1 {
+		return sendDelivery(&allowed[0], now)
+	}
+
+	var ids []uint
+	var body strings.Builder
+	for _, v := range allowed {
+		ids = append(ids, v.ID)
+		body.WriteString(v.Subject + "\n\n" + v.Body + "\n\n")
+	}
+	digest := &store.MessageDelivery{
+		UserId:  userId,
+		Kind:    store.MessageKindDigest,
+		Subject: fmt.Sprintf("Sponsor-Hub digest: %d updates", len(allowed)),
+		Body:    strings.TrimSpace(body.String()),
+	}
+	err = App.Store.MergeHeldMessages(digest, ids, now, deliveryLease)
+	if err != nil {
+		releaseErr := App.Store.ReleaseHeldMessages(ids)
+		if releaseErr != nil {
+			log.Print(releaseErr)
+		}
+		return err
+	}
+	return deliverDigest(digest, now)
+}
+
+func deliverDigest(digest *store.MessageDelivery, now time.Time) error {
+	merged, err := App.Store.ListMergedMessages(digest.ID)
+	if err != nil {
+		return saveDeliveryAttempt(digest, err, now)
+	}
+	var attachments []MailAttachment
+	for _, v := range merged {
+		if v.ReceiptId == 0 {
+			continue
+		}
+		attachment, err := receiptAttachment(v.ReceiptId)
+		if err != nil {
+			return saveDeliveryAttempt(digest, err, now)
+		}
+		attachments = append(attachments, *attachment)
+	}
+	return deliverMessage(digest, attachments, now)
+}
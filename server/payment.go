@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PaymentProvider interface {
+	Name() store.PaymentProvider
+	Sign(header http.Header, secret []byte, body []byte, eventId string, now time.Time)
+	Verify(header http.Header, secret []byte, body []byte, now time.Time) bool
+	Parse(header http.Header, body []byte) (*store.PaymentEvent, error)
+}
+
+var paymentProviders = map[store.PaymentProvider]PaymentProvider{}
+
+func RegisterPaymentProvider(provider PaymentProvider) {
+	paymentProviders[provider.Name()] = provider
+}
+
+func init() {
+	RegisterPaymentProvider(gitHubSponsorsProvider{})
+	RegisterPaymentProvider(stripeProvider{})
+}
+
+func paymentWebhookSecretFileName(provider store.PaymentProvider) string {
+	return string(provider) + "_webhook_secret.txt"
+}
+
+func readPaymentWebhookSecret(provider store.PaymentProvider) []byte {
+	secret, err := ioutil.ReadFile(paymentWebhookSecretFileName(provider))
+	if err != nil {
+		secret, err = ioutil.ReadFile("../" + paymentWebhookSecretFileName(provider))
+		if err != nil {
+			return nil
+		}
+	}
+	return bytes.TrimSpace(secret)
+}
+
+func hmacSha256Hex(secret []byte, message []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func NewPaymentWebhookRequest(url string, provider store.PaymentProvider, secret []byte, body []byte, eventId string) (*http.Request, error) {
+	paymentProvider, ok := paymentProviders[provider]
+	if !ok {
+		return nil, errors.New("unknown payment provider: " + string(provider))
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	paymentProvider.Sign(req.Header, secret, body, eventId, time.Now())
+	return req, nil
+}
+
+type gitHubSponsorsProvider struct{}
+
+type gitHubSponsorshipEvent struct {
+	Action      string `json:"action"`
+	Sponsorship struct {
+		Sponsor struct {
+			Login string `json:"login"`
+		} `json:"sponsor"`
+		Sponsorable struct {
+			Login string `json:"login"`
+		} `json:"sponsorable"`
+		Tier struct {
+			MonthlyPriceInCents int64 `json:"monthly_price_in_cents"`
+			IsOneTime           bool  `json:"is_one_time"`
+		} `json:"tier"`
+	} `json:"sponsorship"`
+}
+
+func (gitHubSponsorsProvider) Name() store.PaymentProvider {
+	return store.PaymentProviderGitHubSponsors
+}
+
+func (gitHubSponsorsProvider) Sign(header http.Header, secret []byte, body []byte, eventId string, now time.Time) {
+	header.Set("X-GitHub-Event", "sponsorship")
+	header.Set("X-GitHub-Delivery", eventId)
+	header.Set("X-Hub-Signature-256", "sha256="+hmacSha256Hex(secret, body))
+}
+
+func (gitHubSponsorsProvider) Verify(header http.Header, secret []byte, body []byte, now time.Time) bool {
+	return hmac.Equal([]byte(header.Get("X-Hub-Signature-256")), []byte("sha256="+hmacSha256Hex(secret, body)))
+}
+
+func (gitHubSponsorsProvider) Parse(header http.Header, body []byte) (*store.PaymentEvent, error) {
+	event := store.PaymentEvent{
+		Provider: store.PaymentProviderGitHubSponsors,
+		EventId:  header.Get("X-GitHub-Delivery"),
+		Type:     header.Get("X-GitHub-Event"),
+		Action:   store.PaymentActionIgnored,
+		Payload:  string(body),
+	}
+	if len(event.EventId) == 0 {
+		return nil, errors.New("missing X-GitHub-Delivery header")
+	}
+	if event.Type != "sponsorship" {
+		return &event, nil
+	}
+
+	payload := gitHubSponsorshipEvent{}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+	event.Type += "." + payload.Action
+	event.SponsorGitHubId = payload.Sponsorship.Sponsor.Login
+	event.DeveloperGitHubId = payload.Sponsorship.Sponsorable.Login
+	event.Amount = payload.Sponsorship.Tier.MonthlyPriceInCents
+	event.Currency = "USD"
+	event.Recurrence = store.RecurrenceMonthly
+	if payload.Sponsorship.Tier.IsOneTime {
+		event.Recurrence = store.RecurrenceOneOff
+	}
+	switch payload.Action {
+	case "created":
+		event.Action = store.PaymentActionStarted
+	case "tier_changed":
+		event.Action = store.PaymentActionChanged
+	case "cancelled":
+		event.Action = store.PaymentActionCancelled
+	}
+	return &event, nil
+}
+
+const stripeSignatureTolerance = 5 * time.Minute
+
+type stripeProvider struct{}
+
+type stripeEvent struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			Mode            string `json:"mode"`
+			PaymentStatus   string `json:"payment_status"`
+			AmountTotal     int64  `json:"amount_total"`
+			AmountPaid      int64  `json:"amount_paid"`
+			Currency        string `json:"currency"`
+			CustomerEmail   string `json:"customer_email"`
+			CustomerDetails struct {
+				Email string `json:"email"`
+			} `json:"customer_details"`
+			Metadata            map[string]string `json:"metadata"`
+			SubscriptionDetails struct {
+				Metadata map[string]string `json:"metadata"`
+			} `json:"subscription_details"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+func (stripeProvider) Name() store.PaymentProvider {
+	return store.PaymentProviderStripe
+}
+
+func (stripeProvider) Sign(header http.Header, secret []byte, body []byte, eventId string, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header.Set("Stripe-Signature", "t="+timestamp+",v1="+hmacSha256Hex(secret, []byte(timestamp+"."+string(body))))
+}
+
+func (stripeProvider) Verify(header http.Header, secret []byte, body []byte, now time.Time) bool {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header.Get("Stripe-Signature"), ",") {
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		switch keyValue[0] {
+		case "t":
+			timestamp = keyValue[1]
+		case "v1":
+			signatures = append(signatures, keyValue[1])
+		}
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(signedAt, 0))
+	if age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return false
+	}
+	expected := hmacSha256Hex(secret, []byte(timestamp+"."+string(body)))
+	for _, v := range signatures {
+		if hmac.Equal([]byte(v), []byte(expected)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (stripeProvider) Parse(header http.Header, body []byte) (*store.PaymentEvent, error) {
+	payload := stripeEvent{}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload.Id) == 0 {
+		return nil, errors.New("missing event id")
+	}
+	object := payload.Data.Object
+	metadata := map[string]string{}
+	for k, v := range object.SubscriptionDetails.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range object.Metadata {
+		metadata[k] = v
+	}
+
+	event := store.PaymentEvent{
+		Provider:          store.PaymentProviderStripe,
+		EventId:           payload.Id,
+		Type:              payload.Type,
+		Action:            store.PaymentActionIgnored,
+		SponsorEmail:      metadata["sponsor_email"],
+		SponsorGitHubId:   metadata["sponsor_github"],
+		DeveloperEmail:    metadata["developer_email"],
+		DeveloperGitHubId: metadata["developer_github"],
+		Money:             store.Money{Currency: strings.ToUpper(object.Currency)},
+		Payload:           string(body),
+	}
+	if len(object.CustomerEmail) > 0 {
+		event.SponsorEmail = object.CustomerEmail
+	} else if len(object.CustomerDetails.Email) > 0 {
+		event.SponsorEmail = object.CustomerDetails.Email
+	}
+	event.Recurrence, err = store.ParseRecurrence(metadata["recurrence"])
+	if err != nil {
+		return nil, err
+	}
+
+	switch payload.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		if object.Mode == "subscription" {
+			if object.PaymentStatus == "paid" || object.PaymentStatus == "no_payment_required" {
+				event.Action = store.PaymentActionStarted
+			}
+		} else if object.PaymentStatus == "paid" {
+			event.Action = store.PaymentActionStarted
+			event.Amount = object.AmountTotal
+			event.Recurrence = store.RecurrenceOneOff
+		}
+	case "invoice.paid":
+		event.Action = store.PaymentActionRenewed
+		event.Amount = object.AmountPaid
+	case "customer.subscription.deleted":
+		event.Action = store.PaymentActionCancelled
+	}
+	return &event, nil
+}
+
+func PaymentWebhook(c *gin.Context) {
+	provider, ok := paymentProviders[store.PaymentProvider(c.Param("provider"))]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Unknown payment provider"})
+		return
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Unable to read webhook body"})
+		return
+	}
+	secret := App.PaymentSecrets[provider.Name()]
+	if len(secret) == 0 || !provider.Verify(c.Request.Header, secret, body, time.Now()) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"statusText": "Invalid webhook signature"})
+		return
+	}
+	event, err := provider.Parse(c.Request.Header, body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Invalid webhook payload - err: %s", err.Error())})
+		return
+	}
+
+	err = App.Store.IngestPaymentEvent(event)
+	if err == store.ErrPaymentEventDuplicate {
+		c.JSON(http.StatusOK, gin.H{
+			"status": http.StatusOK, "message": "Payment event already processed",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": "Processing payment event failed"})
+		return
+	}
+	if event.Status == store.PaymentEventStatusProcessed {
+		go emailReceiptForSource(store.ReceiptSourceProvider, event.ID)
+		go checkFundingMilestones(event.DeveloperUserId)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Payment event " + string(event.Status), "resourceId": event.ID,
+	})
+}
+
+func PaymentEventsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	events, err := App.Store.ListPaymentEvents(store.PaymentEventStatus(c.Query("status")))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Payment events not found"})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+type PaymentEventResolutionJSON struct {
+	SponsorId   uint
+	DeveloperId uint
+}
+
+func ResolvePaymentEvent(c *gin.Context) {
+	eventId, err := strconv.Atoi(c.Param("eventID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid EventID"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	resolution := PaymentEventResolutionJSON{}
+	err = c.BindJSON(&resolution)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Resolution failed validation - err: %s", err.Error())})
+		return
+	}
+
+	event, err := App.Store.ResolvePaymentEvent(uint(eventId), resolution.SponsorId, resolution.DeveloperId, loggedInUserId)
+	if err == store.ErrPaymentEventResolved {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": "Payment event does not need reconciling"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Resolve Payment event failed - err: %s", err.Error())})
+		return
+	}
+	go emailReceiptForSource(store.ReceiptSourceProvider, event.ID)
+	go checkFundingMilestones(event.DeveloperUserId)
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Payment event resolved", "resourceId": event.ID,
+	})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	"github.com/gin-gonic/gin"
+	"html"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const unsubscribeValidFor = 365 * 24 * time.Hour
+
+type NotificationPreferencesJSON struct {
+	Frequency  string
+	Categories map[store.NotificationCategory]bool
+	Push       map[store.NotificationCategory]bool
+}
+
+func unsubscribeResource(userId uint, category store.NotificationCategory) string {
+	return fmt.Sprintf("unsubscribe/%d/%s", userId, category)
+}
+
+func withUnsubscribe(message *MailMessage, userId uint, category store.NotificationCategory) *MailMessage {
+	if category == store.NotificationCategoryAccount {
+		return message
+	}
+	link := signedUrl(unsubscribeResource(userId, category), time.Now().Add(unsubscribeValidFor))
+	if message.Headers == nil {
+		message.Headers = map[string]string{}
+	}
+	message.Headers["List-Unsubscribe"] = "<" + link + ">"
+	message.Headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	message.Text += "\r\n--\r\nUnsubscribe: " + link + "\r\n"
+	message.HTML += "<hr>\r\n<p><a href=\"" + link + "\">Unsubscribe</a></p>\r\n"
+	return message
+}
+
+func NotificationPreferencesForUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	preferences, err := App.Store.LoadNotificationPreferences(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Notification preferences not found"})
+		return
+	}
+	c.JSON(http.StatusOK, preferences)
+}
+
+func UpdateNotificationPreferences(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	preferencesJSON := NotificationPreferencesJSON{}
+	err := c.BindJSON(&preferencesJSON)
+	if err == nil {
+		err = App.Store.UpdateNotificationPreferences(userId, &store.NotificationPreferences{
+			Frequency:  store.CommsFrequency(preferencesJSON.Frequency),
+			Categories: preferencesJSON.Categories,
+			Push:       preferencesJSON.Push,
+		}, "preference-centre")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Notification preferences failed validation - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Notification preferences updated successfully",
+	})
+}
+
+func unsubscribeParams(c *gin.Context) (uint, store.NotificationCategory, bool) {
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return 0, "", false
+	}
+	category, err := store.ParseNotificationCategory(c.Param("category"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return 0, "", false
+	}
+	if !validSignedRequest(c, unsubscribeResource(uint(userId), category)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Unsubscribe link is invalid or has expired"})
+		return 0, "", false
+	}
+	return uint(userId), category, true
+}
+
+func UnsubscribePage(c *gin.Context) {
+	_, category, ok := unsubscribeParams(c)
+	if !ok {
+		return
+	}
+	what := string(category) + " emails"
+	if category == store.NotificationCategoryAll {
+		what = "all optional emails"
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte("<!DOCTYPE html>\r\n<html>\r\n<body>\r\n"+
+		"<form method=\"post\">\r\n"+
+		"<p>Stop receiving Sponsor-Hub "+html.EscapeString(what)+"?</p>\r\n"+
+		"<button type=\"submit\">Unsubscribe</button>\r\n"+
+		"</form>\r\n</body>\r\n</html>\r\n"))
+}
+
+func Unsubscribe(c *gin.Context) {
+	userId, category, ok := unsubscribeParams(c)
+	if !ok {
+		return
+	}
+	err := App.Store.UnsubscribeFromNotifications(userId, category, "one-click-unsubscribe")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Unsubscribe failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "You have been unsubscribed",
+	})
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const vapidKeyFileName = "vapid_private_key.txt"
+const vapidTokenValidFor = 12 * time.Hour
+const pushTimeToLive = 24 * time.Hour
+const pushTimeout = 30 * time.Second
+const pushRecordSize = 4096
+const pushMaxPayload = pushRecordSize - 16 - 1 - 86
+
+func noPushRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+var ErrPushSubscriptionExpired = errors.New("push subscription has expired")
+
+type PushSubscriptionJSON struct {
+	Endpoint string
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	}
+}
+
+type PushPayload struct {
+	ID       uint
+	Category store.NotificationCategory
+	Title    string
+	Body     string
+}
+
+func readVapidKey() *ecdsa.PrivateKey {
+	encoded, err := ioutil.ReadFile(vapidKeyFileName)
+	if err != nil {
+		encoded, err = ioutil.ReadFile("../" + vapidKeyFileName)
+	}
+	if err != nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		encoded = []byte(base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))))
+		err = ioutil.WriteFile(vapidKeyFileName, encoded, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return key
+	}
+	d, err := base64.RawURLEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err == nil {
+		var key *ecdh.PrivateKey
+		key, err = ecdh.P256().NewPrivateKey(d)
+		if err == nil {
+			public := key.PublicKey().Bytes()
+			return &ecdsa.PrivateKey{
+				PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(public[1:33]), Y: new(big.Int).SetBytes(public[33:])},
+				D:         new(big.Int).SetBytes(d),
+			}
+		}
+	}
+	log.Fatal(err)
+	return nil
+}
+
+func vapidPublicKey() string {
+	key, err := App.VapidKey.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+func vapidAuthorization(endpoint string, now time.Time) (string, error) {
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(gin.H{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(gin.H{
+		"aud": endpointUrl.Scheme + "://" + endpointUrl.Host,
+		"exp": now.Add(vapidTokenValidFor).Unix(),
+		"sub": "mailto:" + App.Organisation.Email,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, App.VapidKey, hash[:])
+	if err != nil {
+		return "", err
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(signature) + ", k=" + vapidPublicKey(), nil
+}
+
+func hkdfBytes(secret []byte, salt []byte, info []byte, length int) []byte {
+	out := make([]byte, length)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out)
+	return out
+}
+
+func encryptPushPayload(subscription *store.PushSubscription, payload []byte) ([]byte, error) {
+	serverKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return encryptPushPayloadWith(subscription, payload, serverKey, salt)
+}
+
+func encryptPushPayloadWith(subscription *store.PushSubscription, payload []byte, serverKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(payload) > pushMaxPayload {
+		return nil, errors.New("push payload is too large")
+	}
+	userAgentKey, err := store.DecodePushKey(subscription.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := store.DecodePushKey(subscription.Auth)
+	if err != nil {
+		return nil, err
+	}
+	userAgentPublic, err := ecdh.P256().NewPublicKey(userAgentKey)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := serverKey.ECDH(userAgentPublic)
+	if err != nil {
+		return nil, err
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), userAgentKey...), serverPublic...)
+	inputKey := hkdfBytes(shared, authSecret, keyInfo, 32)
+	contentKey := hkdfBytes(inputKey, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfBytes(inputKey, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.NewBuffer(append([]byte{}, salt...))
+	_ = binary.Write(body, binary.BigEndian, uint32(pushRecordSize))
+	body.WriteByte(byte(len(serverPublic)))
+	body.Write(serverPublic)
+	plaintext := append(append([]byte{}, payload...), 2)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
+
+func sendPush(subscription *store.PushSubscription, payload []byte, now time.Time) error {
+	if !store.ValidPushEndpoint(subscription.Endpoint, App.PushServiceHosts) {
+		return errors.New("push endpoint is not on a known push service: " + subscription.Endpoint)
+	}
+	body, err := encryptPushPayload(subscription, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(subscription.Endpoint, now)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTimeToLive.Seconds())))
+	response, err := App.PushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	switch {
+	case response.StatusCode == http.StatusGone || response.StatusCode == http.StatusNotFound:
+		err = App.Store.DeletePushSubscriptionByEndpoint(subscription.Endpoint)
+		if err != nil {
+			return err
+		}
+		return ErrPushSubscriptionExpired
+	case response.StatusCode >= 300:
+		return fmt.Errorf("push service responded %d", response.StatusCode)
+	}
+	return App.Store.MarkPushSubscriptionUsed(subscription.ID, now)
+}
+
+func pushToUser(userId uint, notification PushPayload) {
+	if !App.Store.AllowsPushNotification(userId, notification.Category) {
+		return
+	}
+	subscriptions, err := App.Store.ListPushSubscriptionsForUser(userId)
+	if err != nil || len(subscriptions) == 0 {
+		return
+	}
+	payload, _ := json.Marshal(notification)
+	if len(payload) > pushMaxPayload {
+		notification.Body = ""
+		payload, _ = json.Marshal(notification)
+	}
+	now := time.Now()
+	for i := range subscriptions {
+		err = sendPush(&subscriptions[i], payload, now)
+		if err != nil && err != ErrPushSubscriptionExpired {
+			log.Print(err)
+		}
+	}
+}
+
+func VapidPublicKey(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"PublicKey": vapidPublicKey()})
+}
+
+func PushSubscriptionsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	subscriptions, err := App.Store.ListPushSubscriptionsForUser(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Push subscriptions not found"})
+		return
+	}
+	c.JSON(http.StatusOK, subscriptions)
+}
+
+func AddPushSubscription(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	subscriptionJSON := PushSubscriptionJSON{}
+	err := c.BindJSON(&subscriptionJSON)
+	subscription := store.PushSubscription{
+		UserId:    userId,
+		Endpoint:  strings.TrimSpace(subscriptionJSON.Endpoint),
+		P256dh:    subscriptionJSON.Keys.P256dh,
+		Auth:      subscriptionJSON.Keys.Auth,
+		UserAgent: c.Request.UserAgent(),
+	}
+	if err == nil {
+		err = subscription.Validate(App.PushServiceHosts)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Push subscription failed validation - err: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.SavePushSubscription(&subscription)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Add Push subscription failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Push subscription registered", "resourceId": subscription.ID,
+	})
+}
+
+func DeletePushSubscription(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	subscriptionId, err := strconv.Atoi(c.Param("subscriptionID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid SubscriptionID"})
+		return
+	}
+	err = App.Store.DeletePushSubscription(userId, uint(subscriptionId))
+	if err == store.ErrPushSubscriptionNotFound {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Delete Push subscription failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Push subscription removed", "resourceId": subscriptionId,
+	})
+}
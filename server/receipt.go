@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"github.com/jung-kurt/gofpdf"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Organisation struct {
+	Name          string
+	Address       string
+	Email         string
+	Website       string
+	TaxId         string
+	ReceiptPrefix string
+	EmailReceipts bool
+}
+
+func readOrganisation() Organisation {
+	const organisationFileName = "organisation.json"
+	organisation := Organisation{
+		Name:          "Sponsor-Hub",
+		Email:         "no-reply@thinkglobally.org",
+		Website:       publicBaseUrl,
+		ReceiptPrefix: store.ReceiptPrefixDefault,
+	}
+	data, err := ioutil.ReadFile(organisationFileName)
+	if err != nil {
+		data, err = ioutil.ReadFile("../" + organisationFileName)
+		if err != nil {
+			return organisation
+		}
+	}
+	err = json.Unmarshal(data, &organisation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return organisation
+}
+
+func newPdfDocument(title string) (*gofpdf.Fpdf, func(string) string) {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(title, true)
+	pdf.SetCreator(App.Organisation.Name, true)
+	pdf.AddPage()
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	organisation := App.Organisation
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 8, tr(organisation.Name), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, line := range strings.Split(organisation.Address, "\n") {
+		if len(line) > 0 {
+			pdf.CellFormat(0, 5, tr(line), "", 1, "L", false, 0, "")
+		}
+	}
+	for _, line := range []string{organisation.Email, organisation.Website} {
+		if len(line) > 0 {
+			pdf.CellFormat(0, 5, tr(line), "", 1, "L", false, 0, "")
+		}
+	}
+	if len(organisation.TaxId) > 0 {
+		pdf.CellFormat(0, 5, tr("Tax ID: "+organisation.TaxId), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(8)
+	pdf.SetFont("Helvetica", "B", 14)
+	pdf.CellFormat(0, 8, tr(title), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+	pdf.SetFont("Helvetica", "", 11)
+	return pdf, tr
+}
+
+func pdfBytes(pdf *gofpdf.Fpdf) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := pdf.Output(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func pdfRow(pdf *gofpdf.Fpdf, tr func(string) string, label string, value string) {
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.CellFormat(50, 7, tr(label), "", 0, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.CellFormat(0, 7, tr(value), "", 1, "L", false, 0, "")
+}
+
+func userDisplayName(user *store.PrivilegedUser) string {
+	if len(user.Name) > 0 {
+		return user.Name + " <" + user.Email + ">"
+	}
+	return user.Email
+}
+
+func developerDisplayName(developerId uint) string {
+	developer, err := App.Store.LoadPublicUser(developerId)
+	if err != nil || len(developer.Name) == 0 {
+		return "Developer #" + strconv.FormatUint(uint64(developerId), 10)
+	}
+	return developer.Name
+}
+
+func receiptPdf(receipt *store.Receipt, sponsor *store.PrivilegedUser) ([]byte, error) {
+	pdf, tr := newPdfDocument("Receipt " + receipt.Number)
+	pdfRow(pdf, tr, "Receipt number", receipt.Number)
+	pdfRow(pdf, tr, "Date paid", receipt.PaidAt.Format("2 January 2006"))
+	pdfRow(pdf, tr, "Received from", userDisplayName(sponsor))
+	pdfRow(pdf, tr, "In support of", developerDisplayName(receipt.DeveloperId))
+	pdfRow(pdf, tr, "Amount", receipt.Money.String())
+	if receipt.Reporting != nil && receipt.Reporting.Currency != receipt.Currency {
+		pdfRow(pdf, tr, "Equivalent", receipt.Reporting.String())
+	}
+	if receipt.VoidedAt != nil {
+		pdf.Ln(6)
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.CellFormat(0, 8, tr("VOID - this payment was reversed on "+receipt.VoidedAt.Format("2 January 2006")), "", 1, "L", false, 0, "")
+	}
+	return pdfBytes(pdf)
+}
+
+func statementPdf(statement *store.AnnualStatement, sponsor *store.PrivilegedUser) ([]byte, error) {
+	pdf, tr := newPdfDocument(fmt.Sprintf("Annual statement %d", statement.Year))
+	pdfRow(pdf, tr, "Sponsor", userDisplayName(sponsor))
+	pdfRow(pdf, tr, "Period", fmt.Sprintf("1 January %d to 31 December %d", statement.Year, statement.Year))
+	pdf.Ln(4)
+
+	pdf.SetFont("Helvetica", "B", 10)
+	for _, v := range []struct {
+		width float64
+		title string
+	}{{45, "Receipt"}, {30, "Date"}, {70, "In support of"}, {35, "Amount"}} {
+		pdf.CellFormat(v.width, 7, tr(v.title), "B", 0, "L", false, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont("Helvetica", "", 10)
+	for _, receipt := range statement.Receipts {
+		pdf.CellFormat(45, 6, tr(receipt.Number), "", 0, "L", false, 0, "")
+		pdf.CellFormat(30, 6, receipt.PaidAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
+		pdf.CellFormat(70, 6, tr(developerDisplayName(receipt.DeveloperId)), "", 0, "L", false, 0, "")
+		pdf.CellFormat(35, 6, tr(receipt.Money.String()), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(4)
+	for _, total := range statement.Totals {
+		pdfRow(pdf, tr, "Total "+total.Currency, total.String())
+	}
+	if statement.ReportingTotal != nil && len(statement.Totals) > 1 {
+		pdfRow(pdf, tr, "Total equivalent", statement.ReportingTotal.String())
+	}
+	return pdfBytes(pdf)
+}
+
+func loadOwnReceipt(c *gin.Context) (*store.Receipt, bool) {
+	receiptId, err := strconv.Atoi(c.Param("receiptID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid ReceiptID"})
+		return nil, false
+	}
+	receipt, err := App.Store.LoadReceipt(uint(receiptId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Receipt not found"})
+		return nil, false
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if receipt.SponsorId != loggedInUserId {
+		user, err := App.Store.LoadPrivilegedUserAsSelf(loggedInUserId, loggedInUserId)
+		if err != nil || user.Permissions < store.UserPermissionsFinance {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Trying to access someone else's receipt?"})
+			return nil, false
+		}
+	}
+	return receipt, true
+}
+
+func statementYearParam(c *gin.Context) (int, bool) {
+	year, err := strconv.Atoi(c.Param("year"))
+	if err != nil || year < 2000 || year > time.Now().Year() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid year"})
+		return 0, false
+	}
+	return year, true
+}
+
+func ReceiptsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	receipts, err := App.Store.ListReceiptsForSponsor(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Receipts not found"})
+		return
+	}
+	c.JSON(http.StatusOK, receipts)
+}
+
+func DownloadReceipt(c *gin.Context) {
+	receipt, ok := loadOwnReceipt(c)
+	if !ok {
+		return
+	}
+	data, err := renderReceipt(receipt)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": "Generating receipt failed"})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=\"receipt-"+receipt.Number+".pdf\"")
+	c.Data(http.StatusOK, "application/pdf", data)
+}
+
+func EmailReceipt(c *gin.Context) {
+	receipt, ok := loadOwnReceipt(c)
+	if !ok {
+		return
+	}
+	err := emailReceipt(receipt)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": "Emailing receipt failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Receipt emailed", "resourceId": receipt.ID,
+	})
+}
+
+func DownloadAnnualStatement(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	year, ok := statementYearParam(c)
+	if !ok {
+		return
+	}
+	data, err := renderAnnualStatement(userId, year)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": "Generating statement failed"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%d.pdf\"", year))
+	c.Data(http.StatusOK, "application/pdf", data)
+}
+
+func EmailAnnualStatement(c *gin.Context) {
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	year, ok := statementYearParam(c)
+	if !ok {
+		return
+	}
+	data, err := renderAnnualStatement(userId, year)
+	if err == nil {
+		err = sendDocument(userId, fmt.Sprintf("Sponsor-Hub annual statement %d", year),
+			fmt.Sprintf("Your Sponsor-Hub sponsorship statement for %d is attached.", year), fmt.Sprintf("statement-%d.pdf", year), data)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": "Emailing statement failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Statement emailed",
+	})
+}
+
+func renderReceipt(receipt *store.Receipt) ([]byte, error) {
+	sponsor, err := App.Store.LoadPrivilegedUserAsSelf(receipt.SponsorId, receipt.SponsorId)
+	if err != nil {
+		return nil, err
+	}
+	return receiptPdf(receipt, sponsor)
+}
+
+func renderAnnualStatement(userId uint, year int) ([]byte, error) {
+	sponsor, err := App.Store.LoadPrivilegedUserAsSelf(userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := App.Store.AnnualStatementForSponsor(userId, year)
+	if err != nil {
+		return nil, err
+	}
+	return statementPdf(statement, sponsor)
+}
+
+func sendDocument(userId uint, subject string, text string, fileName string, data []byte) error {
+	user, err := App.Store.LoadPrivilegedUserAsSelf(userId, userId)
+	if err != nil {
+		return err
+	}
+	return sendMail(withUnsubscribe(&MailMessage{
+		To:          user.Email,
+		Subject:     subject,
+		Text:        text + "\r\n",
+		HTML:        "<p>" + text + "</p>\r\n",
+		Attachments: []MailAttachment{{FileName: fileName, ContentType: "application/pdf", Data: data}},
+	}, user.ID, store.NotificationCategoryReceipts))
+}
+
+func receiptDelivery(receipt *store.Receipt) *store.MessageDelivery {
+	return &store.MessageDelivery{
+		UserId:    receipt.SponsorId,
+		Kind:      store.NotificationCategoryReceipts.Kind(),
+		Category:  store.NotificationCategoryReceipts,
+		Subject:   "Sponsor-Hub receipt " + receipt.Number,
+		Body:      "Thank you for your sponsorship, your receipt " + receipt.Number + " is attached.",
+		ReceiptId: receipt.ID,
+	}
+}
+
+func emailReceipt(receipt *store.Receipt) error {
+	return deliverReceipt(receiptDelivery(receipt), receipt, time.Now())
+}
+
+func receiptAttachment(receiptId uint) (*MailAttachment, error) {
+	receipt, err := App.Store.LoadReceipt(receiptId)
+	if err != nil {
+		return nil, err
+	}
+	data, err := renderReceipt(receipt)
+	if err != nil {
+		return nil, err
+	}
+	return &MailAttachment{FileName: "receipt-" + receipt.Number + ".pdf", ContentType: "application/pdf", Data: data}, nil
+}
+
+func deliverReceipt(delivery *store.MessageDelivery, receipt *store.Receipt, now time.Time) error {
+	data, err := renderReceipt(receipt)
+	if err == nil {
+		err = sendDocument(receipt.SponsorId, delivery.Subject, delivery.Body, "receipt-"+receipt.Number+".pdf", data)
+	}
+	return saveDeliveryAttempt(delivery, err, now)
+}
+
+func emailReceiptForSource(source store.ReceiptSource, sourceId uint) {
+	if !App.Organisation.EmailReceipts {
+		return
+	}
+	receipt, err := App.Store.LoadReceiptForSource(source, sourceId)
+	if err != nil {
+		return
+	}
+	_ = dispatchDelivery(receiptDelivery(receipt), time.Now())
+}
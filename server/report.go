@@ -0,0 +1,266 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+type TestReportJSON struct {
+	Verdict     string
+	Device      string
+	Description string
+}
+
+type TestReportStatusJSON struct {
+	Status string
+}
+
+func AddTestReport(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	artifact, ok := loadBuildArtifact(c)
+	if !ok {
+		return
+	}
+	if !App.Store.CanDownloadBuildArtifact(loggedInUserId, artifact.ID) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Not subscribed to this build's channel"})
+		return
+	}
+	report := store.TestReport{ArtifactId: artifact.ID, UserId: loggedInUserId}
+	err := readJSONIntoTestReport(&report, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Test report failed validation - err: %s", err.Error())})
+		return
+	}
+	reportId, err := App.Store.InsertTestReport(&report)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Test report failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Test report submitted successfully", "resourceId": reportId,
+	})
+}
+
+func UpdateTestReport(c *gin.Context) {
+	report, ok := loadOwnTestReport(c, false)
+	if !ok {
+		return
+	}
+	err := readJSONIntoTestReport(report, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Test report failed validation - err: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.UpdateTestReport(report)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Test report failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Test report updated successfully", "resourceId": report.ID,
+	})
+}
+
+func LoadTestReport(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	report, ok := loadOwnTestReport(c, true)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func UserTestReportsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	reports, err := App.Store.ListTestReportsForUser(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Test reports not found"})
+		return
+	}
+	c.JSON(http.StatusOK, reports)
+}
+
+func BuildTestReportsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	artifact, ok := loadBuildArtifact(c)
+	if !ok {
+		return
+	}
+	reports, err := App.Store.ListTestReportsForBuild(artifact.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Test reports not found"})
+		return
+	}
+	c.JSON(http.StatusOK, reports)
+}
+
+func BuildTestReportSummary(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	artifact, ok := loadBuildArtifact(c)
+	if !ok {
+		return
+	}
+	summary, err := App.Store.TestReportSummaryForBuild(artifact)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Test reports not found"})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+func UpdateTestReportStatus(c *gin.Context) {
+	report, ok := loadOwnTestReport(c, true)
+	if !ok {
+		return
+	}
+	statusJSON := TestReportStatusJSON{}
+	err := c.BindJSON(&statusJSON)
+	if err == nil {
+		report.Status, err = store.ParseTestReportStatus(statusJSON.Status)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Test report status failed validation - err: %s", err.Error())})
+		return
+	}
+	changed, err := App.Store.UpdateTestReportStatus(report.ID, report.Status)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Test report status failed"})
+		return
+	}
+	if changed {
+		go notifyTestReportStatus(report)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Test report is now " + string(report.Status), "resourceId": report.ID,
+	})
+}
+
+func notifyTestReportStatus(report *store.TestReport) {
+	version := ""
+	artifact, err := App.Store.LoadBuildArtifact(report.ArtifactId)
+	if err == nil {
+		version = " " + artifact.Version
+	}
+	subject := fmt.Sprintf("Your report on build%s is now %s", version, report.Status)
+	body := fmt.Sprintf("Thanks for testing build%s on %s.\r\n\r\nYour report has been marked as %s.\r\n", version, report.Device, report.Status)
+	_, err = Notify(report.UserId, store.NotificationCategoryTesting, subject, body)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func AddTestReportAttachment(c *gin.Context) {
+	report, ok := loadOwnTestReport(c, false)
+	if !ok {
+		return
+	}
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Attachment file is missing"})
+		return
+	}
+	attachment := store.TestReportAttachment{
+		ReportId:    report.ID,
+		FileName:    filepath.Base(fileHeader.Filename),
+		ContentType: fileHeader.Header.Get("Content-Type"),
+		Size:        fileHeader.Size,
+	}
+	err = attachment.Validate()
+	if err == nil {
+		file, openErr := fileHeader.Open()
+		if openErr != nil {
+			err = openErr
+		} else {
+			attachment.Data, err = ioutil.ReadAll(file)
+			_ = file.Close()
+		}
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Attachment failed validation - err: %s", err.Error())})
+		return
+	}
+	if len(attachment.ContentType) == 0 {
+		attachment.ContentType = http.DetectContentType(attachment.Data)
+	}
+	attachmentId, err := App.Store.InsertTestReportAttachment(&attachment)
+	if err == store.ErrTooManyAttachments {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Attachment failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Attachment uploaded successfully", "resourceId": attachmentId,
+	})
+}
+
+func DownloadTestReportAttachment(c *gin.Context) {
+	report, ok := loadOwnTestReport(c, true)
+	if !ok {
+		return
+	}
+	attachmentId, err := strconv.Atoi(c.Param("attachmentID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid AttachmentID"})
+		return
+	}
+	attachment, err := App.Store.LoadTestReportAttachment(report.ID, uint(attachmentId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Attachment not found"})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=\""+attachment.FileName+"\"")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, attachment.ContentType, attachment.Data)
+}
+
+func loadOwnTestReport(c *gin.Context, developersAllowed bool) (*store.TestReport, bool) {
+	reportId, err := strconv.Atoi(c.Param("reportID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid ReportID"})
+		return nil, false
+	}
+	report, err := App.Store.LoadTestReport(uint(reportId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Test report not found"})
+		return nil, false
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if report.UserId != loggedInUserId {
+		user, err := App.Store.LoadPrivilegedUserAsSelf(loggedInUserId, loggedInUserId)
+		if !developersAllowed || err != nil || user.Permissions < store.UserPermissionsUser {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Trying to access someone else's test report?"})
+			return nil, false
+		}
+	}
+	return report, true
+}
+
+func readJSONIntoTestReport(report *store.TestReport, c *gin.Context) error {
+	reportJSON := TestReportJSON{}
+	err := c.BindJSON(&reportJSON)
+	if err != nil {
+		return err
+	}
+
+	report.Verdict = store.TestVerdict(reportJSON.Verdict)
+	report.Device = reportJSON.Device
+	report.Description = reportJSON.Description
+	return report.Validate()
+}
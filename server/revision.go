@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+func loadViewableSurvey(c *gin.Context) (*store.Survey, bool) {
+	surveyId, err := strconv.Atoi(c.Param("surveyID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid SurveyID"})
+		return nil, false
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	survey, err := App.Store.LoadSurvey(uint(surveyId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey not found"})
+		return nil, false
+	}
+	if !App.Store.SurveyVisibleTo(survey, loggedInUserId) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Attempt to load someone elses survey")})
+		return nil, false
+	}
+	return survey, true
+}
+
+func surveyViewer(c *gin.Context, survey *store.Survey) store.SurveyViewer {
+	claims := jwt.ExtractClaims(c)
+	return App.Store.SurveyViewerFor(survey, uint(claims["id"].(float64)))
+}
+
+func loadSurveyRevisionParam(c *gin.Context, surveyId uint, param string) (*store.SurveyRevision, bool) {
+	revision, err := strconv.Atoi(c.Param(param))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid Revision"})
+		return nil, false
+	}
+	surveyRevision, err := App.Store.LoadSurveyRevision(surveyId, uint(revision))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey revision not found"})
+		return nil, false
+	}
+	return surveyRevision, true
+}
+
+func SurveyRevisionsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	survey, ok := loadViewableSurvey(c)
+	if !ok {
+		return
+	}
+	revisions, err := App.Store.ListSurveyRevisions(survey.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey revisions not found"})
+		return
+	}
+	viewer := surveyViewer(c, survey)
+	for i := range revisions {
+		revisions[i] = *store.RedactSurveyRevision(&revisions[i], viewer)
+	}
+	c.JSON(http.StatusOK, revisions)
+}
+
+func LoadSurveyRevision(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	survey, ok := loadViewableSurvey(c)
+	if !ok {
+		return
+	}
+	revision, ok := loadSurveyRevisionParam(c, survey.ID, "revision")
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, store.RedactSurveyRevision(revision, surveyViewer(c, survey)))
+}
+
+func DiffSurveyRevisions(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	survey, ok := loadViewableSurvey(c)
+	if !ok {
+		return
+	}
+	from, ok := loadSurveyRevisionParam(c, survey.ID, "revision")
+	if !ok {
+		return
+	}
+	to, ok := loadSurveyRevisionParam(c, survey.ID, "otherRevision")
+	if !ok {
+		return
+	}
+	viewer := surveyViewer(c, survey)
+	c.JSON(http.StatusOK, gin.H{
+		"SurveyId": survey.ID, "From": from.Revision, "To": to.Revision,
+		"Changes": store.DiffSurveyRevisions(store.RedactSurveyRevision(from, viewer), store.RedactSurveyRevision(to, viewer)),
+	})
+}
+
+func RestoreSurveyRevision(c *gin.Context) {
+	survey, ok := loadViewableSurvey(c)
+	if !ok {
+		return
+	}
+	revision, ok := loadSurveyRevisionParam(c, survey.ID, "revision")
+	if !ok {
+		return
+	}
+
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	if !surveyEditable(c, survey) {
+		return
+	}
+	before := *survey
+	revision.ApplyTo(survey)
+	err := saveSurvey(survey, &before, loggedInUserId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Restore Survey revision failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Survey revision restored successfully", "resourceId": survey.ID,
+	})
+}
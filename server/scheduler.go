@@ -0,0 +1,42 @@
+package server
+
+import (
+	"time"
+)
+
+type scheduledJob struct {
+	Name    string
+	Every   time.Duration
+	Run     func(now time.Time)
+	lastRun time.Time
+}
+
+var scheduledJobs = []*scheduledJob{
+	{Name: "comms digests", Every: 15 * time.Minute, Run: SendDueDigests},
+	{Name: "announcements", Every: time.Minute, Run: SendDueAnnouncements},
+	{Name: "privacy policy reconsent", Every: time.Minute, Run: SendDuePrivacyPolicyReconsents},
+	{Name: "webhooks", Every: time.Minute, Run: DeliverWebhooks},
+	{Name: "email retries", Every: 15 * time.Minute, Run: RetryFailedDeliveries},
+	{Name: "data export expiry", Every: time.Hour, Run: ExpireDataExports},
+	{Name: "account deletions", Every: time.Hour, Run: ProcessDueAccountDeletions},
+	{Name: "funding milestones", Every: time.Hour, Run: CheckAllFundingMilestones},
+	{Name: "crash upload retention", Every: 24 * time.Hour, Run: ExpireCrashUploads},
+}
+
+func (a *WebApp) StartScheduler(tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	go func() {
+		for now := range ticker.C {
+			runScheduledJobs(now)
+		}
+	}()
+}
+
+func runScheduledJobs(now time.Time) {
+	for _, job := range scheduledJobs {
+		if now.Sub(job.lastRun) >= job.Every {
+			job.lastRun = now
+			job.Run(now)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"github.com/adamboardman/sponsor-hub/store"
@@ -10,20 +11,57 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 )
 
 type WebApp struct {
-	Router        *gin.Engine
-	Store         *store.Store
-	JwtMiddleware *jwt.GinJWTMiddleware
+	Router              *gin.Engine
+	Store               *store.Store
+	JwtMiddleware       *jwt.GinJWTMiddleware
+	DeletionGracePeriod time.Duration
+	PaymentSecrets      map[store.PaymentProvider][]byte
+	ReportingCurrency   string
+	Organisation        Organisation
+	BuildsDirectory     string
+	LiveEventsBackend   string
+	VapidKey            *ecdsa.PrivateKey
+	LinkKey             []byte
+	PushClient          *http.Client
+	PushServiceHosts    []string
 }
 
 var App *WebApp
 
 func (a *WebApp) Init(dbName string) {
 	App = a
-	a.Store = &store.Store{}
+	if a.DeletionGracePeriod == 0 {
+		a.DeletionGracePeriod = defaultDeletionGracePeriod
+	}
+	if len(a.ReportingCurrency) == 0 {
+		a.ReportingCurrency = store.ReportingCurrencyDefault
+	}
+	if len(a.BuildsDirectory) == 0 {
+		a.BuildsDirectory = buildsDirectoryDefault
+	}
+	if len(a.LiveEventsBackend) == 0 {
+		a.LiveEventsBackend = LiveEventsBackendLocal
+	}
+	if a.PushClient == nil {
+		a.PushClient = &http.Client{Timeout: pushTimeout, CheckRedirect: noPushRedirects}
+	}
+	if a.PushServiceHosts == nil {
+		a.PushServiceHosts = store.DefaultPushServiceHosts
+	}
+	a.PaymentSecrets = map[store.PaymentProvider][]byte{}
+	for name := range paymentProviders {
+		a.PaymentSecrets[name] = readPaymentWebhookSecret(name)
+	}
+	a.Organisation = readOrganisation()
+	a.VapidKey = readVapidKey()
+	a.LinkKey = readLinkKey()
+	a.Store = &store.Store{ReportingCurrency: a.ReportingCurrency, ReceiptPrefix: a.Organisation.ReceiptPrefix}
 	a.Store.StoreInit("test-db")
+	startLiveEvents(a)
 
 	// Set the router as the default one shipped with Gin
 	router := gin.Default()
@@ -55,9 +93,123 @@ func addApiRoutesToApi(a *WebApp, api *gin.RouterGroup) {
 	api.PUT("/surveys/:surveyID", a.JwtMiddleware.MiddlewareFunc(), UpdateSurvey)
 	api.GET("/surveys/:surveyID/sponsors", a.JwtMiddleware.MiddlewareFunc(), LoadSurveySponsors)
 	api.POST("/surveys/:surveyID/sponsors", a.JwtMiddleware.MiddlewareFunc(), AddSurveySponsor)
+	api.PUT("/surveys/:surveyID/sponsors", a.JwtMiddleware.MiddlewareFunc(), ReplaceSurveySponsors)
+	api.PUT("/surveys/:surveyID/sponsors/:userID", a.JwtMiddleware.MiddlewareFunc(), UpdateSurveySponsor)
+	api.PUT("/surveys/:surveyID/sponsors/:userID/state", a.JwtMiddleware.MiddlewareFunc(), UpdateSurveySponsorState)
+	api.GET("/surveys/:surveyID/sponsors/:userID/history", a.JwtMiddleware.MiddlewareFunc(), SurveySponsorHistory)
 	api.DELETE("/surveys/:surveyID/sponsors/:userID", a.JwtMiddleware.MiddlewareFunc(), DeleteSurveySponsor)
 	api.GET("/sponsorable", a.JwtMiddleware.MiddlewareFunc(), SponsorableUsersList)
-	api.GET("/prereleaseusers", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), PreReleaseUsersList)
+	api.GET("/surveys/:surveyID/revisions", a.JwtMiddleware.MiddlewareFunc(), SurveyRevisionsList)
+	api.GET("/surveys/:surveyID/revisions/:revision", a.JwtMiddleware.MiddlewareFunc(), LoadSurveyRevision)
+	api.GET("/surveys/:surveyID/revisions/:revision/diff/:otherRevision", a.JwtMiddleware.MiddlewareFunc(), DiffSurveyRevisions)
+	api.POST("/surveys/:surveyID/revisions/:revision/restore", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), RestoreSurveyRevision)
+	api.GET("/consents", a.JwtMiddleware.MiddlewareFunc(), ConsentsList)
+	api.GET("/consents/history", a.JwtMiddleware.MiddlewareFunc(), ConsentHistory)
+	api.POST("/consents", a.JwtMiddleware.MiddlewareFunc(), AddConsent)
+	api.GET("/privacypolicies", a.JwtMiddleware.MiddlewareFunc(), PrivacyPoliciesList)
+	api.POST("/privacypolicies", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AddPrivacyPolicy)
+	api.POST("/users/:userID/export", a.JwtMiddleware.MiddlewareFunc(), RequestDataExport)
+	api.GET("/users/:userID/exports", a.JwtMiddleware.MiddlewareFunc(), DataExportsList)
+	api.GET("/exports/:exportID/download", DownloadDataExport)
+	api.DELETE("/users/:userID", a.JwtMiddleware.MiddlewareFunc(), DeleteUser)
+	api.GET("/users/:userID/deletion", a.JwtMiddleware.MiddlewareFunc(), LoadAccountDeletion)
+	api.DELETE("/users/:userID/deletion", a.JwtMiddleware.MiddlewareFunc(), CancelAccountDeletion)
+	api.GET("/audit", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AuditRecordsList)
+	api.GET("/users/:userID/tiers", a.JwtMiddleware.MiddlewareFunc(), SponsorshipTiersList)
+	api.POST("/tiers", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), AddSponsorshipTier)
+	api.PUT("/tiers/:tierID", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), UpdateSponsorshipTier)
+	api.DELETE("/tiers/:tierID", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), DeleteSponsorshipTier)
+	api.GET("/users/:userID/sponsorship-metrics", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), DeveloperSponsorshipMetrics)
+	api.GET("/sponsorship-metrics", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), SponsorshipMetrics)
+	api.POST("/payments/webhooks/:provider", PaymentWebhook)
+	api.GET("/payments/events", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), PaymentEventsList)
+	api.POST("/payments/events/:eventID/resolve", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ResolvePaymentEvent)
+	api.GET("/ledger", a.JwtMiddleware.MiddlewareFunc(), FinancePermissionsRequired(), LedgerEntriesList)
+	api.POST("/ledger", a.JwtMiddleware.MiddlewareFunc(), FinancePermissionsRequired(), AddLedgerEntry)
+	api.POST("/ledger/:entryID/reverse", a.JwtMiddleware.MiddlewareFunc(), FinancePermissionsRequired(), ReverseLedgerEntry)
+	api.GET("/ledger-balances", a.JwtMiddleware.MiddlewareFunc(), FinancePermissionsRequired(), LedgerBalancesList)
+	api.GET("/reconciliation/:month", a.JwtMiddleware.MiddlewareFunc(), FinancePermissionsRequired(), LedgerReconciliationReport)
+	api.GET("/exchangerates", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ExchangeRatesList)
+	api.POST("/exchangerates", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AddExchangeRate)
+	api.DELETE("/exchangerates/:rateID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), DeleteExchangeRate)
+	api.GET("/users/:userID/receipts", a.JwtMiddleware.MiddlewareFunc(), ReceiptsList)
+	api.GET("/users/:userID/statements/:year", a.JwtMiddleware.MiddlewareFunc(), DownloadAnnualStatement)
+	api.POST("/users/:userID/statements/:year/email", a.JwtMiddleware.MiddlewareFunc(), EmailAnnualStatement)
+	api.GET("/receipts/:receiptID", a.JwtMiddleware.MiddlewareFunc(), DownloadReceipt)
+	api.POST("/receipts/:receiptID/email", a.JwtMiddleware.MiddlewareFunc(), EmailReceipt)
+	api.GET("/users/:userID/goals", a.JwtMiddleware.MiddlewareFunc(), FundingGoalsList)
+	api.POST("/goals", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), AddFundingGoal)
+	api.PUT("/goals/:goalID", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), UpdateFundingGoal)
+	api.DELETE("/goals/:goalID", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), DeleteFundingGoal)
+	api.GET("/channels", a.JwtMiddleware.MiddlewareFunc(), ReleaseChannelsList)
+	api.POST("/channels", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AddReleaseChannel)
+	api.PUT("/channels/:channelID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), UpdateReleaseChannel)
+	api.DELETE("/channels/:channelID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), DeleteReleaseChannel)
+	api.GET("/channels/:channelID/subscribers", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ChannelSubscribersList)
+	api.GET("/users/:userID/channel-subscriptions", a.JwtMiddleware.MiddlewareFunc(), ChannelSubscriptionsList)
+	api.PUT("/users/:userID/channel-subscriptions", a.JwtMiddleware.MiddlewareFunc(), ReplaceChannelSubscriptions)
+	api.GET("/announcements", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AnnouncementsList)
+	api.POST("/announcements", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AddAnnouncement)
+	api.GET("/announcements/:announcementID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), LoadAnnouncement)
+	api.PUT("/announcements/:announcementID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), UpdateAnnouncement)
+	api.GET("/announcements/:announcementID/preview", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), PreviewAnnouncement)
+	api.POST("/announcements/:announcementID/schedule", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ScheduleAnnouncement)
+	api.POST("/announcements/:announcementID/cancel", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), CancelAnnouncement)
+	api.GET("/announcements/:announcementID/deliveries", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AnnouncementDeliveriesList)
+	api.GET("/announcements/:announcementID/recipients/:userID/unsubscribe", UnsubscribeFromAnnouncementPage)
+	api.POST("/announcements/:announcementID/recipients/:userID/unsubscribe", UnsubscribeFromAnnouncement)
+	api.POST("/builds", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AddBuildArtifact)
+	api.DELETE("/builds/:buildID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), DeleteBuildArtifact)
+	api.GET("/builds/:buildID/downloads", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), BuildDownloadsList)
+	api.GET("/channels/:channelID/builds", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ChannelBuildsList)
+	api.GET("/users/:userID/builds", a.JwtMiddleware.MiddlewareFunc(), UserBuildsList)
+	api.GET("/builds/:buildID/users/:userID/download", DownloadBuildArtifact)
+	api.HEAD("/builds/:buildID/users/:userID/download", DownloadBuildArtifact)
+	api.POST("/builds/:buildID/reports", a.JwtMiddleware.MiddlewareFunc(), AddTestReport)
+	api.GET("/builds/:buildID/reports", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), BuildTestReportsList)
+	api.GET("/builds/:buildID/reports/summary", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), BuildTestReportSummary)
+	api.GET("/users/:userID/reports", a.JwtMiddleware.MiddlewareFunc(), UserTestReportsList)
+	api.GET("/reports/:reportID", a.JwtMiddleware.MiddlewareFunc(), LoadTestReport)
+	api.PUT("/reports/:reportID", a.JwtMiddleware.MiddlewareFunc(), UpdateTestReport)
+	api.PUT("/reports/:reportID/status", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), UpdateTestReportStatus)
+	api.POST("/reports/:reportID/attachments", a.JwtMiddleware.MiddlewareFunc(), AddTestReportAttachment)
+	api.GET("/reports/:reportID/attachments/:attachmentID", a.JwtMiddleware.MiddlewareFunc(), DownloadTestReportAttachment)
+	api.GET("/users/:userID/device-tokens", a.JwtMiddleware.MiddlewareFunc(), DeviceTokensList)
+	api.POST("/users/:userID/device-tokens", a.JwtMiddleware.MiddlewareFunc(), AddDeviceToken)
+	api.DELETE("/users/:userID/device-tokens/:tokenID", a.JwtMiddleware.MiddlewareFunc(), DeleteDeviceToken)
+	api.POST("/builds/:buildID/uploads", IngestCrashUpload)
+	api.GET("/builds/:buildID/crash-groups", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), BuildCrashGroupsList)
+	api.GET("/crash-groups/:groupID/uploads", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), CrashGroupUploadsList)
+	api.GET("/uploads/:uploadID", a.JwtMiddleware.MiddlewareFunc(), UserPermissionsRequired(), DownloadCrashUpload)
+	api.GET("/users/:userID/notification-preferences", a.JwtMiddleware.MiddlewareFunc(), NotificationPreferencesForUser)
+	api.PUT("/users/:userID/notification-preferences", a.JwtMiddleware.MiddlewareFunc(), UpdateNotificationPreferences)
+	api.GET("/unsubscribe/:userID/:category", UnsubscribePage)
+	api.POST("/unsubscribe/:userID/:category", Unsubscribe)
+	api.GET("/users/:userID/inbox", a.JwtMiddleware.MiddlewareFunc(), InboxList)
+	api.GET("/users/:userID/inbox/unread-count", a.JwtMiddleware.MiddlewareFunc(), InboxUnreadCount)
+	api.POST("/users/:userID/inbox/read-all", a.JwtMiddleware.MiddlewareFunc(), MarkAllInboxNotificationsRead)
+	api.POST("/users/:userID/inbox/:notificationID/read", a.JwtMiddleware.MiddlewareFunc(), MarkInboxNotificationRead)
+	api.GET("/users/:userID/events", a.JwtMiddleware.MiddlewareFunc(), LiveEventsStream)
+	api.GET("/users/:userID/events-link", a.JwtMiddleware.MiddlewareFunc(), LiveEventsLink)
+	api.GET("/events/users/:userID", SignedLiveEventsStream)
+	api.GET("/push/public-key", VapidPublicKey)
+	api.GET("/users/:userID/push-subscriptions", a.JwtMiddleware.MiddlewareFunc(), PushSubscriptionsList)
+	api.POST("/users/:userID/push-subscriptions", a.JwtMiddleware.MiddlewareFunc(), AddPushSubscription)
+	api.DELETE("/users/:userID/push-subscriptions/:subscriptionID", a.JwtMiddleware.MiddlewareFunc(), DeletePushSubscription)
+	api.GET("/webhooks", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), WebhooksList)
+	api.POST("/webhooks", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AddWebhook)
+	api.PUT("/webhooks/:webhookID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), UpdateWebhook)
+	api.DELETE("/webhooks/:webhookID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), DeleteWebhook)
+	api.GET("/webhooks/:webhookID/deliveries", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), WebhookDeliveriesList)
+	api.POST("/webhooks/:webhookID/deliveries/:deliveryID/redeliver", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), RedeliverWebhook)
+	api.GET("/campaigns", a.JwtMiddleware.MiddlewareFunc(), SurveyCampaignsList)
+	api.POST("/campaigns", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AddSurveyCampaign)
+	api.PUT("/campaigns/:campaignID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), UpdateSurveyCampaign)
+	api.GET("/campaigns/:campaignID/survey", a.JwtMiddleware.MiddlewareFunc(), LoadCampaignSurvey)
+	api.POST("/campaigns/:campaignID/survey", a.JwtMiddleware.MiddlewareFunc(), AddCampaignSurvey)
+	api.PUT("/campaigns/:campaignID/survey", a.JwtMiddleware.MiddlewareFunc(), UpdateCampaignSurvey)
+	api.GET("/campaigns/:campaignID/report", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), SurveyCampaignReport)
+	api.GET("/campaigns/:campaignID/compare/:otherID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), CompareSurveyCampaigns)
 }
 
 func UserPermissionsRequired() gin.HandlerFunc {
@@ -102,6 +254,27 @@ func AdminPermissionsRequiredImpl(c *gin.Context) {
 	c.Next()
 }
 
+func FinancePermissionsRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		FinancePermissionsRequiredImpl(c)
+	}
+}
+
+func FinancePermissionsRequiredImpl(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	userId := uint(claims[identityId].(float64))
+	user, err := App.Store.LoadPrivilegedUserAsSelf(userId, userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "User not found"})
+		return
+	}
+	if !(user.Permissions >= store.UserPermissionsFinance) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "User is not a finance admin"})
+		return
+	}
+	c.Next()
+}
+
 func Exists(name string) bool {
 	_, err := os.Stat(name)
 	return !os.IsNotExist(err)
@@ -118,6 +291,7 @@ func addDefaultRouteToWebApp(router *gin.Engine) {
 }
 
 func (a *WebApp) Run(addr string) {
+	a.StartScheduler(time.Minute)
 	_ = a.Router.Run(addr)
 }
 
@@ -215,7 +389,10 @@ func SurveysList(c *gin.Context) {
 
 func SponsorableUsersList(c *gin.Context) {
 	c.Header("Content-Type", "application/json")
-	sponsorableUsers, err := App.Store.ListSponsorableUsers()
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	sponsorableUsers, err := App.Store.ListSponsorableUsers(loggedInUserId)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": fmt.Sprintf("No sponsorable users found")})
 	} else {
@@ -223,16 +400,6 @@ func SponsorableUsersList(c *gin.Context) {
 	}
 }
 
-func PreReleaseUsersList(c *gin.Context) {
-	c.Header("Content-Type", "application/json")
-	preReleaseUsers, err := App.Store.ListPreReleaseUsers()
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": fmt.Sprintf("No users have selected pre-release notifications found")})
-	} else {
-		c.JSON(http.StatusOK, preReleaseUsers)
-	}
-}
-
 func AddSurveySponsor(c *gin.Context) {
 	surveySponsor := store.SurveySponsor{}
 
@@ -241,29 +408,24 @@ func AddSurveySponsor(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("SurveySponsor failed validation - err: %s", err.Error())})
 		return
 	}
-	if surveySponsor.SurveyId == 0 && surveySponsor.UserId != 0 {
-		claims := jwt.ExtractClaims(c)
-		loggedInUserId := uint(claims["id"].(float64))
-
-		savedSurvey, err := App.Store.LoadSurveyForUser(loggedInUserId)
-		if err == nil {
-			surveySponsor.SurveyId = savedSurvey.ID
-		} else {
-			savedSurvey.UserId = loggedInUserId
-			surveyId, err := App.Store.InsertSurvey(savedSurvey)
-			if err == nil {
-				surveySponsor.SurveyId = surveyId
-			}
-		}
-	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
 
-	surveySponsorId, err := App.Store.InsertSurveySponsor(&surveySponsor)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert SurveySponsor failed"})
+	err = App.Store.UpsertSurveySponsor(loggedInUserId, &surveySponsor, store.NewOutboxEvent(store.WebhookEventSponsorCreated, &surveySponsor))
+	if err == store.ErrNotSurveyOwner {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Attempt to update someone elses sponsorships"})
+		return
+	} else if err != nil && err != store.ErrSponsorshipStateUnchanged {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Insert SurveySponsor failed - err: %s", err.Error())})
 		return
 	}
+	if err == nil {
+		go notifyNewSponsor(surveySponsor)
+		go publishSponsorshipEvent(LiveEventSponsorAdded, surveySponsor.SurveyId, surveySponsor.UserId)
+	}
+	go checkFundingMilestones(surveySponsor.UserId)
 	c.JSON(http.StatusCreated, gin.H{
-		"status": http.StatusCreated, "message": "Added Survey Sponsor successfully", "resourceId": surveySponsorId,
+		"status": http.StatusCreated, "message": "Added Survey Sponsor successfully", "resourceId": surveySponsor.ID,
 	})
 }
 
@@ -281,57 +443,38 @@ func LoadSurvey(c *gin.Context) {
 	if surveyId == 0 {
 		survey, err = App.Store.LoadSurveyForUser(loggedInUserId)
 	} else {
-		survey, err = App.Store.LoadSurvey(uint(surveyId))
+		survey, err = App.Store.LoadSurveyForViewer(uint(surveyId), loggedInUserId)
 	}
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey not found"})
 		return
 	}
 
-	if survey.UserId != loggedInUserId {
-		var currentUser, err = App.Store.LoadUserAsSelf(loggedInUserId, loggedInUserId)
-		if err != nil || (currentUser.Permissions != store.UserPermissionsAdmin && currentUser.Permissions != store.UserPermissionsUser) {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Attempt to load someone elses survey")})
-			return
-		}
-	}
+	c.JSON(http.StatusOK, surveyToJSON(survey))
+}
 
+func surveyToJSON(survey *store.Survey) SurveyJSON {
 	json := SurveyJSON{}
 	json.ID = survey.ID
+	json.CampaignId = survey.CampaignId
 	json.Name = survey.Name
 	json.GitHubId = survey.GitHubId
 	json.Priorities = survey.Priorities
 	json.Issues = survey.Issues
-	json.CommsFrequency = survey.CommsFrequency
+	json.CommsFrequency = string(survey.CommsFrequency)
 	json.PreRelease = survey.PreRelease
-	json.Privacy = survey.Privacy
-	c.JSON(http.StatusOK, json)
+	json.Privacy = string(survey.Privacy)
+	return json
 }
 
 func LoadSurveySponsors(c *gin.Context) {
 	c.Header("Content-Type", "application/json")
-	surveyId, err := strconv.Atoi(c.Param("surveyID"))
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid SurveyID"})
-		return
-	}
-	claims := jwt.ExtractClaims(c)
-	loggedInUserId := uint(claims["id"].(float64))
-
-	survey, err := App.Store.LoadSurvey(uint(surveyId))
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey not found"})
+	survey, ok := loadViewableSurvey(c)
+	if !ok {
 		return
 	}
-	if survey.UserId != loggedInUserId {
-		var currentUser, err = App.Store.LoadUserAsSelf(loggedInUserId, loggedInUserId)
-		if err != nil || (currentUser.Permissions != store.UserPermissionsAdmin && currentUser.Permissions != store.UserPermissionsUser) {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Attempt to load someone elses survey")})
-			return
-		}
-	}
 
-	sponsors, err := App.Store.SponsorsForSurveyId(uint(surveyId))
+	sponsors, err := App.Store.SponsorsForSurveyId(survey.ID)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "SurveySponsors not found"})
 		return
@@ -359,16 +502,21 @@ func AddSurvey(c *gin.Context) {
 
 	savedSurvey, err := App.Store.LoadSurveyForUser(survey.UserId)
 	surveyId := savedSurvey.ID
+	before := store.Survey{}
 	if err == nil {
+		before = *savedSurvey
 		survey.ID = surveyId
-		_, err = App.Store.UpdateSurvey(&survey)
+		_, err = App.Store.UpdateSurvey(&survey, survey.UserId, surveyUpdatedEvent(&survey, survey.UserId))
 	} else {
-		surveyId, err = App.Store.InsertSurvey(&survey)
+		surveyId, err = App.Store.InsertSurvey(&survey, survey.UserId)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Survey failed"})
 			return
 		}
 	}
+	if err == nil {
+		recordSurveyConsents(survey.UserId, &before, &survey)
+	}
 	c.JSON(http.StatusCreated, gin.H{
 		"status": http.StatusCreated, "message": "Survey created successfully", "resourceId": surveyId,
 	})
@@ -391,19 +539,23 @@ func UpdateSurvey(c *gin.Context) {
 	loggedInUserId := uint(claims["id"].(float64))
 	if survey.UserId != loggedInUserId {
 		var currentUser, err = App.Store.LoadUserAsSelf(loggedInUserId, loggedInUserId)
-		if err != nil || (currentUser.Permissions != store.UserPermissionsAdmin) {
+		if err != nil || (currentUser.Permissions < store.UserPermissionsAdmin) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Attempt to update someone elses survey")})
 			return
 		}
 	}
+	if !surveyEditable(c, survey) {
+		return
+	}
 
+	before := *survey
 	err = readJSONIntoSurvey(survey, c, true)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Survey details failed validation - err: %s", err.Error())})
 		return
 	}
 
-	_, err = App.Store.UpdateSurvey(survey)
+	err = saveSurvey(survey, &before, loggedInUserId)
 	if err == nil {
 		c.JSON(http.StatusOK, gin.H{
 			"status": http.StatusOK, "message": "Concept updated successfully", "resourceId": surveyId,
@@ -411,6 +563,29 @@ func UpdateSurvey(c *gin.Context) {
 	}
 }
 
+func surveyEditable(c *gin.Context, survey *store.Survey) bool {
+	if survey.CampaignId != 0 {
+		campaign, err := App.Store.LoadSurveyCampaign(survey.CampaignId)
+		if err != nil || !campaign.IsOpen(time.Now()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Survey campaign is closed, answers are read-only"})
+			return false
+		}
+	}
+	return true
+}
+
+func saveSurvey(survey *store.Survey, before *store.Survey, authorId uint) error {
+	_, err := App.Store.UpdateSurvey(survey, authorId, surveyUpdatedEvent(survey, authorId))
+	if err != nil {
+		return err
+	}
+	if survey.UserId == authorId {
+		recordSurveyConsents(authorId, before, survey)
+		go notifySurveyChanged(survey.ID)
+	}
+	return nil
+}
+
 func readJSONIntoSurvey(survey *store.Survey, c *gin.Context, forceUpdate bool) error {
 	surveyJSON := SurveyJSON{}
 	err := c.BindJSON(&surveyJSON)
@@ -418,14 +593,23 @@ func readJSONIntoSurvey(survey *store.Survey, c *gin.Context, forceUpdate bool)
 		return err
 	}
 
+	commsFrequency, err := store.ParseCommsFrequency(surveyJSON.CommsFrequency)
+	if err != nil {
+		return err
+	}
+	privacy, err := store.ParsePrivacyLevel(surveyJSON.Privacy)
+	if err != nil {
+		return err
+	}
+
 	if forceUpdate || surveyJSON.ID == 0 {
 		survey.Name = surveyJSON.Name
 		survey.GitHubId = surveyJSON.GitHubId
 		survey.Priorities = surveyJSON.Priorities
 		survey.Issues = surveyJSON.Issues
-		survey.CommsFrequency = surveyJSON.CommsFrequency
+		survey.CommsFrequency = commsFrequency
 		survey.PreRelease = surveyJSON.PreRelease
-		survey.Privacy = surveyJSON.Privacy
+		survey.Privacy = privacy
 	}
 
 	return nil
@@ -433,6 +617,7 @@ func readJSONIntoSurvey(survey *store.Survey, c *gin.Context, forceUpdate bool)
 
 type SurveyJSON struct {
 	ID             uint
+	CampaignId     uint
 	Name           string
 	GitHubId       string
 	Priorities     string
@@ -450,20 +635,51 @@ func readJSONIntoSurveySponsor(surveySponsor *store.SurveySponsor, c *gin.Contex
 	}
 
 	if forceUpdate || surveyJSON.ID == 0 {
-		surveySponsor.UserId = surveyJSON.UserId
 		surveyId, err := strconv.Atoi(c.Param("surveyID"))
 		if err == nil {
 			surveySponsor.SurveyId = uint(surveyId)
 		}
 	}
+	return copySurveySponsorJSON(surveySponsor, &surveyJSON, forceUpdate)
+}
 
-	return nil
+func copySurveySponsorJSON(surveySponsor *store.SurveySponsor, surveyJSON *SurveySponsorJSON, forceUpdate bool) error {
+	recurrence, err := store.ParseRecurrence(surveyJSON.Recurrence)
+	if err != nil {
+		return err
+	}
+
+	if forceUpdate || surveyJSON.ID == 0 {
+		surveySponsor.UserId = surveyJSON.UserId
+		surveySponsor.TierId = surveyJSON.TierId
+		surveySponsor.Amount = surveyJSON.Amount
+		surveySponsor.Currency = surveyJSON.Currency
+		surveySponsor.Recurrence = recurrence
+		if !surveyJSON.StartDate.IsZero() {
+			surveySponsor.StartDate = surveyJSON.StartDate
+		} else if surveySponsor.StartDate.IsZero() {
+			surveySponsor.StartDate = time.Now()
+		}
+		surveySponsor.EndDate = surveyJSON.EndDate
+	}
+
+	err = App.Store.ApplySponsorshipTier(surveySponsor)
+	if err != nil {
+		return err
+	}
+	return surveySponsor.Validate()
 }
 
 type SurveySponsorJSON struct {
-	ID       uint
-	SurveyId uint
-	UserId   uint
+	ID         uint
+	SurveyId   uint
+	UserId     uint
+	TierId     uint
+	Amount     int64
+	Currency   string
+	Recurrence string
+	StartDate  time.Time
+	EndDate    *time.Time
 }
 
 func DeleteSurveySponsor(c *gin.Context) {
@@ -478,20 +694,30 @@ func DeleteSurveySponsor(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Invalid UserID - err: %s", err.Error())})
 		return
 	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	var survey *store.Survey
 	if surveyId == 0 {
-		claims := jwt.ExtractClaims(c)
-		loggedInUserId := uint(claims["id"].(float64))
-		savedSurvey, err := App.Store.LoadSurveyForUser(loggedInUserId)
-		if err == nil {
-			surveyId = int(savedSurvey.ID)
-		}
+		survey, err = App.Store.LoadSurveyForUser(loggedInUserId)
+	} else {
+		survey, err = App.Store.LoadSurvey(uint(surveyId))
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey not found"})
+		return
+	}
+	if survey.UserId != loggedInUserId && uint(userId) != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Attempt to change someone elses sponsorship"})
+		return
 	}
-	err = App.Store.DeleteSurveySponsor(uint(surveyId), uint(userId))
+	surveyId = int(survey.ID)
+	_, err = App.Store.TransitionSurveySponsor(uint(surveyId), uint(userId), store.SponsorshipStateEnded, c.Query("reason"))
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Delete SurveySponsor Failed - err: %s", err.Error())})
 	} else {
+		go publishSponsorshipEvent(LiveEventSponsorRemoved, uint(surveyId), uint(userId))
 		c.JSON(http.StatusOK, gin.H{
-			"status": http.StatusOK, "message": "SurveySponsor deleted",
+			"status": http.StatusOK, "message": "SurveySponsor ended",
 		})
 	}
 }
@@ -1,20 +1,37 @@
 package server
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/adamboardman/sponsor-hub/store"
+	"github.com/gin-gonic/gin"
 	. "github.com/smartystreets/goconvey/convey"
 	"golang.org/x/crypto/argon2"
 	"io/ioutil"
+	"math/big"
+	"mime"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type Response struct {
@@ -245,3 +262,1306 @@ type ApiActionResponse struct {
 	Status      uint
 }
 
+func captureMail() *[]*MailMessage {
+	var sent []*MailMessage
+	sendMail = func(message *MailMessage) error {
+		sent = append(sent, message)
+		return nil
+	}
+	return &sent
+}
+
+func ensureTestSurveyExists(user *store.User) *store.Survey {
+	survey, err := a.Store.LoadSurveyForUser(user.ID)
+	if err != nil {
+		survey = &store.Survey{UserId: user.ID}
+		_, _ = a.Store.InsertSurvey(survey, user.ID)
+	}
+	return survey
+}
+
+func TestMailHeaders(t *testing.T) {
+	Convey("Given a subject containing a line break and non-ASCII text", t, func() {
+		message := MailMessage{To: "test-headers@example.com", Subject: "New sponsor: Zoë\r\nBcc: everyone@example.com", Text: "Hello", HTML: "<p>Hello</p>"}
+
+		Convey("It should stay on the subject line and be encoded", func() {
+			mail := composeMail(&message).String()
+			headers := strings.Split(mail, "\r\n\r\n")[0]
+			So(headers, ShouldNotContainSubstring, "\r\nBcc:")
+			So(headers, ShouldStartWith, "Subject: =?utf-8?q?")
+			decoded, err := new(mime.WordDecoder).DecodeHeader(strings.TrimPrefix(strings.Split(headers, "\r\n")[0], "Subject: "))
+			So(err, ShouldBeNil)
+			So(decoded, ShouldEqual, "New sponsor: Zoë Bcc: everyone@example.com")
+		})
+	})
+}
+
+func TestSurveySponsorOwnership(t *testing.T) {
+	Convey("Given a survey sponsoring a developer", t, func() {
+		owner := ensureTestUserExists("test-ownership-owner@example.com")
+		survey := ensureTestSurveyExists(owner)
+		developer := ensureTestUserExists("test-ownership-developer@example.com")
+		developer.Permissions = store.UserPermissionsUser
+		_, _ = a.Store.UpdateUser(developer)
+		_, err := a.Store.ReplaceSurveySponsors(owner.ID, survey.ID, []store.SurveySponsor{{UserId: developer.ID}})
+		So(err, ShouldBeNil)
+		ensureTestUserExists("test-ownership-intruder@example.com")
+		token := userTokenFromLoginResponse(loginToUserJSON("test-ownership-intruder@example.com"))
+
+		Convey("Someone else should not be able to end the sponsorship", func() {
+			req, _ := http.NewRequest("DELETE", "/api/surveys/"+uintToString(survey.ID)+"/sponsors/"+uintToString(developer.ID), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusForbidden)
+			surveySponsor, _ := a.Store.LoadSurveySponsor(survey.ID, developer.ID)
+			So(surveySponsor.State, ShouldEqual, store.SponsorshipStateActive)
+		})
+
+		developerToken := userTokenFromLoginResponse(loginToUserJSON("test-ownership-developer@example.com"))
+		changeState := func(token string, state store.SponsorshipState) int {
+			data, _ := json.Marshal(SponsorshipStateJSON{State: string(state)})
+			req, _ := http.NewRequest("PUT", "/api/surveys/"+uintToString(survey.ID)+"/sponsors/"+uintToString(developer.ID)+"/state", bytes.NewReader(data))
+			req.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			return response.Code
+		}
+
+		Convey("The developer should be able to end a sponsorship from an admins only survey", func() {
+			survey.Privacy = store.PrivacyLevelAdmins
+			_, _ = a.Store.UpdateSurvey(survey, owner.ID)
+			So(changeState(developerToken, store.SponsorshipStateEnded), ShouldEqual, http.StatusOK)
+			surveySponsor, _ := a.Store.LoadSurveySponsor(survey.ID, developer.ID)
+			So(surveySponsor.State, ShouldEqual, store.SponsorshipStateEnded)
+		})
+
+		Convey("Only the owner should be able to resume a paused sponsorship", func() {
+			So(changeState(developerToken, store.SponsorshipStatePaused), ShouldEqual, http.StatusOK)
+			So(changeState(developerToken, store.SponsorshipStateActive), ShouldEqual, http.StatusForbidden)
+			surveySponsor, _ := a.Store.LoadSurveySponsor(survey.ID, developer.ID)
+			So(surveySponsor.State, ShouldEqual, store.SponsorshipStatePaused)
+			ownerToken := userTokenFromLoginResponse(loginToUserJSON("test-ownership-owner@example.com"))
+			So(changeState(ownerToken, store.SponsorshipStateActive), ShouldEqual, http.StatusOK)
+		})
+
+		Reset(func() {
+			_, _ = a.Store.ReplaceSurveySponsors(owner.ID, survey.ID, nil)
+		})
+	})
+}
+
+func TestNotifyRespectsCommsFrequency(t *testing.T) {
+	Convey("Given a user who wants weekly communications", t, func() {
+		sent := captureMail()
+		user := ensureTestUserExists("test-weekly@example.com")
+		survey := ensureTestSurveyExists(user)
+		survey.CommsFrequency = store.CommsFrequencyWeekly
+		_, _ = a.Store.UpdateSurvey(survey, user.ID)
+		a.Store.PurgeMessageDeliveriesForUser(user.ID)
+		now := time.Now()
+
+		Convey("The first update should be sent and later ones held", func() {
+			first, _ := notifyAt(user.ID, store.NotificationCategorySponsorship, "First", "One", now)
+			second, _ := notifyAt(user.ID, store.NotificationCategorySponsorship, "Second", "Two", now.Add(time.Hour))
+			third, _ := notifyAt(user.ID, store.NotificationCategoryReleases, "Third", "Three", now.Add(2*time.Hour))
+			So(first.Status, ShouldEqual, store.DeliveryStatusSent)
+			So(second.Status, ShouldEqual, store.DeliveryStatusHeld)
+			So(third.Status, ShouldEqual, store.DeliveryStatusHeld)
+			So(len(*sent), ShouldEqual, 1)
+
+			Convey("No digest should be sent before the next allowed slot", func() {
+				SendDueDigests(now.Add(24 * time.Hour))
+				So(len(*sent), ShouldEqual, 1)
+			})
+
+			Convey("Held messages should be merged into a digest at the next slot", func() {
+				SendDueDigests(now.Add(8 * 24 * time.Hour))
+				So(len(*sent), ShouldEqual, 2)
+				So((*sent)[1].Subject, ShouldEqual, "Sponsor-Hub digest: 2 updates")
+				held, _ := a.Store.ListHeldMessagesForUser(user.ID)
+				So(len(held), ShouldEqual, 0)
+			})
+
+			Convey("Held messages claimed by another server should not be sent again until the lease expires", func() {
+				claimed, _ := a.Store.ClaimHeldMessagesForUser(user.ID, now.Add(8*24*time.Hour), deliveryLease)
+				So(len(claimed), ShouldEqual, 2)
+				SendDueDigests(now.Add(8 * 24 * time.Hour))
+				So(len(*sent), ShouldEqual, 1)
+				SendDueDigests(now.Add(8*24*time.Hour + deliveryLease))
+				So(len(*sent), ShouldEqual, 2)
+			})
+
+			Convey("A digest that fails to send should be retried without sending its messages again", func() {
+				sendMail = func(message *MailMessage) error {
+					return errors.New("smtp down")
+				}
+				SendDueDigests(now.Add(8 * 24 * time.Hour))
+				held, _ := a.Store.ListHeldMessagesForUser(user.ID)
+				So(len(held), ShouldEqual, 0)
+				deliveries, _ := a.Store.ListMessageDeliveriesForUser(user.ID)
+				So(deliveries[0].Kind, ShouldEqual, store.MessageKindDigest)
+				So(deliveries[0].Status, ShouldEqual, store.DeliveryStatusFailed)
+
+				sent = captureMail()
+				SendDueDigests(now.Add(9 * 24 * time.Hour))
+				So(len(*sent), ShouldEqual, 0)
+				RetryFailedDeliveries(deliveries[0].NextAttemptAt.Add(time.Second))
+				So(len(*sent), ShouldEqual, 1)
+				So((*sent)[0].Subject, ShouldEqual, "Sponsor-Hub digest: 2 updates")
+			})
+		})
+
+		Convey("Account mail should be sent straight away with the default frequency", func() {
+			survey.CommsFrequency = store.CommsFrequencyDefault
+			_, _ = a.Store.UpdateSurvey(survey, user.ID)
+			update, _ := notifyAt(user.ID, store.NotificationCategorySponsorship, "Update", "Suppressed", now)
+			account, _ := notifyAt(user.ID, store.NotificationCategoryAccount, "Account", "Sent", now)
+			So(update.Status, ShouldEqual, store.DeliveryStatusSuppressed)
+			So(account.Status, ShouldEqual, store.DeliveryStatusSent)
+			So(len(*sent), ShouldEqual, 1)
+			So((*sent)[0].Headers["List-Unsubscribe"], ShouldBeEmpty)
+		})
+
+		Convey("A user who never wants communications should have messages suppressed", func() {
+			survey.CommsFrequency = store.CommsFrequencyNever
+			_, _ = a.Store.UpdateSurvey(survey, user.ID)
+			delivery, _ := notifyAt(user.ID, store.NotificationCategoryReleases, "Release", "Notes", now)
+			So(delivery.Status, ShouldEqual, store.DeliveryStatusSuppressed)
+			So(len(*sent), ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+		})
+	})
+}
+
+func TestDataExport(t *testing.T) {
+	Convey("Given a user with a survey", t, func() {
+		sent := captureMail()
+		user := ensureTestUserExists("test-export@example.com")
+		ensureTestSurveyExists(user)
+
+		Convey("Generating an export should email a signed download link", func() {
+			export := store.DataExport{UserId: user.ID, Status: store.DataExportStatusPending}
+			_, _ = a.Store.InsertDataExport(&export)
+			generateDataExport(&export)
+			So(export.Status, ShouldEqual, store.DataExportStatusReady)
+			So(len(*sent), ShouldEqual, 1)
+
+			link := signedUrl(dataExportResource(export.ID), export.ExpiresAt)
+			So((*sent)[0].Text, ShouldContainSubstring, link)
+			path := strings.TrimPrefix(link, publicBaseUrl)
+
+			Convey("The download link should return a zip with JSON and CSV files", func() {
+				req, _ := http.NewRequest("GET", path, nil)
+				response := httptest.NewRecorder()
+				a.Router.ServeHTTP(response, req)
+				So(response.Code, ShouldEqual, http.StatusOK)
+
+				body := response.Body.Bytes()
+				zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+				So(err, ShouldBeNil)
+				var names []string
+				for _, f := range zipReader.File {
+					names = append(names, f.Name)
+				}
+				So(names, ShouldContain, "sponsor-hub-export.json")
+				So(names, ShouldContain, "surveys.csv")
+				So(names, ShouldContain, "consents.csv")
+			})
+
+			Convey("A developer's export should not reveal their sponsors' contact details", func() {
+				user.Permissions = store.UserPermissionsUser
+				_, _ = a.Store.UpdateUser(user)
+				sponsor := ensureTestUserExists("test-export-sponsor@example.com")
+				payment := store.PaymentEvent{Provider: store.PaymentProviderStripe, EventId: "export-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+					Action: store.PaymentActionRenewed, SponsorEmail: sponsor.Email, DeveloperEmail: user.Email, Money: store.Money{Amount: 100, Currency: "GBP"},
+					Payload: `{"customer_details":{"email":"test-export-sponsor@example.com"}}`}
+				So(a.Store.IngestPaymentEvent(&payment), ShouldBeNil)
+				data, err := a.Store.CollectUserData(user.ID)
+				So(err, ShouldBeNil)
+				exported, _ := json.Marshal(data.Payments)
+				So(string(exported), ShouldContainSubstring, payment.EventId)
+				So(string(exported), ShouldNotContainSubstring, sponsor.Email)
+				So(string(exported), ShouldNotContainSubstring, "customer_details")
+			})
+
+			Convey("A tampered download link should be rejected", func() {
+				req, _ := http.NewRequest("GET", strings.Replace(path, "signature=", "signature=x", 1), nil)
+				response := httptest.NewRecorder()
+				a.Router.ServeHTTP(response, req)
+				So(response.Code, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+		})
+	})
+}
+
+func postPaymentFixture(provider store.PaymentProvider, fixture string, eventId string, secret []byte) *httptest.ResponseRecorder {
+	body, err := ioutil.ReadFile("testdata/payments/" + fixture)
+	So(err, ShouldBeNil)
+	body = bytes.Replace(body, []byte("evt_1NG8Du2eZvKYlo2CzEb2bDxP"), []byte(eventId), 1)
+	req, err := NewPaymentWebhookRequest("/api/payments/webhooks/"+string(provider), provider, secret, body, eventId)
+	So(err, ShouldBeNil)
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+	return response
+}
+
+func TestPrivacyPolicyReconsent(t *testing.T) {
+	Convey("Given a user who consented under the default frequency", t, func() {
+		sent := captureMail()
+		user := ensureTestUserExists("test-reconsent@example.com")
+		survey := ensureTestSurveyExists(user)
+		survey.CommsFrequency = store.CommsFrequencyDefault
+		_, _ = a.Store.UpdateSurvey(survey, user.ID)
+		_, _ = a.Store.RecordConsent(user.ID, store.ConsentTypeDataSharing, true, "test")
+		mailedAbout := func(version string) int {
+			count := 0
+			for _, v := range *sent {
+				if v.To == user.Email && strings.Contains(v.Text, version) {
+					count++
+				}
+			}
+			return count
+		}
+
+		Convey("Publishing a new policy should email them on the next scheduler run", func() {
+			policy := store.PrivacyPolicy{Version: fmt.Sprintf("test-%d", time.Now().UnixNano()), PublishedAt: time.Now()}
+			_, _ = a.Store.InsertPrivacyPolicy(&policy)
+			SendDuePrivacyPolicyReconsents(time.Now())
+			So(mailedAbout(policy.Version), ShouldEqual, 1)
+
+			SendDuePrivacyPolicyReconsents(time.Now())
+			So(mailedAbout(policy.Version), ShouldEqual, 1)
+		})
+
+		Convey("A policy published in the future should wait until it takes effect", func() {
+			policy := store.PrivacyPolicy{Version: fmt.Sprintf("test-%d", time.Now().UnixNano()), PublishedAt: time.Now().Add(time.Hour)}
+			_, _ = a.Store.InsertPrivacyPolicy(&policy)
+			SendDuePrivacyPolicyReconsents(time.Now())
+			So(mailedAbout(policy.Version), ShouldEqual, 0)
+
+			SendDuePrivacyPolicyReconsents(time.Now().Add(2 * time.Hour))
+			So(mailedAbout(policy.Version), ShouldEqual, 1)
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+		})
+	})
+}
+
+func TestCampaignAnswerConsent(t *testing.T) {
+	Convey("Given a user who opted in to pre-release emails", t, func() {
+		user := ensureTestUserExists("test-campaign-consent@example.com")
+		_, _ = a.Store.RecordConsent(user.ID, store.ConsentTypePreReleaseEmails, true, "test")
+
+		Convey("Opting out in a campaign answer should not withdraw their consent", func() {
+			recordSurveyConsents(user.ID, &store.Survey{UserId: user.ID, CampaignId: 1, PreRelease: true},
+				&store.Survey{UserId: user.ID, CampaignId: 1})
+			So(a.Store.HasActiveConsent(user.ID, store.ConsentTypePreReleaseEmails), ShouldBeTrue)
+		})
+	})
+}
+
+func TestPaymentWebhooks(t *testing.T) {
+	Convey("Given a sponsor and a developer with verified GitHub handles", t, func() {
+		secret := []byte("test-webhook-secret")
+		a.PaymentSecrets[store.PaymentProviderGitHubSponsors] = secret
+		a.PaymentSecrets[store.PaymentProviderStripe] = secret
+		sponsor := ensureTestUserExists("payment-sponsor@example.com")
+		sponsorSurvey := ensureTestSurveyExists(sponsor)
+		developer := ensureTestUserExists("payment-developer@example.com")
+		developer.Permissions = store.UserPermissionsUser
+		_, _ = a.Store.UpdateUser(developer)
+		_ = a.Store.VerifyIdentity(developer.ID, store.IdentityProviderGitHub, "payment-developer", "test")
+		eventId := "delivery-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+		Convey("A handle only claimed in a survey should not be trusted", func() {
+			squatter := ensureTestUserExists("payment-squatter@example.com")
+			squatterSurvey := ensureTestSurveyExists(squatter)
+			squatterSurvey.GitHubId = "payment-sponsor"
+			_, _ = a.Store.UpdateSurvey(squatterSurvey, squatter.ID)
+			response := postPaymentFixture(store.PaymentProviderGitHubSponsors, "github-sponsorship-created.json", eventId, secret)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			unmatched, _ := a.Store.ListPaymentEvents(store.PaymentEventStatusUnmatched)
+			So(unmatched[0].EventId, ShouldEqual, eventId)
+			So(unmatched[0].Note, ShouldEqual, "sponsor github handle not verified")
+			_, err := a.Store.LoadSurveySponsor(squatterSurvey.ID, developer.ID)
+			So(err, ShouldNotBeNil)
+
+			Convey("Resolving it should verify the handle for later events", func() {
+				_, err := a.Store.ResolvePaymentEvent(unmatched[0].ID, sponsor.ID, developer.ID, developer.ID)
+				So(err, ShouldBeNil)
+				matched, err := a.Store.FindUserByVerifiedIdentity("", "Payment-Sponsor")
+				So(err, ShouldBeNil)
+				So(matched.ID, ShouldEqual, sponsor.ID)
+			})
+
+			Reset(func() {
+				squatterSurvey.GitHubId = ""
+				_, _ = a.Store.UpdateSurvey(squatterSurvey, squatter.ID)
+			})
+		})
+
+		Convey("A signed sponsorship event should create the sponsorship once", func() {
+			_ = a.Store.VerifyIdentity(sponsor.ID, store.IdentityProviderGitHub, "payment-sponsor", "test")
+			response := postPaymentFixture(store.PaymentProviderGitHubSponsors, "github-sponsorship-created.json", eventId, secret)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			surveySponsor, err := a.Store.LoadSurveySponsor(sponsorSurvey.ID, developer.ID)
+			So(err, ShouldBeNil)
+			So(surveySponsor.State, ShouldEqual, store.SponsorshipStateActive)
+			So(surveySponsor.Amount, ShouldEqual, 500)
+			So(surveySponsor.Currency, ShouldEqual, "USD")
+
+			response = postPaymentFixture(store.PaymentProviderGitHubSponsors, "github-sponsorship-created.json", eventId, secret)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(response.Body.String(), ShouldContainSubstring, "already processed")
+
+			Convey("A cancellation should end the sponsorship", func() {
+				response := postPaymentFixture(store.PaymentProviderGitHubSponsors, "github-sponsorship-cancelled.json", eventId+"-cancel", secret)
+				So(response.Code, ShouldEqual, http.StatusOK)
+				surveySponsor, _ := a.Store.LoadSurveySponsor(sponsorSurvey.ID, developer.ID)
+				So(surveySponsor.State, ShouldEqual, store.SponsorshipStateEnded)
+			})
+		})
+
+		Convey("A Stripe subscription should be receipted once, from its first invoice", func() {
+			subscriber := ensureTestUserExists("payment-stripe-subscriber@example.com")
+			previousReceipts, _ := a.Store.ListReceiptsForSponsor(subscriber.ID)
+			response := postPaymentFixture(store.PaymentProviderStripe, "stripe-checkout-session-subscription.json", eventId+"-checkout", secret)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			subscriberSurvey, err := a.Store.LoadSurveyForUser(subscriber.ID)
+			So(err, ShouldBeNil)
+			surveySponsor, err := a.Store.LoadSurveySponsor(subscriberSurvey.ID, developer.ID)
+			So(err, ShouldBeNil)
+			So(surveySponsor.State, ShouldEqual, store.SponsorshipStateActive)
+			So(surveySponsor.Recurrence, ShouldEqual, store.RecurrenceMonthly)
+			receipts, _ := a.Store.ListReceiptsForSponsor(subscriber.ID)
+			So(len(receipts), ShouldEqual, len(previousReceipts))
+
+			response = postPaymentFixture(store.PaymentProviderStripe, "stripe-invoice-paid-subscription-create.json", eventId+"-invoice", secret)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			surveySponsor, _ = a.Store.LoadSurveySponsor(subscriberSurvey.ID, developer.ID)
+			So(surveySponsor.Money, ShouldResemble, store.Money{Amount: 1500, Currency: "GBP"})
+			receipts, _ = a.Store.ListReceiptsForSponsor(subscriber.ID)
+			So(len(receipts), ShouldEqual, len(previousReceipts)+1)
+		})
+
+		Convey("A checkout that hasn't been paid yet should be ignored", func() {
+			body, err := ioutil.ReadFile("testdata/payments/stripe-checkout-session-completed.json")
+			So(err, ShouldBeNil)
+			body = bytes.Replace(body, []byte(`"payment_status": "paid"`), []byte(`"payment_status": "unpaid"`), 1)
+			event, err := stripeProvider{}.Parse(http.Header{}, body)
+			So(err, ShouldBeNil)
+			So(event.Action, ShouldEqual, store.PaymentActionIgnored)
+			So(event.Amount, ShouldEqual, 0)
+		})
+
+		Convey("An event signed with the wrong secret should be rejected", func() {
+			response := postPaymentFixture(store.PaymentProviderGitHubSponsors, "github-sponsorship-created.json", eventId, []byte("wrong"))
+			So(response.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("An event for an unknown sponsor should wait in the reconciliation queue", func() {
+			response := postPaymentFixture(store.PaymentProviderStripe, "stripe-invoice-paid-unmatched.json", eventId, secret)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			unmatched, _ := a.Store.ListPaymentEvents(store.PaymentEventStatusUnmatched)
+			So(len(unmatched), ShouldBeGreaterThan, 0)
+			So(unmatched[0].EventId, ShouldEqual, eventId)
+			So(unmatched[0].Note, ShouldEqual, "sponsor not found")
+
+			Convey("Resolving it should apply the payment to the chosen users", func() {
+				event, err := a.Store.ResolvePaymentEvent(unmatched[0].ID, sponsor.ID, developer.ID, developer.ID)
+				So(err, ShouldBeNil)
+				So(event.Status, ShouldEqual, store.PaymentEventStatusResolved)
+				surveySponsor, _ := a.Store.LoadSurveySponsor(sponsorSurvey.ID, developer.ID)
+				So(surveySponsor.State, ShouldEqual, store.SponsorshipStateActive)
+				So(surveySponsor.Currency, ShouldEqual, "EUR")
+			})
+		})
+
+		Reset(func() {
+			a.Store.PurgeVerifiedIdentitiesForUser(sponsor.ID)
+		})
+	})
+}
+
+func TestReceiptEmails(t *testing.T) {
+	Convey("Given a payment whose receipt email fails to send", t, func() {
+		a.Organisation.EmailReceipts = true
+		finance := ensureTestUserExists("test-receipt-finance@example.com")
+		sponsor := ensureTestUserExists("test-receipt-sponsor@example.com")
+		developer := ensureTestUserExists("test-receipt-developer@example.com")
+		survey := ensureTestSurveyExists(sponsor)
+		survey.CommsFrequency = store.CommsFrequencyAsItHappens
+		_, _ = a.Store.UpdateSurvey(survey, sponsor.ID)
+		a.Store.PurgeMessageDeliveriesForUser(sponsor.ID)
+		entry := store.LedgerEntry{Kind: store.LedgerEntryKindPayment, SponsorId: sponsor.ID, DeveloperId: developer.ID,
+			Money: store.Money{Amount: 500, Currency: "GBP"}, EffectiveDate: time.Now(), Reference: "BACS", RecordedBy: finance.ID}
+		entryId, err := a.Store.InsertLedgerEntry(&entry)
+		So(err, ShouldBeNil)
+		receipt, _ := a.Store.LoadReceiptForSource(store.ReceiptSourceLedger, entryId)
+		sendMail = func(message *MailMessage) error {
+			return errors.New("smtp unavailable")
+		}
+		emailReceiptForSource(store.ReceiptSourceLedger, entryId)
+
+		Convey("The failure should be recorded and retried until it is sent", func() {
+			deliveries, _ := a.Store.ListMessageDeliveriesForUser(sponsor.ID)
+			So(len(deliveries), ShouldEqual, 1)
+			So(deliveries[0].Status, ShouldEqual, store.DeliveryStatusFailed)
+			So(deliveries[0].ReceiptId, ShouldEqual, receipt.ID)
+			So(deliveries[0].NextAttemptAt, ShouldNotBeNil)
+
+			sent := captureMail()
+			RetryFailedDeliveries(time.Now())
+			So(len(*sent), ShouldEqual, 0)
+
+			RetryFailedDeliveries(deliveries[0].NextAttemptAt.Add(time.Second))
+			So(len(*sent), ShouldEqual, 1)
+			So((*sent)[0].Attachments[0].FileName, ShouldEqual, "receipt-"+receipt.Number+".pdf")
+			deliveries, _ = a.Store.ListMessageDeliveriesForUser(sponsor.ID)
+			So(deliveries[0].Status, ShouldEqual, store.DeliveryStatusSent)
+			So(deliveries[0].Attempts, ShouldEqual, 2)
+		})
+
+		Convey("A sponsor who only wants release emails should not be emailed receipts", func() {
+			survey.CommsFrequency = store.CommsFrequencyReleasesOnly
+			_, _ = a.Store.UpdateSurvey(survey, sponsor.ID)
+			sent := captureMail()
+			entry := store.LedgerEntry{Kind: store.LedgerEntryKindPayment, SponsorId: sponsor.ID, DeveloperId: developer.ID,
+				Money: store.Money{Amount: 700, Currency: "GBP"}, EffectiveDate: time.Now(), Reference: "BACS", RecordedBy: finance.ID}
+			entryId, _ := a.Store.InsertLedgerEntry(&entry)
+			emailReceiptForSource(store.ReceiptSourceLedger, entryId)
+			So(len(*sent), ShouldEqual, 0)
+			deliveries, _ := a.Store.ListMessageDeliveriesForUser(sponsor.ID)
+			So(deliveries[0].Status, ShouldEqual, store.DeliveryStatusSuppressed)
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+			a.Organisation.EmailReceipts = false
+		})
+	})
+}
+
+func TestFundingMilestoneEmails(t *testing.T) {
+	Convey("Given a developer who wants every update and a funding goal", t, func() {
+		sent := captureMail()
+		developer := ensureTestUserExists("test-milestone-developer@example.com")
+		developer.Permissions = store.UserPermissionsUser
+		_, _ = a.Store.UpdateUser(developer)
+		sponsor := ensureTestUserExists("test-milestone-sponsor@example.com")
+		for _, v := range []*store.User{developer, sponsor} {
+			survey := ensureTestSurveyExists(v)
+			survey.CommsFrequency = store.CommsFrequencyAsItHappens
+			_, _ = a.Store.UpdateSurvey(survey, v.ID)
+			a.Store.PurgeMessageDeliveriesForUser(v.ID)
+		}
+		goal := store.FundingGoal{UserId: developer.ID, Title: "Maintenance", Money: store.Money{Amount: 10000, Currency: "GBP"},
+			Milestones: []store.FundingMilestone{{Title: "Bug fixing", Amount: 1000}}}
+		_, _ = a.Store.InsertFundingGoal(&goal)
+		sponsorSurvey, err := a.Store.ReplaceSurveySponsors(sponsor.ID, 0, []store.SurveySponsor{{UserId: developer.ID,
+			Money: store.Money{Amount: 2000, Currency: "GBP"}, Recurrence: store.RecurrenceMonthly}})
+		So(err, ShouldBeNil)
+
+		Convey("Reaching a milestone should email the developer and their sponsors", func() {
+			checkFundingMilestonesAt(developer.ID, time.Now())
+			var recipients []string
+			for _, v := range *sent {
+				recipients = append(recipients, v.To)
+			}
+			So(recipients, ShouldContain, developer.Email)
+			So(recipients, ShouldContain, sponsor.Email)
+		})
+
+		Convey("A sponsor who never wants communications should not be emailed", func() {
+			survey := ensureTestSurveyExists(sponsor)
+			survey.CommsFrequency = store.CommsFrequencyNever
+			_, _ = a.Store.UpdateSurvey(survey, sponsor.ID)
+			checkFundingMilestonesAt(developer.ID, time.Now())
+			var recipients []string
+			for _, v := range *sent {
+				recipients = append(recipients, v.To)
+			}
+			So(recipients, ShouldContain, developer.Email)
+			So(recipients, ShouldNotContain, sponsor.Email)
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+			_, _ = a.Store.ReplaceSurveySponsors(sponsor.ID, sponsorSurvey.ID, nil)
+			_ = a.Store.DeleteFundingGoal(goal.ID)
+		})
+	})
+}
+
+func TestAnnouncements(t *testing.T) {
+	Convey("Given a subscriber to a release channel", t, func() {
+		sent := captureMail()
+		user := ensureTestUserExists("test-announcement@example.com")
+		channel := store.ReleaseChannel{Name: "test-announcements-" + strconv.FormatInt(time.Now().UnixNano(), 10), Platforms: "android"}
+		_, _ = a.Store.InsertReleaseChannel(&channel)
+		_ = a.Store.ReplaceChannelSubscriptions(user.ID, []store.ChannelSubscription{{ChannelId: channel.ID, Platform: "android"}})
+		_, _ = a.Store.RecordConsent(user.ID, store.ConsentTypePreReleaseEmails, true, "test")
+		announcement := store.Announcement{Subject: "Nightly 42", Markdown: "# Nightly 42\n\nFixes the *keyboard*.",
+			Audience: store.AnnouncementAudienceChannel, ChannelId: channel.ID, Platform: "android"}
+		So(announcement.Validate(), ShouldBeNil)
+		_, _ = a.Store.InsertAnnouncement(&announcement)
+
+		Convey("A scheduled announcement should be sent once it is due", func() {
+			now := time.Now()
+			So(a.Store.ScheduleAnnouncement(announcement.ID, now.Add(time.Hour)), ShouldBeNil)
+			SendDueAnnouncements(now)
+			So(len(*sent), ShouldEqual, 0)
+
+			SendDueAnnouncements(now.Add(2 * time.Hour))
+			So(len(*sent), ShouldEqual, 1)
+			message := (*sent)[0]
+			So(message.To, ShouldEqual, "test-announcement@example.com")
+			So(message.HTML, ShouldContainSubstring, "<h1>Nightly 42</h1>")
+			So(message.HTML, ShouldContainSubstring, "<em>keyboard</em>")
+			So(message.Headers["List-Unsubscribe"], ShouldContainSubstring, announcementUnsubscribeResource(announcement.ID, user.ID))
+			loaded, _ := a.Store.LoadAnnouncement(announcement.ID)
+			So(loaded.Status, ShouldEqual, store.AnnouncementStatusSent)
+			So(loaded.Deliveries[store.DeliveryStatusSent], ShouldEqual, 1)
+			deliveries, _ := a.Store.ListAnnouncementDeliveries(announcement.ID)
+			claimed, err := a.Store.ClaimAnnouncementDelivery(deliveries[0].ID)
+			So(err, ShouldBeNil)
+			So(claimed, ShouldBeFalse)
+
+			Convey("Opening the unsubscribe link should only show a confirmation page", func() {
+				link := strings.Trim(message.Headers["List-Unsubscribe"], "<>")
+				req, _ := http.NewRequest("GET", strings.TrimPrefix(link, publicBaseUrl), nil)
+				response := httptest.NewRecorder()
+				a.Router.ServeHTTP(response, req)
+				So(response.Code, ShouldEqual, http.StatusOK)
+				So(response.Body.String(), ShouldContainSubstring, "<form method=\"post\">")
+				subscriptions, _ := a.Store.ListChannelSubscriptionsForUser(user.ID)
+				So(len(subscriptions), ShouldEqual, 1)
+			})
+
+			Convey("The one-click unsubscribe link should remove the channel subscription", func() {
+				link := strings.Trim(message.Headers["List-Unsubscribe"], "<>")
+				req, _ := http.NewRequest("POST", strings.TrimPrefix(link, publicBaseUrl), strings.NewReader("List-Unsubscribe=One-Click"))
+				response := httptest.NewRecorder()
+				a.Router.ServeHTTP(response, req)
+				So(response.Code, ShouldEqual, http.StatusOK)
+				subscriptions, _ := a.Store.ListChannelSubscriptionsForUser(user.ID)
+				So(len(subscriptions), ShouldEqual, 0)
+				So(a.Store.HasGrantedConsent(user.ID, store.ConsentTypePreReleaseEmails), ShouldBeFalse)
+			})
+		})
+
+		Convey("A subscriber who never wants communications should not be emailed", func() {
+			_ = a.Store.UpdateNotificationPreferences(user.ID, &store.NotificationPreferences{Frequency: store.CommsFrequencyNever}, "test")
+			a.Store.PurgeMessageDeliveriesForUser(user.ID)
+			now := time.Now()
+			So(a.Store.ScheduleAnnouncement(announcement.ID, now), ShouldBeNil)
+			SendDueAnnouncements(now.Add(time.Minute))
+			So(len(*sent), ShouldEqual, 0)
+			loaded, _ := a.Store.LoadAnnouncement(announcement.ID)
+			So(loaded.Status, ShouldEqual, store.AnnouncementStatusSent)
+			So(loaded.Deliveries[store.DeliveryStatusSuppressed], ShouldEqual, 1)
+			deliveries, _ := a.Store.ListMessageDeliveriesForUser(user.ID)
+			So(len(deliveries), ShouldEqual, 1)
+			So(deliveries[0].Status, ShouldEqual, store.DeliveryStatusSuppressed)
+			_ = a.Store.UpdateNotificationPreferences(user.ID, &store.NotificationPreferences{Frequency: store.CommsFrequencyDefault}, "test")
+		})
+
+		Convey("Developer announcements should only go to users who opted in", func() {
+			developer := ensureTestUserExists("test-announcement-developer@example.com")
+			developer.Permissions = store.UserPermissionsUser
+			_, _ = a.Store.UpdateUser(developer)
+			isRecipient := func() bool {
+				recipients, _ := a.Store.ListAnnouncementRecipients(&store.Announcement{Audience: store.AnnouncementAudienceDevelopers})
+				for _, v := range recipients {
+					if v.ID == developer.ID {
+						return true
+					}
+				}
+				return false
+			}
+			optIn := func(enabled bool) {
+				_ = a.Store.UpdateNotificationPreferences(developer.ID, &store.NotificationPreferences{
+					Categories: map[store.NotificationCategory]bool{store.NotificationCategoryAnnouncements: enabled}}, "test")
+			}
+			optIn(false)
+			So(isRecipient(), ShouldBeFalse)
+			optIn(true)
+			So(isRecipient(), ShouldBeTrue)
+			optIn(false)
+		})
+
+		Convey("Only drafts should be editable", func() {
+			So(a.Store.ScheduleAnnouncement(announcement.ID, time.Now().Add(time.Hour)), ShouldBeNil)
+			announcement.Subject = "Changed"
+			_, err := a.Store.UpdateAnnouncement(&announcement)
+			So(err, ShouldEqual, store.ErrAnnouncementNotDraft)
+			So(a.Store.CancelAnnouncement(announcement.ID), ShouldBeNil)
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+			_ = a.Store.ReplaceChannelSubscriptions(user.ID, nil)
+			_ = a.Store.DeleteReleaseChannel(channel.ID)
+		})
+	})
+}
+
+func TestBuildDownloads(t *testing.T) {
+	Convey("Given a build registered on a release channel", t, func() {
+		user := ensureTestUserExists("test-build-download@example.com")
+		other := ensureTestUserExists("test-build-other@example.com")
+		a.BuildsDirectory, _ = ioutil.TempDir("", "builds")
+		_ = ioutil.WriteFile(filepath.Join(a.BuildsDirectory, "app-1.0.apk"), []byte("nightly build contents"), 0644)
+		channel := store.ReleaseChannel{Name: "test-builds-" + strconv.FormatInt(time.Now().UnixNano(), 10), Platforms: "android"}
+		_, _ = a.Store.InsertReleaseChannel(&channel)
+		_ = a.Store.ReplaceChannelSubscriptions(user.ID, []store.ChannelSubscription{{ChannelId: channel.ID, Platform: "android"}})
+		artifact := store.BuildArtifact{ChannelId: channel.ID, Platform: "android", Version: "1.0", StorageKey: "app-1.0.apk"}
+		So(artifact.Validate(), ShouldBeNil)
+		So(checksumBuildArtifact(&artifact), ShouldBeNil)
+		_, _ = a.Store.InsertBuildArtifact(&artifact)
+
+		Convey("A subscriber's signed link should stream the file and log the download", func() {
+			So(artifact.Size, ShouldEqual, int64(len("nightly build contents")))
+			link := signedUrl(buildDownloadResource(artifact.ID, user.ID), time.Now().Add(time.Hour))
+			req, _ := http.NewRequest("GET", strings.TrimPrefix(link, publicBaseUrl), nil)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(response.Body.String(), ShouldEqual, "nightly build contents")
+			So(response.Header().Get("Content-Disposition"), ShouldContainSubstring, "app-1.0.apk")
+			downloads, _ := a.Store.ListBuildDownloads(artifact.ID)
+			So(len(downloads), ShouldEqual, 1)
+			So(downloads[0].UserId, ShouldEqual, user.ID)
+			So(downloads[0].Bytes, ShouldEqual, artifact.Size)
+		})
+
+		Convey("A link signed for another user should be refused", func() {
+			link := signedUrl(buildDownloadResource(artifact.ID, user.ID), time.Now().Add(time.Hour))
+			link = strings.Replace(link, fmt.Sprintf("/users/%d/", user.ID), fmt.Sprintf("/users/%d/", other.ID), 1)
+			req, _ := http.NewRequest("GET", strings.TrimPrefix(link, publicBaseUrl), nil)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("A validly signed link for a user without a subscription should be refused", func() {
+			link := signedUrl(buildDownloadResource(artifact.ID, other.ID), time.Now().Add(time.Hour))
+			req, _ := http.NewRequest("GET", strings.TrimPrefix(link, publicBaseUrl), nil)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("An expired link should be refused", func() {
+			link := signedUrl(buildDownloadResource(artifact.ID, user.ID), time.Now().Add(-time.Minute))
+			req, _ := http.NewRequest("GET", strings.TrimPrefix(link, publicBaseUrl), nil)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Reset(func() {
+			_ = a.Store.DeleteBuildArtifact(artifact.ID)
+			_ = a.Store.ReplaceChannelSubscriptions(user.ID, nil)
+			_ = a.Store.DeleteReleaseChannel(channel.ID)
+			_ = os.RemoveAll(a.BuildsDirectory)
+		})
+	})
+}
+
+func TestTestReports(t *testing.T) {
+	Convey("Given reports from testers of a build", t, func() {
+		sent := captureMail()
+		tester := ensureTestUserExists("test-tester@example.com")
+		otherTester := ensureTestUserExists("test-other-tester@example.com")
+		survey := ensureTestSurveyExists(otherTester)
+		survey.CommsFrequency = store.CommsFrequencyAsItHappens
+		_, _ = a.Store.UpdateSurvey(survey, otherTester.ID)
+		a.Store.PurgeMessageDeliveriesForUser(otherTester.ID)
+		artifact := store.BuildArtifact{ChannelId: 1, Platform: "android", Version: "2.0-rc1", StorageKey: "app-2.0-rc1.apk"}
+		_, _ = a.Store.InsertBuildArtifact(&artifact)
+		works := store.TestReport{ArtifactId: artifact.ID, UserId: tester.ID, Verdict: store.TestVerdictWorks, Device: "Pixel 7"}
+		broken := store.TestReport{ArtifactId: artifact.ID, UserId: otherTester.ID, Verdict: store.TestVerdictBroken, Device: "pixel 7",
+			Description: "Crashes on *launch*"}
+		So(works.Validate(), ShouldBeNil)
+		So(broken.Validate(), ShouldBeNil)
+		_, _ = a.Store.InsertTestReport(&works)
+		_, _ = a.Store.InsertTestReport(&broken)
+
+		Convey("The build summary should count verdicts per device", func() {
+			summary, err := a.Store.TestReportSummaryForBuild(&artifact)
+			So(err, ShouldBeNil)
+			So(summary.Reports, ShouldEqual, 2)
+			So(summary.Testers, ShouldEqual, 2)
+			So(summary.Broken, ShouldEqual, 1)
+			So(summary.Statuses[store.TestReportStatusNew], ShouldEqual, 2)
+			So(len(summary.Devices), ShouldEqual, 1)
+			So(summary.Devices[0].Works, ShouldEqual, 1)
+			So(summary.Devices[0].Broken, ShouldEqual, 1)
+		})
+
+		Convey("A status change should notify the reporter once", func() {
+			changed, err := a.Store.UpdateTestReportStatus(broken.ID, store.TestReportStatusFixed)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+			broken.Status = store.TestReportStatusFixed
+			notifyTestReportStatus(&broken)
+			So(len(*sent), ShouldEqual, 1)
+			So((*sent)[0].To, ShouldEqual, "test-other-tester@example.com")
+			So((*sent)[0].Subject, ShouldEqual, "Your report on build 2.0-rc1 is now fixed")
+			changed, _ = a.Store.UpdateTestReportStatus(broken.ID, store.TestReportStatusFixed)
+			So(changed, ShouldBeFalse)
+		})
+
+		Convey("A report should accept a limited number of attachments", func() {
+			for i := 0; i < store.TestReportAttachmentsMax; i++ {
+				_, err := a.Store.InsertTestReportAttachment(&store.TestReportAttachment{ReportId: broken.ID, FileName: "log.txt", Size: 3, Data: []byte("log")})
+				So(err, ShouldBeNil)
+			}
+			_, err := a.Store.InsertTestReportAttachment(&store.TestReportAttachment{ReportId: broken.ID, FileName: "log.txt", Size: 3, Data: []byte("log")})
+			So(err, ShouldEqual, store.ErrTooManyAttachments)
+			loaded, _ := a.Store.LoadTestReport(broken.ID)
+			So(len(loaded.Attachments), ShouldEqual, store.TestReportAttachmentsMax)
+			So(len(loaded.Attachments[0].Data), ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+			_ = a.Store.DeleteBuildArtifact(artifact.ID)
+		})
+	})
+}
+
+func gzipped(text string) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, _ = writer.Write([]byte(text))
+	_ = writer.Close()
+	return buf.Bytes()
+}
+
+func TestCrashIngestion(t *testing.T) {
+	Convey("Given a tester's device token for a build they are subscribed to", t, func() {
+		tester := ensureTestUserExists("test-crash-tester@example.com")
+		channel := store.ReleaseChannel{Name: "test-crashes-" + strconv.FormatInt(time.Now().UnixNano(), 10)}
+		_, _ = a.Store.InsertReleaseChannel(&channel)
+		_ = a.Store.ReplaceChannelSubscriptions(tester.ID, []store.ChannelSubscription{{ChannelId: channel.ID}})
+		artifact := store.BuildArtifact{ChannelId: channel.ID, Version: "3.0-beta", StorageKey: "app-3.0-beta.apk"}
+		_, _ = a.Store.InsertBuildArtifact(&artifact)
+		token := RandomKey(32)
+		deviceToken := store.DeviceToken{UserId: tester.ID, Name: "Pixel 8", TokenHash: store.HashDeviceToken(token)}
+		_, _ = a.Store.InsertDeviceToken(&deviceToken)
+		upload := func(token string, kind string, body []byte) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("POST", fmt.Sprintf("/api/builds/%d/uploads?kind=%s", artifact.ID, kind), bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			return response
+		}
+
+		Convey("Crashes with the same stack should be grouped whatever their addresses", func() {
+			So(upload(token, "crash", gzipped("SIGSEGV in render\n#0 0x7f3a1c render() at view.cpp:120\n#1 0x7f3a2d main()\n")).Code, ShouldEqual, http.StatusCreated)
+			So(upload(token, "crash", gzipped("SIGSEGV in render\n#0 0x7f99aa render() at view.cpp:121\n#1 0x7f99bb main()\n")).Code, ShouldEqual, http.StatusCreated)
+			So(upload(token, "crash", gzipped("SIGABRT in decode\n#0 0x7f3a1c decode() at codec.cpp:9\n")).Code, ShouldEqual, http.StatusCreated)
+			groups, _ := a.Store.ListCrashGroupsForBuild(artifact.ID)
+			So(len(groups), ShouldEqual, 2)
+			So(groups[0].Count, ShouldEqual, 2)
+			So(groups[0].Samples, ShouldEqual, 2)
+			So(groups[0].Title, ShouldEqual, "SIGSEGV in render")
+			uploads, _ := a.Store.ListCrashUploadsForGroup(groups[0].ID)
+			So(len(uploads), ShouldEqual, 2)
+			So(uploads[0].Device, ShouldEqual, "Pixel 8")
+
+			Convey("Uploads past retention should be removed leaving the group counts", func() {
+				ExpireCrashUploads(time.Now().Add(crashUploadRetention + time.Hour))
+				group, _ := a.Store.LoadCrashGroup(groups[0].ID)
+				So(group.Count, ShouldEqual, 2)
+				So(group.Samples, ShouldEqual, 0)
+			})
+		})
+
+		Convey("Crashes past the sample limit should be counted but not reported as stored", func() {
+			for i := 0; i < store.CrashSamplesPerGroup; i++ {
+				So(upload(token, "crash", gzipped("SIGBUS in paint\n#0 0x7f3a1c paint()\n")).Code, ShouldEqual, http.StatusCreated)
+			}
+			response := upload(token, "crash", gzipped("SIGBUS in paint\n#0 0x7f3a1c paint()\n"))
+			So(response.Code, ShouldEqual, http.StatusAccepted)
+			So(response.Body.String(), ShouldContainSubstring, fmt.Sprintf(`"count":%d`, store.CrashSamplesPerGroup+1))
+			groups, _ := a.Store.ListCrashGroupsForBuild(artifact.ID)
+			So(groups[0].Count, ShouldEqual, store.CrashSamplesPerGroup+1)
+			So(groups[0].Samples, ShouldEqual, store.CrashSamplesPerGroup)
+		})
+
+		Convey("Log bundles should be kept per device, newest first up to a limit", func() {
+			for i := 0; i <= store.CrashLogBundlesPerDevice; i++ {
+				So(upload(token, "log", gzipped(fmt.Sprintf("log line %d", i))).Code, ShouldEqual, http.StatusCreated)
+			}
+			otherToken := RandomKey(32)
+			otherDevice := store.DeviceToken{UserId: tester.ID, Name: "Pixel 8", TokenHash: store.HashDeviceToken(otherToken)}
+			_, _ = a.Store.InsertDeviceToken(&otherDevice)
+			So(upload(otherToken, "log", gzipped("log line")).Code, ShouldEqual, http.StatusCreated)
+			groups, _ := a.Store.ListCrashGroupsForBuild(artifact.ID)
+			So(len(groups), ShouldEqual, 2)
+			So(groups[0].Count, ShouldEqual, store.CrashLogBundlesPerDevice+1)
+			So(groups[0].Samples, ShouldEqual, store.CrashLogBundlesPerDevice)
+			So(groups[0].Title, ShouldEqual, fmt.Sprintf("Log bundles from Pixel 8 #%d", deviceToken.ID))
+			uploads, _ := a.Store.ListCrashUploadsForGroup(groups[0].ID)
+			So(len(uploads), ShouldEqual, store.CrashLogBundlesPerDevice)
+			newest, _ := a.Store.LoadCrashUpload(uploads[0].ID)
+			So(newest.Data, ShouldResemble, gzipped(fmt.Sprintf("log line %d", store.CrashLogBundlesPerDevice)))
+			_ = a.Store.DeleteDeviceToken(tester.ID, otherDevice.ID)
+		})
+
+		Convey("Uncompressed crashes and unknown tokens should be refused", func() {
+			So(upload(token, "crash", []byte("SIGSEGV")).Code, ShouldEqual, http.StatusBadRequest)
+			So(upload("not-a-token", "crash", gzipped("SIGSEGV")).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Reset(func() {
+			_ = a.Store.DeleteDeviceToken(tester.ID, deviceToken.ID)
+			_ = a.Store.DeleteBuildArtifact(artifact.ID)
+			_ = a.Store.ReplaceChannelSubscriptions(tester.ID, nil)
+			_ = a.Store.DeleteReleaseChannel(channel.ID)
+		})
+	})
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	Convey("Given a user receiving testing notifications", t, func() {
+		sent := captureMail()
+		user := ensureTestUserExists("test-preferences@example.com")
+		survey := ensureTestSurveyExists(user)
+		survey.CommsFrequency = store.CommsFrequencyAsItHappens
+		_, _ = a.Store.UpdateSurvey(survey, user.ID)
+		a.Store.PurgeMessageDeliveriesForUser(user.ID)
+		delivery, _ := Notify(user.ID, store.NotificationCategoryTesting, "Report fixed", "Your report was fixed")
+		So(delivery.Status, ShouldEqual, store.DeliveryStatusSent)
+		So(len(*sent), ShouldEqual, 1)
+		message := (*sent)[0]
+		So(message.Headers["List-Unsubscribe-Post"], ShouldEqual, "List-Unsubscribe=One-Click")
+		link := strings.TrimPrefix(strings.Trim(message.Headers["List-Unsubscribe"], "<>"), publicBaseUrl)
+		So(link, ShouldContainSubstring, unsubscribeResource(user.ID, store.NotificationCategoryTesting))
+
+		Convey("Opening the link should only show a confirmation page", func() {
+			req, _ := http.NewRequest("GET", link, nil)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(a.Store.AllowsNotification(user.ID, store.NotificationCategoryTesting), ShouldBeTrue)
+		})
+
+		Convey("A one-click POST should turn the category off without a login", func() {
+			req, _ := http.NewRequest("POST", link, strings.NewReader("List-Unsubscribe=One-Click"))
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			preferences, _ := a.Store.LoadNotificationPreferences(user.ID)
+			So(preferences.Categories[store.NotificationCategoryTesting], ShouldBeFalse)
+			So(preferences.Categories[store.NotificationCategorySponsorship], ShouldBeTrue)
+			delivery, _ := Notify(user.ID, store.NotificationCategoryTesting, "Report closed", "Your report was closed")
+			So(delivery.Status, ShouldEqual, store.DeliveryStatusSuppressed)
+			So(len(*sent), ShouldEqual, 1)
+		})
+
+		Convey("Saving a frequency should create the survey it is stored on when missing", func() {
+			a.Store.PurgeUser("test-preferences-new@example.com")
+			newUser := ensureTestUserExists("test-preferences-new@example.com")
+			err := a.Store.UpdateNotificationPreferences(newUser.ID, &store.NotificationPreferences{
+				Frequency: store.CommsFrequencyWeekly}, "test")
+			So(err, ShouldBeNil)
+			So(a.Store.LoadCommsFrequencyForUser(newUser.ID), ShouldEqual, store.CommsFrequencyWeekly)
+		})
+
+		Convey("A link signed for one category should not unsubscribe from another", func() {
+			tampered := strings.Replace(link, "/testing?", "/all?", 1)
+			req, _ := http.NewRequest("POST", tampered, strings.NewReader("List-Unsubscribe=One-Click"))
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+			_ = a.Store.UpdateNotificationPreferences(user.ID, &store.NotificationPreferences{
+				Categories: map[store.NotificationCategory]bool{store.NotificationCategoryTesting: true}}, "test")
+		})
+	})
+}
+
+func TestInbox(t *testing.T) {
+	Convey("Given notifications for a user who gets few emails", t, func() {
+		sent := captureMail()
+		user := ensureTestUserExists("test-inbox@example.com")
+		survey := ensureTestSurveyExists(user)
+		survey.CommsFrequency = store.CommsFrequencyNever
+		_, _ = a.Store.UpdateSurvey(survey, user.ID)
+		_, _ = a.Store.MarkAllInboxNotificationsRead(user.ID, store.NotificationCategoryAll, time.Now())
+		_, _ = Notify(user.ID, store.NotificationCategorySponsorship, "New sponsor", "Someone sponsors you")
+		_, _ = Notify(user.ID, store.NotificationCategoryTesting, "Report fixed", "Your report was fixed")
+		_, _ = Notify(user.ID, store.NotificationCategoryTesting, "Report closed", "Your report was closed")
+
+		Convey("Every notification should be in the inbox even when not emailed", func() {
+			So(len(*sent), ShouldEqual, 0)
+			count, err := a.Store.InboxUnreadCountForUser(user.ID)
+			So(err, ShouldBeNil)
+			So(count.Unread, ShouldEqual, 3)
+			So(count.Categories[store.NotificationCategoryTesting], ShouldEqual, 2)
+			unread, _ := a.Store.ListInboxNotifications(user.ID, true, 0)
+			So(len(unread), ShouldEqual, 3)
+			So(unread[0].Title, ShouldEqual, "Report closed")
+		})
+
+		Convey("Notifications can be marked read singly or by category", func() {
+			unread, _ := a.Store.ListInboxNotifications(user.ID, true, 0)
+			marked, err := a.Store.MarkInboxNotificationRead(user.ID, unread[2].ID, time.Now())
+			So(err, ShouldBeNil)
+			So(marked, ShouldBeTrue)
+			marked, _ = a.Store.MarkInboxNotificationRead(user.ID+1, unread[1].ID, time.Now())
+			So(marked, ShouldBeFalse)
+			count, _ := a.Store.MarkAllInboxNotificationsRead(user.ID, store.NotificationCategoryTesting, time.Now())
+			So(count, ShouldEqual, 2)
+			unreadCount, _ := a.Store.InboxUnreadCountForUser(user.ID)
+			So(unreadCount.Unread, ShouldEqual, 0)
+		})
+
+		Convey("The API should 404 for notifications that aren't theirs and mark all read separately", func() {
+			token := userTokenFromLoginResponse(loginToUser(user.Email))
+			post := func(path string) int {
+				req, _ := http.NewRequest("POST", fmt.Sprintf("/api/users/%d/inbox/%s", user.ID, path), nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				response := httptest.NewRecorder()
+				a.Router.ServeHTTP(response, req)
+				return response.Code
+			}
+			unread, _ := a.Store.ListInboxNotifications(user.ID, true, 0)
+			So(post(uintToString(unread[0].ID)+"/read"), ShouldEqual, http.StatusOK)
+			So(post(uintToString(unread[0].ID)+"/read"), ShouldEqual, http.StatusOK)
+			So(post("0/read"), ShouldEqual, http.StatusNotFound)
+			So(post("read-all"), ShouldEqual, http.StatusOK)
+			unreadCount, _ := a.Store.InboxUnreadCountForUser(user.ID)
+			So(unreadCount.Unread, ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			sendMail = smtpSendMail
+		})
+	})
+}
+
+func TestLiveEvents(t *testing.T) {
+	Convey("Given a user subscribed to live events", t, func() {
+		user := ensureTestUserExists("test-live-events@example.com")
+		events := liveEvents.subscribe(user.ID)
+
+		Convey("New notifications should be pushed to them but not to others", func() {
+			other := liveEvents.subscribe(user.ID + 1)
+			defer liveEvents.unsubscribe(user.ID+1, other)
+			addToInbox(user.ID, store.NotificationCategoryTesting, "Report fixed", "Your report was fixed")
+			select {
+			case event := <-events:
+				So(event.Type, ShouldEqual, LiveEventNotification)
+				So(string(event.Data), ShouldContainSubstring, "Report fixed")
+			case <-time.After(time.Second):
+				So("no event", ShouldBeEmpty)
+			}
+			So(len(other), ShouldEqual, 0)
+		})
+
+		Convey("A signed link should stream events to a browser", func() {
+			server := httptest.NewServer(a.Router)
+			defer server.Close()
+			link := strings.TrimPrefix(signedUrl(liveEventsResource(user.ID), time.Now().Add(liveEventsLinkValidFor)), publicBaseUrl)
+			response, err := http.Get(server.URL + link)
+			So(err, ShouldBeNil)
+			defer response.Body.Close()
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			So(response.Header.Get("Content-Type"), ShouldStartWith, "text/event-stream")
+			publishLiveEvent(user.ID, LiveEventSponsorAdded, gin.H{"SurveyId": 1, "DeveloperId": user.ID})
+			buffer := make([]byte, 512)
+			read, _ := response.Body.Read(buffer)
+			So(string(buffer[:read]), ShouldContainSubstring, "event:"+LiveEventSponsorAdded)
+
+			response2, _ := http.Get(server.URL + "/api/events/users/" + uintToString(user.ID+1) + link[strings.Index(link, "?"):])
+			So(response2.StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		Reset(func() {
+			liveEvents.unsubscribe(user.ID, events)
+		})
+	})
+}
+
+func decryptPushPayload(body []byte, userAgentKey *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	salt, keyLength := body[:16], int(body[20])
+	serverKey, err := ecdh.P256().NewPublicKey(body[21 : 21+keyLength])
+	if err != nil {
+		return nil, err
+	}
+	shared, _ := userAgentKey.ECDH(serverKey)
+	keyInfo := append(append([]byte("WebPush: info\x00"), userAgentKey.PublicKey().Bytes()...), body[21:21+keyLength]...)
+	inputKey := hkdfBytes(shared, authSecret, keyInfo, 32)
+	block, _ := aes.NewCipher(hkdfBytes(inputKey, salt, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, hkdfBytes(inputKey, salt, []byte("Content-Encoding: nonce\x00"), 12), body[21+keyLength:], nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(plaintext, []byte{2}), nil
+}
+
+func TestWebPushEncryption(t *testing.T) {
+	Convey("Given the RFC 8291 example keys and salt", t, func() {
+		serverPrivate, _ := base64.RawURLEncoding.DecodeString("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+		serverKey, err := ecdh.P256().NewPrivateKey(serverPrivate)
+		So(err, ShouldBeNil)
+		salt, _ := base64.RawURLEncoding.DecodeString("DGv6ra1nlYgDCS1FRnbzlw")
+		subscription := store.PushSubscription{
+			P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+			Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+		}
+
+		Convey("The encrypted message should match the one in the RFC", func() {
+			body, err := encryptPushPayloadWith(&subscription, []byte("When I grow up, I want to be a watermelon"), serverKey, salt)
+			So(err, ShouldBeNil)
+			So(base64.RawURLEncoding.EncodeToString(body), ShouldEqual, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+		})
+	})
+}
+
+func TestWebPush(t *testing.T) {
+	Convey("Given a user with a browser subscribed to push", t, func() {
+		user := ensureTestUserExists("test-push@example.com")
+		_ = a.Store.UpdateNotificationPreferences(user.ID, &store.NotificationPreferences{
+			Push: map[store.NotificationCategory]bool{store.NotificationCategoryTesting: true},
+		}, "test")
+		userAgentKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+		authSecret := []byte("0123456789abcdef")
+		status := http.StatusCreated
+		var received [][]byte
+		var authorizations []string
+		pushService := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received = append(received, body)
+			authorizations = append(authorizations, r.Header.Get("Authorization"))
+			w.WriteHeader(status)
+		}))
+		pushClient, pushServiceHosts := a.PushClient, a.PushServiceHosts
+		a.PushClient = pushService.Client()
+		a.PushServiceHosts = append(append([]string{}, pushServiceHosts...), "127.0.0.1")
+		subscription := store.PushSubscription{
+			UserId:   user.ID,
+			Endpoint: pushService.URL + "/push/" + uintToString(user.ID),
+			P256dh:   base64.RawURLEncoding.EncodeToString(userAgentKey.PublicKey().Bytes()),
+			Auth:     base64.RawURLEncoding.EncodeToString(authSecret),
+		}
+		So(subscription.Validate(a.PushServiceHosts), ShouldBeNil)
+		_, err := a.Store.SavePushSubscription(&subscription)
+		So(err, ShouldBeNil)
+
+		Convey("Notifications should be encrypted for the browser and signed with the VAPID key", func() {
+			pushToUser(user.ID, PushPayload{ID: 1, Category: store.NotificationCategoryTesting, Title: "Report fixed", Body: "Your report was fixed"})
+			So(len(received), ShouldEqual, 1)
+			plaintext, err := decryptPushPayload(received[0], userAgentKey, authSecret)
+			So(err, ShouldBeNil)
+			payload := PushPayload{}
+			_ = json.Unmarshal(plaintext, &payload)
+			So(payload.Title, ShouldEqual, "Report fixed")
+
+			So(authorizations[0], ShouldStartWith, "vapid t=")
+			token := strings.TrimPrefix(strings.Split(authorizations[0], ", k=")[0], "vapid t=")
+			parts := strings.Split(token, ".")
+			So(len(parts), ShouldEqual, 3)
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			valid := ecdsa.Verify(&a.VapidKey.PublicKey, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+			So(valid, ShouldBeTrue)
+			So(strings.Split(authorizations[0], ", k=")[1], ShouldEqual, vapidPublicKey())
+		})
+
+		Convey("Categories turned off for push should not be sent", func() {
+			_ = a.Store.UpdateNotificationPreferences(user.ID, &store.NotificationPreferences{
+				Push: map[store.NotificationCategory]bool{store.NotificationCategoryTesting: false},
+			}, "test")
+			pushToUser(user.ID, PushPayload{Category: store.NotificationCategoryTesting, Title: "Report closed"})
+			So(len(received), ShouldEqual, 0)
+		})
+
+		Convey("Subscriptions the push service reports gone should be removed", func() {
+			status = http.StatusGone
+			pushToUser(user.ID, PushPayload{Category: store.NotificationCategoryTesting, Title: "Report closed"})
+			So(len(received), ShouldEqual, 1)
+			subscriptions, _ := a.Store.ListPushSubscriptionsForUser(user.ID)
+			So(len(subscriptions), ShouldEqual, 0)
+		})
+
+		Convey("Endpoints outside the known push services should be refused", func() {
+			for _, endpoint := range []string{"https://169.254.169.254/latest/meta-data", "https://fcm.googleapis.com.example.com/push", "http://fcm.googleapis.com/fcm/send/1"} {
+				invalid := subscription
+				invalid.Endpoint = endpoint
+				So(invalid.Validate(a.PushServiceHosts), ShouldNotBeNil)
+				So(sendPush(&invalid, []byte("{}"), time.Now()), ShouldNotBeNil)
+			}
+			valid := subscription
+			valid.Endpoint = "https://fcm.googleapis.com/fcm/send/1"
+			So(valid.Validate(a.PushServiceHosts), ShouldBeNil)
+			So(len(received), ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			pushService.Close()
+			a.PushClient, a.PushServiceHosts = pushClient, pushServiceHosts
+			_ = a.Store.DeletePushSubscriptionByEndpoint(subscription.Endpoint)
+		})
+	})
+}
+
+func TestUserRegisteredOnConfirmation(t *testing.T) {
+	Convey("Given a webhook subscribed to user registrations", t, func() {
+		now := time.Now()
+		for fannedOut, _ := a.Store.FanOutOutboxEvents(now); fannedOut > 0; fannedOut, _ = a.Store.FanOutOutboxEvents(now) {
+		}
+		var received []*http.Request
+		integration := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = append(received, r)
+		}))
+		endpoint := store.WebhookEndpoint{Url: integration.URL + "/hooks", EventTypes: string(store.WebhookEventUserRegistered), Secret: RandomKey(32), Active: true}
+		_, _ = a.Store.InsertWebhookEndpoint(&endpoint)
+		sent := captureMail()
+		const emailAddress = "test-webhook-confirm@example.com"
+		a.Store.PurgeUser(emailAddress)
+
+		Convey("A user registering should only be announced once they confirm their email", func() {
+			data, _ := json.Marshal(RegisterJSON{Email: emailAddress, Password: "1234", PasswordConfirmation: "1234"})
+			req, _ := http.NewRequest("POST", "/api/auth/register", bytes.NewReader(data))
+			req.Header.Set("Content-Type", "application/json")
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			DeliverWebhooks(now)
+			So(len(received), ShouldEqual, 0)
+
+			So(len(*sent), ShouldEqual, 1)
+			text := (*sent)[0].Text
+			confirmUrl := text[strings.Index(text, "/api/auth/confirm_email?"):]
+			confirmUrl = confirmUrl[:strings.Index(confirmUrl, "\r\n")]
+			req, _ = http.NewRequest("GET", confirmUrl, nil)
+			response = httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, 307)
+			DeliverWebhooks(now)
+			So(len(received), ShouldEqual, 1)
+		})
+
+		Reset(func() {
+			integration.Close()
+			_ = a.Store.DeleteWebhookEndpoint(endpoint.ID)
+			a.Store.PurgeUser(emailAddress)
+		})
+	})
+}
+
+func TestOutboundWebhooks(t *testing.T) {
+	Convey("Given a webhook subscribed to user registrations", t, func() {
+		now := time.Now()
+		for fannedOut, _ := a.Store.FanOutOutboxEvents(now); fannedOut > 0; fannedOut, _ = a.Store.FanOutOutboxEvents(now) {
+		}
+		status := http.StatusOK
+		var received []*http.Request
+		var bodies [][]byte
+		integration := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received = append(received, r)
+			bodies = append(bodies, body)
+			w.WriteHeader(status)
+		}))
+		endpoint := store.WebhookEndpoint{Url: integration.URL + "/hooks", EventTypes: string(store.WebhookEventUserRegistered), Secret: RandomKey(32), Active: true}
+		So(endpoint.Validate(), ShouldBeNil)
+		_, _ = a.Store.InsertWebhookEndpoint(&endpoint)
+		a.Store.PurgeUser("test-webhook-registered@example.com")
+		user := store.User{}
+		user.Email = "test-webhook-registered@example.com"
+		_, err := a.Store.InsertUser(&user, store.NewOutboxEvent(store.WebhookEventUserRegistered, &user.PublicUser))
+		So(err, ShouldBeNil)
+
+		Convey("The registration should be delivered once and signed with the webhook secret", func() {
+			DeliverWebhooks(now)
+			So(len(received), ShouldEqual, 1)
+			So(received[0].Header.Get("X-Sponsor-Hub-Event"), ShouldEqual, string(store.WebhookEventUserRegistered))
+			signature := strings.Split(received[0].Header.Get("X-Sponsor-Hub-Signature"), ",")
+			So(len(signature), ShouldEqual, 2)
+			timestamp := strings.TrimPrefix(signature[0], "t=")
+			unix, err := strconv.ParseInt(timestamp, 10, 64)
+			So(err, ShouldBeNil)
+			So(unix, ShouldBeBetweenOrEqual, now.Unix(), now.Unix()+1)
+			mac := hmac.New(sha256.New, []byte(endpoint.Secret))
+			mac.Write([]byte(timestamp + "."))
+			mac.Write(bodies[0])
+			So(signature[1], ShouldEqual, "v1="+hex.EncodeToString(mac.Sum(nil)))
+			payload := WebhookPayload{}
+			_ = json.Unmarshal(bodies[0], &payload)
+			registered := store.PublicUser{}
+			_ = json.Unmarshal(payload.Data, &registered)
+			So(registered.ID, ShouldEqual, user.ID)
+			So(received[0].Header.Get("X-Sponsor-Hub-Delivery"), ShouldEqual, uintToString(payload.DeliveryId))
+
+			DeliverWebhooks(now.Add(time.Minute))
+			So(len(received), ShouldEqual, 1)
+
+			Convey("Admins can redeliver it from the delivery log", func() {
+				deliveries, _ := a.Store.ListWebhookDeliveries(endpoint.ID)
+				So(len(deliveries), ShouldEqual, 1)
+				So(deliveries[0].Status, ShouldEqual, store.WebhookDeliveryDelivered)
+				_, err := a.Store.RedeliverWebhook(endpoint.ID, deliveries[0].ID, now)
+				So(err, ShouldBeNil)
+				DeliverWebhooks(now)
+				So(len(received), ShouldEqual, 2)
+			})
+		})
+
+		Convey("A claimed delivery should not be claimed again while it is being sent", func() {
+			_, _ = a.Store.FanOutOutboxEvents(now)
+			delivery, err := a.Store.ClaimDueWebhookDelivery(now, webhookDeliveryLease)
+			So(err, ShouldBeNil)
+			So(delivery, ShouldNotBeNil)
+			again, err := a.Store.ClaimDueWebhookDelivery(now.Add(webhookDeliveryLease/2), webhookDeliveryLease)
+			So(err, ShouldBeNil)
+			So(again, ShouldBeNil)
+			DeliverWebhooks(now)
+			So(len(received), ShouldEqual, 0)
+		})
+
+		Convey("Failed deliveries should be retried with exponential backoff", func() {
+			status = http.StatusInternalServerError
+			DeliverWebhooks(now)
+			So(len(received), ShouldEqual, 1)
+			deliveries, _ := a.Store.ListWebhookDeliveries(endpoint.ID)
+			So(deliveries[0].Status, ShouldEqual, store.WebhookDeliveryPending)
+			So(deliveries[0].Attempts, ShouldEqual, 1)
+			So(deliveries[0].ResponseStatus, ShouldEqual, http.StatusInternalServerError)
+
+			DeliverWebhooks(now.Add(30 * time.Second))
+			So(len(received), ShouldEqual, 1)
+			DeliverWebhooks(now.Add(store.WebhookRetryDelay(1)))
+			So(len(received), ShouldEqual, 2)
+			So(store.WebhookRetryDelay(2), ShouldEqual, 2*store.WebhookRetryDelay(1))
+			DeliverWebhooks(now.Add(store.WebhookRetryDelay(1) + time.Minute))
+			So(len(received), ShouldEqual, 2)
+		})
+
+		Reset(func() {
+			integration.Close()
+			_ = a.Store.DeleteWebhookEndpoint(endpoint.ID)
+			a.Store.PurgeUser(user.Email)
+		})
+	})
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const publicBaseUrl = "https://gemian.thinkglobally.org/sponsor-hub"
+
+const linkSecretFileName = "link_secret.txt"
+
+func readLinkKey() []byte {
+	secret, err := ioutil.ReadFile(linkSecretFileName)
+	if err != nil {
+		secret, err = ioutil.ReadFile("../" + linkSecretFileName)
+	}
+	if err != nil {
+		secret = []byte(RandomKey(32))
+		err = ioutil.WriteFile(linkSecretFileName, secret, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return hkdfBytes(bytes.TrimSpace(secret), nil, []byte("sponsor-hub signed links"), 32)
+}
+
+func signature(message string) string {
+	mac := hmac.New(sha256.New, App.LinkKey)
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validSignature(message string, sig string) bool {
+	return hmac.Equal([]byte(signature(message)), []byte(sig))
+}
+
+func signedUrl(resource string, expires time.Time) string {
+	expiresString := strconv.FormatInt(expires.Unix(), 10)
+	data := url.Values{}
+	data.Set("expires", expiresString)
+	data.Set("signature", signature(resource+"\n"+expiresString))
+	return publicBaseUrl + "/api/" + resource + "?" + data.Encode()
+}
+
+func validSignedRequest(c *gin.Context, resource string) bool {
+	expiresString := c.Query("expires")
+	expires, err := strconv.ParseInt(expiresString, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return validSignature(resource+"\n"+expiresString, c.Query("signature"))
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type SponsorshipTierJSON struct {
+	ID          uint
+	Name        string
+	Description string
+	Perks       string
+	Amount      int64
+	Currency    string
+	Recurrence  string
+}
+
+func SponsorshipTiersList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	tiers, err := App.Store.ListSponsorshipTiersForUser(uint(userId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Sponsorship tiers not found"})
+		return
+	}
+	c.JSON(http.StatusOK, tiers)
+}
+
+func AddSponsorshipTier(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	tier := store.SponsorshipTier{UserId: uint(claims["id"].(float64))}
+
+	err := readJSONIntoSponsorshipTier(&tier, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Sponsorship tier failed validation - err: %s", err.Error())})
+		return
+	}
+	tierId, err := App.Store.InsertSponsorshipTier(&tier)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Sponsorship tier failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Sponsorship tier created successfully", "resourceId": tierId,
+	})
+}
+
+func UpdateSponsorshipTier(c *gin.Context) {
+	tier, ok := loadOwnSponsorshipTier(c)
+	if !ok {
+		return
+	}
+	err := readJSONIntoSponsorshipTier(tier, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Sponsorship tier failed validation - err: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.UpdateSponsorshipTier(tier)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Sponsorship tier failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Sponsorship tier updated successfully", "resourceId": tier.ID,
+	})
+}
+
+func DeleteSponsorshipTier(c *gin.Context) {
+	tier, ok := loadOwnSponsorshipTier(c)
+	if !ok {
+		return
+	}
+	err := App.Store.DeleteSponsorshipTier(tier.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Delete Sponsorship tier failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Sponsorship tier deleted",
+	})
+}
+
+func loadOwnSponsorshipTier(c *gin.Context) (*store.SponsorshipTier, bool) {
+	tierId, err := strconv.Atoi(c.Param("tierID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid TierID"})
+		return nil, false
+	}
+	tier, err := App.Store.LoadSponsorshipTier(uint(tierId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Sponsorship tier not found"})
+		return nil, false
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if tier.UserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Attempt to change someone elses sponsorship tier"})
+		return nil, false
+	}
+	return tier, true
+}
+
+func readJSONIntoSponsorshipTier(tier *store.SponsorshipTier, c *gin.Context) error {
+	tierJSON := SponsorshipTierJSON{}
+	err := c.BindJSON(&tierJSON)
+	if err != nil {
+		return err
+	}
+	recurrence, err := store.ParseRecurrence(tierJSON.Recurrence)
+	if err != nil {
+		return err
+	}
+
+	tier.Name = tierJSON.Name
+	tier.Description = tierJSON.Description
+	tier.Perks = tierJSON.Perks
+	tier.Amount = tierJSON.Amount
+	tier.Currency = tierJSON.Currency
+	tier.Recurrence = recurrence
+	return tier.Validate()
+}
+
+func UpdateSurveySponsor(c *gin.Context) {
+	survey, ok := loadViewableSurvey(c)
+	if !ok {
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if survey.UserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Attempt to update someone elses sponsorship"})
+		return
+	}
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Invalid UserID - err: %s", err.Error())})
+		return
+	}
+	surveySponsor, err := App.Store.LoadSurveySponsor(survey.ID, uint(userId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "SurveySponsor not found"})
+		return
+	}
+
+	err = readJSONIntoSurveySponsor(surveySponsor, c, true)
+	if err == nil && surveySponsor.UserId != uint(userId) {
+		err = errors.New("UserId does not match the sponsorship being updated")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("SurveySponsor failed validation - err: %s", err.Error())})
+		return
+	}
+	surveySponsor.SurveyId = survey.ID
+
+	_, err = App.Store.UpdateSurveySponsor(surveySponsor)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update SurveySponsor failed"})
+		return
+	}
+	go checkFundingMilestones(surveySponsor.UserId)
+	go publishSponsorshipEvent(LiveEventSponsorUpdated, survey.ID, surveySponsor.UserId)
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "SurveySponsor updated successfully", "resourceId": surveySponsor.ID,
+	})
+}
+
+func ReplaceSurveySponsors(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	surveyId, err := strconv.Atoi(c.Param("surveyID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid SurveyID"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	var sponsorsJSON []SurveySponsorJSON
+	err = c.BindJSON(&sponsorsJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("SurveySponsors failed validation - err: %s", err.Error())})
+		return
+	}
+	var sponsors []store.SurveySponsor
+	for i := range sponsorsJSON {
+		surveySponsor := store.SurveySponsor{}
+		err = copySurveySponsorJSON(&surveySponsor, &sponsorsJSON[i], true)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("SurveySponsor failed validation - err: %s", err.Error())})
+			return
+		}
+		sponsors = append(sponsors, surveySponsor)
+	}
+
+	previousIds, _ := App.Store.ListActiveSponsoredDeveloperIds(uint(surveyId))
+	survey, err := App.Store.ReplaceSurveySponsors(loggedInUserId, uint(surveyId), sponsors)
+	switch err {
+	case nil:
+	case store.ErrNotSurveyOwner:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Attempt to update someone elses sponsorships"})
+		return
+	case store.ErrSelfSponsorship, store.ErrNotSponsorable, store.ErrDuplicateSponsor:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("SurveySponsors failed validation - err: %s", err.Error())})
+		return
+	default:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": "Replace SurveySponsors failed"})
+		return
+	}
+	remaining := map[uint]bool{}
+	for _, v := range sponsors {
+		remaining[v.UserId] = true
+		go checkFundingMilestones(v.UserId)
+		go publishSponsorshipEvent(LiveEventSponsorUpdated, survey.ID, v.UserId)
+	}
+	for _, v := range previousIds {
+		if !remaining[v] {
+			go publishSponsorshipEvent(LiveEventSponsorRemoved, survey.ID, v)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "SurveySponsors replaced successfully", "resourceId": survey.ID,
+	})
+}
+
+type SponsorshipStateJSON struct {
+	State  string
+	Reason string
+}
+
+func UpdateSurveySponsorState(c *gin.Context) {
+	surveyId, err := strconv.Atoi(c.Param("surveyID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Invalid SurveyID - err: %s", err.Error())})
+		return
+	}
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Invalid UserID - err: %s", err.Error())})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	survey, err := App.Store.LoadSurvey(uint(surveyId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Survey not found"})
+		return
+	}
+	if survey.UserId != loggedInUserId && uint(userId) != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Attempt to change someone elses sponsorship"})
+		return
+	}
+
+	stateJSON := SponsorshipStateJSON{}
+	err = c.BindJSON(&stateJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Sponsorship state failed validation - err: %s", err.Error())})
+		return
+	}
+	state, err := store.ParseSponsorshipState(stateJSON.State)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Sponsorship state failed validation - err: %s", err.Error())})
+		return
+	}
+	if survey.UserId != loggedInUserId && state == store.SponsorshipStateActive {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Only the sponsor can resume a sponsorship"})
+		return
+	}
+
+	surveySponsor, err := App.Store.TransitionSurveySponsor(survey.ID, uint(userId), state, stateJSON.Reason)
+	if err == store.ErrSponsorshipStateUnchanged {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": "Sponsorship is already in that state"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "SurveySponsor not found"})
+		return
+	}
+	go checkFundingMilestones(surveySponsor.UserId)
+	if state == store.SponsorshipStateEnded {
+		go publishSponsorshipEvent(LiveEventSponsorRemoved, survey.ID, surveySponsor.UserId)
+	} else {
+		go publishSponsorshipEvent(LiveEventSponsorUpdated, survey.ID, surveySponsor.UserId)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Sponsorship state updated", "resourceId": surveySponsor.ID,
+	})
+}
+
+func SurveySponsorHistory(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	survey, ok := loadViewableSurvey(c)
+	if !ok {
+		return
+	}
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Invalid UserID - err: %s", err.Error())})
+		return
+	}
+	history, err := App.Store.SponsorshipHistory(survey.UserId, uint(userId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Sponsorship history not found"})
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+func metricsMonthsQuery(c *gin.Context) int {
+	months, err := strconv.Atoi(c.DefaultQuery("months", "12"))
+	if err != nil || months < 1 || months > 120 {
+		return 12
+	}
+	return months
+}
+
+func DeveloperSponsorshipMetrics(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, ok := selfUserIdParam(c)
+	if !ok {
+		return
+	}
+	metrics, err := App.Store.SponsorshipMetricsByMonth(userId, metricsMonthsQuery(c), time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Sponsorship metrics not found"})
+		return
+	}
+	c.JSON(http.StatusOK, metrics)
+}
+
+func SponsorshipMetrics(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	developerId, _ := strconv.Atoi(c.Query("developer"))
+	metrics, err := App.Store.SponsorshipMetricsByMonth(uint(developerId), metricsMonthsQuery(c), time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Sponsorship metrics not found"})
+		return
+	}
+	c.JSON(http.StatusOK, metrics)
+}
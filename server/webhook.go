@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/adamboardman/sponsor-hub/store"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+const webhookDeliveryLease = 2 * webhookTimeout
+const webhookDeliveryBatch = 50
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type WebhookEndpointJSON struct {
+	Url         string
+	Description string
+	EventTypes  []string
+	Active      bool
+}
+
+type WebhookPayload struct {
+	ID         uint
+	DeliveryId uint
+	Type       store.WebhookEventType
+	CreatedAt  time.Time
+	Data       json.RawMessage
+}
+
+func surveyUpdatedEvent(survey *store.Survey, authorId uint) *store.OutboxEvent {
+	return store.NewOutboxEvent(store.WebhookEventSurveyUpdated, gin.H{
+		"ID": survey.ID, "UserId": survey.UserId, "CampaignId": survey.CampaignId, "AuthorId": authorId,
+	})
+}
+
+func signWebhook(header http.Header, secret []byte, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header.Set("X-Sponsor-Hub-Signature", "t="+timestamp+",v1="+hmacSha256Hex(secret, []byte(timestamp+"."+string(body))))
+}
+
+func DeliverWebhooks(now time.Time) {
+	_, err := App.Store.FanOutOutboxEvents(now)
+	if err != nil {
+		log.Print(err)
+	}
+	started := time.Now()
+	for i := 0; i < webhookDeliveryBatch; i++ {
+		claimedAt := now.Add(time.Since(started))
+		delivery, err := App.Store.ClaimDueWebhookDelivery(claimedAt, webhookDeliveryLease)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if delivery == nil {
+			return
+		}
+		responseStatus, err := deliverWebhook(delivery, claimedAt)
+		err = App.Store.RecordWebhookAttempt(delivery, responseStatus, err, claimedAt)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func deliverWebhook(delivery *store.WebhookDelivery, now time.Time) (int, error) {
+	endpoint, err := App.Store.LoadWebhookEndpoint(delivery.EndpointId)
+	if err != nil {
+		return 0, err
+	}
+	if !endpoint.Active {
+		return 0, fmt.Errorf("webhook is not active")
+	}
+	event, err := App.Store.LoadOutboxEvent(delivery.EventId)
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(WebhookPayload{ID: event.ID, DeliveryId: delivery.ID, Type: event.Type, CreatedAt: event.CreatedAt, Data: json.RawMessage(event.Payload)})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Sponsor-Hub-Webhooks")
+	req.Header.Set("X-Sponsor-Hub-Event", string(event.Type))
+	req.Header.Set("X-Sponsor-Hub-Delivery", strconv.Itoa(int(delivery.ID)))
+	signWebhook(req.Header, []byte(endpoint.Secret), body, now)
+	response, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("endpoint responded %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+func readJSONIntoWebhookEndpoint(endpoint *store.WebhookEndpoint, c *gin.Context) error {
+	endpointJSON := WebhookEndpointJSON{}
+	err := c.BindJSON(&endpointJSON)
+	if err != nil {
+		return err
+	}
+	eventTypes, err := store.ParseWebhookEventTypes(endpointJSON.EventTypes)
+	if err != nil {
+		return err
+	}
+	endpoint.Url = strings.TrimSpace(endpointJSON.Url)
+	endpoint.Description = endpointJSON.Description
+	endpoint.EventTypes = eventTypes
+	endpoint.Active = endpointJSON.Active
+	return endpoint.Validate()
+}
+
+func loadWebhookEndpoint(c *gin.Context) (*store.WebhookEndpoint, bool) {
+	endpointId, err := strconv.Atoi(c.Param("webhookID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid WebhookID"})
+		return nil, false
+	}
+	endpoint, err := App.Store.LoadWebhookEndpoint(uint(endpointId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Webhook not found"})
+		return nil, false
+	}
+	return endpoint, true
+}
+
+func WebhooksList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	endpoints, err := App.Store.ListWebhookEndpoints()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Webhooks not found"})
+		return
+	}
+	c.JSON(http.StatusOK, endpoints)
+}
+
+func AddWebhook(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	endpoint := store.WebhookEndpoint{AuthorId: uint(claims["id"].(float64)), Secret: RandomKey(32)}
+
+	err := readJSONIntoWebhookEndpoint(&endpoint, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Webhook failed validation - err: %s", err.Error())})
+		return
+	}
+	endpointId, err := App.Store.InsertWebhookEndpoint(&endpoint)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Webhook failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Webhook created, its secret will not be shown again", "resourceId": endpointId, "secret": endpoint.Secret,
+	})
+}
+
+func UpdateWebhook(c *gin.Context) {
+	endpoint, ok := loadWebhookEndpoint(c)
+	if !ok {
+		return
+	}
+	err := readJSONIntoWebhookEndpoint(endpoint, c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Webhook failed validation - err: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.UpdateWebhookEndpoint(endpoint)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Update Webhook failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Webhook updated successfully", "resourceId": endpoint.ID,
+	})
+}
+
+func DeleteWebhook(c *gin.Context) {
+	endpoint, ok := loadWebhookEndpoint(c)
+	if !ok {
+		return
+	}
+	err := App.Store.DeleteWebhookEndpoint(endpoint.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Delete Webhook failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Webhook deleted", "resourceId": endpoint.ID,
+	})
+}
+
+func WebhookDeliveriesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	endpoint, ok := loadWebhookEndpoint(c)
+	if !ok {
+		return
+	}
+	deliveries, err := App.Store.ListWebhookDeliveries(endpoint.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Webhook deliveries not found"})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func RedeliverWebhook(c *gin.Context) {
+	endpoint, ok := loadWebhookEndpoint(c)
+	if !ok {
+		return
+	}
+	deliveryId, err := strconv.Atoi(c.Param("deliveryID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid DeliveryID"})
+		return
+	}
+	delivery, err := App.Store.RedeliverWebhook(endpoint.ID, uint(deliveryId), time.Now())
+	if err == store.ErrWebhookDeliveryNotFound {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Redeliver Webhook failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Webhook queued for redelivery", "resourceId": delivery.ID,
+	})
+}
@@ -0,0 +1,315 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+type AnnouncementAudience string
+
+const (
+	AnnouncementAudienceChannel    AnnouncementAudience = "channel"
+	AnnouncementAudienceSponsors   AnnouncementAudience = "sponsors"
+	AnnouncementAudienceDevelopers AnnouncementAudience = "developers"
+)
+
+var AnnouncementAudiences = []AnnouncementAudience{
+	AnnouncementAudienceChannel,
+	AnnouncementAudienceSponsors,
+	AnnouncementAudienceDevelopers,
+}
+
+func ParseAnnouncementAudience(value string) (AnnouncementAudience, error) {
+	for _, v := range AnnouncementAudiences {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown announcement audience: " + value)
+}
+
+type AnnouncementStatus string
+
+const (
+	AnnouncementStatusDraft     AnnouncementStatus = "draft"
+	AnnouncementStatusScheduled AnnouncementStatus = "scheduled"
+	AnnouncementStatusSending   AnnouncementStatus = "sending"
+	AnnouncementStatusSent      AnnouncementStatus = "sent"
+	AnnouncementStatusCancelled AnnouncementStatus = "cancelled"
+)
+
+type Announcement struct {
+	gorm.Model
+	Subject     string
+	Markdown    string
+	Audience    AnnouncementAudience
+	ChannelId   uint
+	Platform    string
+	Status      AnnouncementStatus `gorm:"index"`
+	ScheduledAt *time.Time
+	SentAt      *time.Time
+	AuthorId    uint
+	Deliveries  map[DeliveryStatus]int `gorm:"-"`
+}
+
+type AnnouncementDelivery struct {
+	gorm.Model
+	AnnouncementId uint `gorm:"index"`
+	UserId         uint `gorm:"index"`
+	Email          string
+	Status         DeliveryStatus
+	SentAt         *time.Time
+	UnsubscribedAt *time.Time
+	Error          string
+}
+
+var (
+	ErrAnnouncementNotDraft     = errors.New("announcement has already been scheduled")
+	ErrAnnouncementNotScheduled = errors.New("announcement is not waiting to be sent")
+)
+
+func (a *Announcement) Validate() error {
+	if len(a.Subject) == 0 {
+		return errors.New("announcement subject is required")
+	}
+	if len(a.Markdown) == 0 {
+		return errors.New("announcement body is required")
+	}
+	_, err := ParseAnnouncementAudience(string(a.Audience))
+	if err != nil {
+		return err
+	}
+	if a.Audience == AnnouncementAudienceChannel && a.ChannelId == 0 {
+		return errors.New("a channel announcement needs a ChannelId")
+	}
+	if a.Audience != AnnouncementAudienceChannel && (a.ChannelId != 0 || len(a.Platform) > 0) {
+		return errors.New("only channel announcements can target a channel or platform")
+	}
+	return nil
+}
+
+func (s *Store) InsertAnnouncement(announcement *Announcement) (uint, error) {
+	announcement.Status = AnnouncementStatusDraft
+	err := s.db.Create(announcement).Error
+	return announcement.ID, err
+}
+
+func (s *Store) UpdateAnnouncement(announcement *Announcement) (uint, error) {
+	update := s.db.Model(announcement).Where("status=?", AnnouncementStatusDraft).
+		Updates(map[string]interface{}{"subject": announcement.Subject, "markdown": announcement.Markdown,
+			"audience": announcement.Audience, "channel_id": announcement.ChannelId, "platform": announcement.Platform})
+	if update.Error == nil && update.RowsAffected == 0 {
+		return announcement.ID, ErrAnnouncementNotDraft
+	}
+	return announcement.ID, update.Error
+}
+
+func (s *Store) LoadAnnouncement(id uint) (*Announcement, error) {
+	announcement := Announcement{}
+	err := s.db.Where("id=?", id).Find(&announcement).Error
+	if err != nil {
+		return &announcement, err
+	}
+	announcement.Deliveries, err = s.announcementDeliveryCounts(id)
+	return &announcement, err
+}
+
+func (s *Store) ListAnnouncements() ([]Announcement, error) {
+	var announcements []Announcement
+	err := s.db.Order("id DESC").Find(&announcements).Error
+	return announcements, err
+}
+
+func (s *Store) announcementDeliveryCounts(announcementId uint) (map[DeliveryStatus]int, error) {
+	rows, err := s.db.Model(&AnnouncementDelivery{}).Select("status, COUNT(*)").
+		Where("announcement_id=?", announcementId).Group("status").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[DeliveryStatus]int{}
+	for rows.Next() {
+		var status DeliveryStatus
+		var count int
+		err = rows.Scan(&status, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *Store) ScheduleAnnouncement(id uint, at time.Time) error {
+	update := s.db.Model(&Announcement{}).Where("id=? AND status IN (?)", id,
+		[]AnnouncementStatus{AnnouncementStatusDraft, AnnouncementStatusScheduled}).
+		Updates(map[string]interface{}{"status": AnnouncementStatusScheduled, "scheduled_at": at})
+	if update.Error == nil && update.RowsAffected == 0 {
+		return ErrAnnouncementNotDraft
+	}
+	return update.Error
+}
+
+func (s *Store) CancelAnnouncement(id uint) error {
+	update := s.db.Model(&Announcement{}).Where("id=? AND status=?", id, AnnouncementStatusScheduled).
+		Update("status", AnnouncementStatusCancelled)
+	if update.Error == nil && update.RowsAffected == 0 {
+		return ErrAnnouncementNotScheduled
+	}
+	return update.Error
+}
+
+func (s *Store) ListDueAnnouncementIds(now time.Time) ([]uint, error) {
+	var ids []uint
+	err := s.db.Model(&Announcement{}).Where("status=? AND scheduled_at<=?", AnnouncementStatusScheduled, now).
+		Order("scheduled_at").Pluck("id", &ids).Error
+	return ids, err
+}
+
+func (s *Store) ListSendingAnnouncementIds() ([]uint, error) {
+	var ids []uint
+	err := s.db.Model(&Announcement{}).Where("status=?", AnnouncementStatusSending).Order("id").Pluck("id", &ids).Error
+	return ids, err
+}
+
+func (a *Announcement) Category() NotificationCategory {
+	if a.Audience == AnnouncementAudienceChannel {
+		return NotificationCategoryReleases
+	}
+	return NotificationCategoryAnnouncements
+}
+
+func (s *Store) ListAnnouncementRecipients(announcement *Announcement) ([]ChannelSubscriber, error) {
+	if announcement.Audience == AnnouncementAudienceChannel {
+		subscribers, err := s.ListChannelSubscribers(announcement.ChannelId, announcement.Platform)
+		if err != nil {
+			return nil, err
+		}
+		disabled, err := s.ListUserIdsWithNotificationDisabled(NotificationCategoryReleases)
+		if err != nil {
+			return nil, err
+		}
+		var recipients []ChannelSubscriber
+		seen := map[uint]bool{}
+		for _, v := range disabled {
+			seen[v] = true
+		}
+		for _, v := range subscribers {
+			if !seen[v.ID] {
+				seen[v.ID] = true
+				recipients = append(recipients, v)
+			}
+		}
+		return recipients, nil
+	}
+
+	query := s.db.Table("users").
+		Select("users.id, COALESCE(NULLIF(surveys.name, ''), users.name) AS name, users.email").
+		Joins("LEFT JOIN surveys ON surveys.user_id=users.id AND surveys.campaign_id=0 AND surveys.deleted_at IS NULL").
+		Where("users.deleted_at IS NULL AND users.confirmed IS TRUE").
+		Where("users.id IN (SELECT user_id FROM notification_preferences WHERE channel=? AND category=? AND enabled IS TRUE AND deleted_at IS NULL)",
+			NotificationChannelEmail, NotificationCategoryAnnouncements)
+	if announcement.Audience == AnnouncementAudienceSponsors {
+		query = query.Where("surveys.id IN (SELECT survey_id FROM survey_sponsors WHERE state=? AND deleted_at IS NULL)", SponsorshipStateActive)
+	} else {
+		query = query.Where("users.permissions>=?", UserPermissionsUser)
+	}
+	var recipients []ChannelSubscriber
+	err := query.Order("users.id").Scan(&recipients).Error
+	return recipients, err
+}
+
+func (s *Store) StartSendingAnnouncement(announcement *Announcement) (bool, error) {
+	recipients, err := s.ListAnnouncementRecipients(announcement)
+	if err != nil {
+		return false, err
+	}
+	tx := s.db.Begin()
+	update := tx.Model(&Announcement{}).Where("id=? AND status=?", announcement.ID, AnnouncementStatusScheduled).
+		Update("status", AnnouncementStatusSending)
+	if update.Error != nil || update.RowsAffected == 0 {
+		tx.Rollback()
+		return false, update.Error
+	}
+	for _, v := range recipients {
+		err = tx.Create(&AnnouncementDelivery{AnnouncementId: announcement.ID, UserId: v.ID, Email: v.Email, Status: DeliveryStatusPending}).Error
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	return true, tx.Commit().Error
+}
+
+func (s *Store) ListPendingAnnouncementDeliveries(announcementId uint) ([]AnnouncementDelivery, error) {
+	var deliveries []AnnouncementDelivery
+	err := s.db.Where("announcement_id=? AND status=?", announcementId, DeliveryStatusPending).Order("id").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (s *Store) ClaimAnnouncementDelivery(id uint) (bool, error) {
+	update := s.db.Model(&AnnouncementDelivery{}).Where("id=? AND status=?", id, DeliveryStatusPending).Update("status", DeliveryStatusSending)
+	return update.RowsAffected == 1, update.Error
+}
+
+func (s *Store) ListAnnouncementDeliveries(announcementId uint) ([]AnnouncementDelivery, error) {
+	var deliveries []AnnouncementDelivery
+	err := s.db.Where("announcement_id=?", announcementId).Order("id").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (s *Store) LoadAnnouncementDelivery(id uint) (*AnnouncementDelivery, error) {
+	delivery := AnnouncementDelivery{}
+	err := s.db.Where("id=?", id).First(&delivery).Error
+	return &delivery, err
+}
+
+func (s *Store) UpdateAnnouncementDelivery(delivery *AnnouncementDelivery) (uint, error) {
+	err := s.db.Save(delivery).Error
+	return delivery.ID, err
+}
+
+func (s *Store) FinishSendingAnnouncement(id uint, now time.Time, events ...*OutboxEvent) error {
+	tx := s.db.Begin()
+	update := tx.Model(&Announcement{}).Where("id=? AND status=?", id, AnnouncementStatusSending).
+		Where("NOT EXISTS (SELECT 1 FROM announcement_deliveries WHERE announcement_id=? AND status=?)", id, DeliveryStatusPending).
+		Updates(map[string]interface{}{"status": AnnouncementStatusSent, "sent_at": now})
+	err := update.Error
+	if err == nil && update.RowsAffected > 0 {
+		err = insertOutboxEvents(tx, events)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) UnsubscribeFromAnnouncement(announcementId uint, userId uint, now time.Time) error {
+	announcement := Announcement{}
+	policyVersion := s.CurrentPrivacyPolicyVersion()
+	tx := s.db.Begin()
+	err := tx.Where("id=?", announcementId).Find(&announcement).Error
+	if err == nil && announcement.Audience == AnnouncementAudienceChannel {
+		err = tx.Unscoped().Where("user_id=? AND channel_id=?", userId, announcement.ChannelId).Delete(ChannelSubscription{}).Error
+		if err == nil {
+			err = tx.Model(&Survey{}).Where("user_id=? AND campaign_id=0", userId).
+				UpdateColumn("pre_release", gorm.Expr("EXISTS (SELECT 1 FROM channel_subscriptions WHERE user_id=?)", userId)).Error
+		}
+		if err == nil {
+			err = withdrawConsentWithoutSubscriptions(tx, userId, policyVersion, "announcement-unsubscribe")
+		}
+	} else if err == nil {
+		err = setNotificationPreference(tx, userId, NotificationChannelEmail, NotificationCategoryAnnouncements, false, "announcement-unsubscribe")
+	}
+	if err == nil {
+		err = tx.Model(&AnnouncementDelivery{}).Where("announcement_id=? AND user_id=? AND unsubscribed_at IS NULL", announcementId, userId).
+			Update("unsubscribed_at", now).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
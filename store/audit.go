@@ -0,0 +1,33 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+)
+
+type AuditRecord struct {
+	gorm.Model
+	Action        string `gorm:"index"`
+	ActorId       uint
+	SubjectUserId uint `gorm:"index"`
+	Details       string
+}
+
+func insertAuditRecord(db *gorm.DB, action string, actorId uint, subjectUserId uint, details string) error {
+	record := AuditRecord{
+		Action:        action,
+		ActorId:       actorId,
+		SubjectUserId: subjectUserId,
+		Details:       details,
+	}
+	return db.Create(&record).Error
+}
+
+func (s *Store) InsertAuditRecord(action string, actorId uint, subjectUserId uint, details string) error {
+	return insertAuditRecord(s.db, action, actorId, subjectUserId, details)
+}
+
+func (s *Store) ListAuditRecords() ([]AuditRecord, error) {
+	var records []AuditRecord
+	err := s.db.Limit(200).Order("id DESC").Find(&records).Error
+	return records, err
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type BuildArtifact struct {
+	gorm.Model
+	ChannelId  uint `gorm:"index"`
+	Platform   string
+	Version    string
+	FileName   string
+	StorageKey string
+	Size       int64
+	Sha256     string
+	Notes      string
+	UploadedBy uint
+}
+
+type BuildDownload struct {
+	gorm.Model
+	ArtifactId uint `gorm:"index"`
+	UserId     uint `gorm:"index"`
+	RemoteAddr string
+	UserAgent  string
+	Bytes      int64
+	Status     int
+}
+
+var sha256Pattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+func (b *BuildArtifact) Validate() error {
+	if b.ChannelId == 0 {
+		return errors.New("a build needs a ChannelId")
+	}
+	if len(b.Version) == 0 {
+		return errors.New("build version is required")
+	}
+	key := path.Clean("/" + b.StorageKey)
+	if len(b.StorageKey) == 0 || key != "/"+b.StorageKey {
+		return errors.New("storage key should be a relative path without . or .. elements")
+	}
+	if len(b.Sha256) > 0 && !sha256Pattern.MatchString(b.Sha256) {
+		return errors.New("checksum should be a lower case hex SHA-256")
+	}
+	if len(b.FileName) == 0 {
+		b.FileName = path.Base(b.StorageKey)
+	}
+	if strings.ContainsAny(b.FileName, "\"/\\\r\n") {
+		return errors.New("file name contains invalid characters")
+	}
+	return nil
+}
+
+func (s *Store) InsertBuildArtifact(artifact *BuildArtifact) (uint, error) {
+	err := s.db.Create(artifact).Error
+	return artifact.ID, err
+}
+
+func (s *Store) LoadBuildArtifact(id uint) (*BuildArtifact, error) {
+	artifact := BuildArtifact{}
+	err := s.db.Where("id=?", id).Find(&artifact).Error
+	return &artifact, err
+}
+
+func (s *Store) DeleteBuildArtifact(id uint) error {
+	return s.db.Where("id=?", id).Delete(BuildArtifact{}).Error
+}
+
+func (s *Store) ListBuildArtifactsForChannel(channelId uint) ([]BuildArtifact, error) {
+	var artifacts []BuildArtifact
+	err := s.db.Where("channel_id=?", channelId).Order("id DESC").Find(&artifacts).Error
+	return artifacts, err
+}
+
+const subscribedArtifactSQL = "SELECT 1 FROM channel_subscriptions WHERE channel_subscriptions.user_id=? " +
+	"AND channel_subscriptions.channel_id=build_artifacts.channel_id AND channel_subscriptions.deleted_at IS NULL " +
+	"AND (channel_subscriptions.platform='' OR build_artifacts.platform='' OR channel_subscriptions.platform=build_artifacts.platform)"
+
+func (s *Store) ListBuildArtifactsForUser(userId uint) ([]BuildArtifact, error) {
+	var artifacts []BuildArtifact
+	err := s.db.Where("EXISTS ("+subscribedArtifactSQL+")", userId).Order("channel_id, id DESC").Find(&artifacts).Error
+	return artifacts, err
+}
+
+func (s *Store) CanDownloadBuildArtifact(userId uint, artifactId uint) bool {
+	var count int
+	err := s.db.Model(&BuildArtifact{}).Where("id=? AND EXISTS ("+subscribedArtifactSQL+")", artifactId, userId).Count(&count).Error
+	return err == nil && count > 0
+}
+
+func (s *Store) InsertBuildDownload(download *BuildDownload) (uint, error) {
+	err := s.db.Create(download).Error
+	return download.ID, err
+}
+
+func (s *Store) ListBuildDownloads(artifactId uint) ([]BuildDownload, error) {
+	var downloads []BuildDownload
+	err := s.db.Where("artifact_id=?", artifactId).Order("id DESC").Find(&downloads).Error
+	return downloads, err
+}
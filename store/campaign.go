@@ -0,0 +1,153 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+type SurveyCampaign struct {
+	gorm.Model
+	Name        string
+	Description string
+	OpensAt     time.Time
+	ClosesAt    time.Time
+}
+
+func (c *SurveyCampaign) IsOpen(now time.Time) bool {
+	return !now.Before(c.OpensAt) && now.Before(c.ClosesAt)
+}
+
+type CampaignStats struct {
+	CampaignId     uint
+	Name           string
+	Responses      int
+	PreRelease     int
+	CommsFrequency map[string]int
+	Privacy        map[string]int
+}
+
+type CampaignComparison struct {
+	From       CampaignStats
+	To         CampaignStats
+	Continuing int
+	New        int
+	Lapsed     int
+}
+
+var ErrCampaignAlreadyAnswered = errors.New("survey already answered for this campaign")
+
+func (s *Store) InsertSurveyCampaign(campaign *SurveyCampaign) (uint, error) {
+	err := s.db.Create(campaign).Error
+	return campaign.ID, err
+}
+
+func (s *Store) UpdateSurveyCampaign(campaign *SurveyCampaign) (uint, error) {
+	err := s.db.Save(campaign).Error
+	return campaign.ID, err
+}
+
+func (s *Store) LoadSurveyCampaign(id uint) (*SurveyCampaign, error) {
+	campaign := SurveyCampaign{}
+	err := s.db.Where("id=?", id).Find(&campaign).Error
+	return &campaign, err
+}
+
+func (s *Store) ListSurveyCampaigns() ([]SurveyCampaign, error) {
+	var campaigns []SurveyCampaign
+	err := s.db.Limit(200).Order("opens_at DESC").Find(&campaigns).Error
+	return campaigns, err
+}
+
+func (s *Store) LoadSurveyForUserCampaign(userId uint, campaignId uint) (*Survey, error) {
+	survey := Survey{}
+	err := s.db.Where("user_id=? AND campaign_id=?", userId, campaignId).Find(&survey).Error
+	return &survey, err
+}
+
+func (s *Store) InsertCampaignSurvey(survey *Survey) (uint, error) {
+	_, err := s.LoadSurveyForUserCampaign(survey.UserId, survey.CampaignId)
+	if err == nil {
+		return 0, ErrCampaignAlreadyAnswered
+	}
+	return s.InsertSurvey(survey, survey.UserId)
+}
+
+func (s *Store) ListSurveysForCampaign(campaignId uint) ([]Survey, error) {
+	var surveys []Survey
+	err := s.db.Where("campaign_id=?", campaignId).Find(&surveys).Error
+	return surveys, err
+}
+
+func (s *Store) CampaignStatistics(campaignId uint) (*CampaignStats, error) {
+	campaign, err := s.LoadSurveyCampaign(campaignId)
+	if err != nil {
+		return nil, err
+	}
+	surveys, err := s.ListSurveysForCampaign(campaignId)
+	if err != nil {
+		return nil, err
+	}
+	return campaignStatsFromSurveys(campaign, surveys), nil
+}
+
+func campaignStatsFromSurveys(campaign *SurveyCampaign, surveys []Survey) *CampaignStats {
+	stats := CampaignStats{
+		CampaignId:     campaign.ID,
+		Name:           campaign.Name,
+		CommsFrequency: map[string]int{},
+		Privacy:        map[string]int{},
+	}
+	for _, v := range surveys {
+		stats.Responses++
+		if v.PreRelease {
+			stats.PreRelease++
+		}
+		stats.CommsFrequency[string(v.CommsFrequency)]++
+		stats.Privacy[string(v.Privacy)]++
+	}
+	return &stats
+}
+
+func (s *Store) CompareCampaigns(fromId uint, toId uint) (*CampaignComparison, error) {
+	fromCampaign, err := s.LoadSurveyCampaign(fromId)
+	if err != nil {
+		return nil, err
+	}
+	toCampaign, err := s.LoadSurveyCampaign(toId)
+	if err != nil {
+		return nil, err
+	}
+	fromSurveys, err := s.ListSurveysForCampaign(fromId)
+	if err != nil {
+		return nil, err
+	}
+	toSurveys, err := s.ListSurveysForCampaign(toId)
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := CampaignComparison{
+		From: *campaignStatsFromSurveys(fromCampaign, fromSurveys),
+		To:   *campaignStatsFromSurveys(toCampaign, toSurveys),
+	}
+	fromUsers := map[uint]bool{}
+	for _, v := range fromSurveys {
+		if v.UserId != 0 {
+			fromUsers[v.UserId] = true
+		}
+	}
+	for _, v := range toSurveys {
+		if v.UserId == 0 {
+			continue
+		}
+		if fromUsers[v.UserId] {
+			comparison.Continuing++
+			delete(fromUsers, v.UserId)
+		} else {
+			comparison.New++
+		}
+	}
+	comparison.Lapsed = len(fromUsers)
+	return &comparison, nil
+}
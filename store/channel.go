@@ -0,0 +1,262 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const ReleaseChannelLegacyName = "pre-release"
+
+type ReleaseChannel struct {
+	gorm.Model
+	Name        string
+	Description string
+	Platforms   string
+	IsDefault   bool
+}
+
+type ChannelSubscription struct {
+	gorm.Model
+	UserId    uint `gorm:"index"`
+	ChannelId uint `gorm:"index"`
+	Platform  string
+}
+
+type ChannelSubscriber struct {
+	ID       uint
+	Name     string
+	Email    string
+	Platform string
+}
+
+var (
+	ErrUnknownReleaseChannel = errors.New("release channel not found")
+	ErrUnsupportedPlatform   = errors.New("platform not offered on that release channel")
+	ErrDuplicateSubscription = errors.New("subscription listed more than once")
+)
+
+var releaseNamePattern = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+func (c *ReleaseChannel) PlatformList() []string {
+	var platforms []string
+	for _, v := range strings.Split(c.Platforms, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) > 0 {
+			platforms = append(platforms, v)
+		}
+	}
+	return platforms
+}
+
+func (c *ReleaseChannel) SupportsPlatform(platform string) bool {
+	if len(platform) == 0 {
+		return true
+	}
+	for _, v := range c.PlatformList() {
+		if v == platform {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ReleaseChannel) Validate() error {
+	if !releaseNamePattern.MatchString(c.Name) {
+		return errors.New("channel name should be lower case letters, digits and dashes")
+	}
+	for _, v := range c.PlatformList() {
+		if !releaseNamePattern.MatchString(v) {
+			return errors.New("platform names should be lower case letters, digits and dashes")
+		}
+	}
+	c.Platforms = strings.Join(c.PlatformList(), ",")
+	return nil
+}
+
+func migratePreReleaseToChannels(db *gorm.DB) {
+	var count int
+	err := db.Model(&ReleaseChannel{}).Unscoped().Count(&count).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	if count > 0 {
+		return
+	}
+	channel := ReleaseChannel{Name: ReleaseChannelLegacyName, Description: "Pre-release builds", IsDefault: true}
+	err = db.Create(&channel).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Exec("INSERT INTO channel_subscriptions (created_at, updated_at, user_id, channel_id, platform) "+
+		"SELECT DISTINCT ON (user_id) updated_at, updated_at, user_id, ?, '' FROM surveys "+
+		"WHERE pre_release IS TRUE AND campaign_id=0 AND user_id IS NOT NULL AND deleted_at IS NULL", channel.ID).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *Store) InsertReleaseChannel(channel *ReleaseChannel) (uint, error) {
+	err := s.saveReleaseChannel(channel)
+	return channel.ID, err
+}
+
+func (s *Store) UpdateReleaseChannel(channel *ReleaseChannel) (uint, error) {
+	err := s.saveReleaseChannel(channel)
+	return channel.ID, err
+}
+
+func (s *Store) saveReleaseChannel(channel *ReleaseChannel) error {
+	tx := s.db.Begin()
+	var err error
+	if channel.IsDefault {
+		err = tx.Model(&ReleaseChannel{}).Where("id<>? AND is_default IS TRUE", channel.ID).UpdateColumn("is_default", false).Error
+	}
+	if err == nil && channel.ID == 0 {
+		err = tx.Create(channel).Error
+	} else if err == nil {
+		err = tx.Save(channel).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) LoadReleaseChannel(id uint) (*ReleaseChannel, error) {
+	channel := ReleaseChannel{}
+	err := s.db.Where("id=?", id).Find(&channel).Error
+	return &channel, err
+}
+
+func (s *Store) DefaultReleaseChannel() (*ReleaseChannel, error) {
+	channel := ReleaseChannel{}
+	err := s.db.Where("is_default IS TRUE").Order("id").First(&channel).Error
+	return &channel, err
+}
+
+func (s *Store) ListReleaseChannels() ([]ReleaseChannel, error) {
+	var channels []ReleaseChannel
+	err := s.db.Order("name").Find(&channels).Error
+	return channels, err
+}
+
+func (s *Store) DeleteReleaseChannel(id uint) error {
+	tx := s.db.Begin()
+	err := tx.Unscoped().Where("channel_id=?", id).Delete(ChannelSubscription{}).Error
+	if err == nil {
+		err = tx.Where("id=?", id).Delete(ReleaseChannel{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) ListChannelSubscriptionsForUser(userId uint) ([]ChannelSubscription, error) {
+	var subscriptions []ChannelSubscription
+	err := s.db.Where("user_id=?", userId).Order("channel_id, platform").Find(&subscriptions).Error
+	return subscriptions, err
+}
+
+func (s *Store) ReplaceChannelSubscriptions(userId uint, subscriptions []ChannelSubscription) error {
+	policyVersion := s.CurrentPrivacyPolicyVersion()
+	tx := s.db.Begin()
+	err := replaceChannelSubscriptions(tx, userId, subscriptions)
+	if err == nil {
+		err = tx.Model(&Survey{}).Where("user_id=? AND campaign_id=0", userId).UpdateColumn("pre_release", len(subscriptions) > 0).Error
+	}
+	if err == nil {
+		err = withdrawConsentWithoutSubscriptions(tx, userId, policyVersion, "channel-subscription")
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func replaceChannelSubscriptions(tx *gorm.DB, userId uint, subscriptions []ChannelSubscription) error {
+	type subscriptionKey struct {
+		channelId uint
+		platform  string
+	}
+	seen := map[subscriptionKey]bool{}
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		key := subscriptionKey{subscription.ChannelId, subscription.Platform}
+		if seen[key] {
+			return ErrDuplicateSubscription
+		}
+		seen[key] = true
+
+		channel := ReleaseChannel{}
+		err := tx.Where("id=?", subscription.ChannelId).Find(&channel).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return ErrUnknownReleaseChannel
+		}
+		if err != nil {
+			return err
+		}
+		if !channel.SupportsPlatform(subscription.Platform) {
+			return ErrUnsupportedPlatform
+		}
+	}
+
+	err := tx.Unscoped().Where("user_id=?", userId).Delete(ChannelSubscription{}).Error
+	if err != nil {
+		return err
+	}
+	for i := range subscriptions {
+		subscriptions[i].ID = 0
+		subscriptions[i].UserId = userId
+		err = tx.Create(&subscriptions[i]).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncLegacyPreReleaseSubscription(tx *gorm.DB, survey *Survey) error {
+	if survey.CampaignId != 0 || survey.UserId == 0 {
+		return nil
+	}
+	if !survey.PreRelease {
+		return tx.Unscoped().Where("user_id=? AND channel_id IN (SELECT id FROM release_channels WHERE is_default IS TRUE)", survey.UserId).
+			Delete(ChannelSubscription{}).Error
+	}
+	var count int
+	err := tx.Model(&ChannelSubscription{}).Where("user_id=?", survey.UserId).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+	channel := ReleaseChannel{}
+	err = tx.Where("is_default IS TRUE").Order("id").First(&channel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Create(&ChannelSubscription{UserId: survey.UserId, ChannelId: channel.ID}).Error
+}
+
+func (s *Store) ListChannelSubscribers(channelId uint, platform string) ([]ChannelSubscriber, error) {
+	query := s.db.Table("channel_subscriptions").
+		Select("users.id, COALESCE(NULLIF(surveys.name, ''), users.name) AS name, users.email, channel_subscriptions.platform").
+		Joins("JOIN users ON users.id=channel_subscriptions.user_id").
+		Joins("LEFT JOIN surveys ON surveys.user_id=users.id AND surveys.campaign_id=0 AND surveys.deleted_at IS NULL").
+		Where("channel_subscriptions.channel_id=? AND channel_subscriptions.deleted_at IS NULL AND users.deleted_at IS NULL", channelId).
+		Where("users.id IN ("+activeConsentUsersSQL+")", ConsentTypePreReleaseEmails, s.CurrentPrivacyPolicyVersion())
+	if len(platform) > 0 {
+		query = query.Where("channel_subscriptions.platform IN (?, '')", platform)
+	}
+	var subscribers []ChannelSubscriber
+	err := query.Order("name, users.id, channel_subscriptions.platform").Scan(&subscribers).Error
+	return subscribers, err
+}
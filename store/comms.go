@@ -0,0 +1,269 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"strings"
+	"time"
+)
+
+type CommsFrequency string
+
+const (
+	CommsFrequencyNever        CommsFrequency = "never"
+	CommsFrequencyReleasesOnly CommsFrequency = "releases-only"
+	CommsFrequencyMonthly      CommsFrequency = "monthly"
+	CommsFrequencyWeekly       CommsFrequency = "weekly"
+	CommsFrequencyAsItHappens  CommsFrequency = "as-it-happens"
+)
+
+const CommsFrequencyDefault = CommsFrequencyReleasesOnly
+
+const messageFirstRetry = 5 * time.Minute
+const messageMaxRetry = 12 * time.Hour
+
+var CommsFrequencies = []CommsFrequency{
+	CommsFrequencyNever,
+	CommsFrequencyReleasesOnly,
+	CommsFrequencyMonthly,
+	CommsFrequencyWeekly,
+	CommsFrequencyAsItHappens,
+}
+
+func ParseCommsFrequency(value string) (CommsFrequency, error) {
+	if len(value) == 0 {
+		return CommsFrequencyDefault, nil
+	}
+	for _, v := range CommsFrequencies {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown communications frequency: " + value)
+}
+
+var legacyCommsFrequencyKeywords = []struct {
+	Frequency CommsFrequency
+	Keywords  []string
+}{
+	{CommsFrequencyNever, []string{"never", "none", "nothing", "no", "not", "don't", "dont", "stop", "unsubscribe"}},
+	{CommsFrequencyReleasesOnly, []string{"release", "releases"}},
+	{CommsFrequencyMonthly, []string{"month", "monthly"}},
+	{CommsFrequencyWeekly, []string{"week", "weekly", "fortnight", "fortnightly"}},
+	{CommsFrequencyAsItHappens, []string{"anything", "everything", "always", "daily", "immediately", "happens"}},
+}
+
+func legacyCommsFrequency(answer string) CommsFrequency {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	for _, v := range CommsFrequencies {
+		if string(v) == answer {
+			return v
+		}
+	}
+	for _, v := range legacyCommsFrequencyKeywords {
+		if legacyAnswerMatches(answer, v.Keywords) {
+			return v.Frequency
+		}
+	}
+	return CommsFrequencyNever
+}
+
+func (f CommsFrequency) Interval() time.Duration {
+	switch f {
+	case CommsFrequencyMonthly:
+		return 30 * 24 * time.Hour
+	case CommsFrequencyWeekly:
+		return 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+func (f CommsFrequency) Allows(kind MessageKind) bool {
+	if kind == MessageKindTransactional {
+		return true
+	}
+	switch f {
+	case CommsFrequencyNever:
+		return false
+	case CommsFrequencyReleasesOnly:
+		return kind == MessageKindRelease
+	}
+	return true
+}
+
+type MessageKind string
+
+const (
+	MessageKindRelease       MessageKind = "release"
+	MessageKindUpdate        MessageKind = "update"
+	MessageKindDigest        MessageKind = "digest"
+	MessageKindTransactional MessageKind = "transactional"
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryStatusPending    DeliveryStatus = "pending"
+	DeliveryStatusSending    DeliveryStatus = "sending"
+	DeliveryStatusSent       DeliveryStatus = "sent"
+	DeliveryStatusHeld       DeliveryStatus = "held"
+	DeliveryStatusMerged     DeliveryStatus = "merged"
+	DeliveryStatusSuppressed DeliveryStatus = "suppressed"
+	DeliveryStatusFailed     DeliveryStatus = "failed"
+)
+
+type MessageDelivery struct {
+	gorm.Model
+	UserId        uint `gorm:"index"`
+	Kind          MessageKind
+	Category      NotificationCategory
+	Subject       string
+	Body          string
+	Status        DeliveryStatus `gorm:"index"`
+	SentAt        *time.Time
+	DigestId      uint
+	ReceiptId     uint
+	Attempts      int
+	NextAttemptAt *time.Time
+
+	AnnouncementDeliveryId uint
+}
+
+func (s *Store) LoadCommsFrequencyForUser(userId uint) CommsFrequency {
+	survey, err := s.LoadSurveyForUser(userId)
+	if err != nil {
+		return CommsFrequencyDefault
+	}
+	frequency, err := ParseCommsFrequency(string(survey.CommsFrequency))
+	if err != nil {
+		return CommsFrequencyDefault
+	}
+	return frequency
+}
+
+func (s *Store) InsertMessageDelivery(delivery *MessageDelivery) (uint, error) {
+	err := s.db.Create(delivery).Error
+	return delivery.ID, err
+}
+
+func (s *Store) UpdateMessageDelivery(delivery *MessageDelivery) (uint, error) {
+	err := s.db.Save(delivery).Error
+	return delivery.ID, err
+}
+
+func (s *Store) LastSentMessageForUser(userId uint) (*MessageDelivery, error) {
+	delivery := MessageDelivery{}
+	err := s.db.Where("user_id=? AND status=? AND kind<>?", userId, DeliveryStatusSent, MessageKindTransactional).Order("sent_at DESC").First(&delivery).Error
+	return &delivery, err
+}
+
+func (s *Store) ListMessageDeliveriesForUser(userId uint) ([]MessageDelivery, error) {
+	var deliveries []MessageDelivery
+	err := s.db.Limit(200).Where("user_id=?", userId).Order("created_at DESC").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (s *Store) ListHeldMessagesForUser(userId uint) ([]MessageDelivery, error) {
+	var deliveries []MessageDelivery
+	err := s.db.Where("user_id=? AND status=?", userId, DeliveryStatusHeld).Order("created_at").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (s *Store) ListUserIdsWithHeldMessages(now time.Time) ([]uint, error) {
+	var userIds []uint
+	err := s.db.Model(&MessageDelivery{}).Where("status=? AND (next_attempt_at IS NULL OR next_attempt_at<=?)", DeliveryStatusHeld, now).
+		Pluck("DISTINCT user_id", &userIds).Error
+	return userIds, err
+}
+
+func (s *Store) ClaimHeldMessagesForUser(userId uint, now time.Time, lease time.Duration) ([]MessageDelivery, error) {
+	tx := s.db.Begin()
+	var deliveries []MessageDelivery
+	err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("user_id=? AND status=? AND (next_attempt_at IS NULL OR next_attempt_at<=?)", userId, DeliveryStatusHeld, now).
+		Order("created_at").Find(&deliveries).Error
+	var ids []uint
+	for _, v := range deliveries {
+		ids = append(ids, v.ID)
+	}
+	leasedUntil := now.Add(lease)
+	if err == nil && len(ids) > 0 {
+		err = tx.Model(&MessageDelivery{}).Where("id IN (?)", ids).UpdateColumn("next_attempt_at", leasedUntil).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i := range deliveries {
+		deliveries[i].NextAttemptAt = &leasedUntil
+	}
+	return deliveries, tx.Commit().Error
+}
+
+func (s *Store) ReleaseHeldMessages(ids []uint) error {
+	return s.db.Model(&MessageDelivery{}).Where("id IN (?) AND status=?", ids, DeliveryStatusHeld).
+		UpdateColumn("next_attempt_at", nil).Error
+}
+
+func (s *Store) MergeHeldMessages(digest *MessageDelivery, ids []uint, now time.Time, lease time.Duration) error {
+	leasedUntil := now.Add(lease)
+	digest.Status = DeliveryStatusSending
+	digest.NextAttemptAt = &leasedUntil
+	tx := s.db.Begin()
+	err := tx.Create(digest).Error
+	if err == nil {
+		err = tx.Model(&MessageDelivery{}).Where("id IN (?)", ids).
+			Updates(map[string]interface{}{"status": DeliveryStatusMerged, "digest_id": digest.ID, "next_attempt_at": nil}).Error
+	}
+	if err == nil {
+		err = tx.Model(&AnnouncementDelivery{}).
+			Where("id IN (SELECT announcement_delivery_id FROM message_deliveries WHERE id IN (?))", ids).
+			Update("status", DeliveryStatusMerged).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) ListMergedMessages(digestId uint) ([]MessageDelivery, error) {
+	var deliveries []MessageDelivery
+	err := s.db.Where("digest_id=? AND status=?", digestId, DeliveryStatusMerged).Order("created_at").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (s *Store) ListDueFailedDeliveries(now time.Time, maxAttempts int) ([]MessageDelivery, error) {
+	var deliveries []MessageDelivery
+	err := s.db.Where("(status=? OR status=?) AND attempts<? AND (next_attempt_at IS NULL OR next_attempt_at<=?)",
+		DeliveryStatusFailed, DeliveryStatusSending, maxAttempts, now).Order("id").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (s *Store) ClaimFailedDelivery(delivery *MessageDelivery, now time.Time, lease time.Duration) (bool, error) {
+	leasedUntil := now.Add(lease)
+	update := s.db.Model(&MessageDelivery{}).
+		Where("id=? AND (status=? OR status=?) AND (next_attempt_at IS NULL OR next_attempt_at<=?)", delivery.ID, DeliveryStatusFailed, DeliveryStatusSending, now).
+		Updates(map[string]interface{}{"status": DeliveryStatusSending, "next_attempt_at": leasedUntil})
+	if update.Error != nil || update.RowsAffected == 0 {
+		return false, update.Error
+	}
+	delivery.Status = DeliveryStatusSending
+	delivery.NextAttemptAt = &leasedUntil
+	return true, nil
+}
+
+func MessageRetryDelay(attempts int) time.Duration {
+	delay := messageFirstRetry
+	for i := 1; i < attempts && delay < messageMaxRetry; i++ {
+		delay *= 2
+	}
+	if delay > messageMaxRetry {
+		delay = messageMaxRetry
+	}
+	return delay
+}
+
+func (s *Store) PurgeMessageDeliveriesForUser(userId uint) {
+	s.db.Unscoped().Where("user_id=?", userId).Delete(MessageDelivery{})
+}
@@ -0,0 +1,212 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+type ConsentType string
+
+const (
+	ConsentTypePreReleaseEmails ConsentType = "pre-release-emails"
+	ConsentTypePublicListing    ConsentType = "public-listing"
+	ConsentTypeDataSharing      ConsentType = "data-sharing"
+)
+
+var ConsentTypes = []ConsentType{
+	ConsentTypePreReleaseEmails,
+	ConsentTypePublicListing,
+	ConsentTypeDataSharing,
+}
+
+func ParseConsentType(value string) (ConsentType, error) {
+	for _, v := range ConsentTypes {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown consent type: " + value)
+}
+
+type PrivacyPolicy struct {
+	gorm.Model
+	Version              string `gorm:"unique_index"`
+	Url                  string
+	PublishedAt          time.Time
+	ReconsentRequestedAt *time.Time
+}
+
+type ConsentRecord struct {
+	gorm.Model
+	UserId        uint `gorm:"index"`
+	Type          ConsentType
+	Granted       bool
+	PolicyVersion string
+	Source        string
+}
+
+type ConsentStatus struct {
+	Type              ConsentType
+	Granted           bool
+	PolicyVersion     string
+	RecordedAt        time.Time
+	Active            bool
+	ReconsentRequired bool
+}
+
+func (s *Store) InsertPrivacyPolicy(policy *PrivacyPolicy) (uint, error) {
+	err := s.db.Create(policy).Error
+	return policy.ID, err
+}
+
+func (s *Store) ListPrivacyPolicies() ([]PrivacyPolicy, error) {
+	var policies []PrivacyPolicy
+	err := s.db.Order("published_at DESC").Find(&policies).Error
+	return policies, err
+}
+
+func (s *Store) ClaimDuePrivacyPolicies(now time.Time) ([]PrivacyPolicy, error) {
+	var due []PrivacyPolicy
+	err := s.db.Where("published_at<=? AND reconsent_requested_at IS NULL", now).Order("published_at").Find(&due).Error
+	if err != nil {
+		return nil, err
+	}
+	var claimed []PrivacyPolicy
+	for _, policy := range due {
+		update := s.db.Model(&PrivacyPolicy{}).Where("id=? AND reconsent_requested_at IS NULL", policy.ID).UpdateColumn("reconsent_requested_at", now)
+		if update.Error != nil {
+			return claimed, update.Error
+		}
+		if update.RowsAffected == 1 {
+			policy.ReconsentRequestedAt = &now
+			claimed = append(claimed, policy)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *Store) CurrentPrivacyPolicyVersion() string {
+	policy := PrivacyPolicy{}
+	err := s.db.Where("published_at<=?", time.Now()).Order("published_at DESC").First(&policy).Error
+	if err != nil {
+		return ""
+	}
+	return policy.Version
+}
+
+func (s *Store) RecordConsent(userId uint, consentType ConsentType, granted bool, source string) (*ConsentRecord, error) {
+	record := ConsentRecord{
+		UserId:        userId,
+		Type:          consentType,
+		Granted:       granted,
+		PolicyVersion: s.CurrentPrivacyPolicyVersion(),
+		Source:        source,
+	}
+	err := s.db.Create(&record).Error
+	return &record, err
+}
+
+func withdrawConsentWithoutSubscriptions(tx *gorm.DB, userId uint, policyVersion string, source string) error {
+	var count int
+	err := tx.Model(&ChannelSubscription{}).Where("user_id=?", userId).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+	latest := ConsentRecord{}
+	err = tx.Where("user_id=? AND type=?", userId, ConsentTypePreReleaseEmails).Order("id DESC").First(&latest).Error
+	if gorm.IsRecordNotFoundError(err) || (err == nil && !latest.Granted) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Create(&ConsentRecord{
+		UserId:        userId,
+		Type:          ConsentTypePreReleaseEmails,
+		Granted:       false,
+		PolicyVersion: policyVersion,
+		Source:        source,
+	}).Error
+}
+
+func (s *Store) ListConsentRecordsForUser(userId uint) ([]ConsentRecord, error) {
+	var records []ConsentRecord
+	err := s.db.Where("user_id=?", userId).Order("id").Find(&records).Error
+	return records, err
+}
+
+func (s *Store) ConsentStatusForUser(userId uint) ([]ConsentStatus, error) {
+	records, err := s.ListConsentRecordsForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	latest := map[ConsentType]ConsentRecord{}
+	for _, v := range records {
+		latest[v.Type] = v
+	}
+
+	currentVersion := s.CurrentPrivacyPolicyVersion()
+	var statuses []ConsentStatus
+	for _, consentType := range ConsentTypes {
+		status := ConsentStatus{Type: consentType}
+		if record, ok := latest[consentType]; ok {
+			status.Granted = record.Granted
+			status.PolicyVersion = record.PolicyVersion
+			status.RecordedAt = record.CreatedAt
+			status.Active = record.Granted && record.PolicyVersion == currentVersion
+			status.ReconsentRequired = record.Granted && record.PolicyVersion != currentVersion
+		} else if consentType == ConsentTypePreReleaseEmails {
+			status.ReconsentRequired = s.HasChannelSubscriptions(userId)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (s *Store) consentStatusForUser(userId uint, consentType ConsentType) ConsentStatus {
+	statuses, err := s.ConsentStatusForUser(userId)
+	if err == nil {
+		for _, v := range statuses {
+			if v.Type == consentType {
+				return v
+			}
+		}
+	}
+	return ConsentStatus{Type: consentType}
+}
+
+func (s *Store) HasActiveConsent(userId uint, consentType ConsentType) bool {
+	return s.consentStatusForUser(userId, consentType).Active
+}
+
+func (s *Store) HasGrantedConsent(userId uint, consentType ConsentType) bool {
+	return s.consentStatusForUser(userId, consentType).Granted
+}
+
+const activeConsentUsersSQL = "SELECT user_id FROM (" +
+	"SELECT DISTINCT ON (user_id) user_id, granted, policy_version FROM consent_records " +
+	"WHERE type=? AND deleted_at IS NULL ORDER BY user_id, id DESC" +
+	") latest WHERE granted IS TRUE AND policy_version=?"
+
+func (s *Store) HasChannelSubscriptions(userId uint) bool {
+	var count int
+	err := s.db.Model(&ChannelSubscription{}).Where("user_id=?", userId).Count(&count).Error
+	return err == nil && count > 0
+}
+
+func (s *Store) ListUserIdsWithGrantedConsent() ([]uint, error) {
+	var userIds []uint
+	err := s.db.Model(&ConsentRecord{}).Where("id IN (SELECT DISTINCT ON (user_id, type) id FROM consent_records "+
+		"WHERE deleted_at IS NULL ORDER BY user_id, type, created_at DESC, id DESC)").
+		Where("granted IS TRUE").Pluck("DISTINCT user_id", &userIds).Error
+	return userIds, err
+}
+
+func (s *Store) ListUserIdsWithUnconsentedSubscriptions() ([]uint, error) {
+	var userIds []uint
+	err := s.db.Model(&ChannelSubscription{}).
+		Where("user_id NOT IN (SELECT user_id FROM consent_records WHERE type=? AND deleted_at IS NULL)", ConsentTypePreReleaseEmails).
+		Pluck("DISTINCT user_id", &userIds).Error
+	return userIds, err
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/adamboardman/gorm"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type CrashKind string
+
+const (
+	CrashKindCrash CrashKind = "crash"
+	CrashKindLog   CrashKind = "log"
+)
+
+const crashSignatureFrames = 8
+const CrashSamplesPerGroup = 10
+const CrashLogBundlesPerDevice = 5
+
+type DeviceToken struct {
+	gorm.Model
+	UserId     uint `gorm:"index"`
+	Name       string
+	TokenHash  string `gorm:"unique_index" json:"-"`
+	LastUsedAt *time.Time
+}
+
+type CrashGroup struct {
+	gorm.Model
+	ArtifactId uint `gorm:"index"`
+	Kind       CrashKind
+	Signature  string
+	Title      string
+	Count      int
+	Samples    int
+	FirstSeen  time.Time
+	LastSeen   time.Time
+}
+
+type CrashUpload struct {
+	gorm.Model
+	GroupId       uint `gorm:"index"`
+	ArtifactId    uint `gorm:"index"`
+	UserId        uint `gorm:"index"`
+	DeviceTokenId uint
+	Device        string
+	Kind          CrashKind
+	ContentType   string
+	Size          int64
+	Data          []byte `json:"-"`
+}
+
+var ErrUnknownDeviceToken = errors.New("unknown device token")
+
+var (
+	crashFramePattern   = regexp.MustCompile(`^(at\s|#\d+\s|\d+\s+\S+\s+0x|\S+\.(go|c|cc|cpp|rs|swift|dart):\d+)`)
+	crashAddressPattern = regexp.MustCompile(`(\+\s*)?0x[0-9a-fA-F]+`)
+	crashNumberPattern  = regexp.MustCompile(`[0-9]+`)
+)
+
+func ParseCrashKind(value string) (CrashKind, error) {
+	switch CrashKind(value) {
+	case CrashKindCrash, CrashKindLog:
+		return CrashKind(value), nil
+	}
+	return "", errors.New("unknown upload kind: " + value)
+}
+
+func HashDeviceToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func normaliseCrashLine(line string) string {
+	line = crashAddressPattern.ReplaceAllString(line, "")
+	line = crashNumberPattern.ReplaceAllString(line, "N")
+	return strings.Join(strings.Fields(line), " ")
+}
+
+func CrashSignature(kind CrashKind, report string) (string, string) {
+	if kind == CrashKindLog {
+		hash := sha256.Sum256([]byte(string(kind) + "\n" + report))
+		return hex.EncodeToString(hash[:]), "Log bundles from " + report
+	}
+	title := ""
+	var frames []string
+	for _, line := range strings.Split(report, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if len(title) == 0 {
+			title = line
+		}
+		if crashFramePattern.MatchString(line) {
+			frames = append(frames, normaliseCrashLine(line))
+			if len(frames) == crashSignatureFrames {
+				break
+			}
+		}
+	}
+	if len(frames) == 0 {
+		frames = append(frames, normaliseCrashLine(title))
+	}
+	if len(title) > 200 {
+		title = title[:200]
+	}
+	hash := sha256.Sum256([]byte(string(kind) + "\n" + strings.Join(frames, "\n")))
+	return hex.EncodeToString(hash[:]), title
+}
+
+func (s *Store) InsertDeviceToken(token *DeviceToken) (uint, error) {
+	err := s.db.Create(token).Error
+	return token.ID, err
+}
+
+func (s *Store) ListDeviceTokensForUser(userId uint) ([]DeviceToken, error) {
+	var tokens []DeviceToken
+	err := s.db.Where("user_id=?", userId).Order("id").Find(&tokens).Error
+	return tokens, err
+}
+
+func (s *Store) DeleteDeviceToken(userId uint, id uint) error {
+	return s.db.Unscoped().Where("id=? AND user_id=?", id, userId).Delete(DeviceToken{}).Error
+}
+
+func (s *Store) AuthenticateDeviceToken(token string, now time.Time) (*DeviceToken, error) {
+	deviceToken := DeviceToken{}
+	err := s.db.Where("token_hash=?", HashDeviceToken(token)).Find(&deviceToken).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrUnknownDeviceToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Model(&deviceToken).UpdateColumn("last_used_at", now).Error
+	return &deviceToken, err
+}
+
+func (s *Store) InsertCrashUpload(upload *CrashUpload, signature string, title string, now time.Time) (*CrashGroup, error) {
+	tx := s.db.Begin()
+	err := tx.Exec("INSERT INTO crash_groups (created_at, updated_at, artifact_id, kind, signature, title, count, samples, first_seen, last_seen) "+
+		"VALUES (?, ?, ?, ?, ?, ?, 0, 0, ?, ?) ON CONFLICT (artifact_id, signature) DO NOTHING",
+		now, now, upload.ArtifactId, upload.Kind, signature, title, now, now).Error
+	group := CrashGroup{}
+	if err == nil {
+		err = tx.Raw("UPDATE crash_groups SET count=count+1, last_seen=?, updated_at=? WHERE artifact_id=? AND signature=? RETURNING *",
+			now, now, upload.ArtifactId, signature).Scan(&group).Error
+	}
+	if err == nil && upload.Kind == CrashKindLog {
+		upload.GroupId = group.ID
+		err = tx.Create(upload).Error
+		if err == nil {
+			err = tx.Unscoped().Where("group_id=? AND id NOT IN (SELECT id FROM crash_uploads WHERE group_id=? ORDER BY id DESC LIMIT ?)",
+				group.ID, group.ID, CrashLogBundlesPerDevice).Delete(CrashUpload{}).Error
+		}
+		if err == nil {
+			err = tx.Model(&CrashGroup{}).Where("id=?", group.ID).
+				UpdateColumn("samples", gorm.Expr("LEAST(samples+1, ?)", CrashLogBundlesPerDevice)).Error
+		}
+		if group.Samples < CrashLogBundlesPerDevice {
+			group.Samples++
+		}
+	} else if err == nil {
+		sample := tx.Model(&CrashGroup{}).Where("id=? AND samples<?", group.ID, CrashSamplesPerGroup).UpdateColumn("samples", gorm.Expr("samples+1"))
+		err = sample.Error
+		if err == nil && sample.RowsAffected > 0 {
+			group.Samples++
+			upload.GroupId = group.ID
+			err = tx.Create(upload).Error
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &group, tx.Commit().Error
+}
+
+func (s *Store) LoadCrashGroup(id uint) (*CrashGroup, error) {
+	group := CrashGroup{}
+	err := s.db.Where("id=?", id).Find(&group).Error
+	return &group, err
+}
+
+func (s *Store) ListCrashGroupsForBuild(artifactId uint) ([]CrashGroup, error) {
+	var groups []CrashGroup
+	err := s.db.Where("artifact_id=?", artifactId).Order("count DESC, last_seen DESC").Find(&groups).Error
+	return groups, err
+}
+
+func (s *Store) ListCrashUploadsForGroup(groupId uint) ([]CrashUpload, error) {
+	var uploads []CrashUpload
+	err := s.db.Select("id, created_at, updated_at, deleted_at, group_id, artifact_id, user_id, device_token_id, device, kind, content_type, size").
+		Where("group_id=?", groupId).Order("id DESC").Find(&uploads).Error
+	return uploads, err
+}
+
+func (s *Store) ListCrashUploadsForUser(userId uint) ([]CrashUpload, error) {
+	var uploads []CrashUpload
+	err := s.db.Select("id, created_at, updated_at, deleted_at, group_id, artifact_id, user_id, device_token_id, device, kind, content_type, size").
+		Where("user_id=?", userId).Order("id").Find(&uploads).Error
+	return uploads, err
+}
+
+func (s *Store) LoadCrashUpload(id uint) (*CrashUpload, error) {
+	upload := CrashUpload{}
+	err := s.db.Where("id=?", id).Find(&upload).Error
+	return &upload, err
+}
+
+func (s *Store) DeleteCrashUploadsBefore(before time.Time) error {
+	err := s.db.Unscoped().Where("created_at<?", before).Delete(CrashUpload{}).Error
+	if err != nil {
+		return err
+	}
+	return s.db.Exec("UPDATE crash_groups SET samples=(SELECT COUNT(*) FROM crash_uploads WHERE crash_uploads.group_id=crash_groups.id) " +
+		"WHERE samples>0").Error
+}
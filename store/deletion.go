@@ -0,0 +1,198 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+type AccountDeletionStatus string
+
+const (
+	AccountDeletionStatusScheduled AccountDeletionStatus = "scheduled"
+	AccountDeletionStatusCancelled AccountDeletionStatus = "cancelled"
+	AccountDeletionStatusCompleted AccountDeletionStatus = "completed"
+)
+
+const (
+	AuditActionDeletionScheduled = "account.deletion.scheduled"
+	AuditActionDeletionCancelled = "account.deletion.cancelled"
+	AuditActionDeletionCompleted = "account.deletion.completed"
+)
+
+type AccountDeletion struct {
+	gorm.Model
+	UserId       uint `gorm:"index"`
+	Status       AccountDeletionStatus
+	ScheduledFor time.Time
+	CompletedAt  *time.Time
+}
+
+var ErrAccountDeletionAlreadyScheduled = errors.New("account deletion already scheduled")
+
+func (s *Store) ScheduleAccountDeletion(userId uint, scheduledFor time.Time) (*AccountDeletion, error) {
+	_, err := s.LoadScheduledAccountDeletion(userId)
+	if err == nil {
+		return nil, ErrAccountDeletionAlreadyScheduled
+	}
+	deletion := AccountDeletion{
+		UserId:       userId,
+		Status:       AccountDeletionStatusScheduled,
+		ScheduledFor: scheduledFor,
+	}
+	tx := s.db.Begin()
+	err = tx.Create(&deletion).Error
+	if err == nil {
+		err = insertAuditRecord(tx, AuditActionDeletionScheduled, userId, userId, "scheduled for "+scheduledFor.Format(time.RFC3339))
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &deletion, tx.Commit().Error
+}
+
+func (s *Store) LoadScheduledAccountDeletion(userId uint) (*AccountDeletion, error) {
+	deletion := AccountDeletion{}
+	err := s.db.Where("user_id=? AND status=?", userId, AccountDeletionStatusScheduled).First(&deletion).Error
+	return &deletion, err
+}
+
+func (s *Store) CancelAccountDeletion(userId uint) error {
+	deletion, err := s.LoadScheduledAccountDeletion(userId)
+	if err != nil {
+		return err
+	}
+	tx := s.db.Begin()
+	err = tx.Model(deletion).Update("status", AccountDeletionStatusCancelled).Error
+	if err == nil {
+		err = insertAuditRecord(tx, AuditActionDeletionCancelled, userId, userId, "")
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) ListDueAccountDeletions(now time.Time) ([]AccountDeletion, error) {
+	var deletions []AccountDeletion
+	err := s.db.Where("status=? AND scheduled_for<=?", AccountDeletionStatusScheduled, now).Find(&deletions).Error
+	return deletions, err
+}
+
+func (s *Store) CompleteAccountDeletion(deletion *AccountDeletion, now time.Time) error {
+	tx := s.db.Begin()
+	err := anonymiseAndDeleteUser(tx, deletion.UserId)
+	if err == nil {
+		deletion.Status = AccountDeletionStatusCompleted
+		deletion.CompletedAt = &now
+		err = tx.Save(deletion).Error
+	}
+	if err == nil {
+		err = insertAuditRecord(tx, AuditActionDeletionCompleted, 0, deletion.UserId, "user deleted and survey content anonymised")
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func anonymiseAndDeleteUser(tx *gorm.DB, userId uint) error {
+	anonymised := map[string]interface{}{"name": "", "git_hub_id": "", "priorities": "", "issues": ""}
+	steps := []func() error{
+		func() error {
+			return tx.Model(&SurveyRevision{}).Where("survey_id IN (SELECT id FROM surveys WHERE user_id=?)", userId).Updates(anonymised).Error
+		},
+		func() error {
+			return tx.Model(&SurveyRevision{}).Where("author_id=?", userId).Update("author_id", 0).Error
+		},
+		func() error {
+			return tx.Model(&SponsorshipTransition{}).Unscoped().Where("sponsor_id=?", userId).Update("sponsor_id", 0).Error
+		},
+		func() error {
+			return tx.Model(&SponsorshipTransition{}).Unscoped().Where("developer_id=?", userId).Update("developer_id", 0).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("survey_id IN (SELECT id FROM surveys WHERE user_id=?)", userId).Delete(SurveySponsor{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(SurveySponsor{}).Error
+		},
+		func() error {
+			return tx.Model(&Survey{}).Unscoped().Where("user_id=?", userId).
+				Updates(map[string]interface{}{"user_id": nil, "name": "", "git_hub_id": "", "priorities": "", "issues": ""}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(MessageDelivery{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(ConsentRecord{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(DataExport{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(SponsorshipTier{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("goal_id IN (SELECT id FROM funding_goals WHERE user_id=?)", userId).Delete(FundingMilestone{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(FundingGoal{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(ChannelSubscription{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(AnnouncementDelivery{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("report_id IN (SELECT id FROM test_reports WHERE user_id=?)", userId).Delete(TestReportAttachment{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(TestReport{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(DeviceToken{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(NotificationPreference{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(InboxNotification{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(PushSubscription{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(VerifiedIdentity{}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("user_id=?", userId).Delete(CrashUpload{}).Error
+		},
+		func() error {
+			return tx.Model(&BuildDownload{}).Unscoped().Where("user_id=?", userId).
+				Updates(map[string]interface{}{"user_id": 0, "remote_addr": "", "user_agent": ""}).Error
+		},
+		func() error {
+			return tx.Model(&PaymentEvent{}).Unscoped().Where("sponsor_user_id=?", userId).
+				Updates(map[string]interface{}{"sponsor_user_id": 0, "sponsor_email": "", "sponsor_git_hub_id": "", "payload": ""}).Error
+		},
+		func() error {
+			return tx.Model(&PaymentEvent{}).Unscoped().Where("developer_user_id=?", userId).
+				Updates(map[string]interface{}{"developer_user_id": 0, "developer_email": "", "developer_git_hub_id": "", "payload": ""}).Error
+		},
+		func() error {
+			return tx.Unscoped().Where("id=?", userId).Delete(User{}).Error
+		},
+	}
+	for _, step := range steps {
+		err := step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
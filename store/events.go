@@ -0,0 +1,42 @@
+package store
+
+import (
+	"github.com/lib/pq"
+	"log"
+	"time"
+)
+
+const liveEventsChannel = "sponsor_hub_events"
+const LiveEventMaxPayload = 7900
+
+func (s *Store) PublishLiveEvent(payload string) error {
+	return s.db.Exec("SELECT pg_notify(?, ?)", liveEventsChannel, payload).Error
+}
+
+func (s *Store) ListenForLiveEvents(handle func(payload string)) error {
+	listener := pq.NewListener(readPostgresArgs(), 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Print(err)
+		}
+	})
+	err := listener.Listen(liveEventsChannel)
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case notification := <-listener.Notify:
+				if notification != nil {
+					handle(notification.Extra)
+				}
+			case <-time.After(90 * time.Second):
+				go func() {
+					_ = listener.Ping()
+				}()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+type DataExportStatus string
+
+const (
+	DataExportStatusPending DataExportStatus = "pending"
+	DataExportStatusReady   DataExportStatus = "ready"
+	DataExportStatusFailed  DataExportStatus = "failed"
+	DataExportStatusExpired DataExportStatus = "expired"
+)
+
+type DataExport struct {
+	gorm.Model
+	UserId    uint `gorm:"index"`
+	Status    DataExportStatus
+	ExpiresAt time.Time
+	Data      []byte `json:"-"`
+}
+
+type UserData struct {
+	User            PrivilegedUser
+	Surveys         []Survey
+	SurveyRevisions []SurveyRevision
+	SurveySponsors  []SurveySponsor
+	Sponsorships    []SponsorshipTransition
+	Payments        []PaymentEvent
+	LedgerEntries   []LedgerEntry
+	Receipts        []Receipt
+	Consents        []ConsentRecord
+	Subscriptions   []ChannelSubscription
+	Downloads       []BuildDownload
+	TestReports     []TestReport
+	DeviceTokens    []DeviceToken
+	CrashUploads    []CrashUpload
+	Preferences     []NotificationPreference
+	Inbox           []InboxNotification
+	Push            []PushSubscription
+	Identities      []VerifiedIdentity
+	Messages        []MessageDelivery
+}
+
+func (s *Store) InsertDataExport(export *DataExport) (uint, error) {
+	err := s.db.Create(export).Error
+	return export.ID, err
+}
+
+func (s *Store) UpdateDataExport(export *DataExport) (uint, error) {
+	err := s.db.Save(export).Error
+	return export.ID, err
+}
+
+func (s *Store) LoadDataExport(id uint) (*DataExport, error) {
+	export := DataExport{}
+	err := s.db.Where("id=?", id).Find(&export).Error
+	return &export, err
+}
+
+func (s *Store) ListDataExportsForUser(userId uint) ([]DataExport, error) {
+	var exports []DataExport
+	err := s.db.Select("id, created_at, updated_at, user_id, status, expires_at").
+		Where("user_id=?", userId).Order("id DESC").Find(&exports).Error
+	return exports, err
+}
+
+func (s *Store) ExpireDataExports(now time.Time) error {
+	return s.db.Model(&DataExport{}).Where("status=? AND expires_at<?", DataExportStatusReady, now).
+		Updates(map[string]interface{}{"status": DataExportStatusExpired, "data": nil}).Error
+}
+
+func (s *Store) CollectUserData(userId uint) (*UserData, error) {
+	data := UserData{}
+	err := s.db.Where("id=?", userId).Find(&data.User).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.Surveys).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("survey_id IN (SELECT id FROM surveys WHERE user_id=?)", userId).Order("survey_id, revision").Find(&data.SurveyRevisions).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=? OR survey_id IN (SELECT id FROM surveys WHERE user_id=?)", userId, userId).Order("id").Find(&data.SurveySponsors).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("sponsor_id=? OR developer_id=?", userId, userId).Order("id").Find(&data.Sponsorships).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("sponsor_user_id=? OR developer_user_id=?", userId, userId).Order("id").Find(&data.Payments).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range data.Payments {
+		if data.Payments[i].SponsorUserId != userId {
+			data.Payments[i].SponsorEmail = ""
+			data.Payments[i].SponsorGitHubId = ""
+		}
+		if data.Payments[i].DeveloperUserId != userId {
+			data.Payments[i].DeveloperEmail = ""
+			data.Payments[i].DeveloperGitHubId = ""
+		}
+	}
+	err = s.db.Where("sponsor_id=? OR developer_id=?", userId, userId).Order("id").Find(&data.LedgerEntries).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("sponsor_id=?", userId).Order("id").Find(&data.Receipts).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.Consents).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.Subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.Downloads).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.TestReports).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.DeviceTokens).Error
+	if err != nil {
+		return nil, err
+	}
+	data.CrashUploads, err = s.ListCrashUploadsForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.Preferences).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.Inbox).Error
+	if err != nil {
+		return nil, err
+	}
+	data.Push, err = s.ListPushSubscriptionsForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	data.Identities, err = s.ListVerifiedIdentitiesForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("user_id=?", userId).Order("id").Find(&data.Messages).Error
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"strings"
+	"time"
+)
+
+type FundingGoal struct {
+	gorm.Model
+	UserId      uint `gorm:"index"`
+	Title       string
+	Description string
+	Money
+	Milestones []FundingMilestone `gorm:"foreignkey:GoalId"`
+	Progress   *FundingProgress   `gorm:"-"`
+}
+
+type FundingMilestone struct {
+	gorm.Model
+	GoalId    uint `gorm:"index"`
+	Title     string
+	Amount    int64
+	ReachedAt *time.Time
+}
+
+type FundingProgress struct {
+	Monthly      Money
+	Sponsors     int
+	Percent      int
+	MissingRates []string
+}
+
+type MilestoneCrossing struct {
+	Goal      FundingGoal
+	Milestone FundingMilestone
+	Progress  FundingProgress
+}
+
+func (g *FundingGoal) Validate() error {
+	if len(g.Title) == 0 {
+		return errors.New("goal title is required")
+	}
+	if strings.ContainsAny(g.Title, "\r\n") {
+		return errors.New("goal title must be a single line")
+	}
+	err := g.Money.Validate()
+	if err != nil {
+		return err
+	}
+	if g.Amount <= 0 {
+		return errors.New("goal amount must be positive")
+	}
+	seen := map[int64]bool{}
+	for _, v := range g.Milestones {
+		if len(v.Title) == 0 {
+			return errors.New("milestone title is required")
+		}
+		if strings.ContainsAny(v.Title, "\r\n") {
+			return errors.New("milestone titles must be a single line")
+		}
+		if v.Amount <= 0 || v.Amount > g.Amount {
+			return errors.New("milestone amounts must be between zero and the goal amount")
+		}
+		if seen[v.Amount] {
+			return errors.New("milestone amounts must be unique")
+		}
+		seen[v.Amount] = true
+	}
+	return nil
+}
+
+func monthlyEquivalent(pledge *SurveySponsor) (Money, bool) {
+	switch pledge.Recurrence {
+	case RecurrenceMonthly:
+		return pledge.Money, true
+	case RecurrenceYearly:
+		return Money{Amount: pledge.Amount / 12, Currency: pledge.Currency}, true
+	}
+	return Money{}, false
+}
+
+func (s *Store) FundingProgressForUser(developerId uint, currency string, now time.Time) (*FundingProgress, error) {
+	var pledges []SurveySponsor
+	err := s.db.Where("user_id=? AND state=? AND start_date<=? AND (end_date IS NULL OR end_date>?)",
+		developerId, SponsorshipStateActive, now, now).Find(&pledges).Error
+	if err != nil {
+		return nil, err
+	}
+	progress := FundingProgress{Monthly: Money{Currency: currency}}
+	for i := range pledges {
+		monthly, ok := monthlyEquivalent(&pledges[i])
+		if !ok || monthly.Amount <= 0 {
+			continue
+		}
+		converted, err := s.ConvertMoney(monthly, currency, now)
+		if err != nil {
+			progress.MissingRates = append(progress.MissingRates, monthly.Currency)
+			continue
+		}
+		progress.Monthly.Amount += converted.Amount
+		progress.Sponsors++
+	}
+	return &progress, nil
+}
+
+func (g *FundingGoal) percentOf(progress *FundingProgress) int {
+	percent := int(progress.Monthly.Amount * 100 / g.Amount)
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+func (s *Store) fillFundingProgress(goals []FundingGoal, now time.Time) error {
+	progressByCurrency := map[uint]map[string]*FundingProgress{}
+	for i := range goals {
+		goal := &goals[i]
+		if progressByCurrency[goal.UserId] == nil {
+			progressByCurrency[goal.UserId] = map[string]*FundingProgress{}
+		}
+		progress := progressByCurrency[goal.UserId][goal.Currency]
+		if progress == nil {
+			var err error
+			progress, err = s.FundingProgressForUser(goal.UserId, goal.Currency, now)
+			if err != nil {
+				return err
+			}
+			progressByCurrency[goal.UserId][goal.Currency] = progress
+		}
+		goalProgress := *progress
+		goalProgress.Percent = goal.percentOf(progress)
+		goal.Progress = &goalProgress
+	}
+	return nil
+}
+
+func orderMilestones(db *gorm.DB) *gorm.DB {
+	return db.Order("amount")
+}
+
+func (s *Store) LoadFundingGoal(id uint) (*FundingGoal, error) {
+	goal := FundingGoal{}
+	err := s.db.Preload("Milestones", orderMilestones).Where("id=?", id).Find(&goal).Error
+	return &goal, err
+}
+
+func (s *Store) ListFundingGoalsForUsers(userIds []uint) ([]FundingGoal, error) {
+	var goals []FundingGoal
+	err := s.db.Preload("Milestones", orderMilestones).Where("user_id IN (?)", userIds).Order("user_id, amount").Find(&goals).Error
+	if err != nil {
+		return nil, err
+	}
+	return goals, s.fillFundingProgress(goals, time.Now())
+}
+
+func (s *Store) InsertFundingGoal(goal *FundingGoal) (uint, error) {
+	err := s.db.Create(goal).Error
+	return goal.ID, err
+}
+
+func (s *Store) UpdateFundingGoal(goal *FundingGoal) (uint, error) {
+	tx := s.db.Begin()
+	var existing []FundingMilestone
+	err := tx.Where("goal_id=?", goal.ID).Find(&existing).Error
+	if err == nil {
+		reached := map[int64]*time.Time{}
+		for _, v := range existing {
+			reached[v.Amount] = v.ReachedAt
+		}
+		for i := range goal.Milestones {
+			goal.Milestones[i].GoalId = goal.ID
+			goal.Milestones[i].ReachedAt = reached[goal.Milestones[i].Amount]
+		}
+		err = tx.Unscoped().Where("goal_id=?", goal.ID).Delete(FundingMilestone{}).Error
+	}
+	if err == nil {
+		err = tx.Save(goal).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return goal.ID, tx.Commit().Error
+}
+
+func (s *Store) DeleteFundingGoal(id uint) error {
+	tx := s.db.Begin()
+	err := tx.Where("goal_id=?", id).Delete(FundingMilestone{}).Error
+	if err == nil {
+		err = tx.Where("id=?", id).Delete(FundingGoal{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) ListUserIdsWithFundingGoals() ([]uint, error) {
+	var userIds []uint
+	err := s.db.Model(&FundingGoal{}).Pluck("DISTINCT user_id", &userIds).Error
+	return userIds, err
+}
+
+func (s *Store) ListActiveSponsorIdsForUser(developerId uint) ([]uint, error) {
+	var sponsorIds []uint
+	err := s.db.Model(&Survey{}).
+		Where("id IN (SELECT survey_id FROM survey_sponsors WHERE user_id=? AND state=? AND deleted_at IS NULL) AND user_id<>0", developerId, SponsorshipStateActive).
+		Pluck("DISTINCT user_id", &sponsorIds).Error
+	return sponsorIds, err
+}
+
+func (s *Store) CheckFundingMilestones(developerId uint, now time.Time) ([]MilestoneCrossing, error) {
+	var goals []FundingGoal
+	err := s.db.Preload("Milestones", orderMilestones).Where("user_id=?", developerId).Find(&goals).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.fillFundingProgress(goals, now)
+	if err != nil {
+		return nil, err
+	}
+	var crossings []MilestoneCrossing
+	for _, goal := range goals {
+		for _, milestone := range goal.Milestones {
+			if milestone.ReachedAt != nil || goal.Progress.Monthly.Amount < milestone.Amount {
+				continue
+			}
+			update := s.db.Model(&FundingMilestone{}).Where("id=? AND reached_at IS NULL", milestone.ID).Update("reached_at", now)
+			if update.Error != nil {
+				return crossings, update.Error
+			}
+			if update.RowsAffected == 1 {
+				milestone.ReachedAt = &now
+				crossings = append(crossings, MilestoneCrossing{Goal: goal, Milestone: milestone, Progress: *goal.Progress})
+			}
+		}
+	}
+	return crossings, nil
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+const inboxPageSize = 50
+
+type InboxNotification struct {
+	gorm.Model
+	UserId   uint `gorm:"index"`
+	Category NotificationCategory
+	Title    string
+	Body     string
+	Link     string
+	ReadAt   *time.Time
+}
+
+type InboxUnreadCount struct {
+	Unread     int
+	Categories map[NotificationCategory]int
+}
+
+func (s *Store) InsertInboxNotification(notification *InboxNotification) (uint, error) {
+	err := s.db.Create(notification).Error
+	return notification.ID, err
+}
+
+func (s *Store) ListInboxNotifications(userId uint, unreadOnly bool, beforeId uint) ([]InboxNotification, error) {
+	query := s.db.Limit(inboxPageSize).Where("user_id=?", userId)
+	if unreadOnly {
+		query = query.Where("read_at IS NULL")
+	}
+	if beforeId != 0 {
+		query = query.Where("id<?", beforeId)
+	}
+	var notifications []InboxNotification
+	err := query.Order("id DESC").Find(&notifications).Error
+	return notifications, err
+}
+
+func (s *Store) InboxUnreadCountForUser(userId uint) (*InboxUnreadCount, error) {
+	rows, err := s.db.Model(&InboxNotification{}).Select("category, COUNT(*)").
+		Where("user_id=? AND read_at IS NULL", userId).Group("category").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	count := InboxUnreadCount{Categories: map[NotificationCategory]int{}}
+	for rows.Next() {
+		var category NotificationCategory
+		var unread int
+		err = rows.Scan(&category, &unread)
+		if err != nil {
+			return nil, err
+		}
+		count.Categories[category] = unread
+		count.Unread += unread
+	}
+	return &count, rows.Err()
+}
+
+func (s *Store) MarkInboxNotificationRead(userId uint, id uint, now time.Time) (bool, error) {
+	update := s.db.Model(&InboxNotification{}).Where("id=? AND user_id=?", id, userId).Update("read_at", gorm.Expr("COALESCE(read_at, ?)", now))
+	return update.RowsAffected > 0, update.Error
+}
+
+func (s *Store) MarkAllInboxNotificationsRead(userId uint, category NotificationCategory, now time.Time) (int64, error) {
+	query := s.db.Model(&InboxNotification{}).Where("user_id=? AND read_at IS NULL", userId)
+	if len(category) > 0 && category != NotificationCategoryAll {
+		query = query.Where("category=?", category)
+	}
+	update := query.Update("read_at", now)
+	return update.RowsAffected, update.Error
+}
+
+func (s *Store) ListActiveSponsoredDeveloperIds(surveyId uint) ([]uint, error) {
+	var developerIds []uint
+	err := s.db.Model(&SurveySponsor{}).Where("survey_id=? AND state=?", surveyId, SponsorshipStateActive).
+		Pluck("DISTINCT user_id", &developerIds).Error
+	return developerIds, err
+}
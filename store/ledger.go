@@ -0,0 +1,375 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type LedgerEntryKind string
+
+const (
+	LedgerEntryKindPayment LedgerEntryKind = "payment"
+	LedgerEntryKindRefund  LedgerEntryKind = "refund"
+	LedgerEntryKindPayout  LedgerEntryKind = "payout"
+)
+
+var LedgerEntryKinds = []LedgerEntryKind{
+	LedgerEntryKindPayment,
+	LedgerEntryKindRefund,
+	LedgerEntryKindPayout,
+}
+
+func ParseLedgerEntryKind(value string) (LedgerEntryKind, error) {
+	for _, v := range LedgerEntryKinds {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown ledger entry kind: " + value)
+}
+
+const LedgerAccountBank = "bank"
+
+func LedgerAccountForDeveloper(developerId uint) string {
+	return "developer:" + strconv.FormatUint(uint64(developerId), 10)
+}
+
+type LedgerEntry struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	Kind        LedgerEntryKind
+	SponsorId   uint `gorm:"index"`
+	DeveloperId uint `gorm:"index"`
+	Money
+	EffectiveDate time.Time `gorm:"index"`
+	Reference     string
+	Memo          string
+	RecordedBy    uint
+	ReversesId    uint            `gorm:"default:0"`
+	Postings      []LedgerPosting `gorm:"foreignkey:EntryId"`
+	Reporting     *Money          `gorm:"-"`
+}
+
+type LedgerPosting struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	EntryId   uint   `gorm:"index"`
+	Account   string `gorm:"index"`
+	Money
+}
+
+type LedgerBalance struct {
+	Account  string
+	Currency string
+	Balance  int64
+}
+
+type ReconciliationLine struct {
+	SponsorId        uint
+	DeveloperId      uint
+	Currency         string
+	Expected         int64
+	ReceivedManual   int64
+	ReceivedProvider int64
+	Difference       int64
+	Reporting        *ReconciliationAmounts `json:",omitempty"`
+}
+
+type ReconciliationAmounts struct {
+	Expected   int64
+	Received   int64
+	Difference int64
+}
+
+type ReconciliationReport struct {
+	PeriodStart       time.Time
+	PeriodEnd         time.Time
+	Lines             []ReconciliationLine
+	Totals            []ReconciliationLine
+	ReportingCurrency string
+	ReportingTotals   ReconciliationAmounts
+	MissingRates      []string
+}
+
+var (
+	ErrLedgerEntryAlreadyReversed = errors.New("ledger entry has already been reversed")
+	ErrLedgerEntryIsReversal      = errors.New("a reversal cannot itself be reversed")
+)
+
+const ledgerImmutableSQL = "CREATE OR REPLACE FUNCTION ledger_immutable() RETURNS trigger AS $$ " +
+	"BEGIN RAISE EXCEPTION 'ledger rows are immutable, record a reversal instead'; END; $$ LANGUAGE plpgsql"
+
+func protectLedgerTables(db *gorm.DB) {
+	err := db.Exec(ledgerImmutableSQL).Error
+	for _, table := range []string{"ledger_entries", "ledger_postings"} {
+		if err == nil {
+			err = db.Exec("DROP TRIGGER IF EXISTS " + table + "_immutable ON " + table).Error
+		}
+		if err == nil {
+			err = db.Exec("CREATE TRIGGER " + table + "_immutable BEFORE UPDATE OR DELETE ON " + table +
+				" FOR EACH ROW EXECUTE PROCEDURE ledger_immutable()").Error
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (e *LedgerEntry) Validate() error {
+	if e.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if !ValidCurrencyCode(e.Currency) {
+		return errors.New("currency must be an ISO 4217 code")
+	}
+	if e.DeveloperId == 0 {
+		return errors.New("developer is required")
+	}
+	if e.Kind == LedgerEntryKindPayout && e.SponsorId != 0 {
+		return errors.New("payouts are not made against a sponsor")
+	}
+	if e.Kind != LedgerEntryKindPayout && e.SponsorId == 0 {
+		return errors.New("sponsor is required")
+	}
+	if e.EffectiveDate.IsZero() {
+		return errors.New("effective date is required")
+	}
+	return nil
+}
+
+func ledgerPostings(e *LedgerEntry) []LedgerPosting {
+	amount := e.Amount
+	if e.Kind != LedgerEntryKindPayment {
+		amount = -amount
+	}
+	return []LedgerPosting{
+		{Account: LedgerAccountBank, Money: Money{Amount: amount, Currency: e.Currency}},
+		{Account: LedgerAccountForDeveloper(e.DeveloperId), Money: Money{Amount: -amount, Currency: e.Currency}},
+	}
+}
+
+func (s *Store) InsertLedgerEntry(entry *LedgerEntry) (uint, error) {
+	entry.Postings = ledgerPostings(entry)
+	tx := s.db.Begin()
+	err := tx.Create(entry).Error
+	if err == nil && entry.Kind == LedgerEntryKindPayment {
+		err = s.issueReceipt(tx, &Receipt{
+			Source:      ReceiptSourceLedger,
+			SourceId:    entry.ID,
+			SponsorId:   entry.SponsorId,
+			DeveloperId: entry.DeveloperId,
+			Money:       entry.Money,
+			PaidAt:      entry.EffectiveDate,
+		})
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return entry.ID, tx.Commit().Error
+}
+
+func (s *Store) LoadLedgerEntry(id uint) (*LedgerEntry, error) {
+	entry := LedgerEntry{}
+	err := s.db.Preload("Postings").Where("id=?", id).Find(&entry).Error
+	return &entry, err
+}
+
+func (s *Store) ListLedgerEntries(sponsorId uint, developerId uint) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	query := s.db.Preload("Postings").Limit(500).Order("effective_date DESC, id DESC")
+	if sponsorId != 0 {
+		query = query.Where("sponsor_id=?", sponsorId)
+	}
+	if developerId != 0 {
+		query = query.Where("developer_id=?", developerId)
+	}
+	err := query.Find(&entries).Error
+	for i := range entries {
+		entries[i].Reporting = s.ToReportingCurrency(entries[i].Money, entries[i].EffectiveDate)
+	}
+	return entries, err
+}
+
+func (s *Store) ReverseLedgerEntry(id uint, memo string, recordedBy uint) (*LedgerEntry, error) {
+	tx := s.db.Begin()
+	original := LedgerEntry{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", id).Find(&original).Error
+	if err == nil && original.ReversesId != 0 {
+		err = ErrLedgerEntryIsReversal
+	}
+	if err == nil {
+		var count int
+		err = tx.Model(&LedgerEntry{}).Where("reverses_id=?", id).Count(&count).Error
+		if err == nil && count > 0 {
+			err = ErrLedgerEntryAlreadyReversed
+		}
+	}
+	reversal := LedgerEntry{
+		Kind:          original.Kind,
+		SponsorId:     original.SponsorId,
+		DeveloperId:   original.DeveloperId,
+		Money:         Money{Amount: -original.Amount, Currency: original.Currency},
+		EffectiveDate: time.Now(),
+		Reference:     original.Reference,
+		Memo:          memo,
+		RecordedBy:    recordedBy,
+		ReversesId:    original.ID,
+	}
+	if err == nil {
+		reversal.Postings = ledgerPostings(&reversal)
+		err = tx.Create(&reversal).Error
+	}
+	if err == nil {
+		err = tx.Model(&Receipt{}).Where("source=? AND source_id=?", ReceiptSourceLedger, original.ID).Update("voided_at", reversal.EffectiveDate).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &reversal, tx.Commit().Error
+}
+
+func (s *Store) LedgerBalances() ([]LedgerBalance, error) {
+	var balances []LedgerBalance
+	err := s.db.Model(&LedgerPosting{}).Select("account, currency, SUM(amount) AS balance").
+		Group("account, currency").Order("account, currency").Scan(&balances).Error
+	return balances, err
+}
+
+func pledgeDueInPeriod(pledge *SurveySponsor, start time.Time, end time.Time) bool {
+	if pledge.Amount <= 0 || !pledge.StartDate.Before(end) {
+		return false
+	}
+	if pledge.EndDate != nil && pledge.EndDate.Before(start) {
+		return false
+	}
+	if pledge.State == SponsorshipStatePaused && pledge.StateChangedAt.Before(start) {
+		return false
+	}
+	switch pledge.Recurrence {
+	case RecurrenceOneOff:
+		return !pledge.StartDate.Before(start)
+	case RecurrenceYearly:
+		return pledge.StartDate.Month() == start.Month()
+	}
+	return true
+}
+
+func (s *Store) ReconciliationReportForMonth(year int, month time.Month) (*ReconciliationReport, error) {
+	start := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	report := ReconciliationReport{PeriodStart: start, PeriodEnd: end, ReportingCurrency: s.reportingCurrency()}
+	missingRates := map[string]bool{}
+	toReporting := func(m Money, on time.Time) int64 {
+		converted := s.ToReportingCurrency(m, on)
+		if converted == nil {
+			missingRates[m.Currency+" on "+on.Format("2006-01-02")] = true
+			return 0
+		}
+		return converted.Amount
+	}
+
+	type lineKey struct {
+		sponsorId   uint
+		developerId uint
+		currency    string
+	}
+	lines := map[lineKey]*ReconciliationLine{}
+	line := func(sponsorId uint, developerId uint, currency string) *ReconciliationLine {
+		key := lineKey{sponsorId, developerId, currency}
+		if lines[key] == nil {
+			lines[key] = &ReconciliationLine{SponsorId: sponsorId, DeveloperId: developerId, Currency: currency, Reporting: &ReconciliationAmounts{}}
+		}
+		return lines[key]
+	}
+
+	var pledges []struct {
+		SurveySponsor
+		SponsorId uint
+	}
+	err := s.db.Table("survey_sponsors").Select("survey_sponsors.*, surveys.user_id AS sponsor_id").
+		Joins("JOIN surveys ON surveys.id=survey_sponsors.survey_id").
+		Where("survey_sponsors.deleted_at IS NULL AND survey_sponsors.amount>0").Scan(&pledges).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range pledges {
+		if pledgeDueInPeriod(&pledges[i].SurveySponsor, start, end) {
+			pledgeLine := line(pledges[i].SponsorId, pledges[i].UserId, pledges[i].Currency)
+			pledgeLine.Expected += pledges[i].Amount
+			pledgeLine.Reporting.Expected += toReporting(pledges[i].Money, start)
+		}
+	}
+
+	var entries []LedgerEntry
+	err = s.db.Where("effective_date>=? AND effective_date<? AND kind IN (?)", start, end,
+		[]LedgerEntryKind{LedgerEntryKindPayment, LedgerEntryKindRefund}).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range entries {
+		amount := v.Amount
+		if v.Kind == LedgerEntryKindRefund {
+			amount = -amount
+		}
+		entryLine := line(v.SponsorId, v.DeveloperId, v.Currency)
+		entryLine.ReceivedManual += amount
+		entryLine.Reporting.Received += toReporting(Money{Amount: amount, Currency: v.Currency}, v.EffectiveDate)
+	}
+
+	var events []PaymentEvent
+	err = s.db.Where("created_at>=? AND created_at<? AND status IN (?) AND action IN (?) AND amount>0", start, end,
+		[]PaymentEventStatus{PaymentEventStatusProcessed, PaymentEventStatusResolved},
+		[]PaymentAction{PaymentActionStarted, PaymentActionRenewed}).Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range events {
+		eventLine := line(v.SponsorUserId, v.DeveloperUserId, v.Currency)
+		eventLine.ReceivedProvider += v.Amount
+		eventLine.Reporting.Received += toReporting(v.Money, v.CreatedAt)
+	}
+
+	totals := map[string]*ReconciliationLine{}
+	for _, v := range lines {
+		v.Difference = v.ReceivedManual + v.ReceivedProvider - v.Expected
+		v.Reporting.Difference = v.Reporting.Received - v.Reporting.Expected
+		report.ReportingTotals.Expected += v.Reporting.Expected
+		report.ReportingTotals.Received += v.Reporting.Received
+		report.ReportingTotals.Difference += v.Reporting.Difference
+		report.Lines = append(report.Lines, *v)
+		if totals[v.Currency] == nil {
+			totals[v.Currency] = &ReconciliationLine{Currency: v.Currency}
+		}
+		totals[v.Currency].Expected += v.Expected
+		totals[v.Currency].ReceivedManual += v.ReceivedManual
+		totals[v.Currency].ReceivedProvider += v.ReceivedProvider
+		totals[v.Currency].Difference += v.Difference
+	}
+	for _, v := range totals {
+		report.Totals = append(report.Totals, *v)
+	}
+	for v := range missingRates {
+		report.MissingRates = append(report.MissingRates, v)
+	}
+	sort.Strings(report.MissingRates)
+	sort.Slice(report.Lines, func(i, j int) bool {
+		a, b := report.Lines[i], report.Lines[j]
+		if a.SponsorId != b.SponsorId {
+			return a.SponsorId < b.SponsorId
+		}
+		if a.DeveloperId != b.DeveloperId {
+			return a.DeveloperId < b.DeveloperId
+		}
+		return a.Currency < b.Currency
+	})
+	sort.Slice(report.Totals, func(i, j int) bool {
+		return report.Totals[i].Currency < report.Totals[j].Currency
+	})
+	return &report, nil
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/gorm"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const ReportingCurrencyDefault = "GBP"
+
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+var currencyExponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLP": 0, "ISK": 0, "JPY": 0, "KRW": 0, "PYG": 0, "UGX": 0, "VND": 0,
+}
+
+func CurrencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+func (m Money) Validate() error {
+	if m.Amount < 0 {
+		return errors.New("amount cannot be negative")
+	}
+	if m.Amount > 0 && !ValidCurrencyCode(m.Currency) {
+		return errors.New("currency must be an ISO 4217 code")
+	}
+	return nil
+}
+
+func (m Money) String() string {
+	exponent := CurrencyExponent(m.Currency)
+	if exponent == 0 {
+		return fmt.Sprintf("%s %d", m.Currency, m.Amount)
+	}
+	value := new(big.Rat).SetFrac(big.NewInt(m.Amount), pow10(exponent))
+	return m.Currency + " " + value.FloatString(exponent)
+}
+
+func pow10(exponent int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+}
+
+func roundRat(value *big.Rat) int64 {
+	quotient, remainder := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	remainder.Abs(remainder).Mul(remainder, big.NewInt(2))
+	if remainder.Cmp(value.Denom()) >= 0 {
+		if value.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	return quotient.Int64()
+}
+
+func (m Money) convert(currency string, rate *big.Rat) Money {
+	value := new(big.Rat).SetInt64(m.Amount)
+	value.Mul(value, rate)
+	value.Mul(value, new(big.Rat).SetFrac(pow10(CurrencyExponent(currency)), pow10(CurrencyExponent(m.Currency))))
+	return Money{Amount: roundRat(value), Currency: currency}
+}
+
+type ExchangeRate struct {
+	gorm.Model
+	FromCurrency  string `gorm:"index"`
+	ToCurrency    string `gorm:"index"`
+	Rate          string
+	EffectiveFrom time.Time
+	CreatedBy     uint
+}
+
+var ErrNoExchangeRate = errors.New("no exchange rate for that currency and date")
+
+func parseRate(rate string) (*big.Rat, bool) {
+	value, ok := new(big.Rat).SetString(strings.TrimSpace(rate))
+	if !ok || value.Sign() <= 0 {
+		return nil, false
+	}
+	return value, true
+}
+
+func (r *ExchangeRate) Validate() error {
+	if !ValidCurrencyCode(r.FromCurrency) || !ValidCurrencyCode(r.ToCurrency) {
+		return errors.New("currencies must be ISO 4217 codes")
+	}
+	if r.FromCurrency == r.ToCurrency {
+		return errors.New("an exchange rate needs two different currencies")
+	}
+	if _, ok := parseRate(r.Rate); !ok {
+		return errors.New("rate must be a positive decimal number")
+	}
+	if r.EffectiveFrom.IsZero() {
+		return errors.New("effective from date is required")
+	}
+	return nil
+}
+
+func (s *Store) InsertExchangeRate(rate *ExchangeRate) (uint, error) {
+	err := s.db.Create(rate).Error
+	return rate.ID, err
+}
+
+func (s *Store) DeleteExchangeRate(id uint) error {
+	return s.db.Where("id=?", id).Delete(ExchangeRate{}).Error
+}
+
+func (s *Store) ListExchangeRates() ([]ExchangeRate, error) {
+	var rates []ExchangeRate
+	err := s.db.Order("from_currency, to_currency, effective_from DESC").Find(&rates).Error
+	return rates, err
+}
+
+func (s *Store) exchangeRateOn(from string, to string, on time.Time) (*big.Rat, error) {
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+	var direct, inverse *big.Rat
+	var directFrom, inverseFrom time.Time
+	rate := ExchangeRate{}
+	err := s.db.Where("from_currency=? AND to_currency=? AND effective_from<=?", from, to, on).Order("effective_from DESC").First(&rate).Error
+	if err == nil {
+		direct, _ = parseRate(rate.Rate)
+		directFrom = rate.EffectiveFrom
+	}
+	rate = ExchangeRate{}
+	err = s.db.Where("from_currency=? AND to_currency=? AND effective_from<=?", to, from, on).Order("effective_from DESC").First(&rate).Error
+	if err == nil {
+		inverse, _ = parseRate(rate.Rate)
+		inverseFrom = rate.EffectiveFrom
+	}
+	if inverse != nil && (direct == nil || inverseFrom.After(directFrom)) {
+		return inverse.Inv(inverse), nil
+	}
+	if direct != nil {
+		return direct, nil
+	}
+	return nil, ErrNoExchangeRate
+}
+
+func (s *Store) ConvertMoney(m Money, currency string, on time.Time) (Money, error) {
+	if m.Amount == 0 {
+		return Money{Currency: currency}, nil
+	}
+	rate, err := s.exchangeRateOn(m.Currency, currency, on)
+	if err != nil {
+		return Money{}, err
+	}
+	return m.convert(currency, rate), nil
+}
+
+func (s *Store) reportingCurrency() string {
+	if len(s.ReportingCurrency) == 0 {
+		return ReportingCurrencyDefault
+	}
+	return s.ReportingCurrency
+}
+
+func (s *Store) ToReportingCurrency(m Money, on time.Time) *Money {
+	converted, err := s.ConvertMoney(m, s.reportingCurrency(), on)
+	if err != nil {
+		return nil
+	}
+	return &converted
+}
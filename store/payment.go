@@ -0,0 +1,278 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+type PaymentProvider string
+
+const (
+	PaymentProviderGitHubSponsors PaymentProvider = "github-sponsors"
+	PaymentProviderStripe         PaymentProvider = "stripe"
+)
+
+type PaymentAction string
+
+const (
+	PaymentActionStarted   PaymentAction = "started"
+	PaymentActionRenewed   PaymentAction = "renewed"
+	PaymentActionChanged   PaymentAction = "changed"
+	PaymentActionCancelled PaymentAction = "cancelled"
+	PaymentActionIgnored   PaymentAction = "ignored"
+)
+
+type PaymentEventStatus string
+
+const (
+	PaymentEventStatusProcessed PaymentEventStatus = "processed"
+	PaymentEventStatusUnmatched PaymentEventStatus = "unmatched"
+	PaymentEventStatusIgnored   PaymentEventStatus = "ignored"
+	PaymentEventStatusResolved  PaymentEventStatus = "resolved"
+)
+
+const AuditActionPaymentEventResolved = "payment.event.resolved"
+
+const IdentityProviderGitHub = "github"
+
+type PaymentEvent struct {
+	gorm.Model
+	Provider          PaymentProvider
+	EventId           string
+	Type              string
+	Action            PaymentAction
+	Status            PaymentEventStatus `gorm:"index"`
+	SponsorEmail      string
+	SponsorGitHubId   string
+	DeveloperEmail    string
+	DeveloperGitHubId string
+	Money
+	Recurrence      Recurrence
+	SponsorUserId   uint `gorm:"index"`
+	DeveloperUserId uint `gorm:"index"`
+	SurveySponsorId uint
+	Note            string
+	Payload         string `json:"-"`
+	Reporting       *Money `gorm:"-"`
+}
+
+type VerifiedIdentity struct {
+	gorm.Model
+	UserId   uint `gorm:"index"`
+	Provider string
+	Login    string
+	Source   string
+}
+
+var (
+	ErrPaymentEventDuplicate = errors.New("payment event already received")
+	ErrPaymentEventResolved  = errors.New("payment event does not need reconciling")
+)
+
+func (s *Store) FindUserByVerifiedIdentity(email string, gitHubId string) (*User, error) {
+	user := User{}
+	if len(email) > 0 {
+		err := s.db.Where("LOWER(email)=LOWER(?) AND confirmed IS TRUE", email).First(&user).Error
+		if err == nil {
+			return &user, nil
+		}
+	}
+	if len(gitHubId) > 0 {
+		err := s.db.Where("id IN (SELECT user_id FROM verified_identities WHERE provider=? AND login=? AND deleted_at IS NULL) AND confirmed IS TRUE",
+			IdentityProviderGitHub, normaliseLogin(gitHubId)).First(&user).Error
+		if err == nil {
+			return &user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func normaliseLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+func verifyIdentity(db *gorm.DB, userId uint, provider string, login string, source string) error {
+	now := time.Now()
+	return db.Exec("INSERT INTO verified_identities (created_at, updated_at, user_id, provider, login, source) "+
+		"VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (provider, login) DO NOTHING", now, now, userId, provider, normaliseLogin(login), source).Error
+}
+
+func (s *Store) VerifyIdentity(userId uint, provider string, login string, source string) error {
+	return verifyIdentity(s.db, userId, provider, login, source)
+}
+
+func (s *Store) ListVerifiedIdentitiesForUser(userId uint) ([]VerifiedIdentity, error) {
+	var identities []VerifiedIdentity
+	err := s.db.Where("user_id=?", userId).Order("id").Find(&identities).Error
+	return identities, err
+}
+
+func (s *Store) PurgeVerifiedIdentitiesForUser(userId uint) {
+	s.db.Unscoped().Where("user_id=?", userId).Delete(VerifiedIdentity{})
+}
+
+func unmatchedIdentityNote(role string, gitHubId string) string {
+	if len(gitHubId) > 0 {
+		return role + " github handle not verified"
+	}
+	return role + " not found"
+}
+
+func (s *Store) LoadPaymentEvent(id uint) (*PaymentEvent, error) {
+	event := PaymentEvent{}
+	err := s.db.Where("id=?", id).Find(&event).Error
+	return &event, err
+}
+
+func (s *Store) ListPaymentEvents(status PaymentEventStatus) ([]PaymentEvent, error) {
+	var events []PaymentEvent
+	query := s.db.Limit(200).Order("id DESC")
+	if len(status) > 0 {
+		query = query.Where("status=?", status)
+	}
+	err := query.Find(&events).Error
+	for i := range events {
+		events[i].Reporting = s.ToReportingCurrency(events[i].Money, events[i].CreatedAt)
+	}
+	return events, err
+}
+
+func (s *Store) IngestPaymentEvent(event *PaymentEvent) error {
+	tx := s.db.Begin()
+	var count int
+	err := tx.Model(&PaymentEvent{}).Where("provider=? AND event_id=?", event.Provider, event.EventId).Count(&count).Error
+	if err == nil && count > 0 {
+		err = ErrPaymentEventDuplicate
+	}
+	if err == nil {
+		err = s.processPaymentEvent(tx, event)
+	}
+	if err == nil {
+		err = tx.Create(event).Error
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+			err = ErrPaymentEventDuplicate
+		}
+	}
+	if err == nil {
+		err = s.issuePaymentEventReceipt(tx, event)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) processPaymentEvent(tx *gorm.DB, event *PaymentEvent) error {
+	if event.Action == PaymentActionIgnored {
+		event.Status = PaymentEventStatusIgnored
+		return nil
+	}
+	var notes []string
+	sponsor, err := s.FindUserByVerifiedIdentity(event.SponsorEmail, event.SponsorGitHubId)
+	if err != nil {
+		notes = append(notes, unmatchedIdentityNote("sponsor", event.SponsorGitHubId))
+	}
+	developer, err := s.FindUserByVerifiedIdentity(event.DeveloperEmail, event.DeveloperGitHubId)
+	if err != nil {
+		notes = append(notes, unmatchedIdentityNote("developer", event.DeveloperGitHubId))
+	}
+	if len(notes) > 0 {
+		event.Status = PaymentEventStatusUnmatched
+		event.Note = strings.Join(notes, ", ")
+		return nil
+	}
+
+	err = s.applyPaymentEvent(tx, event, sponsor.ID, developer.ID)
+	if err == ErrSelfSponsorship || err == ErrNotSponsorable {
+		event.Status = PaymentEventStatusUnmatched
+		event.Note = err.Error()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	event.Status = PaymentEventStatusProcessed
+	return nil
+}
+
+func (s *Store) applyPaymentEvent(tx *gorm.DB, event *PaymentEvent, sponsorId uint, developerId uint) error {
+	survey, err := s.loadOrCreateSurveyForUser(tx, sponsorId)
+	if err != nil {
+		return err
+	}
+	err = checkSponsorable(tx, survey, developerId)
+	if err != nil {
+		return err
+	}
+	event.SponsorUserId = sponsorId
+	event.DeveloperUserId = developerId
+
+	reason := string(event.Provider) + " " + event.Type
+	surveySponsor := SurveySponsor{}
+	err = tx.Where("survey_id=? AND user_id=?", survey.ID, developerId).Find(&surveySponsor).Error
+	if gorm.IsRecordNotFoundError(err) {
+		if event.Action == PaymentActionCancelled {
+			return nil
+		}
+		surveySponsor = SurveySponsor{SurveyId: survey.ID, UserId: developerId, Money: event.Money, Recurrence: event.Recurrence}
+		err = insertSurveySponsor(tx, &surveySponsor)
+		event.SurveySponsorId = surveySponsor.ID
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	event.SurveySponsorId = surveySponsor.ID
+
+	if event.Action == PaymentActionCancelled {
+		if surveySponsor.State == SponsorshipStateEnded {
+			return nil
+		}
+		return transitionSurveySponsor(tx, &surveySponsor, SponsorshipStateEnded, reason)
+	}
+	if event.Amount > 0 {
+		surveySponsor.Money = event.Money
+		surveySponsor.Recurrence = event.Recurrence
+	}
+	if surveySponsor.State != SponsorshipStateActive {
+		return transitionSurveySponsor(tx, &surveySponsor, SponsorshipStateActive, reason)
+	}
+	return tx.Save(&surveySponsor).Error
+}
+
+func (s *Store) ResolvePaymentEvent(id uint, sponsorId uint, developerId uint, actorId uint) (*PaymentEvent, error) {
+	tx := s.db.Begin()
+	event := PaymentEvent{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", id).Find(&event).Error
+	if err == nil && event.Status != PaymentEventStatusUnmatched {
+		err = ErrPaymentEventResolved
+	}
+	if err == nil {
+		err = s.applyPaymentEvent(tx, &event, sponsorId, developerId)
+	}
+	if err == nil {
+		event.Status = PaymentEventStatusResolved
+		err = tx.Save(&event).Error
+	}
+	if err == nil {
+		err = s.issuePaymentEventReceipt(tx, &event)
+	}
+	if err == nil && len(event.SponsorGitHubId) > 0 {
+		err = verifyIdentity(tx, sponsorId, IdentityProviderGitHub, event.SponsorGitHubId, "admin-reconciliation")
+	}
+	if err == nil && len(event.DeveloperGitHubId) > 0 {
+		err = verifyIdentity(tx, developerId, IdentityProviderGitHub, event.DeveloperGitHubId, "admin-reconciliation")
+	}
+	if err == nil {
+		err = insertAuditRecord(tx, AuditActionPaymentEventResolved, actorId, sponsorId, string(event.Provider)+" "+event.EventId)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &event, tx.Commit().Error
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+type NotificationCategory string
+
+const (
+	NotificationCategoryAll           NotificationCategory = "all"
+	NotificationCategoryAccount       NotificationCategory = "account"
+	NotificationCategoryReleases      NotificationCategory = "releases"
+	NotificationCategoryAnnouncements NotificationCategory = "announcements"
+	NotificationCategorySponsorship   NotificationCategory = "sponsorship"
+	NotificationCategoryTesting       NotificationCategory = "testing"
+	NotificationCategoryReceipts      NotificationCategory = "receipts"
+)
+
+type NotificationChannel string
+
+const (
+	NotificationChannelEmail NotificationChannel = "email"
+	NotificationChannelPush  NotificationChannel = "push"
+)
+
+var NotificationCategories = []NotificationCategory{
+	NotificationCategoryReleases,
+	NotificationCategoryAnnouncements,
+	NotificationCategorySponsorship,
+	NotificationCategoryTesting,
+	NotificationCategoryReceipts,
+}
+
+var optInNotificationCategories = map[NotificationCategory]bool{
+	NotificationCategoryAnnouncements: true,
+}
+
+var ErrRequiredNotificationCategory = errors.New("account emails can not be turned off")
+
+func ParseNotificationCategory(value string) (NotificationCategory, error) {
+	switch NotificationCategory(value) {
+	case NotificationCategoryAll:
+		return NotificationCategoryAll, nil
+	case NotificationCategoryAccount:
+		return "", ErrRequiredNotificationCategory
+	}
+	for _, v := range NotificationCategories {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown notification category: " + value)
+}
+
+func (c NotificationCategory) Kind() MessageKind {
+	switch c {
+	case NotificationCategoryReleases:
+		return MessageKindRelease
+	case NotificationCategoryAccount:
+		return MessageKindTransactional
+	}
+	return MessageKindUpdate
+}
+
+type NotificationPreference struct {
+	gorm.Model
+	UserId   uint `gorm:"index"`
+	Category NotificationCategory
+	Channel  NotificationChannel `gorm:"default:'email'"`
+	Enabled  bool
+	Source   string
+}
+
+type NotificationPreferences struct {
+	Frequency  CommsFrequency
+	Categories map[NotificationCategory]bool
+	Push       map[NotificationCategory]bool
+}
+
+func (s *Store) LoadNotificationPreferences(userId uint) (*NotificationPreferences, error) {
+	preferences := NotificationPreferences{
+		Frequency:  s.LoadCommsFrequencyForUser(userId),
+		Categories: map[NotificationCategory]bool{},
+		Push:       map[NotificationCategory]bool{},
+	}
+	for _, v := range NotificationCategories {
+		preferences.Categories[v] = !optInNotificationCategories[v]
+		preferences.Push[v] = !optInNotificationCategories[v]
+	}
+	var stored []NotificationPreference
+	err := s.db.Where("user_id=?", userId).Find(&stored).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range stored {
+		categories := preferences.Categories
+		if v.Channel == NotificationChannelPush {
+			categories = preferences.Push
+		}
+		if _, ok := categories[v.Category]; ok {
+			categories[v.Category] = v.Enabled
+		}
+	}
+	return &preferences, nil
+}
+
+func (s *Store) AllowsNotification(userId uint, category NotificationCategory) bool {
+	return s.allowsNotificationOn(userId, NotificationChannelEmail, category)
+}
+
+func (s *Store) AllowsPushNotification(userId uint, category NotificationCategory) bool {
+	return s.allowsNotificationOn(userId, NotificationChannelPush, category)
+}
+
+func (s *Store) allowsNotificationOn(userId uint, channel NotificationChannel, category NotificationCategory) bool {
+	if category == NotificationCategoryAccount {
+		return true
+	}
+	var count int
+	if optInNotificationCategories[category] {
+		err := s.db.Model(&NotificationPreference{}).Where("user_id=? AND channel=? AND category=? AND enabled IS TRUE", userId, channel, category).
+			Count(&count).Error
+		return err == nil && count > 0
+	}
+	err := s.db.Model(&NotificationPreference{}).Where("user_id=? AND channel=? AND category=? AND enabled IS FALSE", userId, channel, category).
+		Count(&count).Error
+	return err == nil && count == 0
+}
+
+func (s *Store) ListUserIdsWithNotificationDisabled(category NotificationCategory) ([]uint, error) {
+	var userIds []uint
+	err := s.db.Model(&NotificationPreference{}).Where("channel=? AND category=? AND enabled IS FALSE", NotificationChannelEmail, category).
+		Pluck("user_id", &userIds).Error
+	return userIds, err
+}
+
+func setNotificationPreference(db *gorm.DB, userId uint, channel NotificationChannel, category NotificationCategory, enabled bool, source string) error {
+	now := time.Now()
+	return db.Exec("INSERT INTO notification_preferences (created_at, updated_at, user_id, category, channel, enabled, source) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (user_id, category, channel) DO UPDATE SET enabled=EXCLUDED.enabled, "+
+		"source=EXCLUDED.source, updated_at=EXCLUDED.updated_at", now, now, userId, category, channel, enabled, source).Error
+}
+
+func validPreferenceCategories(categories map[NotificationCategory]bool) error {
+	for category := range categories {
+		if category == NotificationCategoryAll {
+			return errors.New("preferences are set per category")
+		}
+		_, err := ParseNotificationCategory(string(category))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) UpdateNotificationPreferences(userId uint, preferences *NotificationPreferences, source string) error {
+	err := validPreferenceCategories(preferences.Categories)
+	if err == nil {
+		err = validPreferenceCategories(preferences.Push)
+	}
+	if err != nil {
+		return err
+	}
+	if len(preferences.Frequency) > 0 {
+		_, err := ParseCommsFrequency(string(preferences.Frequency))
+		if err != nil {
+			return err
+		}
+	}
+
+	tx := s.db.Begin()
+	for category, enabled := range preferences.Categories {
+		err := setNotificationPreference(tx, userId, NotificationChannelEmail, category, enabled, source)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for category, enabled := range preferences.Push {
+		err := setNotificationPreference(tx, userId, NotificationChannelPush, category, enabled, source)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if len(preferences.Frequency) > 0 {
+		update := tx.Model(&Survey{}).Where("user_id=? AND campaign_id=0", userId).UpdateColumn("comms_frequency", preferences.Frequency)
+		err := update.Error
+		if err == nil && update.RowsAffected == 0 {
+			survey := Survey{UserId: userId, CommsFrequency: preferences.Frequency}
+			err = tx.Create(&survey).Error
+			if err == nil {
+				err = s.insertSurveyRevision(tx, &survey, userId)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) UnsubscribeFromNotifications(userId uint, category NotificationCategory, source string) error {
+	categories := []NotificationCategory{category}
+	if category == NotificationCategoryAll {
+		categories = NotificationCategories
+	}
+	preferences := NotificationPreferences{Categories: map[NotificationCategory]bool{}}
+	for _, v := range categories {
+		preferences.Categories[v] = false
+	}
+	return s.UpdateNotificationPreferences(userId, &preferences, source)
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"errors"
+	"strings"
+)
+
+type PrivacyLevel string
+
+const (
+	PrivacyLevelAdmins     PrivacyLevel = "admins"
+	PrivacyLevelDevelopers PrivacyLevel = "developers"
+	PrivacyLevelPublic     PrivacyLevel = "public"
+)
+
+const PrivacyLevelDefault = PrivacyLevelAdmins
+
+var PrivacyLevels = []PrivacyLevel{
+	PrivacyLevelAdmins,
+	PrivacyLevelDevelopers,
+	PrivacyLevelPublic,
+}
+
+func ParsePrivacyLevel(value string) (PrivacyLevel, error) {
+	if len(value) == 0 {
+		return PrivacyLevelDefault, nil
+	}
+	for _, v := range PrivacyLevels {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown privacy level: " + value)
+}
+
+func legacyPrivacyLevel(answer string) PrivacyLevel {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	for _, v := range PrivacyLevels {
+		if string(v) == answer {
+			return v
+		}
+	}
+	switch {
+	case legacyAnswerMatches(answer, []string{"private", "admin", "admins", "no", "not", "nobody", "none"}):
+		return PrivacyLevelAdmins
+	case legacyAnswerMatches(answer, []string{"developer", "developers", "dev", "devs", "sponsored"}):
+		return PrivacyLevelDevelopers
+	case legacyAnswerMatches(answer, []string{"public", "anyone", "everyone", "anybody", "everybody"}):
+		return PrivacyLevelPublic
+	}
+	return PrivacyLevelDefault
+}
+
+type SurveyViewer int
+
+const (
+	SurveyViewerOther SurveyViewer = iota + 1
+	SurveyViewerSponsoredDeveloper
+	SurveyViewerAdmin
+	SurveyViewerOwner
+)
+
+func (l PrivacyLevel) VisibleTo(viewer SurveyViewer) bool {
+	switch viewer {
+	case SurveyViewerOwner, SurveyViewerAdmin:
+		return true
+	case SurveyViewerSponsoredDeveloper:
+		return l == PrivacyLevelDevelopers || l == PrivacyLevelPublic
+	}
+	return l == PrivacyLevelPublic
+}
+
+func (s *Store) SurveyViewerFor(survey *Survey, viewerId uint) SurveyViewer {
+	if survey.UserId == viewerId {
+		return SurveyViewerOwner
+	}
+	viewer, err := s.LoadPrivilegedUserAsSelf(viewerId, viewerId)
+	if err != nil {
+		return SurveyViewerOther
+	}
+	if viewer.Permissions >= UserPermissionsAdmin {
+		return SurveyViewerAdmin
+	}
+	if viewer.Permissions >= UserPermissionsUser {
+		var count int
+		s.db.Model(&SurveySponsor{}).Where("survey_id=? AND user_id=? AND state<>?", survey.ID, viewerId, SponsorshipStateEnded).Count(&count)
+		if count > 0 {
+			return SurveyViewerSponsoredDeveloper
+		}
+	}
+	return SurveyViewerOther
+}
+
+func (s *Store) SurveyVisibleTo(survey *Survey, viewerId uint) bool {
+	return survey.Privacy.VisibleTo(s.SurveyViewerFor(survey, viewerId))
+}
+
+func RedactSurvey(survey *Survey, viewer SurveyViewer) *Survey {
+	if survey.Privacy.VisibleTo(viewer) {
+		return survey
+	}
+	redacted := Survey{
+		Model:      survey.Model,
+		CampaignId: survey.CampaignId,
+		Privacy:    survey.Privacy,
+	}
+	return &redacted
+}
+
+func (s *Store) LoadSurveyForViewer(id uint, viewerId uint) (*Survey, error) {
+	survey, err := s.LoadSurvey(id)
+	if err != nil {
+		return nil, err
+	}
+	return RedactSurvey(survey, s.SurveyViewerFor(survey, viewerId)), nil
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/adamboardman/gorm"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const pushKeyLength = 65
+const pushAuthLength = 16
+
+type PushSubscription struct {
+	gorm.Model
+	UserId     uint   `gorm:"index"`
+	Endpoint   string `gorm:"unique_index"`
+	P256dh     string `json:"-"`
+	Auth       string `json:"-"`
+	UserAgent  string
+	LastUsedAt *time.Time
+}
+
+var ErrPushSubscriptionNotFound = errors.New("push subscription not found")
+
+var DefaultPushServiceHosts = []string{
+	"fcm.googleapis.com",
+	"android.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"push.apple.com",
+	"notify.windows.com",
+}
+
+func ValidPushEndpoint(endpoint string, hosts []string) bool {
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil || endpointUrl.Scheme != "https" || endpointUrl.User != nil {
+		return false
+	}
+	host := strings.ToLower(endpointUrl.Hostname())
+	for _, v := range hosts {
+		if host == v || strings.HasSuffix(host, "."+v) {
+			return true
+		}
+	}
+	return false
+}
+
+func DecodePushKey(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+func (p *PushSubscription) Validate(hosts []string) error {
+	if !ValidPushEndpoint(p.Endpoint, hosts) {
+		return errors.New("endpoint must be an https URL on a known push service")
+	}
+	key, err := DecodePushKey(p.P256dh)
+	if err != nil || len(key) != pushKeyLength || key[0] != 4 {
+		return errors.New("p256dh must be an uncompressed P-256 public key")
+	}
+	auth, err := DecodePushKey(p.Auth)
+	if err != nil || len(auth) != pushAuthLength {
+		return errors.New("auth must be a 16 byte secret")
+	}
+	return nil
+}
+
+func (s *Store) SavePushSubscription(subscription *PushSubscription) (uint, error) {
+	now := time.Now()
+	err := s.db.Exec("INSERT INTO push_subscriptions (created_at, updated_at, user_id, endpoint, p256dh, auth, user_agent) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (endpoint) DO UPDATE SET user_id=EXCLUDED.user_id, p256dh=EXCLUDED.p256dh, "+
+		"auth=EXCLUDED.auth, user_agent=EXCLUDED.user_agent, updated_at=EXCLUDED.updated_at, deleted_at=NULL",
+		now, now, subscription.UserId, subscription.Endpoint, subscription.P256dh, subscription.Auth, subscription.UserAgent).Error
+	if err != nil {
+		return 0, err
+	}
+	err = s.db.Where("endpoint=?", subscription.Endpoint).First(subscription).Error
+	return subscription.ID, err
+}
+
+func (s *Store) ListPushSubscriptionsForUser(userId uint) ([]PushSubscription, error) {
+	var subscriptions []PushSubscription
+	err := s.db.Where("user_id=?", userId).Order("id").Find(&subscriptions).Error
+	return subscriptions, err
+}
+
+func (s *Store) DeletePushSubscription(userId uint, id uint) error {
+	deletion := s.db.Unscoped().Where("id=? AND user_id=?", id, userId).Delete(PushSubscription{})
+	if deletion.Error == nil && deletion.RowsAffected == 0 {
+		return ErrPushSubscriptionNotFound
+	}
+	return deletion.Error
+}
+
+func (s *Store) DeletePushSubscriptionByEndpoint(endpoint string) error {
+	return s.db.Unscoped().Where("endpoint=?", endpoint).Delete(PushSubscription{}).Error
+}
+
+func (s *Store) MarkPushSubscriptionUsed(id uint, now time.Time) error {
+	return s.db.Model(&PushSubscription{}).Where("id=?", id).UpdateColumn("last_used_at", now).Error
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"fmt"
+	"github.com/adamboardman/gorm"
+	"sort"
+	"time"
+)
+
+type ReceiptSource string
+
+const (
+	ReceiptSourceLedger   ReceiptSource = "ledger"
+	ReceiptSourceProvider ReceiptSource = "provider"
+)
+
+const ReceiptPrefixDefault = "SH"
+
+type Receipt struct {
+	gorm.Model
+	Number          string `gorm:"unique_index"`
+	Source          ReceiptSource
+	SourceId        uint
+	SponsorId       uint `gorm:"index"`
+	DeveloperId     uint
+	SurveySponsorId uint
+	Money
+	PaidAt    time.Time
+	VoidedAt  *time.Time
+	Reporting *Money `gorm:"-"`
+}
+
+type ReceiptCounter struct {
+	Year int `gorm:"primary_key;auto_increment:false"`
+	Last int
+}
+
+type AnnualStatement struct {
+	SponsorId      uint
+	Year           int
+	Receipts       []Receipt
+	Totals         []Money
+	ReportingTotal *Money
+}
+
+func (s *Store) receiptPrefix() string {
+	if len(s.ReceiptPrefix) == 0 {
+		return ReceiptPrefixDefault
+	}
+	return s.ReceiptPrefix
+}
+
+func (s *Store) issueReceipt(tx *gorm.DB, receipt *Receipt) error {
+	if receipt.Amount <= 0 || receipt.SponsorId == 0 {
+		return nil
+	}
+	var count int
+	err := tx.Model(&Receipt{}).Where("source=? AND source_id=?", receipt.Source, receipt.SourceId).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+	if receipt.SurveySponsorId == 0 {
+		surveySponsor := SurveySponsor{}
+		err = tx.Where("user_id=? AND survey_id IN (SELECT id FROM surveys WHERE user_id=? AND campaign_id=0)", receipt.DeveloperId, receipt.SponsorId).
+			Find(&surveySponsor).Error
+		if err == nil {
+			receipt.SurveySponsorId = surveySponsor.ID
+		}
+	}
+
+	year := receipt.PaidAt.Year()
+	err = tx.Exec("INSERT INTO receipt_counters (year, last) VALUES (?, 0) ON CONFLICT (year) DO NOTHING", year).Error
+	if err != nil {
+		return err
+	}
+	var last int
+	err = tx.Raw("UPDATE receipt_counters SET last=last+1 WHERE year=? RETURNING last", year).Row().Scan(&last)
+	if err != nil {
+		return err
+	}
+	receipt.Number = fmt.Sprintf("%s-%d-%06d", s.receiptPrefix(), year, last)
+	return tx.Create(receipt).Error
+}
+
+func (s *Store) issuePaymentEventReceipt(tx *gorm.DB, event *PaymentEvent) error {
+	if (event.Action != PaymentActionStarted && event.Action != PaymentActionRenewed) || event.Amount <= 0 {
+		return nil
+	}
+	if event.Status != PaymentEventStatusProcessed && event.Status != PaymentEventStatusResolved {
+		return nil
+	}
+	return s.issueReceipt(tx, &Receipt{
+		Source:          ReceiptSourceProvider,
+		SourceId:        event.ID,
+		SponsorId:       event.SponsorUserId,
+		DeveloperId:     event.DeveloperUserId,
+		SurveySponsorId: event.SurveySponsorId,
+		Money:           event.Money,
+		PaidAt:          event.CreatedAt,
+	})
+}
+
+func (s *Store) LoadReceipt(id uint) (*Receipt, error) {
+	receipt := Receipt{}
+	err := s.db.Where("id=?", id).Find(&receipt).Error
+	receipt.Reporting = s.ToReportingCurrency(receipt.Money, receipt.PaidAt)
+	return &receipt, err
+}
+
+func (s *Store) LoadReceiptForSource(source ReceiptSource, sourceId uint) (*Receipt, error) {
+	receipt := Receipt{}
+	err := s.db.Where("source=? AND source_id=?", source, sourceId).Find(&receipt).Error
+	receipt.Reporting = s.ToReportingCurrency(receipt.Money, receipt.PaidAt)
+	return &receipt, err
+}
+
+func (s *Store) ListReceiptsForSponsor(sponsorId uint) ([]Receipt, error) {
+	var receipts []Receipt
+	err := s.db.Where("sponsor_id=?", sponsorId).Order("paid_at DESC, id DESC").Find(&receipts).Error
+	for i := range receipts {
+		receipts[i].Reporting = s.ToReportingCurrency(receipts[i].Money, receipts[i].PaidAt)
+	}
+	return receipts, err
+}
+
+func (s *Store) AnnualStatementForSponsor(sponsorId uint, year int) (*AnnualStatement, error) {
+	statement := AnnualStatement{SponsorId: sponsorId, Year: year}
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	err := s.db.Where("sponsor_id=? AND paid_at>=? AND paid_at<? AND voided_at IS NULL", sponsorId, start, start.AddDate(1, 0, 0)).
+		Order("paid_at, id").Find(&statement.Receipts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	totals := map[string]int64{}
+	reportingTotal := &Money{Currency: s.reportingCurrency()}
+	for i := range statement.Receipts {
+		receipt := &statement.Receipts[i]
+		totals[receipt.Currency] += receipt.Amount
+		receipt.Reporting = s.ToReportingCurrency(receipt.Money, receipt.PaidAt)
+		if receipt.Reporting == nil {
+			reportingTotal = nil
+		} else if reportingTotal != nil {
+			reportingTotal.Amount += receipt.Reporting.Amount
+		}
+	}
+	for currency, amount := range totals {
+		statement.Totals = append(statement.Totals, Money{Amount: amount, Currency: currency})
+	}
+	sort.Slice(statement.Totals, func(i, j int) bool {
+		return statement.Totals[i].Currency < statement.Totals[j].Currency
+	})
+	statement.ReportingTotal = reportingTotal
+	return &statement, nil
+}
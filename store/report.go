@@ -0,0 +1,208 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"strings"
+)
+
+type TestVerdict string
+
+const (
+	TestVerdictWorks  TestVerdict = "works"
+	TestVerdictBroken TestVerdict = "broken"
+)
+
+type TestReportStatus string
+
+const (
+	TestReportStatusNew           TestReportStatus = "new"
+	TestReportStatusAcknowledged  TestReportStatus = "acknowledged"
+	TestReportStatusInvestigating TestReportStatus = "investigating"
+	TestReportStatusFixed         TestReportStatus = "fixed"
+	TestReportStatusWontFix       TestReportStatus = "wont-fix"
+	TestReportStatusClosed        TestReportStatus = "closed"
+)
+
+var TestReportStatuses = []TestReportStatus{
+	TestReportStatusNew,
+	TestReportStatusAcknowledged,
+	TestReportStatusInvestigating,
+	TestReportStatusFixed,
+	TestReportStatusWontFix,
+	TestReportStatusClosed,
+}
+
+func ParseTestReportStatus(value string) (TestReportStatus, error) {
+	for _, v := range TestReportStatuses {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown test report status: " + value)
+}
+
+const TestReportAttachmentMaxSize = 5 * 1024 * 1024
+const TestReportAttachmentsMax = 5
+
+type TestReport struct {
+	gorm.Model
+	ArtifactId  uint `gorm:"index"`
+	UserId      uint `gorm:"index"`
+	Verdict     TestVerdict
+	Device      string
+	Description string
+	Status      TestReportStatus
+	Attachments []TestReportAttachment `gorm:"foreignkey:ReportId"`
+}
+
+type TestReportAttachment struct {
+	gorm.Model
+	ReportId    uint `gorm:"index"`
+	FileName    string
+	ContentType string
+	Size        int64
+	Data        []byte `json:"-"`
+}
+
+type TestReportDeviceSummary struct {
+	Device string
+	Works  int
+	Broken int
+}
+
+type TestReportSummary struct {
+	ArtifactId uint
+	Version    string
+	Platform   string
+	Reports    int
+	Works      int
+	Broken     int
+	Testers    int
+	Statuses   map[TestReportStatus]int
+	Devices    []TestReportDeviceSummary
+}
+
+var ErrTooManyAttachments = errors.New("test report already has the maximum number of attachments")
+
+func (r *TestReport) Validate() error {
+	if r.ArtifactId == 0 {
+		return errors.New("a test report needs a build")
+	}
+	if r.Verdict != TestVerdictWorks && r.Verdict != TestVerdictBroken {
+		return errors.New("verdict should be works or broken")
+	}
+	r.Device = strings.TrimSpace(r.Device)
+	if len(r.Device) == 0 {
+		return errors.New("device is required")
+	}
+	if r.Verdict == TestVerdictBroken && len(strings.TrimSpace(r.Description)) == 0 {
+		return errors.New("a broken build report needs a description")
+	}
+	return nil
+}
+
+func (a *TestReportAttachment) Validate() error {
+	if len(a.FileName) == 0 || strings.ContainsAny(a.FileName, "\"/\\\r\n") {
+		return errors.New("attachment file name is missing or contains invalid characters")
+	}
+	if a.Size == 0 || a.Size > TestReportAttachmentMaxSize {
+		return errors.New("attachment should be between 1 byte and 5MB")
+	}
+	return nil
+}
+
+func (s *Store) InsertTestReport(report *TestReport) (uint, error) {
+	report.Status = TestReportStatusNew
+	err := s.db.Create(report).Error
+	return report.ID, err
+}
+
+func (s *Store) UpdateTestReport(report *TestReport) (uint, error) {
+	err := s.db.Model(report).Updates(map[string]interface{}{"verdict": report.Verdict, "device": report.Device,
+		"description": report.Description}).Error
+	return report.ID, err
+}
+
+func (s *Store) LoadTestReport(id uint) (*TestReport, error) {
+	report := TestReport{}
+	err := s.db.Where("id=?", id).Preload("Attachments", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id, created_at, updated_at, deleted_at, report_id, file_name, content_type, size").Order("id")
+	}).Find(&report).Error
+	return &report, err
+}
+
+func (s *Store) UpdateTestReportStatus(id uint, status TestReportStatus) (bool, error) {
+	update := s.db.Model(&TestReport{}).Where("id=? AND status<>?", id, status).Update("status", status)
+	return update.RowsAffected > 0, update.Error
+}
+
+func (s *Store) ListTestReportsForBuild(artifactId uint) ([]TestReport, error) {
+	var reports []TestReport
+	err := s.db.Where("artifact_id=?", artifactId).Order("id DESC").Find(&reports).Error
+	return reports, err
+}
+
+func (s *Store) ListTestReportsForUser(userId uint) ([]TestReport, error) {
+	var reports []TestReport
+	err := s.db.Where("user_id=?", userId).Order("id DESC").Find(&reports).Error
+	return reports, err
+}
+
+func (s *Store) TestReportSummaryForBuild(artifact *BuildArtifact) (*TestReportSummary, error) {
+	summary := TestReportSummary{ArtifactId: artifact.ID, Version: artifact.Version, Platform: artifact.Platform,
+		Statuses: map[TestReportStatus]int{}}
+	reports, err := s.ListTestReportsForBuild(artifact.ID)
+	if err != nil {
+		return nil, err
+	}
+	testers := map[uint]bool{}
+	devices := map[string]*TestReportDeviceSummary{}
+	var deviceOrder []string
+	for _, v := range reports {
+		summary.Reports++
+		summary.Statuses[v.Status]++
+		testers[v.UserId] = true
+		device, ok := devices[strings.ToLower(v.Device)]
+		if !ok {
+			device = &TestReportDeviceSummary{Device: v.Device}
+			devices[strings.ToLower(v.Device)] = device
+			deviceOrder = append(deviceOrder, strings.ToLower(v.Device))
+		}
+		if v.Verdict == TestVerdictWorks {
+			summary.Works++
+			device.Works++
+		} else {
+			summary.Broken++
+			device.Broken++
+		}
+	}
+	summary.Testers = len(testers)
+	for _, key := range deviceOrder {
+		summary.Devices = append(summary.Devices, *devices[key])
+	}
+	return &summary, nil
+}
+
+func (s *Store) InsertTestReportAttachment(attachment *TestReportAttachment) (uint, error) {
+	tx := s.db.Begin()
+	var count int
+	err := tx.Model(&TestReportAttachment{}).Where("report_id=?", attachment.ReportId).Count(&count).Error
+	if err == nil && count >= TestReportAttachmentsMax {
+		err = ErrTooManyAttachments
+	}
+	if err == nil {
+		err = tx.Create(attachment).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return attachment.ID, tx.Commit().Error
+}
+
+func (s *Store) LoadTestReportAttachment(reportId uint, id uint) (*TestReportAttachment, error) {
+	attachment := TestReportAttachment{}
+	err := s.db.Where("id=? AND report_id=?", id, reportId).Find(&attachment).Error
+	return &attachment, err
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"strconv"
+)
+
+type SurveyRevision struct {
+	gorm.Model
+	SurveyId       uint
+	Revision       uint
+	AuthorId       uint
+	Name           string
+	GitHubId       string
+	Priorities     string
+	Issues         string
+	CommsFrequency CommsFrequency
+	PreRelease     bool
+	Privacy        PrivacyLevel
+}
+
+type SurveyFieldChange struct {
+	Field string
+	From  string
+	To    string
+}
+
+func (s *Store) insertSurveyRevision(tx *gorm.DB, survey *Survey, authorId uint) error {
+	err := tx.Exec("SELECT id FROM surveys WHERE id=? FOR UPDATE", survey.ID).Error
+	if err != nil {
+		return err
+	}
+	var latest uint
+	err = tx.Model(&SurveyRevision{}).Unscoped().Where("survey_id=?", survey.ID).Select("COALESCE(MAX(revision), 0)").Row().Scan(&latest)
+	if err != nil {
+		return err
+	}
+	revision := SurveyRevision{
+		SurveyId: survey.ID,
+		Revision: latest + 1,
+		AuthorId: authorId,
+	}
+	copySurveyContent(&revision, survey)
+	return tx.Create(&revision).Error
+}
+
+func copySurveyContent(revision *SurveyRevision, survey *Survey) {
+	revision.Name = survey.Name
+	revision.GitHubId = survey.GitHubId
+	revision.Priorities = survey.Priorities
+	revision.Issues = survey.Issues
+	revision.CommsFrequency = survey.CommsFrequency
+	revision.PreRelease = survey.PreRelease
+	revision.Privacy = survey.Privacy
+}
+
+func (r *SurveyRevision) ApplyTo(survey *Survey) {
+	survey.Name = r.Name
+	survey.GitHubId = r.GitHubId
+	survey.Priorities = r.Priorities
+	survey.Issues = r.Issues
+	survey.CommsFrequency = r.CommsFrequency
+	survey.PreRelease = r.PreRelease
+	survey.Privacy = r.Privacy
+}
+
+func RedactSurveyRevision(revision *SurveyRevision, viewer SurveyViewer) *SurveyRevision {
+	if revision.Privacy.VisibleTo(viewer) {
+		return revision
+	}
+	redacted := SurveyRevision{
+		Model:    revision.Model,
+		SurveyId: revision.SurveyId,
+		Revision: revision.Revision,
+		Privacy:  revision.Privacy,
+	}
+	return &redacted
+}
+
+func (s *Store) ListSurveyRevisions(surveyId uint) ([]SurveyRevision, error) {
+	var revisions []SurveyRevision
+	err := s.db.Where("survey_id=?", surveyId).Order("revision").Find(&revisions).Error
+	return revisions, err
+}
+
+func (s *Store) LoadSurveyRevision(surveyId uint, revision uint) (*SurveyRevision, error) {
+	surveyRevision := SurveyRevision{}
+	err := s.db.Where("survey_id=? AND revision=?", surveyId, revision).Find(&surveyRevision).Error
+	return &surveyRevision, err
+}
+
+func DiffSurveyRevisions(from *SurveyRevision, to *SurveyRevision) []SurveyFieldChange {
+	changes := []SurveyFieldChange{}
+	addChange := func(field string, fromValue string, toValue string) {
+		if fromValue != toValue {
+			changes = append(changes, SurveyFieldChange{Field: field, From: fromValue, To: toValue})
+		}
+	}
+	addChange("Name", from.Name, to.Name)
+	addChange("GitHubId", from.GitHubId, to.GitHubId)
+	addChange("Priorities", from.Priorities, to.Priorities)
+	addChange("Issues", from.Issues, to.Issues)
+	addChange("CommsFrequency", string(from.CommsFrequency), string(to.CommsFrequency))
+	addChange("PreRelease", strconv.FormatBool(from.PreRelease), strconv.FormatBool(to.PreRelease))
+	addChange("Privacy", string(from.Privacy), string(to.Privacy))
+	return changes
+}
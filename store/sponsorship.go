@@ -0,0 +1,365 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"log"
+	"regexp"
+	"time"
+)
+
+type Recurrence string
+
+const (
+	RecurrenceOneOff  Recurrence = "one-off"
+	RecurrenceMonthly Recurrence = "monthly"
+	RecurrenceYearly  Recurrence = "yearly"
+)
+
+const RecurrenceDefault = RecurrenceMonthly
+
+var Recurrences = []Recurrence{
+	RecurrenceOneOff,
+	RecurrenceMonthly,
+	RecurrenceYearly,
+}
+
+func ParseRecurrence(value string) (Recurrence, error) {
+	if len(value) == 0 {
+		return RecurrenceDefault, nil
+	}
+	for _, v := range Recurrences {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown recurrence: " + value)
+}
+
+var (
+	ErrSelfSponsorship  = errors.New("you cannot sponsor yourself")
+	ErrNotSponsorable   = errors.New("user is not sponsorable")
+	ErrDuplicateSponsor = errors.New("developer listed more than once")
+	ErrNotSurveyOwner   = errors.New("survey belongs to someone else")
+)
+
+var currencyCodePattern = regexp.MustCompile("^[A-Z]{3}$")
+
+func ValidCurrencyCode(code string) bool {
+	return currencyCodePattern.MatchString(code)
+}
+
+type SponsorshipTier struct {
+	gorm.Model
+	UserId      uint `gorm:"index"`
+	Name        string
+	Description string
+	Perks       string
+	Money
+	Recurrence Recurrence
+	Reporting  *Money `gorm:"-"`
+}
+
+func (t *SponsorshipTier) Validate() error {
+	if len(t.Name) == 0 {
+		return errors.New("tier name is required")
+	}
+	return t.Money.Validate()
+}
+
+func (s *SurveySponsor) periodStartOn(now time.Time) time.Time {
+	months := 0
+	switch s.Recurrence {
+	case RecurrenceMonthly:
+		months = 1
+	case RecurrenceYearly:
+		months = 12
+	default:
+		return s.StartDate
+	}
+	if s.EndDate != nil && s.EndDate.Before(now) {
+		now = *s.EndDate
+	}
+	periods := 0
+	for !s.StartDate.AddDate(0, months*(periods+1), 0).After(now) {
+		periods++
+	}
+	return s.StartDate.AddDate(0, months*periods, 0)
+}
+
+func (s *SurveySponsor) Validate() error {
+	err := s.Money.Validate()
+	if err != nil {
+		return err
+	}
+	if s.EndDate != nil && !s.EndDate.After(s.StartDate) {
+		return errors.New("end date must be after the start date")
+	}
+	return nil
+}
+
+func (s *Store) InsertSponsorshipTier(tier *SponsorshipTier) (uint, error) {
+	err := s.db.Create(tier).Error
+	return tier.ID, err
+}
+
+func (s *Store) UpdateSponsorshipTier(tier *SponsorshipTier) (uint, error) {
+	err := s.db.Save(tier).Error
+	return tier.ID, err
+}
+
+func (s *Store) LoadSponsorshipTier(id uint) (*SponsorshipTier, error) {
+	tier := SponsorshipTier{}
+	err := s.db.Where("id=?", id).Find(&tier).Error
+	return &tier, err
+}
+
+func (s *Store) DeleteSponsorshipTier(id uint) error {
+	return s.db.Where("id=?", id).Delete(SponsorshipTier{}).Error
+}
+
+func (s *Store) ListSponsorshipTiersForUser(userId uint) ([]SponsorshipTier, error) {
+	var tiers []SponsorshipTier
+	err := s.db.Where("user_id=?", userId).Order("amount").Find(&tiers).Error
+	now := time.Now()
+	for i := range tiers {
+		tiers[i].Reporting = s.ToReportingCurrency(tiers[i].Money, now)
+	}
+	return tiers, err
+}
+
+func (s *Store) LoadSurveySponsor(surveyId uint, userId uint) (*SurveySponsor, error) {
+	surveySponsor := SurveySponsor{}
+	err := s.db.Where("survey_id=? AND user_id=?", surveyId, userId).Find(&surveySponsor).Error
+	return &surveySponsor, err
+}
+
+func (s *Store) UpdateSurveySponsor(surveySponsor *SurveySponsor) (uint, error) {
+	err := s.db.Save(surveySponsor).Error
+	return surveySponsor.ID, err
+}
+
+func (s *Store) ApplySponsorshipTier(surveySponsor *SurveySponsor) error {
+	if surveySponsor.TierId == 0 {
+		return nil
+	}
+	tier, err := s.LoadSponsorshipTier(surveySponsor.TierId)
+	if err != nil {
+		return errors.New("sponsorship tier not found")
+	}
+	if tier.UserId != surveySponsor.UserId {
+		return errors.New("sponsorship tier belongs to a different developer")
+	}
+	if surveySponsor.Amount == 0 {
+		surveySponsor.Money = tier.Money
+		surveySponsor.Recurrence = tier.Recurrence
+	}
+	return nil
+}
+
+func defaultSponsorshipStart(surveySponsor *SurveySponsor) {
+	if surveySponsor.StartDate.IsZero() {
+		surveySponsor.StartDate = time.Now()
+	}
+	if len(surveySponsor.Recurrence) == 0 {
+		surveySponsor.Recurrence = RecurrenceDefault
+	}
+}
+
+const duplicateSurveySponsorsSQL = "SELECT id, MIN(id) OVER (PARTITION BY survey_id, user_id) AS keep_id FROM survey_sponsors"
+
+func removeDuplicateSurveySponsors(db *gorm.DB) {
+	err := db.Exec("UPDATE sponsorship_transitions SET survey_sponsor_id=duplicates.keep_id FROM (" + duplicateSurveySponsorsSQL + ") duplicates " +
+		"WHERE sponsorship_transitions.survey_sponsor_id=duplicates.id AND duplicates.id<>duplicates.keep_id").Error
+	if err == nil {
+		err = db.Exec("DELETE FROM survey_sponsors WHERE id IN (SELECT id FROM (" + duplicateSurveySponsorsSQL + ") duplicates WHERE id<>keep_id)").Error
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func checkSponsorable(tx *gorm.DB, survey *Survey, userId uint) error {
+	if userId == survey.UserId {
+		return ErrSelfSponsorship
+	}
+	var count int
+	err := tx.Model(&User{}).Where("id=? AND permissions>=?", userId, UserPermissionsUser).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotSponsorable
+	}
+	return nil
+}
+
+func insertSurveySponsor(tx *gorm.DB, surveySponsor *SurveySponsor) error {
+	defaultSponsorshipStart(surveySponsor)
+	surveySponsor.State = SponsorshipStateActive
+	surveySponsor.StateChangedAt = time.Now()
+	err := tx.Create(surveySponsor).Error
+	if err != nil {
+		return err
+	}
+	return insertSponsorshipTransition(tx, surveySponsor, "", "started")
+}
+
+func (s *Store) loadOrCreateSurveyForUser(tx *gorm.DB, userId uint) (*Survey, error) {
+	survey := Survey{}
+	err := tx.Where("user_id=? AND campaign_id=0", userId).Find(&survey).Error
+	if gorm.IsRecordNotFoundError(err) {
+		survey = Survey{UserId: userId}
+		err = tx.Create(&survey).Error
+		if err == nil {
+			err = s.insertSurveyRevision(tx, &survey, userId)
+		}
+	}
+	return &survey, err
+}
+
+func (s *Store) ReplaceSurveySponsors(ownerId uint, surveyId uint, sponsors []SurveySponsor) (*Survey, error) {
+	tx := s.db.Begin()
+	survey, err := s.replaceSurveySponsors(tx, ownerId, surveyId, sponsors)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return survey, tx.Commit().Error
+}
+
+func (s *Store) UpsertSurveySponsor(ownerId uint, surveySponsor *SurveySponsor, events ...*OutboxEvent) error {
+	tx := s.db.Begin()
+	err := s.upsertSurveySponsor(tx, ownerId, surveySponsor)
+	if err == nil {
+		err = insertOutboxEvents(tx, events)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) upsertSurveySponsor(tx *gorm.DB, ownerId uint, surveySponsor *SurveySponsor) error {
+	if surveySponsor.SurveyId == 0 {
+		survey, err := s.loadOrCreateSurveyForUser(tx, ownerId)
+		if err != nil {
+			return err
+		}
+		surveySponsor.SurveyId = survey.ID
+	}
+	survey := Survey{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", surveySponsor.SurveyId).Find(&survey).Error
+	if err != nil {
+		return err
+	}
+	if survey.UserId != ownerId {
+		return ErrNotSurveyOwner
+	}
+
+	existing := SurveySponsor{}
+	err = tx.Where("survey_id=? AND user_id=?", survey.ID, surveySponsor.UserId).Find(&existing).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = checkSponsorable(tx, &survey, surveySponsor.UserId)
+		if err != nil {
+			return err
+		}
+		return insertSurveySponsor(tx, surveySponsor)
+	}
+	if err != nil {
+		return err
+	}
+	if existing.State == SponsorshipStateActive {
+		*surveySponsor = existing
+		return ErrSponsorshipStateUnchanged
+	}
+	err = checkSponsorable(tx, &survey, surveySponsor.UserId)
+	if err != nil {
+		return err
+	}
+	existing.TierId = surveySponsor.TierId
+	existing.Money = surveySponsor.Money
+	existing.Recurrence = surveySponsor.Recurrence
+	if !surveySponsor.StartDate.IsZero() {
+		existing.StartDate = surveySponsor.StartDate
+	}
+	defaultSponsorshipStart(&existing)
+	*surveySponsor = existing
+	return transitionSurveySponsor(tx, surveySponsor, SponsorshipStateActive, "restarted")
+}
+
+func (s *Store) replaceSurveySponsors(tx *gorm.DB, ownerId uint, surveyId uint, sponsors []SurveySponsor) (*Survey, error) {
+	var survey *Survey
+	var err error
+	if surveyId == 0 {
+		survey, err = s.loadOrCreateSurveyForUser(tx, ownerId)
+	} else {
+		survey = &Survey{}
+		err = tx.Where("id=?", surveyId).Find(survey).Error
+		if err == nil && survey.UserId != ownerId {
+			err = ErrNotSurveyOwner
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var existing []SurveySponsor
+	err = tx.Set("gorm:query_option", "FOR UPDATE").Where("survey_id=?", survey.ID).Find(&existing).Error
+	if err != nil {
+		return nil, err
+	}
+	current := map[uint]*SurveySponsor{}
+	for i := range existing {
+		current[existing[i].UserId] = &existing[i]
+	}
+
+	wanted := map[uint]bool{}
+	var events []*OutboxEvent
+	for i := range sponsors {
+		sponsor := &sponsors[i]
+		if wanted[sponsor.UserId] {
+			return nil, ErrDuplicateSponsor
+		}
+		wanted[sponsor.UserId] = true
+		err = checkSponsorable(tx, survey, sponsor.UserId)
+		if err != nil {
+			return nil, err
+		}
+
+		previous, ok := current[sponsor.UserId]
+		if !ok {
+			sponsor.SurveyId = survey.ID
+			err = insertSurveySponsor(tx, sponsor)
+			events = append(events, NewOutboxEvent(WebhookEventSponsorCreated, sponsor))
+		} else {
+			previous.TierId = sponsor.TierId
+			previous.Money = sponsor.Money
+			previous.Recurrence = sponsor.Recurrence
+			if !sponsor.StartDate.IsZero() {
+				previous.StartDate = sponsor.StartDate
+			}
+			defaultSponsorshipStart(previous)
+			if previous.State != SponsorshipStateActive {
+				err = transitionSurveySponsor(tx, previous, SponsorshipStateActive, "restarted")
+				events = append(events, NewOutboxEvent(WebhookEventSponsorCreated, previous))
+			} else {
+				err = tx.Save(previous).Error
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range existing {
+		if !wanted[existing[i].UserId] && existing[i].State != SponsorshipStateEnded {
+			err = transitionSurveySponsor(tx, &existing[i], SponsorshipStateEnded, "removed")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return survey, insertOutboxEvents(tx, events)
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"log"
+	"time"
+)
+
+type SponsorshipState string
+
+const (
+	SponsorshipStateActive SponsorshipState = "active"
+	SponsorshipStatePaused SponsorshipState = "paused"
+	SponsorshipStateEnded  SponsorshipState = "ended"
+)
+
+func ParseSponsorshipState(value string) (SponsorshipState, error) {
+	for _, v := range []SponsorshipState{SponsorshipStateActive, SponsorshipStatePaused, SponsorshipStateEnded} {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", errors.New("unknown sponsorship state: " + value)
+}
+
+type SponsorshipTransition struct {
+	gorm.Model
+	SurveySponsorId uint `gorm:"index"`
+	SponsorId       uint `gorm:"index"`
+	DeveloperId     uint `gorm:"index"`
+	FromState       SponsorshipState
+	ToState         SponsorshipState
+	Reason          string
+}
+
+type SponsorshipMetrics struct {
+	PeriodStart   time.Time
+	PeriodEnd     time.Time
+	ActiveAtStart int
+	Started       int
+	Ended         int
+	ActiveAtEnd   int
+	ChurnRate     float64
+	RetentionRate float64
+}
+
+var ErrSponsorshipStateUnchanged = errors.New("sponsorship is already in that state")
+
+func backfillSponsorshipStates(db *gorm.DB) {
+	err := db.Exec("INSERT INTO sponsorship_transitions (created_at, updated_at, survey_sponsor_id, sponsor_id, developer_id, from_state, to_state, reason) " +
+		"SELECT survey_sponsors.created_at, survey_sponsors.created_at, survey_sponsors.id, surveys.user_id, survey_sponsors.user_id, '', 'active', 'backfill' " +
+		"FROM survey_sponsors JOIN surveys ON surveys.id=survey_sponsors.survey_id WHERE survey_sponsors.state IS NULL").Error
+	if err == nil {
+		err = db.Exec("UPDATE survey_sponsors SET state='active', state_changed_at=created_at WHERE state IS NULL").Error
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func insertSponsorshipTransition(tx *gorm.DB, surveySponsor *SurveySponsor, from SponsorshipState, reason string) error {
+	survey := Survey{}
+	err := tx.Unscoped().Where("id=?", surveySponsor.SurveyId).Find(&survey).Error
+	if err != nil {
+		return err
+	}
+	transition := SponsorshipTransition{
+		SurveySponsorId: surveySponsor.ID,
+		SponsorId:       survey.UserId,
+		DeveloperId:     surveySponsor.UserId,
+		FromState:       from,
+		ToState:         surveySponsor.State,
+		Reason:          reason,
+	}
+	return tx.Create(&transition).Error
+}
+
+func (s *Store) TransitionSurveySponsor(surveyId uint, userId uint, state SponsorshipState, reason string, events ...*OutboxEvent) (*SurveySponsor, error) {
+	tx := s.db.Begin()
+	surveySponsor := &SurveySponsor{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("survey_id=? AND user_id=?", surveyId, userId).Find(surveySponsor).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if surveySponsor.State == state {
+		tx.Rollback()
+		return surveySponsor, ErrSponsorshipStateUnchanged
+	}
+
+	err = transitionSurveySponsor(tx, surveySponsor, state, reason)
+	if err == nil {
+		err = insertOutboxEvents(tx, events)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return surveySponsor, tx.Commit().Error
+}
+
+func transitionSurveySponsor(tx *gorm.DB, surveySponsor *SurveySponsor, state SponsorshipState, reason string) error {
+	from := surveySponsor.State
+	now := time.Now()
+	surveySponsor.State = state
+	surveySponsor.StateChangedAt = now
+	if state == SponsorshipStateEnded {
+		surveySponsor.EndDate = &now
+	} else {
+		surveySponsor.EndDate = nil
+	}
+	err := tx.Save(surveySponsor).Error
+	if err != nil {
+		return err
+	}
+	return insertSponsorshipTransition(tx, surveySponsor, from, reason)
+}
+
+func (s *Store) SponsorshipHistory(sponsorId uint, developerId uint) ([]SponsorshipTransition, error) {
+	var transitions []SponsorshipTransition
+	err := s.db.Where("sponsor_id=? AND developer_id=?", sponsorId, developerId).Order("id").Find(&transitions).Error
+	return transitions, err
+}
+
+func (s *Store) listSponsorshipTransitions(developerId uint, before time.Time) ([]SponsorshipTransition, error) {
+	var transitions []SponsorshipTransition
+	query := s.db.Where("created_at<?", before)
+	if developerId != 0 {
+		query = query.Where("developer_id=?", developerId)
+	}
+	err := query.Order("created_at, id").Find(&transitions).Error
+	return transitions, err
+}
+
+func (s *Store) SponsorshipMetricsByMonth(developerId uint, months int, now time.Time) ([]SponsorshipMetrics, error) {
+	transitions, err := s.listSponsorshipTransitions(developerId, now)
+	if err != nil {
+		return nil, err
+	}
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	var metrics []SponsorshipMetrics
+	for i := months - 1; i >= 0; i-- {
+		start := monthStart.AddDate(0, -i, 0)
+		end := start.AddDate(0, 1, 0)
+		if end.After(now) {
+			end = now
+		}
+		metrics = append(metrics, SponsorshipMetricsForPeriod(transitions, start, end))
+	}
+	return metrics, nil
+}
+
+func SponsorshipMetricsForPeriod(transitions []SponsorshipTransition, start time.Time, end time.Time) SponsorshipMetrics {
+	metrics := SponsorshipMetrics{PeriodStart: start, PeriodEnd: end}
+	stateAtStart := map[uint]SponsorshipState{}
+	stateAtEnd := map[uint]SponsorshipState{}
+	for _, v := range transitions {
+		if v.CreatedAt.Before(start) {
+			stateAtStart[v.SurveySponsorId] = v.ToState
+		}
+		if v.CreatedAt.Before(end) {
+			stateAtEnd[v.SurveySponsorId] = v.ToState
+			if !v.CreatedAt.Before(start) && v.ToState == SponsorshipStateActive && len(v.FromState) == 0 {
+				metrics.Started++
+			}
+		}
+	}
+	for id, state := range stateAtStart {
+		if state != SponsorshipStateActive {
+			continue
+		}
+		metrics.ActiveAtStart++
+		if stateAtEnd[id] == SponsorshipStateEnded {
+			metrics.Ended++
+		}
+	}
+	for _, state := range stateAtEnd {
+		if state == SponsorshipStateActive {
+			metrics.ActiveAtEnd++
+		}
+	}
+	if metrics.ActiveAtStart > 0 {
+		metrics.ChurnRate = float64(metrics.Ended) / float64(metrics.ActiveAtStart)
+		metrics.RetentionRate = 1 - metrics.ChurnRate
+	}
+	return metrics
+}
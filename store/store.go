@@ -8,11 +8,15 @@ import (
 	"io/ioutil"
 	"log"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type Store struct {
-	db *gorm.DB
+	db                *gorm.DB
+	ReportingCurrency string
+	ReceiptPrefix     string
 }
 
 type PublicUser struct {
@@ -30,6 +34,7 @@ const (
 	UserPermissionsNone UserPermissions = iota + 1
 	UserPermissionsUser
 	UserPermissionsAdmin
+	UserPermissionsFinance
 )
 
 type User struct {
@@ -54,31 +59,35 @@ type PrivilegedUser struct {
 type Survey struct {
 	gorm.Model
 	UserId         uint
+	CampaignId     uint `gorm:"default:0"`
 	Name           string
 	GitHubId       string
 	Priorities     string
 	Issues         string
-	CommsFrequency string
+	CommsFrequency CommsFrequency
 	PreRelease     bool
-	Privacy        string
+	Privacy        PrivacyLevel
 }
 
 type SurveySponsor struct {
 	gorm.Model
 	SurveyId uint
 	UserId   uint
+	TierId   uint
+	Money
+	Recurrence     Recurrence
+	StartDate      time.Time
+	EndDate        *time.Time
+	State          SponsorshipState
+	StateChangedAt time.Time
+	Reporting      *Money `gorm:"-"`
 }
 
 type SponsorableUser struct {
 	ID       uint
 	Name     string
 	GitHubId string
-}
-
-type EmailableUser struct {
-	ID    uint
-	Name  string
-	Email string
+	Goals    []FundingGoal
 }
 
 type PosixDateTime time.Time
@@ -137,26 +146,133 @@ func (s *Store) StoreInit(dbName string) {
 
 	_, _ = db.DB().Exec("CREATE EXTENSION postgis;")
 
-	err = db.AutoMigrate(&User{}, &Survey{}, &SurveySponsor{}).Error
+	err = db.AutoMigrate(&User{}, &Survey{}, &SurveySponsor{}, &SurveyCampaign{}, &SurveyRevision{},
+		&MessageDelivery{}, &PrivacyPolicy{}, &ConsentRecord{}, &DataExport{},
+		&AuditRecord{}, &AccountDeletion{}, &SponsorshipTier{}, &SponsorshipTransition{}, &PaymentEvent{},
+		&LedgerEntry{}, &LedgerPosting{}, &ExchangeRate{}, &Receipt{}, &ReceiptCounter{},
+		&FundingGoal{}, &FundingMilestone{}, &ReleaseChannel{}, &ChannelSubscription{},
+		&Announcement{}, &AnnouncementDelivery{}, &BuildArtifact{}, &BuildDownload{},
+		&TestReport{}, &TestReportAttachment{}, &DeviceToken{}, &CrashGroup{}, &CrashUpload{},
+		&NotificationPreference{}, &InboxNotification{}, &PushSubscription{},
+		&WebhookEndpoint{}, &OutboxEvent{}, &WebhookDelivery{}, &VerifiedIdentity{}).Error
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	migrateFreeTextCommsFrequency(db)
+	migrateFreeTextPrivacy(db)
+	migratePreReleaseToChannels(db)
+	db.Unscoped().Where("deleted_at IS NOT NULL").Delete(ChannelSubscription{})
+	db.Model(&SurveySponsor{}).Where("start_date IS NULL").UpdateColumn("start_date", gorm.Expr("created_at"))
+	backfillSponsorshipStates(db)
+	removeDuplicateSurveySponsors(db)
+	protectLedgerTables(db)
+
 	//DEBUG - add/remove to investigate SQL queries being executed
 	//db.LogMode(true)
 
 	db.Model(&SurveySponsor{}).AddForeignKey("survey_id", "surveys(id)", "CASCADE", "RESTRICT")
 	db.Model(&SurveySponsor{}).AddForeignKey("user_id", "users(id)", "CASCADE", "RESTRICT")
+	db.Model(&SurveySponsor{}).AddUniqueIndex("idx_survey_sponsors_survey_user", "survey_id", "user_id")
+	db.Model(&LedgerPosting{}).AddForeignKey("entry_id", "ledger_entries(id)", "RESTRICT", "RESTRICT")
+	db.Model(&PaymentEvent{}).AddUniqueIndex("idx_payment_events_provider_event", "provider", "event_id")
+	db.Model(&VerifiedIdentity{}).AddUniqueIndex("idx_verified_identities_provider_login", "provider", "login")
+	db.Model(&Survey{}).AddUniqueIndex("idx_surveys_user_campaign", "user_id", "campaign_id")
+	db.Model(&SurveyRevision{}).AddUniqueIndex("idx_survey_revisions_survey_revision", "survey_id", "revision")
+	db.Model(&SurveyRevision{}).AddForeignKey("survey_id", "surveys(id)", "CASCADE", "RESTRICT")
+	db.Model(&AnnouncementDelivery{}).AddUniqueIndex("idx_announcement_deliveries_announcement_user", "announcement_id", "user_id")
+	db.Model(&ReleaseChannel{}).RemoveIndex("uix_release_channels_name")
+	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_release_channels_name ON release_channels (name) WHERE deleted_at IS NULL")
+	db.Model(&ChannelSubscription{}).AddUniqueIndex("idx_channel_subscriptions_user_channel_platform", "user_id", "channel_id", "platform")
+	db.Model(&CrashGroup{}).AddUniqueIndex("idx_crash_groups_artifact_signature", "artifact_id", "signature")
+	db.Model(&NotificationPreference{}).RemoveIndex("idx_notification_preferences_user_category")
+	db.Model(&NotificationPreference{}).AddUniqueIndex("idx_notification_preferences_user_category_channel", "user_id", "category", "channel")
+}
+
+func legacyAnswerWords(value string) []string {
+	return strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+}
+
+func legacyAnswerMatches(value string, keywords []string) bool {
+	for _, word := range legacyAnswerWords(value) {
+		for _, keyword := range keywords {
+			if word == keyword {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (s *Store) InsertUser(user *User) (uint, error) {
-	err := s.db.Create(user).Error
-	return user.ID, err
+func migrateFreeTextColumn(db *gorm.DB, column string, interpret func(string) string) {
+	legacyColumn := "legacy_" + column
+	if db.Dialect().HasColumn("surveys", legacyColumn) {
+		return
+	}
+	tx := db.Begin()
+	err := tx.Exec("ALTER TABLE surveys ADD COLUMN " + legacyColumn + " text").Error
+	if err == nil {
+		err = tx.Exec("UPDATE surveys SET " + legacyColumn + "=" + column).Error
+	}
+	var answers []string
+	if err == nil {
+		err = tx.Table("surveys").Where(column+" IS NOT NULL").Pluck("DISTINCT "+column, &answers).Error
+	}
+	if err == nil {
+		err = tx.Table("surveys").Where(column+" IS NULL").UpdateColumn(column, interpret("")).Error
+	}
+	for i := 0; err == nil && i < len(answers); i++ {
+		if interpreted := interpret(answers[i]); interpreted != answers[i] {
+			err = tx.Table("surveys").Where(column+"=?", answers[i]).UpdateColumn(column, interpreted).Error
+		}
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Fatal(err)
+	}
+}
+
+func migrateFreeTextCommsFrequency(db *gorm.DB) {
+	migrateFreeTextColumn(db, "comms_frequency", func(answer string) string {
+		return string(legacyCommsFrequency(answer))
+	})
+}
+
+func migrateFreeTextPrivacy(db *gorm.DB) {
+	migrateFreeTextColumn(db, "privacy", func(answer string) string {
+		return string(legacyPrivacyLevel(answer))
+	})
+}
+
+func (s *Store) InsertUser(user *User, events ...*OutboxEvent) (uint, error) {
+	tx := s.db.Begin()
+	err := tx.Create(user).Error
+	if err == nil {
+		err = insertOutboxEvents(tx, events)
+	}
+	if err != nil {
+		tx.Rollback()
+		return user.ID, err
+	}
+	return user.ID, tx.Commit().Error
 }
 
-func (s *Store) UpdateUser(user *User) (uint, error) {
-	err := s.db.Save(user).Error
-	return user.ID, err
+func (s *Store) UpdateUser(user *User, events ...*OutboxEvent) (uint, error) {
+	tx := s.db.Begin()
+	err := tx.Save(user).Error
+	if err == nil {
+		err = insertOutboxEvents(tx, events)
+	}
+	if err != nil {
+		tx.Rollback()
+		return user.ID, err
+	}
+	return user.ID, tx.Commit().Error
 }
 
 func (s *Store) FindUser(email string) (*User, error) {
@@ -169,6 +285,7 @@ func (s *Store) FindUser(email string) (*User, error) {
 }
 
 func (s *Store) PurgeUser(email string) {
+	s.db.Unscoped().Where("user_id IN (SELECT id FROM users WHERE email=?)", email).Delete(Survey{})
 	s.db.Unscoped().Where("email=?", email).Delete(User{})
 }
 
@@ -208,13 +325,40 @@ func (s *Store) LoadUserAsSelf(userId uint, loggedInUserId uint) (*User, error)
 	return &user, err
 }
 
-func (s *Store) InsertSurvey(survey *Survey) (uint, error) {
-	err := s.db.Create(survey).Error
+func (s *Store) InsertSurvey(survey *Survey, authorId uint) (uint, error) {
+	tx := s.db.Begin()
+	err := tx.Create(survey).Error
+	if err == nil {
+		err = s.insertSurveyRevision(tx, survey, authorId)
+	}
+	if err == nil {
+		err = syncLegacyPreReleaseSubscription(tx, survey)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit().Error
 	return survey.ID, err
 }
 
-func (s *Store) UpdateSurvey(survey *Survey) (uint, error) {
-	err := s.db.Save(survey).Error
+func (s *Store) UpdateSurvey(survey *Survey, authorId uint, events ...*OutboxEvent) (uint, error) {
+	tx := s.db.Begin()
+	err := tx.Save(survey).Error
+	if err == nil {
+		err = s.insertSurveyRevision(tx, survey, authorId)
+	}
+	if err == nil {
+		err = syncLegacyPreReleaseSubscription(tx, survey)
+	}
+	if err == nil {
+		err = insertOutboxEvents(tx, events)
+	}
+	if err != nil {
+		tx.Rollback()
+		return survey.ID, err
+	}
+	err = tx.Commit().Error
 	return survey.ID, err
 }
 
@@ -226,20 +370,23 @@ func (s *Store) LoadSurvey(id uint) (*Survey, error) {
 
 func (s *Store) LoadSurveyForUser(id uint) (*Survey, error) {
 	survey := Survey{}
-	err := s.db.Where("user_id=?", id).Find(&survey).Error
+	err := s.db.Where("user_id=? AND campaign_id=0", id).Find(&survey).Error
 	return &survey, err
 }
 
 func (s *Store) ListSurveysForUserId(id uint) ([]Survey, error) {
 	var surveys []Survey
-	err := s.db.Limit(200).Order("name").Where("id IN (SELECT survey_id FROM survey_sponsors WHERE user_id=?)", id).Find(&surveys).Error
+	err := s.db.Limit(200).Order("name").Where("id IN (SELECT survey_id FROM survey_sponsors WHERE user_id=? AND state<>?)", id, SponsorshipStateEnded).Find(&surveys).Error
 	if err != nil {
 		return nil, err
 	}
+	for i := range surveys {
+		surveys[i] = *RedactSurvey(&surveys[i], s.SurveyViewerFor(&surveys[i], id))
+	}
 	return surveys, err
 }
 
-func (s *Store) ListSponsorableUsers() ([]SponsorableUser, error) {
+func (s *Store) ListSponsorableUsers(viewerId uint) ([]SponsorableUser, error) {
 	var users []PublicUser
 	err := s.db.Limit(200).Order("name").Where("permissions >= 2").Find(&users).Error
 	if err != nil {
@@ -248,7 +395,7 @@ func (s *Store) ListSponsorableUsers() ([]SponsorableUser, error) {
 	var sponsorableUsers []SponsorableUser
 	for _, v := range users {
 		survey, err := s.LoadSurveyForUser(v.ID)
-		if err != nil {
+		if err != nil || !s.SurveyVisibleTo(survey, viewerId) {
 			sponsorableUsers = append(sponsorableUsers,
 				SponsorableUser{ID: v.ID, Name: v.Name, GitHubId: ""})
 		} else {
@@ -256,41 +403,54 @@ func (s *Store) ListSponsorableUsers() ([]SponsorableUser, error) {
 				SponsorableUser{ID: v.ID, Name: survey.Name, GitHubId: survey.GitHubId})
 		}
 	}
-	return sponsorableUsers, err
-}
-
-func (s *Store) ListPreReleaseUsers() ([]EmailableUser, error) {
-	var users []PrivilegedUser
-	err := s.db.Limit(200).Order("name").Where("id IN (SELECT user_id FROM surveys WHERE pre_release IS TRUE)").Find(&users).Error
+	if len(sponsorableUsers) == 0 {
+		return sponsorableUsers, nil
+	}
+	var userIds []uint
+	for _, v := range sponsorableUsers {
+		userIds = append(userIds, v.ID)
+	}
+	goals, err := s.ListFundingGoalsForUsers(userIds)
 	if err != nil {
 		return nil, err
 	}
-	var emailableUsers []EmailableUser
-	for _, v := range users {
-		survey, err := s.LoadSurveyForUser(v.ID)
-		if err != nil {
-			emailableUsers = append(emailableUsers,
-				EmailableUser{ID: v.ID, Name: v.Name, Email: v.Email})
-		} else {
-			emailableUsers = append(emailableUsers,
-				EmailableUser{ID: v.ID, Name: survey.Name, Email: v.Email})
+	for i := range sponsorableUsers {
+		for _, goal := range goals {
+			if goal.UserId == sponsorableUsers[i].ID {
+				sponsorableUsers[i].Goals = append(sponsorableUsers[i].Goals, goal)
+			}
 		}
 	}
-	return emailableUsers, err
+	return sponsorableUsers, nil
 }
 
-func (s *Store) InsertSurveySponsor(surveySponsor *SurveySponsor) (uint, error) {
-	err := s.db.Create(surveySponsor).Error
+func (s *Store) InsertSurveySponsor(surveySponsor *SurveySponsor, events ...*OutboxEvent) (uint, error) {
+	tx := s.db.Begin()
+	survey := Survey{}
+	err := tx.Where("id=?", surveySponsor.SurveyId).Find(&survey).Error
+	if err == nil {
+		err = checkSponsorable(tx, &survey, surveySponsor.UserId)
+	}
+	if err == nil {
+		err = insertSurveySponsor(tx, surveySponsor)
+	}
+	if err == nil {
+		err = insertOutboxEvents(tx, events)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit().Error
 	return surveySponsor.ID, err
 }
 
 func (s *Store) SponsorsForSurveyId(surveyId uint) ([]SurveySponsor, error) {
 	var surveySponsors []SurveySponsor
-	err := s.db.Where("survey_id=?", surveyId).Find(&surveySponsors).Error
+	err := s.db.Where("survey_id=? AND state<>?", surveyId, SponsorshipStateEnded).Find(&surveySponsors).Error
+	now := time.Now()
+	for i := range surveySponsors {
+		surveySponsors[i].Reporting = s.ToReportingCurrency(surveySponsors[i].Money, surveySponsors[i].periodStartOn(now))
+	}
 	return surveySponsors, err
 }
-
-func (s *Store) DeleteSurveySponsor(surveyId uint, userId uint) error {
-	err := s.db.Unscoped().Where("survey_id=? AND user_id=?", surveyId, userId).Delete(SurveySponsor{}).Error
-	return err
-}
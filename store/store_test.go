@@ -1,10 +1,14 @@
 package store
 
 import (
+	"encoding/json"
+	"github.com/adamboardman/gorm"
 	. "github.com/smartystreets/goconvey/convey"
 	"golang.org/x/crypto/bcrypt"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 var s Store
@@ -77,7 +81,7 @@ func TestStore_SurveyCreation(t *testing.T) {
 			PreRelease: 	false,
 			Privacy:        "NayBother",
 		}
-		surveyId, _ := s.InsertSurvey(&survey)
+		surveyId, _ := s.InsertSurvey(&survey, user1.ID)
 		Convey("Survey should be created", func() {
 			surveyLoaded, _ := s.LoadSurveyForUser(user1.ID)
 			So(surveyLoaded.ID, ShouldEqual, surveyId)
@@ -91,7 +95,7 @@ func TestStore_SurveyCreation(t *testing.T) {
 
 			Convey("Updating the survey", func() {
 				survey.Priorities = "Changed priorities"
-				surveyId2, _ := s.UpdateSurvey(surveyLoaded)
+				surveyId2, _ := s.UpdateSurvey(surveyLoaded, user1.ID)
 				Convey("Concept should keep the same ID and content", func() {
 					So(surveyId2, ShouldEqual, surveyId)
 					reloadedSurvey, _ := s.LoadSurvey(surveyId2)
@@ -108,3 +112,869 @@ func TestStore_SurveyCreation(t *testing.T) {
 		})
 	})
 }
+
+func TestStore_LegacyCommsFrequency(t *testing.T) {
+	Convey("Free-text frequencies should map to the closest choice without opting anyone in", t, func() {
+		So(legacyCommsFrequency("Weekly"), ShouldEqual, CommsFrequencyWeekly)
+		So(legacyCommsFrequency(" monthly please"), ShouldEqual, CommsFrequencyMonthly)
+		So(legacyCommsFrequency("Only when there's a release"), ShouldEqual, CommsFrequencyReleasesOnly)
+		So(legacyCommsFrequency("Anything goes"), ShouldEqual, CommsFrequencyAsItHappens)
+		So(legacyCommsFrequency("never email me"), ShouldEqual, CommsFrequencyNever)
+		So(legacyCommsFrequency("Don't send weekly mail"), ShouldEqual, CommsFrequencyNever)
+		So(legacyCommsFrequency("NayBother"), ShouldEqual, CommsFrequencyNever)
+		So(legacyCommsFrequency(""), ShouldEqual, CommsFrequencyNever)
+	})
+}
+
+func TestStore_LegacyPrivacyLevel(t *testing.T) {
+	Convey("Free-text privacy answers should map to the closest level and default to admins", t, func() {
+		So(legacyPrivacyLevel("Public"), ShouldEqual, PrivacyLevelPublic)
+		So(legacyPrivacyLevel("Anyone can see it"), ShouldEqual, PrivacyLevelPublic)
+		So(legacyPrivacyLevel("only the developers I sponsor"), ShouldEqual, PrivacyLevelDevelopers)
+		So(legacyPrivacyLevel("Not public please"), ShouldEqual, PrivacyLevelAdmins)
+		So(legacyPrivacyLevel("NayBother"), ShouldEqual, PrivacyLevelAdmins)
+	})
+}
+
+func TestStore_SurveyCampaigns(t *testing.T) {
+	Convey("Given two survey campaigns", t, func() {
+		user1 := ensureTestUserExists("user1@example.com")
+		user2 := ensureTestUserExists("user2@example.com")
+		now := time.Now()
+		campaign1 := SurveyCampaign{Name: "Q2 priorities", OpensAt: now.Add(-48 * time.Hour), ClosesAt: now.Add(-24 * time.Hour)}
+		campaign2 := SurveyCampaign{Name: "Q3 priorities", OpensAt: now.Add(-time.Hour), ClosesAt: now.Add(time.Hour)}
+		campaign1Id, _ := s.InsertSurveyCampaign(&campaign1)
+		campaign2Id, _ := s.InsertSurveyCampaign(&campaign2)
+
+		Convey("Only the current campaign should be open", func() {
+			So(campaign1.IsOpen(now), ShouldBeFalse)
+			So(campaign2.IsOpen(now), ShouldBeTrue)
+		})
+
+		Convey("Users answer the campaigns", func() {
+			_, err := s.InsertCampaignSurvey(&Survey{UserId: user1.ID, CampaignId: campaign1Id, CommsFrequency: "monthly", PreRelease: true})
+			So(err, ShouldBeNil)
+			_, err = s.InsertCampaignSurvey(&Survey{UserId: user1.ID, CampaignId: campaign2Id, CommsFrequency: "weekly"})
+			So(err, ShouldBeNil)
+			_, err = s.InsertCampaignSurvey(&Survey{UserId: user2.ID, CampaignId: campaign2Id, CommsFrequency: "weekly"})
+			So(err, ShouldBeNil)
+
+			Convey("A second answer to the same campaign should be rejected", func() {
+				_, err := s.InsertCampaignSurvey(&Survey{UserId: user2.ID, CampaignId: campaign2Id})
+				So(err, ShouldEqual, ErrCampaignAlreadyAnswered)
+			})
+
+			Convey("The comparison should count continuing and new respondents", func() {
+				comparison, err := s.CompareCampaigns(campaign1Id, campaign2Id)
+				So(err, ShouldBeNil)
+				So(comparison.From.Responses, ShouldEqual, 1)
+				So(comparison.From.PreRelease, ShouldEqual, 1)
+				So(comparison.To.Responses, ShouldEqual, 2)
+				So(comparison.To.CommsFrequency["weekly"], ShouldEqual, 2)
+				So(comparison.Continuing, ShouldEqual, 1)
+				So(comparison.New, ShouldEqual, 1)
+				So(comparison.Lapsed, ShouldEqual, 0)
+			})
+		})
+
+		Reset(func() {
+			s.db.Unscoped().Where("campaign_id IN (?)", []uint{campaign1Id, campaign2Id}).Delete(Survey{})
+			s.db.Unscoped().Where("id IN (?)", []uint{campaign1Id, campaign2Id}).Delete(SurveyCampaign{})
+		})
+	})
+}
+
+func TestStore_SurveyRevisions(t *testing.T) {
+	Convey("Given a survey that has been edited", t, func() {
+		user1 := ensureTestUserExists("user1@example.com")
+		s.db.Unscoped().Where("user_id=?", user1.ID).Delete(Survey{})
+		survey := Survey{UserId: user1.ID, Priorities: "Keyboard driver", PreRelease: false}
+		surveyId, _ := s.InsertSurvey(&survey, user1.ID)
+		survey.Priorities = "Battery life"
+		survey.PreRelease = true
+		_, _ = s.UpdateSurvey(&survey, user1.ID)
+
+		Convey("Each write should be recorded as a revision", func() {
+			revisions, err := s.ListSurveyRevisions(surveyId)
+			So(err, ShouldBeNil)
+			So(len(revisions), ShouldEqual, 2)
+			So(revisions[0].Revision, ShouldEqual, 1)
+			So(revisions[0].AuthorId, ShouldEqual, user1.ID)
+			So(revisions[1].Priorities, ShouldEqual, "Battery life")
+
+			Convey("The diff should list only the changed fields", func() {
+				changes := DiffSurveyRevisions(&revisions[0], &revisions[1])
+				So(changes, ShouldResemble, []SurveyFieldChange{
+					{Field: "Priorities", From: "Keyboard driver", To: "Battery life"},
+					{Field: "PreRelease", From: "false", To: "true"},
+				})
+			})
+		})
+
+		Convey("A revision made while the survey was private should stay redacted after it is made public", func() {
+			survey.Privacy = PrivacyLevelPublic
+			_, _ = s.UpdateSurvey(&survey, user1.ID)
+			revisions, _ := s.ListSurveyRevisions(surveyId)
+			private := RedactSurveyRevision(&revisions[1], SurveyViewerOther)
+			So(private.Revision, ShouldEqual, 2)
+			So(private.Priorities, ShouldBeEmpty)
+			public := RedactSurveyRevision(&revisions[2], SurveyViewerOther)
+			So(public.Priorities, ShouldEqual, "Battery life")
+		})
+
+		Convey("Concurrent saves should each get their own revision number", func() {
+			saves := 5
+			errs := make(chan error, saves)
+			for i := 0; i < saves; i++ {
+				edit := survey
+				edit.Priorities = "Concurrent " + strconv.Itoa(i)
+				go func() {
+					_, err := s.UpdateSurvey(&edit, user1.ID)
+					errs <- err
+				}()
+			}
+			for i := 0; i < saves; i++ {
+				So(<-errs, ShouldBeNil)
+			}
+			revisions, _ := s.ListSurveyRevisions(surveyId)
+			So(len(revisions), ShouldEqual, 2+saves)
+			for i, v := range revisions {
+				So(v.Revision, ShouldEqual, i+1)
+			}
+		})
+	})
+}
+
+func ensureTestUserWithPermissions(emailAddress string, permissions UserPermissions) *User {
+	user := ensureTestUserExists(emailAddress)
+	user.Permissions = permissions
+	_, _ = s.UpdateUser(user)
+	return user
+}
+
+func TestStore_SurveyPrivacy(t *testing.T) {
+	Convey("Given a survey sponsoring a developer", t, func() {
+		owner := ensureTestUserWithPermissions("privacy-owner@example.com", UserPermissionsNone)
+		admin := ensureTestUserWithPermissions("privacy-admin@example.com", UserPermissionsAdmin)
+		developer := ensureTestUserWithPermissions("privacy-developer@example.com", UserPermissionsUser)
+		otherDeveloper := ensureTestUserWithPermissions("privacy-other-developer@example.com", UserPermissionsUser)
+		other := ensureTestUserWithPermissions("privacy-other@example.com", UserPermissionsNone)
+		s.db.Unscoped().Where("user_id=?", owner.ID).Delete(Survey{})
+		survey := Survey{UserId: owner.ID, Name: "Owner", GitHubId: "owner-gh", Priorities: "Private priorities"}
+		surveyId, _ := s.InsertSurvey(&survey, owner.ID)
+		_, _ = s.InsertSurveySponsor(&SurveySponsor{SurveyId: surveyId, UserId: developer.ID})
+
+		viewers := []struct {
+			name   string
+			user   *User
+			viewer SurveyViewer
+		}{
+			{"owner", owner, SurveyViewerOwner},
+			{"admin", admin, SurveyViewerAdmin},
+			{"sponsored developer", developer, SurveyViewerSponsoredDeveloper},
+			{"other developer", otherDeveloper, SurveyViewerOther},
+			{"other user", other, SurveyViewerOther},
+		}
+		expectedVisible := map[PrivacyLevel]map[SurveyViewer]bool{
+			PrivacyLevelAdmins: {
+				SurveyViewerOwner: true, SurveyViewerAdmin: true, SurveyViewerSponsoredDeveloper: false, SurveyViewerOther: false,
+			},
+			PrivacyLevelDevelopers: {
+				SurveyViewerOwner: true, SurveyViewerAdmin: true, SurveyViewerSponsoredDeveloper: true, SurveyViewerOther: false,
+			},
+			PrivacyLevelPublic: {
+				SurveyViewerOwner: true, SurveyViewerAdmin: true, SurveyViewerSponsoredDeveloper: true, SurveyViewerOther: true,
+			},
+		}
+
+		for _, level := range PrivacyLevels {
+			level := level
+			Convey("With privacy level "+string(level), func() {
+				survey.Privacy = level
+				_, _ = s.UpdateSurvey(&survey, owner.ID)
+
+				for _, v := range viewers {
+					v := v
+					visible := expectedVisible[level][v.viewer]
+					Convey("The "+v.name+" should see the survey content: "+strconv.FormatBool(visible), func() {
+						So(s.SurveyViewerFor(&survey, v.user.ID), ShouldEqual, v.viewer)
+						So(level.VisibleTo(v.viewer), ShouldEqual, visible)
+						loaded, err := s.LoadSurveyForViewer(surveyId, v.user.ID)
+						So(err, ShouldBeNil)
+						So(loaded.Privacy, ShouldEqual, level)
+						if visible {
+							So(loaded.Priorities, ShouldEqual, "Private priorities")
+							So(loaded.GitHubId, ShouldEqual, "owner-gh")
+						} else {
+							So(loaded.Priorities, ShouldEqual, "")
+							So(loaded.GitHubId, ShouldEqual, "")
+							So(loaded.Name, ShouldEqual, "")
+						}
+					})
+				}
+			})
+		}
+
+		Reset(func() {
+			s.db.Unscoped().Where("user_id=?", owner.ID).Delete(Survey{})
+		})
+	})
+}
+
+func TestStore_PreReleaseConsent(t *testing.T) {
+	Convey("Given a user who asked for pre-release builds", t, func() {
+		user := ensureTestUserExists("consent@example.com")
+		s.db.Unscoped().Where("user_id=?", user.ID).Delete(Survey{})
+		s.db.Unscoped().Where("user_id=?", user.ID).Delete(ConsentRecord{})
+		survey := Survey{UserId: user.ID, PreRelease: true}
+		_, _ = s.InsertSurvey(&survey, user.ID)
+
+		channel, err := s.DefaultReleaseChannel()
+		So(err, ShouldBeNil)
+		isListed := func() bool {
+			users, _ := s.ListChannelSubscribers(channel.ID, "")
+			for _, v := range users {
+				if v.ID == user.ID {
+					return true
+				}
+			}
+			return false
+		}
+
+		Convey("Without consent they should not be listed but asked for it", func() {
+			So(isListed(), ShouldBeFalse)
+			statuses, _ := s.ConsentStatusForUser(user.ID)
+			So(statuses[0].Granted, ShouldBeFalse)
+			So(statuses[0].ReconsentRequired, ShouldBeTrue)
+			unconsented, _ := s.ListUserIdsWithUnconsentedSubscriptions()
+			So(unconsented, ShouldContain, user.ID)
+		})
+
+		Convey("Once consent is granted they should be listed", func() {
+			_, err := s.RecordConsent(user.ID, ConsentTypePreReleaseEmails, true, "test")
+			So(err, ShouldBeNil)
+			So(isListed(), ShouldBeTrue)
+			So(s.HasActiveConsent(user.ID, ConsentTypePreReleaseEmails), ShouldBeTrue)
+
+			Convey("Withdrawing consent should remove them", func() {
+				_, _ = s.RecordConsent(user.ID, ConsentTypePreReleaseEmails, false, "test")
+				So(isListed(), ShouldBeFalse)
+				granted, _ := s.ListUserIdsWithGrantedConsent()
+				So(granted, ShouldNotContain, user.ID)
+			})
+
+			Convey("A new privacy policy version should require consent again", func() {
+				policy := PrivacyPolicy{Version: "test-" + strconv.FormatInt(time.Now().UnixNano(), 10), PublishedAt: time.Now()}
+				_, _ = s.InsertPrivacyPolicy(&policy)
+				So(isListed(), ShouldBeFalse)
+				statuses, _ := s.ConsentStatusForUser(user.ID)
+				So(statuses[0].Type, ShouldEqual, ConsentTypePreReleaseEmails)
+				So(statuses[0].ReconsentRequired, ShouldBeTrue)
+
+				_, _ = s.RecordConsent(user.ID, ConsentTypePreReleaseEmails, true, "test")
+				So(isListed(), ShouldBeTrue)
+
+				Reset(func() {
+					s.db.Unscoped().Where("id=?", policy.ID).Delete(PrivacyPolicy{})
+				})
+			})
+		})
+	})
+}
+
+func TestStore_AccountDeletion(t *testing.T) {
+	Convey("Given a user with a survey sponsoring a developer", t, func() {
+		s.PurgeUser("delete-me@example.com")
+		user := ensureTestUserExists("delete-me@example.com")
+		developer := ensureTestUserWithPermissions("delete-developer@example.com", UserPermissionsUser)
+		survey := Survey{UserId: user.ID, Name: "Delete Me", Priorities: "Personal notes", PreRelease: true}
+		surveyId, _ := s.InsertSurvey(&survey, user.ID)
+		_, _ = s.InsertSurveySponsor(&SurveySponsor{SurveyId: surveyId, UserId: developer.ID})
+
+		Convey("Scheduling a deletion should only be possible once", func() {
+			_, err := s.ScheduleAccountDeletion(user.ID, time.Now().Add(time.Hour))
+			So(err, ShouldBeNil)
+			_, err = s.ScheduleAccountDeletion(user.ID, time.Now().Add(time.Hour))
+			So(err, ShouldEqual, ErrAccountDeletionAlreadyScheduled)
+
+			Convey("A cancelled deletion should not become due", func() {
+				So(s.CancelAccountDeletion(user.ID), ShouldBeNil)
+				due, _ := s.ListDueAccountDeletions(time.Now().Add(2 * time.Hour))
+				for _, v := range due {
+					So(v.UserId, ShouldNotEqual, user.ID)
+				}
+			})
+
+			Convey("Completing the deletion should remove the user and anonymise the survey", func() {
+				var developerTransitions int
+				s.db.Model(&SponsorshipTransition{}).Where("developer_id=?", developer.ID).Count(&developerTransitions)
+				deletion, _ := s.LoadScheduledAccountDeletion(user.ID)
+				So(s.CompleteAccountDeletion(deletion, time.Now()), ShouldBeNil)
+
+				_, err := s.FindUser("delete-me@example.com")
+				So(err, ShouldNotBeNil)
+				anonymised, err := s.LoadSurvey(surveyId)
+				So(err, ShouldBeNil)
+				So(anonymised.UserId, ShouldEqual, 0)
+				So(anonymised.Name, ShouldEqual, "")
+				So(anonymised.Priorities, ShouldEqual, "")
+				So(anonymised.PreRelease, ShouldBeTrue)
+				sponsors, _ := s.SponsorsForSurveyId(surveyId)
+				So(len(sponsors), ShouldEqual, 0)
+				var transitions, userTransitions int
+				s.db.Model(&SponsorshipTransition{}).Where("developer_id=?", developer.ID).Count(&transitions)
+				So(transitions, ShouldEqual, developerTransitions)
+				s.db.Model(&SponsorshipTransition{}).Where("sponsor_id=?", user.ID).Count(&userTransitions)
+				So(userTransitions, ShouldEqual, 0)
+				revisions, _ := s.ListSurveyRevisions(surveyId)
+				So(revisions[0].Priorities, ShouldEqual, "")
+
+				var audit AuditRecord
+				err = s.db.Where("action=? AND subject_user_id=?", AuditActionDeletionCompleted, user.ID).First(&audit).Error
+				So(err, ShouldBeNil)
+
+				Reset(func() {
+					s.db.Unscoped().Where("id=?", surveyId).Delete(Survey{})
+				})
+			})
+		})
+	})
+}
+
+func TestStore_SponsorshipTiers(t *testing.T) {
+	Convey("Given a developer with a sponsorship tier", t, func() {
+		developer := ensureTestUserWithPermissions("tier-developer@example.com", UserPermissionsUser)
+		otherDeveloper := ensureTestUserWithPermissions("tier-other-developer@example.com", UserPermissionsUser)
+		tier := SponsorshipTier{UserId: developer.ID, Name: "Supporter", Perks: "Name in the credits", Money: Money{Amount: 500, Currency: "GBP"}, Recurrence: RecurrenceMonthly}
+		So(tier.Validate(), ShouldBeNil)
+		tierId, _ := s.InsertSponsorshipTier(&tier)
+
+		Convey("A sponsorship on that tier should pick up its pledge", func() {
+			surveySponsor := SurveySponsor{UserId: developer.ID, TierId: tierId}
+			So(s.ApplySponsorshipTier(&surveySponsor), ShouldBeNil)
+			So(surveySponsor.Amount, ShouldEqual, 500)
+			So(surveySponsor.Currency, ShouldEqual, "GBP")
+			So(surveySponsor.Recurrence, ShouldEqual, RecurrenceMonthly)
+		})
+
+		Convey("The tier should not be usable for another developer", func() {
+			surveySponsor := SurveySponsor{UserId: otherDeveloper.ID, TierId: tierId}
+			So(s.ApplySponsorshipTier(&surveySponsor), ShouldNotBeNil)
+		})
+
+		Convey("Invalid pledges should fail validation", func() {
+			So((&SurveySponsor{Money: Money{Amount: -1}}).Validate(), ShouldNotBeNil)
+			So((&SurveySponsor{Money: Money{Amount: 100, Currency: "pounds"}}).Validate(), ShouldNotBeNil)
+			start := time.Now()
+			end := start.Add(-time.Hour)
+			So((&SurveySponsor{StartDate: start, EndDate: &end}).Validate(), ShouldNotBeNil)
+			_, err := ParseRecurrence("fortnightly")
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			s.db.Unscoped().Where("id=?", tierId).Delete(SponsorshipTier{})
+		})
+	})
+}
+
+func TestStore_SponsorshipLifecycle(t *testing.T) {
+	Convey("Given a survey sponsoring a developer", t, func() {
+		sponsor := ensureTestUserWithPermissions("lifecycle-sponsor@example.com", UserPermissionsNone)
+		developer := ensureTestUserWithPermissions("lifecycle-developer@example.com", UserPermissionsUser)
+		survey := Survey{UserId: sponsor.ID, Name: "Lifecycle"}
+		surveyId, _ := s.InsertSurvey(&survey, sponsor.ID)
+		_, err := s.InsertSurveySponsor(&SurveySponsor{SurveyId: surveyId, UserId: developer.ID})
+		So(err, ShouldBeNil)
+
+		Convey("Pausing and ending should be recorded without deleting the sponsorship", func() {
+			_, err := s.TransitionSurveySponsor(surveyId, developer.ID, SponsorshipStatePaused, "holiday")
+			So(err, ShouldBeNil)
+			_, err = s.TransitionSurveySponsor(surveyId, developer.ID, SponsorshipStatePaused, "")
+			So(err, ShouldEqual, ErrSponsorshipStateUnchanged)
+			ended, err := s.TransitionSurveySponsor(surveyId, developer.ID, SponsorshipStateEnded, "budget")
+			So(err, ShouldBeNil)
+			So(ended.EndDate, ShouldNotBeNil)
+
+			sponsors, _ := s.SponsorsForSurveyId(surveyId)
+			So(len(sponsors), ShouldEqual, 0)
+			history, err := s.SponsorshipHistory(sponsor.ID, developer.ID)
+			So(err, ShouldBeNil)
+			So(len(history), ShouldEqual, 3)
+			So(history[0].ToState, ShouldEqual, SponsorshipStateActive)
+			So(history[2].FromState, ShouldEqual, SponsorshipStatePaused)
+			So(history[2].Reason, ShouldEqual, "budget")
+		})
+
+		Convey("Adding the same sponsor again should restart it rather than duplicate it", func() {
+			again := SurveySponsor{SurveyId: surveyId, UserId: developer.ID}
+			So(s.UpsertSurveySponsor(sponsor.ID, &again), ShouldEqual, ErrSponsorshipStateUnchanged)
+			_, _ = s.TransitionSurveySponsor(surveyId, developer.ID, SponsorshipStateEnded, "budget")
+			restarted := SurveySponsor{SurveyId: surveyId, UserId: developer.ID, Money: Money{Amount: 700, Currency: "EUR"}, Recurrence: RecurrenceYearly}
+			So(s.UpsertSurveySponsor(sponsor.ID, &restarted), ShouldBeNil)
+			So(restarted.ID, ShouldEqual, again.ID)
+			So(restarted.State, ShouldEqual, SponsorshipStateActive)
+			stored, _ := s.LoadSurveySponsor(surveyId, developer.ID)
+			So(stored.Money, ShouldResemble, Money{Amount: 700, Currency: "EUR"})
+			So(stored.Recurrence, ShouldEqual, RecurrenceYearly)
+			history, _ := s.SponsorshipHistory(sponsor.ID, developer.ID)
+			So(history[len(history)-1].Reason, ShouldEqual, "restarted")
+		})
+
+		Convey("A developer whose permissions were revoked should not be restarted", func() {
+			_, _ = s.TransitionSurveySponsor(surveyId, developer.ID, SponsorshipStateEnded, "budget")
+			_ = ensureTestUserWithPermissions("lifecycle-developer@example.com", UserPermissionsNone)
+			restarted := SurveySponsor{SurveyId: surveyId, UserId: developer.ID}
+			So(s.UpsertSurveySponsor(sponsor.ID, &restarted), ShouldEqual, ErrNotSponsorable)
+			ended, _ := s.LoadSurveySponsor(surveyId, developer.ID)
+			So(ended.State, ShouldEqual, SponsorshipStateEnded)
+		})
+
+		Convey("Re-submitting a paused sponsor in the full list should restart it", func() {
+			_, _ = s.TransitionSurveySponsor(surveyId, developer.ID, SponsorshipStatePaused, "holiday")
+			_, err := s.ReplaceSurveySponsors(sponsor.ID, surveyId, []SurveySponsor{{UserId: developer.ID}})
+			So(err, ShouldBeNil)
+			restarted, _ := s.LoadSurveySponsor(surveyId, developer.ID)
+			So(restarted.State, ShouldEqual, SponsorshipStateActive)
+		})
+
+		Convey("Only the survey owner should be able to add sponsors to it", func() {
+			_, _ = s.TransitionSurveySponsor(surveyId, developer.ID, SponsorshipStateEnded, "budget")
+			intruder := SurveySponsor{SurveyId: surveyId, UserId: developer.ID}
+			So(s.UpsertSurveySponsor(developer.ID, &intruder), ShouldEqual, ErrNotSurveyOwner)
+			ended, _ := s.LoadSurveySponsor(surveyId, developer.ID)
+			So(ended.State, ShouldEqual, SponsorshipStateEnded)
+		})
+
+		Reset(func() {
+			s.db.Unscoped().Where("survey_id=?", surveyId).Delete(SurveySponsor{})
+			s.db.Unscoped().Where("sponsor_id=?", sponsor.ID).Delete(SponsorshipTransition{})
+			s.db.Unscoped().Where("id=?", surveyId).Delete(Survey{})
+		})
+	})
+
+	Convey("Churn should count sponsorships active at the start of a period that ended within it", t, func() {
+		start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+		end := start.AddDate(0, 1, 0)
+		transitions := []SponsorshipTransition{
+			{SurveySponsorId: 1, ToState: SponsorshipStateActive},
+			{SurveySponsorId: 2, ToState: SponsorshipStateActive},
+			{SurveySponsorId: 2, FromState: SponsorshipStateActive, ToState: SponsorshipStateEnded},
+			{SurveySponsorId: 3, ToState: SponsorshipStateActive},
+		}
+		transitions[0].CreatedAt = start.AddDate(0, -2, 0)
+		transitions[1].CreatedAt = start.AddDate(0, -1, 0)
+		transitions[2].CreatedAt = start.AddDate(0, 0, 10)
+		transitions[3].CreatedAt = start.AddDate(0, 0, 20)
+
+		metrics := SponsorshipMetricsForPeriod(transitions, start, end)
+		So(metrics.ActiveAtStart, ShouldEqual, 2)
+		So(metrics.Started, ShouldEqual, 1)
+		So(metrics.Ended, ShouldEqual, 1)
+		So(metrics.ActiveAtEnd, ShouldEqual, 2)
+		So(metrics.ChurnRate, ShouldEqual, 0.5)
+		So(metrics.RetentionRate, ShouldEqual, 0.5)
+	})
+}
+
+func TestStore_ReplaceSurveySponsors(t *testing.T) {
+	Convey("Given a survey owner and some developers", t, func() {
+		owner := ensureTestUserWithPermissions("replace-owner@example.com", UserPermissionsUser)
+		developer := ensureTestUserWithPermissions("replace-developer@example.com", UserPermissionsUser)
+		otherDeveloper := ensureTestUserWithPermissions("replace-other-developer@example.com", UserPermissionsUser)
+		notDeveloper := ensureTestUserWithPermissions("replace-not-developer@example.com", UserPermissionsNone)
+
+		survey, err := s.ReplaceSurveySponsors(owner.ID, 0, []SurveySponsor{{UserId: developer.ID}})
+		So(err, ShouldBeNil)
+		So(survey.UserId, ShouldEqual, owner.ID)
+
+		Convey("Replacing the set should end the sponsors that were left out", func() {
+			_, err := s.ReplaceSurveySponsors(owner.ID, survey.ID, []SurveySponsor{{UserId: otherDeveloper.ID, Money: Money{Amount: 300, Currency: "EUR"}}})
+			So(err, ShouldBeNil)
+			sponsors, _ := s.SponsorsForSurveyId(survey.ID)
+			So(len(sponsors), ShouldEqual, 1)
+			So(sponsors[0].UserId, ShouldEqual, otherDeveloper.ID)
+			ended, _ := s.LoadSurveySponsor(survey.ID, developer.ID)
+			So(ended.State, ShouldEqual, SponsorshipStateEnded)
+		})
+
+		Convey("An invalid set should leave the existing sponsors untouched", func() {
+			_, err := s.ReplaceSurveySponsors(owner.ID, survey.ID, []SurveySponsor{{UserId: otherDeveloper.ID}, {UserId: owner.ID}})
+			So(err, ShouldEqual, ErrSelfSponsorship)
+			_, err = s.ReplaceSurveySponsors(owner.ID, survey.ID, []SurveySponsor{{UserId: notDeveloper.ID}})
+			So(err, ShouldEqual, ErrNotSponsorable)
+			_, err = s.ReplaceSurveySponsors(owner.ID, survey.ID, []SurveySponsor{{UserId: otherDeveloper.ID}, {UserId: otherDeveloper.ID}})
+			So(err, ShouldEqual, ErrDuplicateSponsor)
+			_, err = s.ReplaceSurveySponsors(developer.ID, survey.ID, nil)
+			So(err, ShouldEqual, ErrNotSurveyOwner)
+
+			sponsors, _ := s.SponsorsForSurveyId(survey.ID)
+			So(len(sponsors), ShouldEqual, 1)
+			So(sponsors[0].UserId, ShouldEqual, developer.ID)
+		})
+
+		Convey("New and restarted sponsors should each emit sponsor.created", func() {
+			var lastEventId uint
+			_ = s.db.Model(&OutboxEvent{}).Select("COALESCE(MAX(id), 0)").Row().Scan(&lastEventId)
+			_, err := s.ReplaceSurveySponsors(owner.ID, survey.ID, []SurveySponsor{{UserId: developer.ID}, {UserId: otherDeveloper.ID}})
+			So(err, ShouldBeNil)
+			_, _ = s.ReplaceSurveySponsors(owner.ID, survey.ID, []SurveySponsor{{UserId: otherDeveloper.ID}})
+			_, err = s.ReplaceSurveySponsors(owner.ID, survey.ID, []SurveySponsor{{UserId: developer.ID}, {UserId: otherDeveloper.ID}})
+			So(err, ShouldBeNil)
+
+			var events []OutboxEvent
+			_ = s.db.Where("type=? AND id>?", WebhookEventSponsorCreated, lastEventId).Order("id").Find(&events).Error
+			var created []uint
+			for _, v := range events {
+				sponsor := SurveySponsor{}
+				_ = json.Unmarshal([]byte(v.Payload), &sponsor)
+				if sponsor.SurveyId == survey.ID {
+					created = append(created, sponsor.UserId)
+				}
+			}
+			So(created, ShouldResemble, []uint{otherDeveloper.ID, developer.ID})
+		})
+
+		Reset(func() {
+			s.db.Unscoped().Where("survey_id=?", survey.ID).Delete(SurveySponsor{})
+			s.db.Unscoped().Where("sponsor_id=?", owner.ID).Delete(SponsorshipTransition{})
+			s.db.Unscoped().Where("id=?", survey.ID).Delete(Survey{})
+		})
+	})
+}
+
+func reconciliationLineFor(sponsorId uint, developerId uint) ReconciliationLine {
+	report, err := s.ReconciliationReportForMonth(2001, time.May)
+	So(err, ShouldBeNil)
+	for _, v := range report.Lines {
+		if v.SponsorId == sponsorId && v.DeveloperId == developerId && v.Currency == "GBP" {
+			return v
+		}
+	}
+	return ReconciliationLine{}
+}
+
+func TestStore_FundingLedger(t *testing.T) {
+	Convey("Given a sponsor pledging monthly by bank transfer", t, func() {
+		finance := ensureTestUserWithPermissions("ledger-finance@example.com", UserPermissionsFinance)
+		sponsor := ensureTestUserWithPermissions("ledger-sponsor@example.com", UserPermissionsNone)
+		developer := ensureTestUserWithPermissions("ledger-developer@example.com", UserPermissionsUser)
+		survey, err := s.ReplaceSurveySponsors(sponsor.ID, 0, []SurveySponsor{{UserId: developer.ID, Money: Money{Amount: 1000, Currency: "GBP"},
+			Recurrence: RecurrenceMonthly, StartDate: time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)}})
+		So(err, ShouldBeNil)
+		before := reconciliationLineFor(sponsor.ID, developer.ID)
+		So(before.Expected, ShouldEqual, 1000)
+
+		entry := LedgerEntry{Kind: LedgerEntryKindPayment, SponsorId: sponsor.ID, DeveloperId: developer.ID, Money: Money{Amount: 600, Currency: "GBP"},
+			EffectiveDate: time.Date(2001, time.May, 10, 0, 0, 0, 0, time.UTC), Reference: "BACS", RecordedBy: finance.ID}
+		So(entry.Validate(), ShouldBeNil)
+		entryId, err := s.InsertLedgerEntry(&entry)
+		So(err, ShouldBeNil)
+
+		Convey("The payment should balance and appear in the reconciliation report", func() {
+			saved, _ := s.LoadLedgerEntry(entryId)
+			So(len(saved.Postings), ShouldEqual, 2)
+			So(saved.Postings[0].Amount+saved.Postings[1].Amount, ShouldEqual, 0)
+			after := reconciliationLineFor(sponsor.ID, developer.ID)
+			So(after.ReceivedManual, ShouldEqual, before.ReceivedManual+600)
+			So(after.Difference, ShouldEqual, before.Difference+600)
+		})
+
+		Convey("Provider payments should count but tier changes should not", func() {
+			paidAt := time.Date(2001, time.May, 12, 0, 0, 0, 0, time.UTC)
+			eventId := "ledger-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			for _, action := range []PaymentAction{PaymentActionRenewed, PaymentActionChanged} {
+				event := PaymentEvent{Model: gorm.Model{CreatedAt: paidAt}, Provider: PaymentProviderStripe, EventId: eventId + "-" + string(action), Action: action,
+					Status: PaymentEventStatusProcessed, SponsorUserId: sponsor.ID, DeveloperUserId: developer.ID, Money: Money{Amount: 400, Currency: "GBP"}}
+				So(s.db.Create(&event).Error, ShouldBeNil)
+			}
+			after := reconciliationLineFor(sponsor.ID, developer.ID)
+			So(after.ReceivedProvider, ShouldEqual, before.ReceivedProvider+400)
+		})
+
+		Convey("Entries should be immutable and corrected by a single reversal", func() {
+			So(s.db.Model(&LedgerEntry{}).Where("id=?", entryId).Update("memo", "edited").Error, ShouldNotBeNil)
+			reversal, err := s.ReverseLedgerEntry(entryId, "Wrong sponsor", finance.ID)
+			So(err, ShouldBeNil)
+			So(reversal.Amount, ShouldEqual, -600)
+			_, err = s.ReverseLedgerEntry(entryId, "Again", finance.ID)
+			So(err, ShouldEqual, ErrLedgerEntryAlreadyReversed)
+			_, err = s.ReverseLedgerEntry(reversal.ID, "Undo", finance.ID)
+			So(err, ShouldEqual, ErrLedgerEntryIsReversal)
+		})
+
+		Reset(func() {
+			s.db.Unscoped().Where("survey_id=?", survey.ID).Delete(SurveySponsor{})
+		})
+	})
+}
+
+func TestStore_ExchangeRates(t *testing.T) {
+	Convey("Given exchange rates that change part way through a year", t, func() {
+		first := ExchangeRate{FromCurrency: "XTS", ToCurrency: "GBP", Rate: "0.5", EffectiveFrom: time.Date(2002, time.January, 1, 0, 0, 0, 0, time.UTC)}
+		second := ExchangeRate{FromCurrency: "XTS", ToCurrency: "GBP", Rate: "0.25", EffectiveFrom: time.Date(2002, time.June, 1, 0, 0, 0, 0, time.UTC)}
+		So(first.Validate(), ShouldBeNil)
+		So((&ExchangeRate{FromCurrency: "XTS", ToCurrency: "XTS", Rate: "1", EffectiveFrom: time.Now()}).Validate(), ShouldNotBeNil)
+		So((&ExchangeRate{FromCurrency: "XTS", ToCurrency: "GBP", Rate: "-1", EffectiveFrom: time.Now()}).Validate(), ShouldNotBeNil)
+		_, _ = s.InsertExchangeRate(&first)
+		_, _ = s.InsertExchangeRate(&second)
+
+		Convey("Amounts should convert using the rate valid on the transaction date", func() {
+			march := time.Date(2002, time.March, 1, 0, 0, 0, 0, time.UTC)
+			july := time.Date(2002, time.July, 1, 0, 0, 0, 0, time.UTC)
+			converted, err := s.ConvertMoney(Money{Amount: 1001, Currency: "XTS"}, "GBP", march)
+			So(err, ShouldBeNil)
+			So(converted, ShouldResemble, Money{Amount: 501, Currency: "GBP"})
+			So(s.ToReportingCurrency(Money{Amount: 1000, Currency: "XTS"}, july).Amount, ShouldEqual, 250)
+
+			inverse, err := s.ConvertMoney(Money{Amount: 250, Currency: "GBP"}, "XTS", july)
+			So(err, ShouldBeNil)
+			So(inverse.Amount, ShouldEqual, 1000)
+
+			_, err = s.ConvertMoney(Money{Amount: 1000, Currency: "XTS"}, "GBP", time.Date(2001, time.December, 1, 0, 0, 0, 0, time.UTC))
+			So(err, ShouldEqual, ErrNoExchangeRate)
+		})
+
+		Convey("A later rate entered the other way round should take over from the direct rate", func() {
+			_, _ = s.InsertExchangeRate(&ExchangeRate{FromCurrency: "GBP", ToCurrency: "XTS", Rate: "8",
+				EffectiveFrom: time.Date(2002, time.September, 1, 0, 0, 0, 0, time.UTC)})
+			july, _ := s.ConvertMoney(Money{Amount: 1000, Currency: "XTS"}, "GBP", time.Date(2002, time.July, 1, 0, 0, 0, 0, time.UTC))
+			So(july.Amount, ShouldEqual, 250)
+			october, _ := s.ConvertMoney(Money{Amount: 1000, Currency: "XTS"}, "GBP", time.Date(2002, time.October, 1, 0, 0, 0, 0, time.UTC))
+			So(october.Amount, ShouldEqual, 125)
+		})
+
+		Convey("A recurring pledge should convert at the start of its current period", func() {
+			pledge := SurveySponsor{Money: Money{Amount: 1000, Currency: "XTS"}, Recurrence: RecurrenceMonthly,
+				StartDate: time.Date(2002, time.January, 15, 0, 0, 0, 0, time.UTC)}
+			So(pledge.periodStartOn(time.Date(2002, time.July, 20, 0, 0, 0, 0, time.UTC)), ShouldResemble,
+				time.Date(2002, time.July, 15, 0, 0, 0, 0, time.UTC))
+			pledge.Recurrence = RecurrenceOneOff
+			So(pledge.periodStartOn(time.Date(2002, time.July, 20, 0, 0, 0, 0, time.UTC)), ShouldResemble, pledge.StartDate)
+		})
+
+		Convey("Money should format using the currency's minor units", func() {
+			So(Money{Amount: 1234, Currency: "GBP"}.String(), ShouldEqual, "GBP 12.34")
+			So(Money{Amount: 1234, Currency: "JPY"}.String(), ShouldEqual, "JPY 1234")
+			So(Money{Amount: 1234, Currency: "KWD"}.String(), ShouldEqual, "KWD 1.234")
+		})
+
+		Reset(func() {
+			s.db.Unscoped().Where("from_currency=? OR to_currency=?", "XTS", "XTS").Delete(ExchangeRate{})
+		})
+	})
+}
+
+func TestStore_Receipts(t *testing.T) {
+	Convey("Given two payments recorded for a sponsor in the same year", t, func() {
+		s.ReceiptPrefix = "TEST"
+		finance := ensureTestUserWithPermissions("receipt-finance@example.com", UserPermissionsFinance)
+		sponsor := ensureTestUserWithPermissions("receipt-sponsor@example.com", UserPermissionsNone)
+		developer := ensureTestUserWithPermissions("receipt-developer@example.com", UserPermissionsUser)
+		var entryIds []uint
+		for _, month := range []time.Month{time.February, time.March} {
+			entry := LedgerEntry{Kind: LedgerEntryKindPayment, SponsorId: sponsor.ID, DeveloperId: developer.ID, Money: Money{Amount: 500, Currency: "GBP"},
+				EffectiveDate: time.Date(2003, month, 1, 0, 0, 0, 0, time.UTC), Reference: "BACS", RecordedBy: finance.ID}
+			entryId, err := s.InsertLedgerEntry(&entry)
+			So(err, ShouldBeNil)
+			entryIds = append(entryIds, entryId)
+		}
+
+		Convey("Each payment should get its own sequential receipt number", func() {
+			first, err := s.LoadReceiptForSource(ReceiptSourceLedger, entryIds[0])
+			So(err, ShouldBeNil)
+			second, err := s.LoadReceiptForSource(ReceiptSourceLedger, entryIds[1])
+			So(err, ShouldBeNil)
+			So(first.Number, ShouldStartWith, "TEST-2003-")
+			So(second.Number, ShouldBeGreaterThan, first.Number)
+			So(first.SponsorId, ShouldEqual, sponsor.ID)
+		})
+
+		Convey("A reversed payment should be voided and left out of the annual statement", func() {
+			_, err := s.ReverseLedgerEntry(entryIds[0], "Bounced", finance.ID)
+			So(err, ShouldBeNil)
+			voided, _ := s.LoadReceiptForSource(ReceiptSourceLedger, entryIds[0])
+			So(voided.VoidedAt, ShouldNotBeNil)
+			statement, err := s.AnnualStatementForSponsor(sponsor.ID, 2003)
+			So(err, ShouldBeNil)
+			So(len(statement.Receipts), ShouldEqual, 1)
+			So(statement.Totals, ShouldResemble, []Money{{Amount: 500, Currency: "GBP"}})
+		})
+
+		Reset(func() {
+			s.db.Unscoped().Where("sponsor_id=?", sponsor.ID).Delete(Receipt{})
+			s.ReceiptPrefix = ""
+		})
+	})
+}
+
+func TestStore_FundingGoals(t *testing.T) {
+	Convey("Given a developer with a monthly funding goal and milestones", t, func() {
+		developer := ensureTestUserWithPermissions("goal-developer@example.com", UserPermissionsUser)
+		monthly := ensureTestUserWithPermissions("goal-monthly@example.com", UserPermissionsNone)
+		yearly := ensureTestUserWithPermissions("goal-yearly@example.com", UserPermissionsNone)
+		s.db.Unscoped().Where("goal_id IN (SELECT id FROM funding_goals WHERE user_id=?)", developer.ID).Delete(FundingMilestone{})
+		s.db.Unscoped().Where("user_id=?", developer.ID).Delete(FundingGoal{})
+		goal := FundingGoal{UserId: developer.ID, Title: "Full-time on the keyboard driver", Money: Money{Amount: 10000, Currency: "GBP"},
+			Milestones: []FundingMilestone{{Title: "One day a week", Amount: 3000}, {Title: "Full-time", Amount: 10000}}}
+		So(goal.Validate(), ShouldBeNil)
+		_, err := s.InsertFundingGoal(&goal)
+		So(err, ShouldBeNil)
+		start := time.Now().AddDate(0, -1, 0)
+		monthlySurvey, err := s.ReplaceSurveySponsors(monthly.ID, 0, []SurveySponsor{{UserId: developer.ID,
+			Money: Money{Amount: 5000, Currency: "GBP"}, Recurrence: RecurrenceMonthly, StartDate: start}})
+		So(err, ShouldBeNil)
+
+		Convey("Progress should be computed from active sponsorships and each milestone crossed once", func() {
+			goals, err := s.ListFundingGoalsForUsers([]uint{developer.ID})
+			So(err, ShouldBeNil)
+			So(len(goals), ShouldEqual, 1)
+			So(goals[0].Progress.Monthly.Amount, ShouldEqual, 5000)
+			So(goals[0].Progress.Percent, ShouldEqual, 50)
+
+			crossings, err := s.CheckFundingMilestones(developer.ID, time.Now())
+			So(err, ShouldBeNil)
+			So(len(crossings), ShouldEqual, 1)
+			So(crossings[0].Milestone.Title, ShouldEqual, "One day a week")
+			crossings, _ = s.CheckFundingMilestones(developer.ID, time.Now())
+			So(len(crossings), ShouldEqual, 0)
+
+			yearlySurvey, err := s.ReplaceSurveySponsors(yearly.ID, 0, []SurveySponsor{{UserId: developer.ID,
+				Money: Money{Amount: 60000, Currency: "GBP"}, Recurrence: RecurrenceYearly, StartDate: start}})
+			So(err, ShouldBeNil)
+			crossings, _ = s.CheckFundingMilestones(developer.ID, time.Now())
+			So(len(crossings), ShouldEqual, 1)
+			So(crossings[0].Progress.Sponsors, ShouldEqual, 2)
+			So(crossings[0].Progress.Percent, ShouldEqual, 100)
+			s.db.Unscoped().Where("survey_id=?", yearlySurvey.ID).Delete(SurveySponsor{})
+		})
+
+		Convey("Milestones above the goal should fail validation", func() {
+			invalid := FundingGoal{Title: "Too far", Money: Money{Amount: 100, Currency: "GBP"}, Milestones: []FundingMilestone{{Title: "Beyond", Amount: 200}}}
+			So(invalid.Validate(), ShouldNotBeNil)
+			multiline := FundingGoal{Title: "Lines", Money: Money{Amount: 100, Currency: "GBP"}, Milestones: []FundingMilestone{{Title: "Half\r\nBcc: everyone@example.com", Amount: 50}}}
+			So(multiline.Validate(), ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			s.db.Unscoped().Where("survey_id=?", monthlySurvey.ID).Delete(SurveySponsor{})
+			_ = s.DeleteFundingGoal(goal.ID)
+		})
+	})
+}
+
+func TestStore_ReleaseChannels(t *testing.T) {
+	Convey("Given a nightly channel built for two platforms", t, func() {
+		user := ensureTestUserExists("channels@example.com")
+		s.db.Unscoped().Where("name=?", "test-nightly").Delete(ReleaseChannel{})
+		channel := ReleaseChannel{Name: "test-nightly", Platforms: "android, linux"}
+		So(channel.Validate(), ShouldBeNil)
+		So(channel.Platforms, ShouldEqual, "android,linux")
+		_, err := s.InsertReleaseChannel(&channel)
+		So(err, ShouldBeNil)
+		_, _ = s.RecordConsent(user.ID, ConsentTypePreReleaseEmails, true, "test")
+
+		Convey("A deleted channel's name should be free to use again", func() {
+			_ = s.DeleteReleaseChannel(channel.ID)
+			again := ReleaseChannel{Name: "test-nightly"}
+			_, err := s.InsertReleaseChannel(&again)
+			So(err, ShouldBeNil)
+			duplicate := ReleaseChannel{Name: "test-nightly"}
+			_, err = s.InsertReleaseChannel(&duplicate)
+			So(err, ShouldNotBeNil)
+			s.db.Unscoped().Where("id=?", again.ID).Delete(ReleaseChannel{})
+		})
+
+		Convey("Making a channel the default should clear the flag on the others", func() {
+			previous, err := s.DefaultReleaseChannel()
+			channel.IsDefault = true
+			_, _ = s.UpdateReleaseChannel(&channel)
+			current, _ := s.DefaultReleaseChannel()
+			So(current.ID, ShouldEqual, channel.ID)
+			if err == nil {
+				reloaded, _ := s.LoadReleaseChannel(previous.ID)
+				So(reloaded.IsDefault, ShouldBeFalse)
+				reloaded.IsDefault = true
+				_, _ = s.UpdateReleaseChannel(reloaded)
+			}
+		})
+
+		Convey("Subscribers should be listed per platform", func() {
+			err := s.ReplaceChannelSubscriptions(user.ID, []ChannelSubscription{{ChannelId: channel.ID, Platform: "android"}})
+			So(err, ShouldBeNil)
+			subscribers, err := s.ListChannelSubscribers(channel.ID, "android")
+			So(err, ShouldBeNil)
+			So(len(subscribers), ShouldEqual, 1)
+			So(subscribers[0].Email, ShouldEqual, "channels@example.com")
+			subscribers, _ = s.ListChannelSubscribers(channel.ID, "linux")
+			So(len(subscribers), ShouldEqual, 0)
+		})
+
+		Convey("Invalid subscriptions should be rejected and leave the existing ones", func() {
+			_ = s.ReplaceChannelSubscriptions(user.ID, []ChannelSubscription{{ChannelId: channel.ID}})
+			err := s.ReplaceChannelSubscriptions(user.ID, []ChannelSubscription{{ChannelId: channel.ID, Platform: "windows"}})
+			So(err, ShouldEqual, ErrUnsupportedPlatform)
+			err = s.ReplaceChannelSubscriptions(user.ID, []ChannelSubscription{{ChannelId: channel.ID}, {ChannelId: channel.ID}})
+			So(err, ShouldEqual, ErrDuplicateSubscription)
+			subscriptions, _ := s.ListChannelSubscriptionsForUser(user.ID)
+			So(len(subscriptions), ShouldEqual, 1)
+		})
+
+		Convey("Subscribing should not grant consent but removing the last subscription should withdraw it", func() {
+			_, _ = s.RecordConsent(user.ID, ConsentTypePreReleaseEmails, false, "test")
+			_ = s.ReplaceChannelSubscriptions(user.ID, []ChannelSubscription{{ChannelId: channel.ID}})
+			So(s.HasGrantedConsent(user.ID, ConsentTypePreReleaseEmails), ShouldBeFalse)
+			_, _ = s.RecordConsent(user.ID, ConsentTypePreReleaseEmails, true, "test")
+			_ = s.ReplaceChannelSubscriptions(user.ID, nil)
+			So(s.HasGrantedConsent(user.ID, ConsentTypePreReleaseEmails), ShouldBeFalse)
+			records, _ := s.ListConsentRecordsForUser(user.ID)
+			So(records[len(records)-1].Source, ShouldEqual, "channel-subscription")
+		})
+
+		Convey("Saving a survey without pre-release should keep subscriptions to other channels", func() {
+			_ = s.ReplaceChannelSubscriptions(user.ID, []ChannelSubscription{{ChannelId: channel.ID, Platform: "linux"}})
+			survey, err := s.LoadSurveyForUser(user.ID)
+			if err != nil {
+				survey = &Survey{UserId: user.ID}
+				_, _ = s.InsertSurvey(survey, user.ID)
+			}
+			survey.PreRelease = false
+			_, err = s.UpdateSurvey(survey, user.ID)
+			So(err, ShouldBeNil)
+			subscriptions, _ := s.ListChannelSubscriptionsForUser(user.ID)
+			So(len(subscriptions), ShouldEqual, 1)
+			So(subscriptions[0].ChannelId, ShouldEqual, channel.ID)
+		})
+
+		Reset(func() {
+			_ = s.ReplaceChannelSubscriptions(user.ID, nil)
+			s.db.Unscoped().Where("id=?", channel.ID).Delete(ReleaseChannel{})
+		})
+	})
+}
+
+func TestStore_LiveEvents(t *testing.T) {
+	Convey("Given a listener for live events", t, func() {
+		received := make(chan string, 16)
+		err := s.ListenForLiveEvents(func(payload string) {
+			received <- payload
+		})
+		So(err, ShouldBeNil)
+
+		Convey("A published event should be delivered through Postgres", func() {
+			payload := "live-event-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			So(s.PublishLiveEvent(payload), ShouldBeNil)
+			delivered := ""
+			timeout := time.After(5 * time.Second)
+			for delivered != payload {
+				select {
+				case delivered = <-received:
+				case <-timeout:
+					So(delivered, ShouldEqual, payload)
+					return
+				}
+			}
+			So(delivered, ShouldEqual, payload)
+		})
+	})
+}
@@ -0,0 +1,273 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/adamboardman/gorm"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type WebhookEventType string
+
+const (
+	WebhookEventSponsorCreated   WebhookEventType = "sponsor.created"
+	WebhookEventSurveyUpdated    WebhookEventType = "survey.updated"
+	WebhookEventUserRegistered   WebhookEventType = "user.registered"
+	WebhookEventAnnouncementSent WebhookEventType = "announcement.sent"
+)
+
+var WebhookEventTypes = []WebhookEventType{
+	WebhookEventSponsorCreated,
+	WebhookEventSurveyUpdated,
+	WebhookEventUserRegistered,
+	WebhookEventAnnouncementSent,
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
+)
+
+const WebhookMaxAttempts = 8
+const webhookFirstRetry = time.Minute
+const webhookMaxRetry = 6 * time.Hour
+const webhookFanOutBatch = 100
+
+type WebhookEndpoint struct {
+	gorm.Model
+	Url         string
+	Description string
+	EventTypes  string
+	Secret      string `json:"-"`
+	Active      bool
+	AuthorId    uint
+}
+
+type OutboxEvent struct {
+	gorm.Model
+	Type         WebhookEventType
+	Payload      string
+	DispatchedAt *time.Time  `gorm:"index"`
+	Data         interface{} `gorm:"-" json:"-"`
+}
+
+type WebhookDelivery struct {
+	gorm.Model
+	EndpointId     uint `gorm:"index"`
+	EventId        uint `gorm:"index"`
+	EventType      WebhookEventType
+	Status         WebhookDeliveryStatus `gorm:"index"`
+	Attempts       int
+	NextAttemptAt  *time.Time `gorm:"index"`
+	ResponseStatus int
+	Error          string
+	DeliveredAt    *time.Time
+}
+
+var ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+
+func ParseWebhookEventTypes(values []string) (string, error) {
+	if len(values) == 0 {
+		return "", errors.New("at least one event type is required")
+	}
+	var eventTypes []string
+	for _, value := range values {
+		known := false
+		for _, v := range WebhookEventTypes {
+			if string(v) == value {
+				known = true
+			}
+		}
+		if !known {
+			return "", errors.New("unknown webhook event type: " + value)
+		}
+		eventTypes = append(eventTypes, value)
+	}
+	return strings.Join(eventTypes, ","), nil
+}
+
+func (w *WebhookEndpoint) Validate() error {
+	endpoint, err := url.Parse(w.Url)
+	if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || len(endpoint.Host) == 0 {
+		return errors.New("url must be an http or https URL")
+	}
+	_, err = ParseWebhookEventTypes(strings.Split(w.EventTypes, ","))
+	return err
+}
+
+func (w *WebhookEndpoint) Subscribes(eventType WebhookEventType) bool {
+	for _, v := range strings.Split(w.EventTypes, ",") {
+		if v == string(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func WebhookRetryDelay(attempts int) time.Duration {
+	delay := webhookFirstRetry
+	for i := 1; i < attempts && delay < webhookMaxRetry; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetry {
+		delay = webhookMaxRetry
+	}
+	return delay
+}
+
+func NewOutboxEvent(eventType WebhookEventType, data interface{}) *OutboxEvent {
+	return &OutboxEvent{Type: eventType, Data: data}
+}
+
+func insertOutboxEvents(tx *gorm.DB, events []*OutboxEvent) error {
+	for _, event := range events {
+		payload, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		event.Payload = string(payload)
+		err = tx.Create(event).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) LoadOutboxEvent(id uint) (*OutboxEvent, error) {
+	event := OutboxEvent{}
+	err := s.db.Where("id=?", id).Find(&event).Error
+	return &event, err
+}
+
+func (s *Store) InsertWebhookEndpoint(endpoint *WebhookEndpoint) (uint, error) {
+	err := s.db.Create(endpoint).Error
+	return endpoint.ID, err
+}
+
+func (s *Store) UpdateWebhookEndpoint(endpoint *WebhookEndpoint) (uint, error) {
+	err := s.db.Save(endpoint).Error
+	return endpoint.ID, err
+}
+
+func (s *Store) LoadWebhookEndpoint(id uint) (*WebhookEndpoint, error) {
+	endpoint := WebhookEndpoint{}
+	err := s.db.Where("id=?", id).Find(&endpoint).Error
+	return &endpoint, err
+}
+
+func (s *Store) ListWebhookEndpoints() ([]WebhookEndpoint, error) {
+	var endpoints []WebhookEndpoint
+	err := s.db.Order("id").Find(&endpoints).Error
+	return endpoints, err
+}
+
+func (s *Store) DeleteWebhookEndpoint(id uint) error {
+	tx := s.db.Begin()
+	err := tx.Model(&WebhookDelivery{}).Where("endpoint_id=? AND status=?", id, WebhookDeliveryPending).
+		Updates(map[string]interface{}{"status": WebhookDeliveryFailed, "next_attempt_at": nil, "error": "endpoint deleted"}).Error
+	if err == nil {
+		err = tx.Where("id=?", id).Delete(WebhookEndpoint{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *Store) FanOutOutboxEvents(now time.Time) (int, error) {
+	tx := s.db.Begin()
+	var events []OutboxEvent
+	err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").Where("dispatched_at IS NULL").Order("id").
+		Limit(webhookFanOutBatch).Find(&events).Error
+	var endpoints []WebhookEndpoint
+	if err == nil {
+		err = tx.Where("active IS TRUE").Find(&endpoints).Error
+	}
+	var eventIds []uint
+	for i := 0; err == nil && i < len(events); i++ {
+		eventIds = append(eventIds, events[i].ID)
+		for j := 0; err == nil && j < len(endpoints); j++ {
+			if endpoints[j].Subscribes(events[i].Type) {
+				err = tx.Create(&WebhookDelivery{EndpointId: endpoints[j].ID, EventId: events[i].ID, EventType: events[i].Type,
+					Status: WebhookDeliveryPending, NextAttemptAt: &now}).Error
+			}
+		}
+	}
+	if err == nil && len(eventIds) > 0 {
+		err = tx.Model(&OutboxEvent{}).Where("id IN (?)", eventIds).UpdateColumn("dispatched_at", now).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return len(events), tx.Commit().Error
+}
+
+func (s *Store) ClaimDueWebhookDelivery(now time.Time, lease time.Duration) (*WebhookDelivery, error) {
+	tx := s.db.Begin()
+	delivery := WebhookDelivery{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").Where("status=? AND next_attempt_at<=?", WebhookDeliveryPending, now).
+		Order("next_attempt_at").Limit(1).Find(&delivery).Error
+	if gorm.IsRecordNotFoundError(err) {
+		tx.Rollback()
+		return nil, nil
+	}
+	leasedUntil := now.Add(lease)
+	if err == nil {
+		err = tx.Model(&WebhookDelivery{}).Where("id=?", delivery.ID).UpdateColumn("next_attempt_at", leasedUntil).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	delivery.NextAttemptAt = &leasedUntil
+	return &delivery, tx.Commit().Error
+}
+
+func (s *Store) RecordWebhookAttempt(delivery *WebhookDelivery, responseStatus int, attemptError error, now time.Time) error {
+	delivery.Attempts++
+	delivery.ResponseStatus = responseStatus
+	delivery.Error = ""
+	if attemptError == nil {
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+	} else {
+		delivery.Error = attemptError.Error()
+		if delivery.Attempts >= WebhookMaxAttempts {
+			delivery.Status = WebhookDeliveryFailed
+			delivery.NextAttemptAt = nil
+		} else {
+			next := now.Add(WebhookRetryDelay(delivery.Attempts))
+			delivery.NextAttemptAt = &next
+		}
+	}
+	return s.db.Save(delivery).Error
+}
+
+func (s *Store) ListWebhookDeliveries(endpointId uint) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := s.db.Limit(200).Where("endpoint_id=?", endpointId).Order("id DESC").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (s *Store) RedeliverWebhook(endpointId uint, deliveryId uint, now time.Time) (*WebhookDelivery, error) {
+	previous := WebhookDelivery{}
+	err := s.db.Where("id=? AND endpoint_id=?", deliveryId, endpointId).Find(&previous).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrWebhookDeliveryNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	delivery := WebhookDelivery{EndpointId: previous.EndpointId, EventId: previous.EventId, EventType: previous.EventType,
+		Status: WebhookDeliveryPending, NextAttemptAt: &now}
+	err = s.db.Create(&delivery).Error
+	return &delivery, err
+}